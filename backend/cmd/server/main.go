@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/Foodstream-io/etchebest/internal/cluster"
 	"github.com/Foodstream-io/etchebest/internal/db"
+	"github.com/Foodstream-io/etchebest/internal/hls"
 	"github.com/Foodstream-io/etchebest/internal/modules/chat"
 	"github.com/Foodstream-io/etchebest/internal/modules/country"
 	"github.com/Foodstream-io/etchebest/internal/modules/dish"
@@ -11,8 +14,11 @@ import (
 	"github.com/Foodstream-io/etchebest/internal/modules/tag"
 	"github.com/Foodstream-io/etchebest/internal/modules/user"
 	"github.com/Foodstream-io/etchebest/internal/modules/activity"
+	"github.com/Foodstream-io/etchebest/internal/turnserver"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	_ "github.com/Foodstream-io/etchebest/docs"
 	"github.com/Foodstream-io/etchebest/internal/routes"
@@ -70,19 +76,65 @@ func main() {
 	var migrateModels = []any{
 		&user.User{},
 		&room.Room{},
+		&room.Invitation{},
 		&country.Country{},
 		&dish.Dish{},
 		&live.Live{},
+		&live.LiveTransition{},
 		&tag.Tag{},
 		&chat.Chat{},
 		&activity.Activity{},
+		&cluster.RoomLease{},
+		&room.PlaybackRevocation{},
 	}
 
 	if err := db.AutoMigrate(migrateModels...); err != nil {
 		log.Fatal(err)
 	}
 
-	routes.Routes(r, db, jwtKey, stunServerURL, webrtcIP)
+	// Room ownership across backend instances sharing this database
+	registry := cluster.NewRegistry(db, cluster.ConfigFromEnv(port))
+	room.SetOwnership(registry)
+	registry.OnLost(room.EvictRoom)
+	registry.Start(context.Background())
+	room.StartStatsSampler(context.Background())
+	room.StartReaper(context.Background(), db, room.ReaperConfigFromEnv())
+	room.StartPlaybackRevocationSync(context.Background(), db)
+	live.OnTransition(room.BroadcastLiveStatus)
+
+	if v, err := strconv.Atoi(os.Getenv("HOST_RECONNECT_GRACE_SECONDS")); err == nil && v >= 0 {
+		room.SetHostReconnectGrace(time.Duration(v) * time.Second)
+	}
+	if v, err := strconv.ParseBool(os.Getenv("RECORDING_ENABLED")); err == nil {
+		room.SetRecording(v)
+	}
+	if path := os.Getenv("HLS_LADDERS_FILE"); path != "" {
+		if err := hls.LoadLadders(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+	hls.SetPlaybackAuth(hls.PlaybackAuthConfigFromEnv(jwtKey))
+	if format := os.Getenv("HLS_SEGMENT_FORMAT"); format != "" {
+		if err := hls.SetSegmentFormat(format); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if ms, err := strconv.Atoi(os.Getenv("HLS_PART_DURATION_MS")); err == nil {
+		if err := hls.SetLowLatency(time.Duration(ms) * time.Millisecond); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Optional TURN relay for clients behind symmetric NATs and firewalls
+	var turnServer *turnserver.Server
+	if turnCfg := turnserver.ConfigFromEnv(jwtKey, webrtcIP); turnCfg.Enabled {
+		turnServer, err = turnserver.Start(turnCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	routes.Routes(r, db, jwtKey, stunServerURL, webrtcIP, registry, turnServer)
 
 	if err := r.Run(":" + port); err != nil {
 		log.Fatal(err)
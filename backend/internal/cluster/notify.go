@@ -0,0 +1,108 @@
+package cluster
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// eventsChannel is the Postgres NOTIFY channel shared by all instances.
+const eventsChannel = "room_events"
+
+const (
+	EventAcquired  = "acquired"
+	EventReleased  = "released"
+	EventReclaimed = "reclaimed"
+)
+
+// Event is a room ownership change broadcast to every instance.
+type Event struct {
+	Type       string `json:"type"`
+	RoomID     string `json:"roomId"`
+	InstanceID string `json:"instanceId"`
+}
+
+// publish notifies the other instances. Delivery is best effort: the
+// heartbeat catches anything a missed notification would have told us.
+func (r *Registry) publish(ev Event) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	if err := r.db.Exec("SELECT pg_notify(?, ?)", eventsChannel, string(payload)).Error; err != nil {
+		log.Printf("[CLUSTER] notify %s for room %s failed: %v", ev.Type, ev.RoomID, err)
+	}
+}
+
+// listen keeps a dedicated connection LISTENing on the events channel,
+// reconnecting after errors.
+func (r *Registry) listen(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := r.listenOnce(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("[CLUSTER] event listener stopped: %v, reconnecting", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func (r *Registry) listenOnce(ctx context.Context) error {
+	sqlDB, err := r.db.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		stdConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return errors.New("LISTEN requires the pgx driver")
+		}
+		pgConn := stdConn.Conn()
+		if _, err := pgConn.Exec(ctx, "LISTEN "+eventsChannel); err != nil {
+			return err
+		}
+		for {
+			n, err := pgConn.WaitForNotification(ctx)
+			if err != nil {
+				// The connection is still subscribed: keep it out of the pool.
+				return fmt.Errorf("%w: %v", driver.ErrBadConn, err)
+			}
+			var ev Event
+			if err := json.Unmarshal([]byte(n.Payload), &ev); err != nil {
+				log.Printf("[CLUSTER] invalid event payload %q: %v", n.Payload, err)
+				continue
+			}
+			r.handleEvent(ev)
+		}
+	})
+}
+
+// handleEvent reacts to another instance claiming a room this one still
+// serves, without waiting for the next heartbeat to notice.
+func (r *Registry) handleEvent(ev Event) {
+	if ev.InstanceID == r.cfg.InstanceID {
+		return
+	}
+	log.Printf("[CLUSTER] room %s %s by instance %s", ev.RoomID, ev.Type, ev.InstanceID)
+	if ev.Type != EventAcquired && ev.Type != EventReclaimed {
+		return
+	}
+
+	r.mu.Lock()
+	_, owned := r.owned[ev.RoomID]
+	delete(r.owned, ev.RoomID)
+	r.mu.Unlock()
+	if owned {
+		r.lose(ev.RoomID)
+	}
+}
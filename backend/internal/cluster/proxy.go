@@ -0,0 +1,119 @@
+package cluster
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// forwardedHeader marks a request proxied by another instance, so a stale
+// lease can never bounce it back and forth.
+const forwardedHeader = "X-Etchebest-Forwarded-By"
+
+// RoomIDResolver extracts the room a request targets ("" if none).
+type RoomIDResolver func(c *gin.Context) string
+
+// RoomIDParam reads the room ID from a path parameter.
+func RoomIDParam(name string) RoomIDResolver {
+	return func(c *gin.Context) string {
+		return c.Param(name)
+	}
+}
+
+// RoomIDQuery reads the room ID from a query parameter.
+func RoomIDQuery(name string) RoomIDResolver {
+	return func(c *gin.Context) string {
+		return c.Query(name)
+	}
+}
+
+// RoomIDPathPrefix reads the room ID from the first segment of a wildcard
+// path parameter, e.g. /api/hls/<roomId>/master.m3u8.
+func RoomIDPathPrefix(name string) RoomIDResolver {
+	return func(c *gin.Context) string {
+		id, _, _ := strings.Cut(strings.TrimPrefix(c.Param(name), "/"), "/")
+		return id
+	}
+}
+
+// RouteToOwner serves room requests on the instance that owns the room and
+// proxies them there otherwise, WebSocket upgrades included. It only looks
+// the owner up: reads such as playback or stats must not take a room away
+// from the instance holding its media. Rooms no instance serves are
+// handled locally.
+func (r *Registry) RouteToOwner(roomID RoomIDResolver) gin.HandlerFunc {
+	return r.route(roomID, r.Owner)
+}
+
+// ClaimOrRouteToOwner routes the requests that create or join a room like
+// RouteToOwner, except that an unowned room, or one whose owner stopped
+// heartbeating, is claimed by this instance first.
+func (r *Registry) ClaimOrRouteToOwner(roomID RoomIDResolver) gin.HandlerFunc {
+	return r.route(roomID, r.Acquire)
+}
+
+// route serves the request locally unless owner names another instance,
+// which it is then proxied to.
+func (r *Registry) route(roomID RoomIDResolver, owner func(roomID string) (RoomLease, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := roomID(c)
+		if id == "" || r.owns(id) {
+			c.Next()
+			return
+		}
+
+		lease, err := owner(id)
+		if err != nil {
+			log.Printf("[CLUSTER] lookup owner of room %s: %v", id, err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "room registry unavailable"})
+			return
+		}
+		// No lease: no instance serves the room, let the handler answer.
+		if lease.InstanceID == "" || lease.InstanceID == r.cfg.InstanceID {
+			c.Next()
+			return
+		}
+
+		if c.GetHeader(forwardedHeader) != "" {
+			log.Printf("[CLUSTER] room %s request forwarded by %s but owned by %s",
+				id, c.GetHeader(forwardedHeader), lease.InstanceID)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "room owner unavailable"})
+			return
+		}
+		r.proxy(c, lease)
+	}
+}
+
+// proxy forwards the request to the owner instance and aborts the chain.
+func (r *Registry) proxy(c *gin.Context, lease RoomLease) {
+	defer c.Abort()
+
+	target, err := url.Parse(lease.Address)
+	if err != nil {
+		log.Printf("[CLUSTER] invalid address %q for instance %s: %v", lease.Address, lease.InstanceID, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "room owner unreachable"})
+		return
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ModifyResponse = func(res *http.Response) error {
+		// CORS headers were already set by this instance's middleware.
+		for key := range res.Header {
+			if strings.HasPrefix(key, "Access-Control-") {
+				res.Header.Del(key)
+			}
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		log.Printf("[CLUSTER] proxy %s to instance %s failed: %v", req.URL.Path, lease.InstanceID, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	c.Request.Header.Set(forwardedHeader, r.cfg.InstanceID)
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
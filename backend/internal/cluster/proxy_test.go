@@ -0,0 +1,100 @@
+package cluster
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routedRouter serves GET /rooms/:roomId through route with the given
+// owner lookup; local requests answer "local".
+func routedRouter(r *Registry, owner func(string) (RoomLease, error)) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/rooms/:roomId", r.route(RoomIDParam("roomId"), owner), func(c *gin.Context) {
+		c.String(http.StatusOK, "local")
+	})
+	return router
+}
+
+// get requests path from a server running router: the reverse proxy
+// needs a real connection.
+func get(t *testing.T, router http.Handler, path string, header http.Header) (int, http.Header, string) {
+	t.Helper()
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return res.StatusCode, res.Header, string(body)
+}
+
+func TestRequestsAreProxiedToTheOwner(t *testing.T) {
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		_, _ = w.Write([]byte("owner " + req.URL.Path + " from " + req.Header.Get(forwardedHeader)))
+	}))
+	defer owner.Close()
+
+	r := NewRegistry(nil, Config{InstanceID: "a", Address: "http://a", LeaseTTL: time.Minute})
+	leases := map[string]RoomLease{
+		"remote": {RoomID: "remote", InstanceID: "b", Address: owner.URL},
+		"mine":   {RoomID: "mine", InstanceID: "a", Address: "http://a"},
+	}
+	router := routedRouter(r, func(id string) (RoomLease, error) {
+		return leases[id], nil
+	})
+
+	code, header, body := get(t, router, "/rooms/remote", nil)
+	if code != http.StatusOK || body != "owner /rooms/remote from a" {
+		t.Fatalf("remote room: code=%d body=%q", code, body)
+	}
+	if header.Get("Access-Control-Allow-Origin") != "" {
+		t.Error("the owner's CORS headers were passed through")
+	}
+
+	for _, id := range []string{"mine", "unowned"} {
+		if _, _, body := get(t, router, "/rooms/"+id, nil); body != "local" {
+			t.Errorf("room %s: body=%q, want it served locally", id, body)
+		}
+	}
+
+	// A request another instance forwarded is never forwarded again.
+	if code, _, _ := get(t, router, "/rooms/remote", http.Header{forwardedHeader: {"c"}}); code != http.StatusServiceUnavailable {
+		t.Errorf("forwarded request: code=%d, want 503", code)
+	}
+}
+
+func TestOwnedRoomsAreServedWithoutLookup(t *testing.T) {
+	r := NewRegistry(nil, Config{InstanceID: "a", LeaseTTL: time.Minute})
+	r.owned["mine"] = time.Now().Add(time.Minute)
+	lookups := 0
+	router := routedRouter(r, func(string) (RoomLease, error) {
+		lookups++
+		return RoomLease{}, errors.New("registry down")
+	})
+
+	if _, _, body := get(t, router, "/rooms/mine", nil); body != "local" || lookups != 0 {
+		t.Errorf("owned room: body=%q after %d lookups", body, lookups)
+	}
+	// Without a lease the owner must be looked up; a failing registry is
+	// reported rather than guessed.
+	if code, _, _ := get(t, router, "/rooms/other", nil); code != http.StatusServiceUnavailable || lookups != 1 {
+		t.Errorf("registry down: code=%d after %d lookups", code, lookups)
+	}
+}
@@ -0,0 +1,329 @@
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DefaultLeaseTTL is how long a room lease survives without a heartbeat
+// when ROOM_LEASE_TTL_SECONDS is not configured.
+const DefaultLeaseTTL = 15 * time.Second
+
+// RoomLease records which backend instance serves a live room. Leases are
+// renewed by the owner's heartbeat; an expired lease belongs to a crashed
+// instance and may be reclaimed by any other one.
+type RoomLease struct {
+	RoomID     string    `json:"roomId" gorm:"primaryKey"`
+	InstanceID string    `json:"instanceId" gorm:"index"`
+	Address    string    `json:"address"`
+	ExpiresAt  time.Time `json:"expiresAt" gorm:"index"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// Config identifies this instance in the room registry.
+type Config struct {
+	// InstanceID uniquely names this process among the backend instances.
+	InstanceID string
+	// Address is the base URL other instances use to reach this one.
+	Address  string
+	LeaseTTL time.Duration
+}
+
+// ConfigFromEnv reads INSTANCE_ID, INSTANCE_URL and ROOM_LEASE_TTL_SECONDS,
+// defaulting to a random ID and the local listening port.
+func ConfigFromEnv(port string) Config {
+	cfg := Config{
+		InstanceID: os.Getenv("INSTANCE_ID"),
+		Address:    os.Getenv("INSTANCE_URL"),
+		LeaseTTL:   DefaultLeaseTTL,
+	}
+	if cfg.InstanceID == "" {
+		host, _ := os.Hostname()
+		suffix := make([]byte, 4)
+		_, _ = rand.Read(suffix)
+		cfg.InstanceID = host + "-" + hex.EncodeToString(suffix)
+	}
+	if cfg.Address == "" {
+		cfg.Address = "http://127.0.0.1:" + port
+	}
+	if v, err := strconv.Atoi(os.Getenv("ROOM_LEASE_TTL_SECONDS")); err == nil && v > 0 {
+		cfg.LeaseTTL = time.Duration(v) * time.Second
+	}
+	return cfg
+}
+
+// Registry claims, renews and releases room leases for this instance.
+type Registry struct {
+	db  *gorm.DB
+	cfg Config
+
+	mu sync.Mutex
+	// owned maps the rooms leased by this instance to the local view of
+	// their lease expiry, so routing does not hit the database per request.
+	owned  map[string]time.Time
+	onLost []func(roomID string)
+}
+
+func NewRegistry(db *gorm.DB, cfg Config) *Registry {
+	return &Registry{db: db, cfg: cfg, owned: make(map[string]time.Time)}
+}
+
+// InstanceID returns the ID of this instance.
+func (r *Registry) InstanceID() string {
+	return r.cfg.InstanceID
+}
+
+// OnLost registers a callback run when another instance takes over a room
+// this instance was serving.
+func (r *Registry) OnLost(fn func(roomID string)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onLost = append(r.onLost, fn)
+}
+
+// Start runs the heartbeat and the cross-instance event listener until ctx
+// is cancelled.
+func (r *Registry) Start(ctx context.Context) {
+	log.Printf("[CLUSTER] instance %s serving rooms at %s (lease %s)", r.cfg.InstanceID, r.cfg.Address, r.cfg.LeaseTTL)
+	go r.heartbeat(ctx)
+	go r.listen(ctx)
+}
+
+func (r *Registry) leaseSeconds() float64 {
+	return r.cfg.LeaseTTL.Seconds()
+}
+
+// owns reports whether this instance holds a lease on roomID that has not
+// expired locally.
+func (r *Registry) owns(roomID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	expiry, ok := r.owned[roomID]
+	return ok && time.Now().Before(expiry)
+}
+
+// Owned lists the rooms this instance holds an unexpired lease on.
+func (r *Registry) Owned() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	ids := make([]string, 0, len(r.owned))
+	for id, expiry := range r.owned {
+		if now.Before(expiry) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Claim takes roomID over when no instance serves it and reports whether
+// this instance serves it now.
+func (r *Registry) Claim(roomID string) bool {
+	lease, err := r.Acquire(roomID)
+	if err != nil {
+		log.Printf("[CLUSTER] failed to claim room %s: %v", roomID, err)
+		return false
+	}
+	return lease.InstanceID == r.cfg.InstanceID
+}
+
+// Acquire claims roomID for this instance when it is unowned or its lease
+// expired, and returns the lease of the current owner. It returns a zero
+// lease when the room does not exist.
+func (r *Registry) Acquire(roomID string) (RoomLease, error) {
+	var claimed []struct {
+		Previous *string
+	}
+	// The CTE reads the lease as it was before the upsert, so a takeover
+	// of a crashed instance's room can be told apart from a fresh claim.
+	err := r.db.Raw(`
+		WITH previous AS (
+			SELECT instance_id FROM room_leases WHERE room_id = @room
+		)
+		INSERT INTO room_leases (room_id, instance_id, address, expires_at, updated_at)
+		SELECT @room, @instance, @address, now() + make_interval(secs => @ttl), now()
+		WHERE EXISTS (SELECT 1 FROM rooms WHERE id = @room)
+		ON CONFLICT (room_id) DO UPDATE
+		SET instance_id = EXCLUDED.instance_id,
+			address = EXCLUDED.address,
+			expires_at = EXCLUDED.expires_at,
+			updated_at = now()
+		WHERE room_leases.instance_id = EXCLUDED.instance_id
+			OR room_leases.expires_at < now()
+		RETURNING (SELECT instance_id FROM previous) AS previous`,
+		map[string]any{
+			"room":     roomID,
+			"instance": r.cfg.InstanceID,
+			"address":  r.cfg.Address,
+			"ttl":      r.leaseSeconds(),
+		}).Scan(&claimed).Error
+	if err != nil {
+		return RoomLease{}, err
+	}
+
+	if len(claimed) == 1 {
+		r.mu.Lock()
+		r.owned[roomID] = time.Now().Add(r.cfg.LeaseTTL)
+		r.mu.Unlock()
+
+		switch previous := claimed[0].Previous; {
+		case previous == nil:
+			log.Printf("[CLUSTER] acquired room %s", roomID)
+			r.publish(Event{Type: EventAcquired, RoomID: roomID, InstanceID: r.cfg.InstanceID})
+		case *previous != r.cfg.InstanceID:
+			log.Printf("[CLUSTER] reclaimed room %s from expired instance %s", roomID, *previous)
+			r.publish(Event{Type: EventReclaimed, RoomID: roomID, InstanceID: r.cfg.InstanceID})
+		}
+		return RoomLease{RoomID: roomID, InstanceID: r.cfg.InstanceID, Address: r.cfg.Address}, nil
+	}
+
+	var lease RoomLease
+	if err := r.db.Where("room_id = ?", roomID).Limit(1).Find(&lease).Error; err != nil {
+		return RoomLease{}, err
+	}
+	return lease, nil
+}
+
+// Owner returns the lease of the instance serving roomID, or a zero lease
+// when none does: the room does not exist, was released or its owner
+// stopped heartbeating. Unlike Acquire, it never claims the room.
+func (r *Registry) Owner(roomID string) (RoomLease, error) {
+	var lease RoomLease
+	if err := r.db.Where("room_id = ? AND expires_at > now()", roomID).Limit(1).Find(&lease).Error; err != nil {
+		return RoomLease{}, err
+	}
+	return lease, nil
+}
+
+// Release gives up this instance's lease on roomID, typically once the
+// live has ended.
+func (r *Registry) Release(roomID string) {
+	r.mu.Lock()
+	delete(r.owned, roomID)
+	r.mu.Unlock()
+
+	res := r.db.Where("room_id = ? AND instance_id = ?", roomID, r.cfg.InstanceID).Delete(&RoomLease{})
+	if res.Error != nil {
+		log.Printf("[CLUSTER] failed to release room %s: %v", roomID, res.Error)
+		return
+	}
+	if res.RowsAffected > 0 {
+		log.Printf("[CLUSTER] released room %s", roomID)
+		r.publish(Event{Type: EventReleased, RoomID: roomID, InstanceID: r.cfg.InstanceID})
+	}
+}
+
+// heartbeat renews this instance's leases and reclaims the leases of
+// instances that stopped renewing theirs.
+func (r *Registry) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.LeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.renew()
+			r.reclaimExpired()
+		}
+	}
+}
+
+// renew extends every lease held by this instance and detects the ones
+// another instance took over (e.g. after this one missed heartbeats).
+func (r *Registry) renew() {
+	var renewed []string
+	err := r.db.Raw(`
+		UPDATE room_leases
+		SET expires_at = now() + make_interval(secs => ?), address = ?, updated_at = now()
+		WHERE instance_id = ?
+		RETURNING room_id`,
+		r.leaseSeconds(), r.cfg.Address, r.cfg.InstanceID).Scan(&renewed).Error
+	if err != nil {
+		log.Printf("[CLUSTER] heartbeat failed: %v", err)
+		return
+	}
+
+	expiry := time.Now().Add(r.cfg.LeaseTTL)
+	still := make(map[string]bool, len(renewed))
+	for _, id := range renewed {
+		still[id] = true
+	}
+
+	r.mu.Lock()
+	var lost []string
+	for id := range r.owned {
+		if !still[id] {
+			lost = append(lost, id)
+			delete(r.owned, id)
+		}
+	}
+	for _, id := range renewed {
+		r.owned[id] = expiry
+	}
+	r.mu.Unlock()
+
+	for _, id := range lost {
+		r.lose(id)
+	}
+}
+
+// reclaimExpired takes over the rooms of crashed instances and drops the
+// leases of rooms that no longer exist. SKIP LOCKED lets several instances
+// sweep at once without claiming the same room twice.
+func (r *Registry) reclaimExpired() {
+	if err := r.db.Exec(`
+		DELETE FROM room_leases
+		WHERE expires_at < now() AND NOT EXISTS (SELECT 1 FROM rooms WHERE rooms.id = room_leases.room_id)`).Error; err != nil {
+		log.Printf("[CLUSTER] failed to drop orphan leases: %v", err)
+	}
+
+	var reclaimed []struct {
+		RoomID   string
+		Previous string
+	}
+	err := r.db.Raw(`
+		WITH expired AS (
+			SELECT room_id, instance_id FROM room_leases
+			WHERE expires_at < now()
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE room_leases
+		SET instance_id = ?, address = ?, expires_at = now() + make_interval(secs => ?), updated_at = now()
+		FROM expired
+		WHERE room_leases.room_id = expired.room_id
+		RETURNING room_leases.room_id, expired.instance_id AS previous`,
+		r.cfg.InstanceID, r.cfg.Address, r.leaseSeconds()).Scan(&reclaimed).Error
+	if err != nil {
+		log.Printf("[CLUSTER] reclaim failed: %v", err)
+		return
+	}
+
+	expiry := time.Now().Add(r.cfg.LeaseTTL)
+	for _, l := range reclaimed {
+		r.mu.Lock()
+		r.owned[l.RoomID] = expiry
+		r.mu.Unlock()
+		log.Printf("[CLUSTER] reclaimed room %s from expired instance %s", l.RoomID, l.Previous)
+		r.publish(Event{Type: EventReclaimed, RoomID: l.RoomID, InstanceID: r.cfg.InstanceID})
+	}
+}
+
+// lose runs the OnLost callbacks for a room now served elsewhere.
+func (r *Registry) lose(roomID string) {
+	log.Printf("[CLUSTER] lost ownership of room %s", roomID)
+	r.mu.Lock()
+	callbacks := append([]func(string){}, r.onLost...)
+	r.mu.Unlock()
+	for _, fn := range callbacks {
+		fn(roomID)
+	}
+}
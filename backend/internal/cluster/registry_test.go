@@ -0,0 +1,137 @@
+package cluster
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestLocalLeasesExpire(t *testing.T) {
+	r := NewRegistry(nil, Config{InstanceID: "a", LeaseTTL: time.Minute})
+	r.owned["live"] = time.Now().Add(time.Minute)
+	r.owned["stale"] = time.Now().Add(-time.Second)
+
+	if !r.owns("live") || r.owns("stale") || r.owns("unknown") {
+		t.Errorf("owns: live=%v stale=%v unknown=%v", r.owns("live"), r.owns("stale"), r.owns("unknown"))
+	}
+	if got := r.Owned(); !slices.Equal(got, []string{"live"}) {
+		t.Errorf("Owned() = %v, want [live]", got)
+	}
+}
+
+func TestTakeoverByAnotherInstanceLosesTheRoom(t *testing.T) {
+	r := NewRegistry(nil, Config{InstanceID: "a", LeaseTTL: time.Minute})
+	var lost []string
+	r.OnLost(func(roomID string) { lost = append(lost, roomID) })
+	r.owned["room"] = time.Now().Add(time.Minute)
+	r.owned["other"] = time.Now().Add(time.Minute)
+
+	// Our own claims and other instances' releases change nothing.
+	r.handleEvent(Event{Type: EventAcquired, RoomID: "room", InstanceID: "a"})
+	r.handleEvent(Event{Type: EventReleased, RoomID: "room", InstanceID: "b"})
+	if len(lost) != 0 || !r.owns("room") {
+		t.Fatalf("room lost to a non-takeover event: lost=%v", lost)
+	}
+
+	r.handleEvent(Event{Type: EventReclaimed, RoomID: "room", InstanceID: "b"})
+	if !slices.Equal(lost, []string{"room"}) || r.owns("room") || !r.owns("other") {
+		t.Errorf("after takeover: lost=%v owned=%v", lost, r.Owned())
+	}
+	// A room we did not serve is not reported lost.
+	r.handleEvent(Event{Type: EventAcquired, RoomID: "elsewhere", InstanceID: "b"})
+	if len(lost) != 1 {
+		t.Errorf("lost=%v, want only the taken over room", lost)
+	}
+}
+
+// leaseDB opens the Postgres database named by TEST_DATABASE_URL, on a
+// single connection whose temporary rooms and room_leases tables shadow
+// any real ones.
+func leaseDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+
+	for _, stmt := range []string{
+		`CREATE TEMP TABLE rooms (id text PRIMARY KEY)`,
+		`CREATE TEMP TABLE room_leases (
+			room_id text PRIMARY KEY,
+			instance_id text,
+			address text,
+			expires_at timestamptz,
+			updated_at timestamptz)`,
+		`INSERT INTO rooms (id) VALUES ('room')`,
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	return db
+}
+
+func TestLeaseAcquireExpiryAndTakeover(t *testing.T) {
+	db := leaseDB(t)
+	const ttl = time.Second
+	a := NewRegistry(db, Config{InstanceID: "a", Address: "http://a", LeaseTTL: ttl})
+	b := NewRegistry(db, Config{InstanceID: "b", Address: "http://b", LeaseTTL: ttl})
+	var lost []string
+	a.OnLost(func(roomID string) { lost = append(lost, roomID) })
+
+	if lease, err := a.Acquire("missing"); err != nil || lease.InstanceID != "" {
+		t.Fatalf("room that does not exist: lease=%+v err=%v", lease, err)
+	}
+
+	lease, err := a.Acquire("room")
+	if err != nil || lease.InstanceID != "a" || !a.owns("room") {
+		t.Fatalf("first claim: lease=%+v err=%v", lease, err)
+	}
+	// While a heartbeats, b only sees the owner.
+	if lease, err := b.Acquire("room"); err != nil || lease.InstanceID != "a" || lease.Address != "http://a" {
+		t.Fatalf("claim of an owned room: lease=%+v err=%v", lease, err)
+	}
+	a.renew()
+	if lease, err := b.Owner("room"); err != nil || lease.InstanceID != "a" {
+		t.Fatalf("owner: lease=%+v err=%v", lease, err)
+	}
+
+	// a stops heartbeating: its lease expires and b takes the room over.
+	time.Sleep(ttl + 200*time.Millisecond)
+	if lease, err := b.Owner("room"); err != nil || lease.InstanceID != "" {
+		t.Fatalf("owner of an expired lease: lease=%+v err=%v", lease, err)
+	}
+	if lease, err := b.Acquire("room"); err != nil || lease.InstanceID != "b" {
+		t.Fatalf("takeover: lease=%+v err=%v", lease, err)
+	}
+	// a notices at its next heartbeat.
+	a.renew()
+	if !slices.Equal(lost, []string{"room"}) || a.owns("room") {
+		t.Fatalf("a after the takeover: lost=%v owns=%v", lost, a.owns("room"))
+	}
+
+	// a's release cannot drop b's lease; b's own can.
+	a.Release("room")
+	if lease, _ := a.Owner("room"); lease.InstanceID != "b" {
+		t.Fatalf("owner after a released: %+v", lease)
+	}
+	b.Release("room")
+	if lease, _ := a.Owner("room"); lease.InstanceID != "" {
+		t.Fatalf("owner after b released: %+v", lease)
+	}
+}
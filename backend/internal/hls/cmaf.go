@@ -0,0 +1,239 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// Segment formats. MPEG-TS segments are only playable as HLS; CMAF
+// (fragmented MP4) segments are written once and listed both by the HLS
+// playlists and by a DASH manifest.
+const (
+	SegmentFormatTS   = "ts"
+	SegmentFormatCMAF = "cmaf"
+)
+
+// audioRendition names the audio track of a CMAF stream: a CMAF track
+// carries a single media type, so the audio is encoded once and shared by
+// the video renditions instead of being muxed into each of them.
+const audioRendition = "audio"
+
+var segmentFormat = SegmentFormatTS
+
+func init() {
+	// Served by the playback server and the replay storage alike.
+	_ = mime.AddExtensionType(".m3u8", "application/vnd.apple.mpegurl")
+	_ = mime.AddExtensionType(".m4s", "video/iso.segment")
+	_ = mime.AddExtensionType(".mpd", "application/dash+xml")
+}
+
+// SetSegmentFormat picks the segment format of the streams started from
+// then on: SegmentFormatTS (the default) or SegmentFormatCMAF. Meant to be
+// called once at startup.
+func SetSegmentFormat(format string) error {
+	switch format {
+	case SegmentFormatTS, SegmentFormatCMAF:
+		segmentFormat = format
+		return nil
+	}
+	return fmt.Errorf("invalid HLS segment format %q", format)
+}
+
+// cmafArgs are the FFmpeg HLS muxer options writing fragmented MP4. The
+// init segment of a rendition is rewritten on restarts, which is harmless:
+// its encoding settings do not change.
+func cmafArgs() []string {
+	return []string{
+		"-hls_segment_type", "fmp4",
+		"-hls_fmp4_init_filename", "init.mp4",
+	}
+}
+
+// cmafSegmentNames are the segment and part file name patterns of the
+// run-th FFmpeg process of a CMAF stream. The run starts their names: the
+// DASH manifest has a period per run, timestamps restarting with FFmpeg.
+func cmafSegmentNames(run int) (segment, part string) {
+	return fmt.Sprintf("segment_%d_%%03d.m4s", run), fmt.Sprintf("part_%d_%%05d.m4s", run)
+}
+
+// cmafRunRE matches the names of CMAF segments and parts.
+var cmafRunRE = regexp.MustCompile(`^(?:segment|part)_(\d+)_\d+\.m4s$`)
+
+// cmafRun returns the FFmpeg run a CMAF segment or part was written by, -1
+// for any other file.
+func cmafRun(name string) int {
+	m := cmafRunRE.FindStringSubmatch(name)
+	if m == nil {
+		return -1
+	}
+	run, _ := strconv.Atoi(m[1])
+	return run
+}
+
+// numberedRE splits a numbered file name around its last number.
+var numberedRE = regexp.MustCompile(`^(.*?)(\d+)(\.[a-z0-9]+)$`)
+
+// mp4Box descends a path of ISO BMFF boxes and returns the payload of the
+// last one, nil when missing. A box cut short by the end of data returns
+// what data holds of it.
+func mp4Box(data []byte, path ...string) []byte {
+	for _, typ := range path {
+		found := false
+		for len(data) >= 8 {
+			size := uint64(binary.BigEndian.Uint32(data))
+			header := uint64(8)
+			switch size {
+			case 0:
+				size = uint64(len(data))
+			case 1:
+				if len(data) < 16 {
+					return nil
+				}
+				size, header = binary.BigEndian.Uint64(data[8:]), 16
+			}
+			if size < header {
+				return nil
+			}
+			if string(data[4:8]) == typ {
+				data = data[header:min(size, uint64(len(data)))]
+				found = true
+				break
+			}
+			if size > uint64(len(data)) {
+				return nil
+			}
+			data = data[size:]
+		}
+		if !found {
+			return nil
+		}
+	}
+	return data
+}
+
+// initInfo is what the DASH manifest needs from a CMAF init segment.
+type initInfo struct {
+	timescale uint32
+	codecs    string
+}
+
+// readInit reads the timescale and codec of the single track of a CMAF
+// init segment.
+func readInit(path string) (initInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return initInfo{}, err
+	}
+	mdhd := mp4Box(data, "moov", "trak", "mdia", "mdhd")
+	var info initInfo
+	switch {
+	case len(mdhd) >= 24 && mdhd[0] == 1:
+		info.timescale = binary.BigEndian.Uint32(mdhd[20:])
+	case len(mdhd) >= 16 && mdhd[0] == 0:
+		info.timescale = binary.BigEndian.Uint32(mdhd[12:])
+	}
+	if info.timescale == 0 {
+		return initInfo{}, fmt.Errorf("%s: no track timescale", path)
+	}
+
+	stsd := mp4Box(data, "moov", "trak", "mdia", "minf", "stbl", "stsd")
+	switch {
+	case bytes.Contains(stsd, []byte("avcC")):
+		// avcC: version, then the profile, compatibility and level bytes.
+		i := bytes.Index(stsd, []byte("avcC")) + 4
+		if i+4 > len(stsd) {
+			return initInfo{}, fmt.Errorf("%s: short avcC", path)
+		}
+		info.codecs = fmt.Sprintf("avc1.%02x%02x%02x", stsd[i+1], stsd[i+2], stsd[i+3])
+	case bytes.Contains(stsd, []byte("mp4a")):
+		// FFmpeg's aac encoder writes AAC-LC.
+		info.codecs = "mp4a.40.2"
+	default:
+		return initInfo{}, fmt.Errorf("%s: unsupported codec", path)
+	}
+	return info, nil
+}
+
+// readDecodeTime returns the decode time of the first sample of a CMAF
+// segment or part, in its track timescale.
+func readDecodeTime(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// The fragment header comes first; the media data is not needed.
+	data, err := io.ReadAll(io.LimitReader(f, 16<<10))
+	if err != nil {
+		return 0, err
+	}
+	tfdt := mp4Box(data, "moof", "traf", "tfdt")
+	switch {
+	case len(tfdt) >= 12 && tfdt[0] == 1:
+		return binary.BigEndian.Uint64(tfdt[4:]), nil
+	case len(tfdt) >= 8 && tfdt[0] == 0:
+		return uint64(binary.BigEndian.Uint32(tfdt[4:])), nil
+	}
+	return 0, fmt.Errorf("%s: no decode time", path)
+}
+
+// sampleNonSync is the sample_is_non_sync_sample bit of ISO BMFF sample
+// flags.
+const sampleNonSync = 0x00010000
+
+// fragmentStartsWithSync reports whether the first sample of a CMAF
+// fragment is a sync sample, going by the flags of its trun, else the
+// defaults of its tfhd. A fragment with neither leaves it to the init
+// segment, and is not taken for one.
+func fragmentStartsWithSync(data []byte) bool {
+	traf := mp4Box(data, "moof", "traf")
+	if trun := mp4Box(traf, "trun"); len(trun) >= 8 {
+		flags := binary.BigEndian.Uint32(trun) & 0xffffff
+		// The fields after the sample count, in order, by flag.
+		off := 8
+		if flags&0x01 != 0 { // data offset
+			off += 4
+		}
+		switch {
+		case flags&0x04 != 0: // first sample flags
+		case flags&0x400 != 0: // per sample flags, after duration and size
+			if flags&0x100 != 0 {
+				off += 4
+			}
+			if flags&0x200 != 0 {
+				off += 4
+			}
+		default:
+			off = -1
+		}
+		if off >= 0 {
+			return len(trun) >= off+4 && binary.BigEndian.Uint32(trun[off:])&sampleNonSync == 0
+		}
+	}
+
+	tfhd := mp4Box(traf, "tfhd")
+	if len(tfhd) < 8 {
+		return false
+	}
+	flags := binary.BigEndian.Uint32(tfhd) & 0xffffff
+	if flags&0x20 == 0 { // default sample flags
+		return false
+	}
+	// The fields after the track ID, in order, by flag.
+	off := 8
+	for _, field := range []struct {
+		flag uint32
+		size int
+	}{{0x01, 8}, {0x02, 4}, {0x08, 4}, {0x10, 4}} {
+		if flags&field.flag != 0 {
+			off += field.size
+		}
+	}
+	return len(tfhd) >= off+4 && binary.BigEndian.Uint32(tfhd[off:])&sampleNonSync == 0
+}
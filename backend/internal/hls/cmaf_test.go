@@ -0,0 +1,126 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mp4 builds an ISO BMFF box.
+func mp4(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(8+len(body))), append([]byte(typ), body...)...)
+}
+
+// mp4Large builds an ISO BMFF box with a 64-bit size.
+func mp4Large(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	box := append(binary.BigEndian.AppendUint32(nil, 1), typ...)
+	box = binary.BigEndian.AppendUint64(box, uint64(16+len(body)))
+	return append(box, body...)
+}
+
+func TestMP4BoxDescendsThePath(t *testing.T) {
+	data := append(mp4("ftyp", []byte("iso6")), mp4Large("moov", mp4("mvhd", []byte{1}), mp4("trak", []byte("track")))...)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		path []string
+		want []byte
+	}{
+		{"sibling skipped", data, []string{"moov", "trak"}, []byte("track")},
+		{"64-bit size", data, []string{"moov", "mvhd"}, []byte{1}},
+		{"missing", data, []string{"moov", "mdia"}, nil},
+		{"size 0 runs to the end", append([]byte{0, 0, 0, 0}, "mdat1234"...), []string{"mdat"}, []byte("1234")},
+		{"cut short", mp4("moof", []byte("fragment"))[:12], []string{"moof"}, []byte("frag")},
+		{"64-bit size cut short", mp4Large("moov")[:12], []string{"moov"}, nil},
+		{"size below the header", append([]byte{0, 0, 0, 4}, "moov"...), []string{"moov"}, nil},
+		{"sibling past the end", append([]byte{0, 0, 1, 0}, "free"...), []string{"moov"}, nil},
+		{"shorter than a header", []byte{0, 0, 0}, []string{"moov"}, nil},
+	} {
+		if got := mp4Box(tc.data, tc.path...); !bytes.Equal(got, tc.want) || (got == nil) != (tc.want == nil) {
+			t.Errorf("%s: mp4Box = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// trackInit builds a CMAF init segment of one track with the given mdhd
+// payload and sample entry.
+func trackInit(mdhd, entry []byte) []byte {
+	stsd := mp4("stsd", make([]byte, 8), entry)
+	return mp4("moov", mp4("trak", mp4("mdia", mp4("mdhd", mdhd), mp4("minf", mp4("stbl", stsd)))))
+}
+
+func TestReadInit(t *testing.T) {
+	dir := t.TempDir()
+	avc1 := mp4("avc1", make([]byte, 78), mp4("avcC", []byte{1, 0x64, 0, 0x1f}))
+	mp4a := mp4("mp4a", make([]byte, 28))
+	// Version 0: 32-bit times, timescale at offset 12; version 1: 64-bit
+	// times, timescale at offset 20.
+	v0 := binary.BigEndian.AppendUint32(make([]byte, 12), 90000)
+	v1 := binary.BigEndian.AppendUint32(append([]byte{1}, make([]byte, 19)...), 48000)
+
+	for _, tc := range []struct {
+		name      string
+		data      []byte
+		timescale uint32
+		codecs    string
+	}{
+		{"avc version 0", trackInit(append(v0, make([]byte, 8)...), avc1), 90000, "avc1.64001f"},
+		{"aac version 1", trackInit(append(v1, make([]byte, 12)...), mp4a), 48000, "mp4a.40.2"},
+		{"truncated mdhd", trackInit(v0[:14], avc1), 0, ""},
+		{"short avcC", trackInit(v0, mp4("avc1", mp4("avcC", []byte{1, 0x64}))), 0, ""},
+		{"unsupported codec", trackInit(v0, mp4("hvc1", make([]byte, 78))), 0, ""},
+		{"cut short", trackInit(v0, avc1)[:20], 0, ""},
+	} {
+		path := filepath.Join(dir, "init.mp4")
+		if err := os.WriteFile(path, tc.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := readInit(path)
+		if tc.timescale == 0 {
+			if err == nil {
+				t.Errorf("%s: readInit = %+v, want an error", tc.name, info)
+			}
+			continue
+		}
+		if err != nil || info.timescale != tc.timescale || info.codecs != tc.codecs {
+			t.Errorf("%s: readInit = %+v, %v", tc.name, info, err)
+		}
+	}
+	if _, err := readInit(filepath.Join(dir, "missing.mp4")); err == nil {
+		t.Error("missing init segment read")
+	}
+}
+
+func TestReadDecodeTime(t *testing.T) {
+	dir := t.TempDir()
+	v0 := binary.BigEndian.AppendUint32(make([]byte, 4), 900)
+	v1 := binary.BigEndian.AppendUint64([]byte{1, 0, 0, 0}, 1<<40)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want uint64
+		ok   bool
+	}{
+		{"version 0", mp4("moof", mp4("traf", mp4("tfdt", v0))), 900, true},
+		{"version 1", mp4("moof", mp4("traf", mp4("tfdt", v1))), 1 << 40, true},
+		{"64-bit moof", mp4Large("moof", mp4("mfhd", make([]byte, 8)), mp4("traf", mp4("tfdt", v0))), 900, true},
+		{"truncated tfdt", mp4("moof", mp4("traf", mp4("tfdt", v1[:10]))), 0, false},
+		{"no tfdt", mp4("moof", mp4("traf")), 0, false},
+		{"cut short", mp4("moof", mp4("traf", mp4("tfdt", v0)))[:18], 0, false},
+	} {
+		path := filepath.Join(dir, "segment.m4s")
+		if err := os.WriteFile(path, tc.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readDecodeTime(path)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("%s: readDecodeTime = %d, %v", tc.name, got, err)
+		}
+	}
+}
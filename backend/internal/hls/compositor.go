@@ -0,0 +1,609 @@
+package hls
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Composite layouts.
+const (
+	LayoutGrid       = "grid"
+	LayoutPiP        = "pip"
+	LayoutSideBySide = "side-by-side"
+)
+
+// ValidLayout reports whether layout is one the compositor can render.
+func ValidLayout(layout string) bool {
+	switch layout {
+	case LayoutGrid, LayoutPiP, LayoutSideBySide:
+		return true
+	}
+	return false
+}
+
+const (
+	canvasWidth  = 1920
+	canvasHeight = 1080
+	// reconfigureDelay coalesces the audio and video tracks of a joining
+	// participant (and simultaneous joins) into a single FFmpeg restart.
+	reconfigureDelay = 500 * time.Millisecond
+)
+
+// Input is one participant fed into the composite. A nil codec means the
+// participant does not contribute that kind of media.
+type Input struct {
+	ID    string
+	Audio *CodecInfo
+	Video *CodecInfo
+	// Height is the short side of the video picture, 0 while unknown. The
+	// ladder has no rendition above the largest input.
+	Height int
+}
+
+// compositeInput is an Input with the UDP ports it was given. Ports (and
+// the writer dialed to them) outlive FFmpeg restarts.
+type compositeInput struct {
+	Input
+	audioPort int
+	videoPort int
+	writer    *HLSWriter
+}
+
+// Compositor renders every input of a room into one HLS ladder: the video
+// inputs are laid out on a 1080p canvas and the audio inputs are mixed.
+// FFmpeg cannot add inputs on the fly, so a change of inputs or layout
+// restarts it on the same ports; the playlists are appended to, keeping
+// their media sequence, with a discontinuity at each restart.
+type Compositor struct {
+	roomID string
+	// onRestart runs after FFmpeg (re)started, e.g. to ask the sources for
+	// keyframes since the new process has no decoder state.
+	onRestart func()
+
+	// profile is the transcoding ladder, fitted to the inputs.
+	profile Profile
+	// lowLatency is set when FFmpeg writes LL-HLS parts.
+	lowLatency bool
+	// cmaf is set when FFmpeg writes fragmented MP4 rather than MPEG-TS.
+	cmaf bool
+
+	mu     sync.Mutex
+	layout string
+	inputs []*compositeInput
+	// ports holds the RTP ports (and their RTCP neighbours) given to inputs.
+	ports map[int]bool
+
+	changed chan struct{}
+	done    chan struct{}
+
+	// procMu serializes FFmpeg starts and stops.
+	procMu   sync.Mutex
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	restarts int
+}
+
+// NewCompositor registers the HLS stream of a room, encoded with a ladder
+// profile (the default one if unknown). FFmpeg starts once Update provides
+// inputs.
+func NewCompositor(roomID, layout, profile string, onRestart func()) *Compositor {
+	if !ValidLayout(layout) {
+		layout = LayoutGrid
+	}
+	c := &Compositor{
+		roomID:     roomID,
+		onRestart:  onRestart,
+		profile:    lookupProfile(profile),
+		lowLatency: partDuration > 0,
+		cmaf:       segmentFormat == SegmentFormatCMAF,
+		layout:     layout,
+		ports:      make(map[int]bool),
+		changed:    make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	RegisterToStream(roomID, c.stop)
+	go c.run()
+	return c
+}
+
+// Update sets the inputs of the composite, in layout order (the first one
+// is the main picture in picture-in-picture). Inputs keep their writer
+// across updates; the returned map holds the writer of every input.
+func (c *Compositor) Update(inputs []Input) map[string]*HLSWriter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current := make(map[string]*compositeInput, len(c.inputs))
+	for _, in := range c.inputs {
+		current[in.ID] = in
+	}
+
+	changed := len(inputs) != len(c.inputs)
+	ladder := len(c.ladder(c.inputs))
+	next := make([]*compositeInput, 0, len(inputs))
+	writers := make(map[string]*HLSWriter, len(inputs))
+	for _, in := range inputs {
+		ci, ok := current[in.ID]
+		if ok {
+			delete(current, in.ID)
+			if !sameCodec(ci.Audio, in.Audio) || !sameCodec(ci.Video, in.Video) {
+				changed = true
+			}
+		} else {
+			ci = &compositeInput{writer: &HLSWriter{}}
+		}
+		if err := c.connect(ci, in); err != nil {
+			log.Printf("[HLS] room %s: input %s: %v", c.roomID, in.ID, err)
+			c.release(ci)
+			changed = true
+			continue
+		}
+		if len(next) >= len(c.inputs) || c.inputs[len(next)] != ci {
+			changed = true
+		}
+		next = append(next, ci)
+		writers[in.ID] = ci.writer
+	}
+
+	for _, removed := range current {
+		c.release(removed)
+		changed = true
+	}
+	c.inputs = next
+	if len(c.ladder(next)) != ladder {
+		// A source got a (larger) picture: renditions come in or out.
+		changed = true
+	}
+
+	if changed {
+		c.reconfigure()
+	}
+	return writers
+}
+
+// SetLayout switches the composite layout.
+func (c *Compositor) SetLayout(layout string) error {
+	if !ValidLayout(layout) {
+		return fmt.Errorf("unknown layout %q", layout)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.layout != layout {
+		c.layout = layout
+		c.reconfigure()
+	}
+	return nil
+}
+
+// connect allocates ports and dials the writer for the media kinds the
+// input needs and does not have yet. Must be called with c.mu held.
+func (c *Compositor) connect(ci *compositeInput, in Input) error {
+	ci.Input = in
+	if in.Audio != nil && ci.writer.AudioConn == nil {
+		port, conn, err := c.dialFreePort()
+		if err != nil {
+			return fmt.Errorf("audio: %w", err)
+		}
+		ci.audioPort, ci.writer.AudioConn = port, conn
+	}
+	if in.Video != nil && ci.writer.VideoConn == nil {
+		port, conn, err := c.dialFreePort()
+		if err != nil {
+			return fmt.Errorf("video: %w", err)
+		}
+		ci.videoPort, ci.writer.VideoConn = port, conn
+	}
+	return nil
+}
+
+// dialFreePort picks an RTP port pair unused by the other inputs and dials
+// it. Must be called with c.mu held.
+func (c *Compositor) dialFreePort() (int, net.Conn, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		port, err := getFreeRTPPort()
+		if err != nil {
+			return 0, nil, err
+		}
+		if c.ports[port] || c.ports[port+1] {
+			continue
+		}
+		conn, err := net.Dial("udp4", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			return 0, nil, err
+		}
+		c.ports[port], c.ports[port+1] = true, true
+		return port, conn, nil
+	}
+	return 0, nil, fmt.Errorf("could not find free RTP port")
+}
+
+// release closes the writer of an input leaving the composite and frees
+// its ports. Must be called with c.mu held.
+func (c *Compositor) release(ci *compositeInput) {
+	for _, p := range []int{ci.audioPort, ci.videoPort} {
+		if p != 0 {
+			delete(c.ports, p)
+			delete(c.ports, p+1)
+		}
+	}
+	if ci.writer.AudioConn != nil {
+		_ = ci.writer.AudioConn.Close()
+	}
+	if ci.writer.VideoConn != nil {
+		_ = ci.writer.VideoConn.Close()
+	}
+}
+
+// ladder returns the renditions the inputs can feed.
+func (c *Compositor) ladder(inputs []*compositeInput) []Rendition {
+	// Sources of unknown size are left out: the ones whose size is known
+	// bound the ladder, every rendition is kept only when none is.
+	height := 0
+	for _, in := range inputs {
+		if in.Video != nil {
+			height = max(height, in.Height)
+		}
+	}
+	return c.profile.Fit(height)
+}
+
+// reconfigure schedules an FFmpeg restart. Must be called with c.mu held.
+func (c *Compositor) reconfigure() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run restarts FFmpeg whenever the configuration settles after a change.
+func (c *Compositor) run() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.changed:
+		}
+
+		timer := time.NewTimer(reconfigureDelay)
+	settle:
+		for {
+			select {
+			case <-c.done:
+				timer.Stop()
+				return
+			case <-c.changed:
+				timer.Reset(reconfigureDelay)
+			case <-timer.C:
+				break settle
+			}
+		}
+		c.restart()
+	}
+}
+
+// restart stops the running FFmpeg, if any, and starts a new one for the
+// current inputs and layout.
+func (c *Compositor) restart() {
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	c.mu.Lock()
+	layout := c.layout
+	inputs := make([]compositeInput, 0, len(c.inputs))
+	for _, in := range c.inputs {
+		inputs = append(inputs, *in)
+	}
+	renditions := c.ladder(c.inputs)
+	c.mu.Unlock()
+
+	if c.cmd != nil {
+		gracefulStopFFmpeg(c.roomID, c.cmd, c.stdin)
+		c.cmd, c.stdin = nil, nil
+	}
+	if len(inputs) == 0 {
+		log.Printf("[HLS] room %s has no inputs left, composite paused", c.roomID)
+		return
+	}
+
+	cmd, stdin, err := c.startFFmpeg(layout, inputs, renditions)
+	if err != nil {
+		log.Printf("[HLS] failed to start composite for room %s: %v", c.roomID, err)
+		return
+	}
+	c.cmd, c.stdin = cmd, stdin
+	c.restarts++
+
+	if c.onRestart != nil {
+		go c.onRestart()
+	}
+}
+
+// startFFmpeg writes one SDP per input and launches FFmpeg on them,
+// encoding the given renditions.
+func (c *Compositor) startFFmpeg(layout string, inputs []compositeInput, renditions []Rendition) (*exec.Cmd, io.WriteCloser, error) {
+	hlsDir := filepath.Join("./hls", c.roomID)
+	if err := os.MkdirAll(hlsDir, 0755); err != nil {
+		return nil, nil, err
+	}
+	names := renditionNames(renditions)
+	if c.cmaf && slices.ContainsFunc(inputs, func(in compositeInput) bool { return in.Audio != nil }) {
+		names = append(names, audioRendition)
+	}
+	for _, name := range names {
+		if err := os.MkdirAll(filepath.Join(hlsDir, name), 0755); err != nil {
+			return nil, nil, err
+		}
+	}
+	setStreamRenditions(c.roomID, names)
+
+	var args []string
+	var videoInputs, audioInputs []int
+	for i, in := range inputs {
+		sdpContent := buildSDP(in.audioPort, in.Audio, in.videoPort, in.Video)
+		sdpPath := filepath.Join(hlsDir, fmt.Sprintf("input_%d.sdp", i))
+		if err := os.WriteFile(sdpPath, []byte(sdpContent), 0644); err != nil {
+			return nil, nil, fmt.Errorf("write sdp: %w", err)
+		}
+		log.Printf("[HLS] room %s input %d (%s): audio port=%d codec=%v video port=%d codec=%v",
+			c.roomID, i, in.ID, in.audioPort, codecSummary(in.Audio), in.videoPort, codecSummary(in.Video))
+
+		args = append(args,
+			"-rtbufsize", "5000k",
+			"-fflags", "+genpts+discardcorrupt+nobuffer+flush_packets",
+			"-use_wallclock_as_timestamps", "1",
+			"-max_delay", "3000000",
+			"-analyzeduration", "10000000",
+			"-probesize", "2000000",
+			"-protocol_whitelist", "file,udp,rtp",
+			"-i", sdpPath,
+		)
+		if in.Video != nil {
+			videoInputs = append(videoInputs, i)
+		}
+		if in.Audio != nil {
+			audioInputs = append(audioInputs, i)
+		}
+	}
+
+	args = append([]string{"-loglevel", "warning"}, args...)
+	hasAudio := len(audioInputs) > 0
+	// MPEG-TS renditions each mux their own audio; CMAF ones share a
+	// separate audio track.
+	audioOutputs := renditionNames(renditions)
+	if c.cmaf {
+		audioOutputs = []string{audioRendition}
+	}
+	args = append(args,
+		"-fps_mode", "cfr",
+		"-filter_complex", buildFilterGraph(layout, videoInputs, audioInputs, renditions, audioOutputs, c.profile.FrameRate),
+	)
+	streamMap := make([]string, 0, len(renditions)+1)
+	for i, r := range renditions {
+		args = append(args, r.args(i, c.profile.FrameRate, hasAudio && !c.cmaf)...)
+		switch {
+		case hasAudio && c.cmaf:
+			streamMap = append(streamMap, fmt.Sprintf("v:%d,agroup:%s,name:%s", i, audioRendition, r.Name))
+		case hasAudio:
+			streamMap = append(streamMap, fmt.Sprintf("v:%d,a:%d,name:%s", i, i, r.Name))
+		default:
+			streamMap = append(streamMap, fmt.Sprintf("v:%d,name:%s", i, r.Name))
+		}
+	}
+	if hasAudio && c.cmaf {
+		args = append(args,
+			"-map", "[a"+audioRendition+"out]",
+			"-c:a:0", "aac",
+			"-b:a:0", renditions[0].AudioBitrate,
+		)
+		streamMap = append(streamMap, fmt.Sprintf("a:0,agroup:%s,name:%s", audioRendition, audioRendition))
+	}
+
+	hlsFlags := "append_list"
+	if c.restarts > 0 {
+		// The new process restarts timestamps: players must reset decoders.
+		hlsFlags += "+discont_start"
+	}
+	args = append(args,
+		"-force_key_frames", "expr:floor(t/2)*2",
+		"-var_stream_map", strings.Join(streamMap, " "),
+	)
+	segmentName, partName := "segment_%03d.ts", "part_%05d.ts"
+	if c.cmaf {
+		segmentName, partName = cmafSegmentNames(c.restarts)
+		args = append(args, cmafArgs()...)
+	}
+	if c.lowLatency {
+		args = append(args, lowLatencyArgs(hlsDir, hlsFlags, partName)...)
+	} else {
+		args = append(args,
+			"-f", "hls",
+			"-hls_time", "2",
+			"-hls_list_size", "0",
+			"-hls_playlist_type", "event",
+			"-hls_flags", hlsFlags+"+independent_segments",
+			"-master_pl_name", "master.m3u8",
+			"-hls_segment_filename", filepath.Join(hlsDir, "%v", segmentName),
+			filepath.Join(hlsDir, "%v", "index.m3u8"),
+		)
+	}
+
+	cmd := exec.Command("ffmpeg", args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("ffmpeg stdin pipe: %w", err)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("start ffmpeg: %w", err)
+	}
+	log.Printf("[HLS] FFmpeg started PID=%d room=%s layout=%s inputs=%d (video=%d audio=%d) renditions=%s low-latency=%v cmaf=%v restart=%d",
+		cmd.Process.Pid, c.roomID, layout, len(inputs), len(videoInputs), len(audioInputs),
+		strings.Join(names, ","), c.lowLatency, c.cmaf, c.restarts)
+
+	// Wait a moment for FFmpeg to create initial playlists, then log status
+	roomID := c.roomID
+	go func() {
+		time.Sleep(3 * time.Second)
+		masterPath := filepath.Join("./hls", roomID, "master.m3u8")
+		if data, err := os.ReadFile(masterPath); err == nil {
+			log.Printf("[HLS] master.m3u8 created for room %s:\n%s", roomID, string(data))
+		} else {
+			log.Printf("[HLS] ERROR: master.m3u8 not found for room %s: %v", roomID, err)
+		}
+	}()
+
+	return cmd, stdin, nil
+}
+
+// stop ends the composite for good: FFmpeg is stopped and every writer
+// closed. It is the stop function registered for the room's stream.
+func (c *Compositor) stop() {
+	c.mu.Lock()
+	select {
+	case <-c.done:
+		c.mu.Unlock()
+		return
+	default:
+		close(c.done)
+	}
+	for _, in := range c.inputs {
+		c.release(in)
+	}
+	c.inputs = nil
+	c.mu.Unlock()
+
+	c.procMu.Lock()
+	defer c.procMu.Unlock()
+	if c.cmd != nil {
+		gracefulStopFFmpeg(c.roomID, c.cmd, c.stdin)
+		c.cmd, c.stdin = nil, nil
+	}
+}
+
+func sameCodec(a, b *CodecInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// tile is where one video input is drawn on the canvas.
+type tile struct {
+	x, y, w, h int
+}
+
+// layoutTiles computes the tile of each of n video inputs.
+func layoutTiles(layout string, n int) []tile {
+	tiles := make([]tile, 0, n)
+	switch {
+	case n == 1:
+		tiles = append(tiles, tile{0, 0, canvasWidth, canvasHeight})
+
+	case layout == LayoutPiP:
+		// The first input fills the canvas; the others are inset
+		// right-to-left along the bottom, three per row.
+		const margin = 24
+		w, h := even(canvasWidth/4), even(canvasHeight/4)
+		tiles = append(tiles, tile{0, 0, canvasWidth, canvasHeight})
+		for i := 1; i < n; i++ {
+			col, row := (i-1)%3, (i-1)/3
+			tiles = append(tiles, tile{
+				x: canvasWidth - (col+1)*(w+margin),
+				y: canvasHeight - (row+1)*(h+margin),
+				w: w,
+				h: h,
+			})
+		}
+
+	default:
+		cols := int(math.Ceil(math.Sqrt(float64(n))))
+		if layout == LayoutSideBySide {
+			cols = n
+		}
+		rows := (n + cols - 1) / cols
+		w, h := even(canvasWidth/cols), even(canvasHeight/rows)
+		for i := 0; i < n; i++ {
+			row := i / cols
+			x := (i % cols) * w
+			// Center an incomplete last row.
+			if row == rows-1 && n%cols != 0 {
+				x += (canvasWidth - (n%cols)*w) / 2
+			}
+			tiles = append(tiles, tile{x: x, y: row * h, w: w, h: h})
+		}
+	}
+	return tiles
+}
+
+func even(v int) int {
+	return v &^ 1
+}
+
+// buildFilterGraph lays the video inputs out on a black canvas at fps and
+// mixes the audio inputs, then splits both for the ladder. The outputs are
+// [v<name>out] per rendition and, with audio, [a<name>out] per audio
+// output.
+func buildFilterGraph(layout string, videoInputs, audioInputs []int, renditions []Rendition, audioOutputs []string, fps int) string {
+	var parts []string
+
+	parts = append(parts, fmt.Sprintf("color=c=black:s=%dx%d:r=%d[bg0]", canvasWidth, canvasHeight, fps))
+	base := "bg0"
+	for i, tl := range layoutTiles(layout, len(videoInputs)) {
+		in := videoInputs[i]
+		parts = append(parts, fmt.Sprintf(
+			"[%d:v]fps=%d,scale=w=%d:h=%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1[tile%d]",
+			in, fps, tl.w, tl.h, tl.w, tl.h, i))
+		next := fmt.Sprintf("bg%d", i+1)
+		parts = append(parts, fmt.Sprintf("[%s][tile%d]overlay=x=%d:y=%d:eof_action=pass[%s]", base, i, tl.x, tl.y, next))
+		base = next
+	}
+
+	split := fmt.Sprintf("[%s]split=%d", base, len(renditions))
+	for _, r := range renditions {
+		split += "[v" + r.Name + "]"
+	}
+	parts = append(parts, split)
+	for _, r := range renditions {
+		parts = append(parts, fmt.Sprintf(
+			"[v%s]scale=w=%d:h=%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2[v%sout]",
+			r.Name, r.Width, r.Height, r.Width, r.Height, r.Name))
+	}
+
+	if len(audioInputs) == 0 {
+		return strings.Join(parts, ";")
+	}
+
+	mix := ""
+	for i, in := range audioInputs {
+		parts = append(parts, fmt.Sprintf("[%d:a]aresample=async=1:first_pts=0[mix%d]", in, i))
+		mix += fmt.Sprintf("[mix%d]", i)
+	}
+	if len(audioInputs) > 1 {
+		mix += fmt.Sprintf("amix=inputs=%d:duration=longest:dropout_transition=0,", len(audioInputs))
+	}
+	mix += fmt.Sprintf("asplit=%d", len(audioOutputs))
+	for _, name := range audioOutputs {
+		mix += "[a" + name + "out]"
+	}
+	parts = append(parts, mix)
+
+	return strings.Join(parts, ";")
+}
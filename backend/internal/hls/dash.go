@@ -0,0 +1,369 @@
+package hls
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manifestName is the DASH manifest of a CMAF stream, next to its master
+// playlist.
+const manifestName = "manifest.mpd"
+
+// errNotCMAF is returned for the manifest of a stream whose segments are
+// not CMAF.
+var errNotCMAF = errors.New("not a CMAF stream")
+
+// masterEntry is a rendition the master playlist lists: a variant stream
+// or, for the shared audio track, a rendition group member.
+type masterEntry struct {
+	name     string
+	playlist string // relative to the room directory
+	audio    bool
+	attrs    map[string]string
+}
+
+var attrRE = regexp.MustCompile(`([A-Z0-9-]+)=("[^"]*"|[^,]*)`)
+
+func parseAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range attrRE.FindAllStringSubmatch(s, -1) {
+		attrs[m[1]] = strings.Trim(m[2], `"`)
+	}
+	return attrs
+}
+
+func parseMaster(data string) []masterEntry {
+	var entries []masterEntry
+	add := func(e masterEntry) {
+		name, _, ok := strings.Cut(e.playlist, "/")
+		if !ok || slices.ContainsFunc(entries, func(o masterEntry) bool { return o.name == name }) {
+			return
+		}
+		e.name = name
+		entries = append(entries, e)
+	}
+	var inf map[string]string
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			inf = parseAttrs(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			attrs := parseAttrs(strings.TrimPrefix(line, "#EXT-X-MEDIA:"))
+			if attrs["URI"] != "" {
+				add(masterEntry{playlist: attrs["URI"], audio: attrs["TYPE"] == "AUDIO", attrs: attrs})
+			}
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			add(masterEntry{playlist: line, attrs: inf})
+			inf = nil
+		}
+	}
+	return entries
+}
+
+// dashSegment is a segment of a CMAF track.
+type dashSegment struct {
+	uri      string // relative to the rendition directory
+	file     string // the file it starts with
+	duration float64
+	run      int
+}
+
+// dashTrack is a rendition of a CMAF stream, as its playlist lists it.
+type dashTrack struct {
+	entry    masterEntry
+	init     initInfo
+	initURI  string
+	segments []dashSegment
+	ended    bool
+	modTime  time.Time
+}
+
+func readTrack(roomDir string, e masterEntry) (*dashTrack, error) {
+	playlist := filepath.Join(roomDir, filepath.FromSlash(e.playlist))
+	info, err := os.Stat(playlist)
+	if err != nil {
+		return nil, err
+	}
+	list, err := readPartList(playlist)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil || list.init == "" {
+		return nil, errNotCMAF
+	}
+	t := &dashTrack{entry: e, initURI: list.init, ended: list.ended, modTime: info.ModTime()}
+	if filepath.Base(playlist) == partsPlaylist && !list.ended {
+		// A live low-latency stream: the segments the playback server
+		// groups the parts into.
+		for i, s := range list.segments(perSegment(partTarget(list))) {
+			if !s.complete {
+				break
+			}
+			first := s.parts[0].name
+			uri := fmt.Sprintf("seg_%d%s", i, filepath.Ext(first))
+			t.segments = append(t.segments, dashSegment{uri, first, s.duration(), cmafRun(first)})
+		}
+	} else {
+		for _, p := range list.parts {
+			t.segments = append(t.segments, dashSegment{p.name, p.name, p.duration, cmafRun(p.name)})
+		}
+	}
+	if t.init, err = readInit(filepath.Join(filepath.Dir(playlist), list.init)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// representation describes the segments of the track in one period, and
+// returns their duration.
+func (t *dashTrack) representation(roomDir string, segments []dashSegment) (mpdRepresentation, float64, error) {
+	dir := filepath.Dir(filepath.Join(roomDir, filepath.FromSlash(t.entry.playlist)))
+	start, err := readDecodeTime(filepath.Join(dir, segments[0].file))
+	if err != nil {
+		return mpdRepresentation{}, 0, err
+	}
+	m := numberedRE.FindStringSubmatch(segments[0].uri)
+	if m == nil {
+		return mpdRepresentation{}, 0, fmt.Errorf("unnumbered segment %s", segments[0].uri)
+	}
+	first, _ := strconv.Atoi(m[2])
+
+	prefix := path.Dir(t.entry.playlist) + "/"
+	timescale := t.init.timescale
+	tmpl := mpdSegmentTemplate{
+		Timescale:              timescale,
+		PresentationTimeOffset: start,
+		StartNumber:            first,
+		Initialization:         prefix + t.initURI,
+		Media:                  fmt.Sprintf("%s%s$Number%%0%dd$%s", prefix, m[1], len(m[2]), m[3]),
+	}
+	// Durations are rounded from the running total, not one by one: the
+	// timeline does not drift from the media.
+	var elapsed float64
+	end := start
+	for i, seg := range segments {
+		elapsed += seg.duration
+		next := start + uint64(math.Round(elapsed*float64(timescale)))
+		d := next - end
+		end = next
+		if n := len(tmpl.Timeline); n > 0 && tmpl.Timeline[n-1].D == d {
+			tmpl.Timeline[n-1].R++
+			continue
+		}
+		entry := mpdS{D: d}
+		if i == 0 {
+			entry.T = &start
+		}
+		tmpl.Timeline = append(tmpl.Timeline, entry)
+	}
+
+	rep := mpdRepresentation{
+		ID:              t.entry.name,
+		Bandwidth:       t.bandwidth(dir, segments),
+		Codecs:          t.init.codecs,
+		SegmentTemplate: tmpl,
+	}
+	if w, h, ok := strings.Cut(t.entry.attrs["RESOLUTION"], "x"); ok {
+		rep.Width, _ = strconv.Atoi(w)
+		rep.Height, _ = strconv.Atoi(h)
+	}
+	return rep, elapsed, nil
+}
+
+// bandwidth is the one the master playlist announces or, for the audio
+// track it does not, the one of its first segment.
+func (t *dashTrack) bandwidth(dir string, segments []dashSegment) int {
+	if b, err := strconv.Atoi(t.entry.attrs["BANDWIDTH"]); err == nil && b > 0 {
+		return b
+	}
+	s := segments[0]
+	if info, err := os.Stat(filepath.Join(dir, s.file)); err == nil && s.file == s.uri && s.duration > 0 {
+		return int(float64(info.Size()*8) / s.duration)
+	}
+	return 128000
+}
+
+type mpd struct {
+	XMLName                    xml.Name    `xml:"MPD"`
+	XMLNS                      string      `xml:"xmlns,attr"`
+	Profiles                   string      `xml:"profiles,attr"`
+	Type                       string      `xml:"type,attr"`
+	AvailabilityStartTime      string      `xml:"availabilityStartTime,attr,omitempty"`
+	PublishTime                string      `xml:"publishTime,attr,omitempty"`
+	MinimumUpdatePeriod        string      `xml:"minimumUpdatePeriod,attr,omitempty"`
+	SuggestedPresentationDelay string      `xml:"suggestedPresentationDelay,attr,omitempty"`
+	MediaPresentationDuration  string      `xml:"mediaPresentationDuration,attr,omitempty"`
+	MinBufferTime              string      `xml:"minBufferTime,attr"`
+	Periods                    []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	ID             string             `xml:"id,attr"`
+	Start          string             `xml:"start,attr"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ContentType      string              `xml:"contentType,attr"`
+	MimeType         string              `xml:"mimeType,attr"`
+	SegmentAlignment bool                `xml:"segmentAlignment,attr"`
+	StartWithSAP     int                 `xml:"startWithSAP,attr"`
+	Representations  []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID              string             `xml:"id,attr"`
+	Bandwidth       int                `xml:"bandwidth,attr"`
+	Width           int                `xml:"width,attr,omitempty"`
+	Height          int                `xml:"height,attr,omitempty"`
+	Codecs          string             `xml:"codecs,attr"`
+	SegmentTemplate mpdSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type mpdSegmentTemplate struct {
+	Timescale              uint32 `xml:"timescale,attr"`
+	PresentationTimeOffset uint64 `xml:"presentationTimeOffset,attr,omitempty"`
+	StartNumber            int    `xml:"startNumber,attr"`
+	Initialization         string `xml:"initialization,attr"`
+	Media                  string `xml:"media,attr"`
+	Timeline               []mpdS `xml:"SegmentTimeline>S"`
+}
+
+type mpdS struct {
+	T *uint64 `xml:"t,attr,omitempty"`
+	D uint64  `xml:"d,attr"`
+	R int     `xml:"r,attr,omitempty"`
+}
+
+// renderManifest writes the DASH manifest of the CMAF stream in roomDir,
+// over the segments its HLS playlists list. Each FFmpeg run is a period,
+// timestamps restarting with the process. The manifest is dynamic until
+// every playlist ended.
+func renderManifest(roomDir string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(roomDir, "master.m3u8"))
+	if err != nil {
+		return nil, err
+	}
+	var tracks []*dashTrack
+	for _, e := range parseMaster(string(data)) {
+		t, err := readTrack(roomDir, e)
+		if errors.Is(err, errNotCMAF) {
+			return nil, err
+		}
+		if err != nil {
+			// Not written yet.
+			continue
+		}
+		tracks = append(tracks, t)
+	}
+	if len(tracks) == 0 {
+		return nil, errNotCMAF
+	}
+
+	var runs []int
+	dynamic := false
+	var latest time.Time
+	for _, t := range tracks {
+		for _, s := range t.segments {
+			if s.run >= 0 && !slices.Contains(runs, s.run) {
+				runs = append(runs, s.run)
+			}
+		}
+		dynamic = dynamic || !t.ended
+		if t.modTime.After(latest) {
+			latest = t.modTime
+		}
+	}
+	slices.Sort(runs)
+
+	var periods []mpdPeriod
+	var start float64
+	for _, run := range runs {
+		video := mpdAdaptationSet{ContentType: "video", MimeType: "video/mp4", SegmentAlignment: true, StartWithSAP: 1}
+		audio := mpdAdaptationSet{ContentType: "audio", MimeType: "audio/mp4", SegmentAlignment: true, StartWithSAP: 1}
+		var length float64
+		for _, t := range tracks {
+			var segments []dashSegment
+			for _, s := range t.segments {
+				if s.run == run {
+					segments = append(segments, s)
+				}
+			}
+			if len(segments) == 0 {
+				continue
+			}
+			rep, d, err := t.representation(roomDir, segments)
+			if err != nil {
+				continue
+			}
+			length = max(length, d)
+			if t.entry.audio {
+				audio.Representations = append(audio.Representations, rep)
+			} else {
+				video.Representations = append(video.Representations, rep)
+			}
+		}
+		period := mpdPeriod{ID: strconv.Itoa(run), Start: xsDuration(start)}
+		for _, set := range []mpdAdaptationSet{video, audio} {
+			if len(set.Representations) > 0 {
+				period.AdaptationSets = append(period.AdaptationSets, set)
+			}
+		}
+		if len(period.AdaptationSets) == 0 {
+			continue
+		}
+		periods = append(periods, period)
+		start += length
+	}
+
+	manifest := mpd{
+		XMLNS:         "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:      "urn:mpeg:dash:profile:isoff-live:2011,urn:mpeg:dash:profile:cmaf:2019",
+		Type:          "static",
+		MinBufferTime: xsDuration(2 * segmentDuration.Seconds()),
+		Periods:       periods,
+	}
+	if dynamic {
+		// The last segment was listed when its playlist was last written:
+		// the stream started its length earlier.
+		manifest.Type = "dynamic"
+		manifest.AvailabilityStartTime = latest.Add(-time.Duration(start * float64(time.Second))).UTC().Format(time.RFC3339Nano)
+		manifest.PublishTime = latest.UTC().Format(time.RFC3339Nano)
+		manifest.MinimumUpdatePeriod = xsDuration(segmentDuration.Seconds())
+		manifest.SuggestedPresentationDelay = xsDuration(3 * segmentDuration.Seconds())
+	} else {
+		manifest.MediaPresentationDuration = xsDuration(start)
+	}
+	out, err := xml.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(out, '\n')...), nil
+}
+
+// writeManifest writes the final DASH manifest of a stopped CMAF stream,
+// served along with its replay.
+func writeManifest(roomDir string) error {
+	data, err := renderManifest(roomDir)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(roomDir, manifestName), data, 0644)
+}
+
+// xsDuration formats seconds as an xs:duration.
+func xsDuration(seconds float64) string {
+	return "PT" + strconv.FormatFloat(seconds, 'f', 3, 64) + "S"
+}
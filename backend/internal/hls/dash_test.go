@@ -0,0 +1,91 @@
+package hls
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCMAFStreamIsServedAsDASH(t *testing.T) {
+	// Token-less playback; TestPlaybackTokensGuardTheStream covers tokens.
+	SetPlaybackAuth(PlaybackAuthConfig{Optional: true})
+	defer SetPlaybackAuth(PlaybackAuthConfig{})
+
+	root := t.TempDir()
+	write := func(name string, data []byte) {
+		path := filepath.Join(root, "room-cmaf", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Init segments: a version 0 mdhd at 90kHz for the video, 48kHz for
+	// the audio, and their sample entries.
+	mdhd := func(timescale uint32) []byte {
+		return append(binary.BigEndian.AppendUint32(make([]byte, 12), timescale), make([]byte, 8)...)
+	}
+	write("720p/init.mp4", trackInit(mdhd(90000), mp4("avc1", make([]byte, 78), mp4("avcC", []byte{1, 0x64, 0, 0x1f}))))
+	write("audio/init.mp4", trackInit(mdhd(48000), mp4("mp4a", make([]byte, 28))))
+	// Segments starting at decode time 0, then 900 after the restart.
+	segment := func(decodeTime uint32) []byte {
+		return mp4("moof", mp4("traf", mp4("tfdt", binary.BigEndian.AppendUint32(make([]byte, 4), decodeTime))))
+	}
+	playlist := "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:2\n#EXT-X-MAP:URI=\"init.mp4\"\n"
+	for _, name := range []string{"720p", "audio"} {
+		write(name+"/segment_0_000.m4s", segment(0))
+		write(name+"/segment_0_001.m4s", segment(0))
+		write(name+"/segment_1_002.m4s", segment(900))
+		write(name+"/index.m3u8", []byte(playlist+
+			"#EXTINF:2.000000,\nsegment_0_000.m4s\n#EXTINF:2.000000,\nsegment_0_001.m4s\n"+
+			"#EXT-X-DISCONTINUITY\n#EXTINF:2.000000,\nsegment_1_002.m4s\n"))
+	}
+	write("master.m3u8", []byte("#EXTM3U\n#EXT-X-VERSION:7\n"+
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"group_audio\",NAME=\"audio_0\",DEFAULT=YES,URI=\"audio/index.m3u8\"\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=3000000,RESOLUTION=1280x720,CODECS=\"avc1.64001f,mp4a.40.2\",AUDIO=\"group_audio\"\n"+
+		"720p/index.m3u8\n"))
+
+	server := NewPlaybackServer(root)
+	get := func() string {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/room-cmaf/manifest.mpd", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("manifest.mpd: status %d", w.Code)
+		}
+		return w.Body.String()
+	}
+
+	manifest := get()
+	for _, want := range []string{
+		`type="dynamic"`,
+		`<Period id="0" start="PT0.000S">`,
+		`<Period id="1" start="PT4.000S">`,
+		`<Representation id="720p" bandwidth="3000000" width="1280" height="720" codecs="avc1.64001f">`,
+		`<Representation id="audio" bandwidth="128" codecs="mp4a.40.2">`,
+		`media="720p/segment_0_$Number%03d$.m4s"`,
+		`startNumber="2" initialization="720p/init.mp4" media="720p/segment_1_$Number%03d$.m4s"`,
+		`<S t="0" d="180000" r="1"></S>`,
+		`<S t="900" d="96000"></S>`,
+	} {
+		if !strings.Contains(manifest, want) {
+			t.Errorf("manifest lacks %s:\n%s", want, manifest)
+		}
+	}
+
+	for _, name := range []string{"720p", "audio"} {
+		f, err := os.OpenFile(filepath.Join(root, "room-cmaf", name, "index.m3u8"), os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.WriteString("#EXT-X-ENDLIST\n")
+		f.Close()
+	}
+	if manifest := get(); !strings.Contains(manifest, `type="static"`) || !strings.Contains(manifest, `mediaPresentationDuration="PT6.000S"`) {
+		t.Errorf("ended stream manifest is not static:\n%s", manifest)
+	}
+}
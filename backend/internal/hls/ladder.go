@@ -0,0 +1,227 @@
+package hls
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+)
+
+// DefaultProfile is the ladder profile used when no other is configured.
+const DefaultProfile = "default"
+
+// Rendition is one rendition of the adaptive HLS ladder.
+type Rendition struct {
+	Name         string `json:"name"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	VideoBitrate string `json:"videoBitrate"`
+	MaxRate      string `json:"maxRate"`
+	BufSize      string `json:"bufSize"`
+	// Level is the H.264 level the rendition is encoded at.
+	Level        string `json:"level"`
+	AudioBitrate string `json:"audioBitrate"`
+}
+
+// Profile is a transcoding ladder: its renditions, highest first, and the
+// frame rate they are encoded at.
+type Profile struct {
+	FrameRate  int         `json:"frameRate"`
+	Renditions []Rendition `json:"renditions"`
+}
+
+// LadderConfig is the ladder configuration file: the profiles by name, the
+// one lives use by default, and the one each chef tier uses.
+type LadderConfig struct {
+	Default  string             `json:"default"`
+	Tiers    map[string]string  `json:"tiers"`
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+var defaultLadder = Profile{
+	FrameRate: 30,
+	Renditions: []Rendition{
+		{"1080p", 1920, 1080, "5000k", "5500k", "10000k", "4.2", "128k"},
+		{"720p", 1280, 720, "2800k", "3200k", "5600k", "4.0", "128k"},
+		{"480p", 854, 480, "1200k", "1400k", "2400k", "3.1", "96k"},
+		{"360p", 640, 360, "700k", "900k", "1400k", "3.0", "64k"},
+	},
+}
+
+var (
+	laddersMu sync.RWMutex
+	ladders   = LadderConfig{
+		Default:  DefaultProfile,
+		Profiles: map[string]Profile{DefaultProfile: defaultLadder},
+	}
+)
+
+// LoadLadders reads the ladder configuration from a JSON file. The
+// built-in default profile stays available unless the file redefines it.
+// Meant to be called once at startup.
+func LoadLadders(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var cfg LadderConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return SetLadders(cfg)
+}
+
+// SetLadders validates and installs a ladder configuration.
+func SetLadders(cfg LadderConfig) error {
+	profiles := map[string]Profile{DefaultProfile: defaultLadder}
+	for name, p := range cfg.Profiles {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("ladder profile %q: %w", name, err)
+		}
+		if p.FrameRate == 0 {
+			p.FrameRate = defaultLadder.FrameRate
+		}
+		// Highest first: the source cap drops renditions from the top.
+		p.Renditions = slices.Clone(p.Renditions)
+		slices.SortStableFunc(p.Renditions, func(a, b Rendition) int { return b.Height - a.Height })
+		profiles[name] = p
+	}
+	if cfg.Default == "" {
+		cfg.Default = DefaultProfile
+	}
+	if _, ok := profiles[cfg.Default]; !ok {
+		return fmt.Errorf("default ladder profile %q is not defined", cfg.Default)
+	}
+	for tier, name := range cfg.Tiers {
+		if _, ok := profiles[name]; !ok {
+			return fmt.Errorf("ladder profile %q of tier %q is not defined", name, tier)
+		}
+	}
+	cfg.Profiles = profiles
+
+	laddersMu.Lock()
+	ladders = cfg
+	laddersMu.Unlock()
+	log.Printf("[HLS] %d ladder profiles loaded, default %q", len(profiles), cfg.Default)
+	return nil
+}
+
+func (p Profile) validate() error {
+	if len(p.Renditions) == 0 {
+		return fmt.Errorf("no renditions")
+	}
+	if p.FrameRate < 0 || p.FrameRate > 60 {
+		return fmt.Errorf("invalid frame rate %d", p.FrameRate)
+	}
+	seen := make(map[string]bool, len(p.Renditions))
+	for _, r := range p.Renditions {
+		switch {
+		case !validRenditionName(r.Name):
+			return fmt.Errorf("invalid rendition name %q", r.Name)
+		case r.Name == audioRendition:
+			return fmt.Errorf("rendition name %q is reserved", r.Name)
+		case seen[r.Name]:
+			return fmt.Errorf("duplicate rendition %q", r.Name)
+		case r.Width <= 0 || r.Height <= 0 || r.Width%2 != 0 || r.Height%2 != 0:
+			return fmt.Errorf("rendition %s: invalid size %dx%d", r.Name, r.Width, r.Height)
+		case r.VideoBitrate == "" || r.MaxRate == "" || r.BufSize == "" || r.Level == "" || r.AudioBitrate == "":
+			return fmt.Errorf("rendition %s: missing bitrate or level", r.Name)
+		}
+		seen[r.Name] = true
+	}
+	return nil
+}
+
+// validRenditionName reports whether name can name a rendition directory.
+func validRenditionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidProfile reports whether a ladder profile is configured.
+func ValidProfile(name string) bool {
+	laddersMu.RLock()
+	defer laddersMu.RUnlock()
+	_, ok := ladders.Profiles[name]
+	return ok
+}
+
+// ProfileForTier returns the ladder profile of a chef tier, or the default
+// one when the tier has none.
+func ProfileForTier(tier string) string {
+	laddersMu.RLock()
+	defer laddersMu.RUnlock()
+	if name, ok := ladders.Tiers[tier]; ok {
+		return name
+	}
+	return ladders.Default
+}
+
+// lookupProfile returns a ladder profile, falling back to the default one.
+func lookupProfile(name string) Profile {
+	laddersMu.RLock()
+	defer laddersMu.RUnlock()
+	if p, ok := ladders.Profiles[name]; ok {
+		return p
+	}
+	return ladders.Profiles[ladders.Default]
+}
+
+// Fit returns the renditions of the profile a source whose picture is
+// sourceHeight lines high (its short side) can feed: the ones above it are
+// dropped rather than upscaled, keeping at least the lowest rendition. An
+// unknown source height (0) keeps them all.
+func (p Profile) Fit(sourceHeight int) []Rendition {
+	if sourceHeight <= 0 {
+		return p.Renditions
+	}
+	for i, r := range p.Renditions {
+		if r.Height <= sourceHeight {
+			return p.Renditions[i:]
+		}
+	}
+	return p.Renditions[len(p.Renditions)-1:]
+}
+
+// args maps the filter graph outputs of the i-th rendition and sets its
+// encoders, with a keyframe every gop frames.
+func (r Rendition) args(i, gop int, withAudio bool) []string {
+	args := []string{
+		"-map", "[v" + r.Name + "out]",
+		fmt.Sprintf("-c:v:%d", i), "libx264",
+		fmt.Sprintf("-preset:v:%d", i), "veryfast",
+		fmt.Sprintf("-tune:v:%d", i), "zerolatency",
+		fmt.Sprintf("-b:v:%d", i), r.VideoBitrate,
+		fmt.Sprintf("-maxrate:v:%d", i), r.MaxRate,
+		fmt.Sprintf("-bufsize:v:%d", i), r.BufSize,
+		fmt.Sprintf("-g:v:%d", i), fmt.Sprint(gop),
+		fmt.Sprintf("-keyint_min:v:%d", i), fmt.Sprint(gop),
+		fmt.Sprintf("-sc_threshold:v:%d", i), "0",
+		fmt.Sprintf("-level:v:%d", i), r.Level,
+	}
+	if withAudio {
+		args = append(args,
+			"-map", "[a"+r.Name+"out]",
+			fmt.Sprintf("-c:a:%d", i), "aac",
+			fmt.Sprintf("-b:a:%d", i), r.AudioBitrate,
+		)
+	}
+	return args
+}
+
+func renditionNames(renditions []Rendition) []string {
+	names := make([]string, len(renditions))
+	for i, r := range renditions {
+		names[i] = r.Name
+	}
+	return names
+}
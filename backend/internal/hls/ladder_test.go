@@ -0,0 +1,55 @@
+package hls
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLadderIgnoresSourcesOfUnknownSize(t *testing.T) {
+	c := &Compositor{profile: Profile{Renditions: []Rendition{
+		{Name: "1080p", Height: 1080}, {Name: "720p", Height: 720}, {Name: "360p", Height: 360},
+	}}}
+	video := &CodecInfo{}
+	input := func(height int) *compositeInput {
+		return &compositeInput{Input: Input{Video: video, Height: height}}
+	}
+
+	for _, tc := range []struct {
+		inputs []*compositeInput
+		want   []string
+	}{
+		{[]*compositeInput{input(720), input(0)}, []string{"720p", "360p"}},
+		{[]*compositeInput{input(0), input(360), input(720)}, []string{"720p", "360p"}},
+		{[]*compositeInput{input(0)}, []string{"1080p", "720p", "360p"}},
+		// Audio-only inputs have no say.
+		{[]*compositeInput{{Input: Input{Audio: &CodecInfo{}}}, input(360)}, []string{"360p"}},
+	} {
+		var got []string
+		for _, r := range c.ladder(tc.inputs) {
+			got = append(got, r.Name)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("ladder = %v, want %v", got, tc.want)
+		}
+	}
+}
+
+func TestFitDropsRenditionsAboveTheSource(t *testing.T) {
+	ladder := Profile{Renditions: []Rendition{
+		{Name: "1080p", Height: 1080}, {Name: "720p", Height: 720}, {Name: "360p", Height: 360},
+	}}
+	for height, want := range map[int][]string{
+		0:    {"1080p", "720p", "360p"},
+		720:  {"720p", "360p"},
+		1079: {"720p", "360p"},
+		240:  {"360p"},
+	} {
+		var got []string
+		for _, r := range ladder.Fit(height) {
+			got = append(got, r.Name)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("Fit(%d) = %v, want %v", height, got, want)
+		}
+	}
+}
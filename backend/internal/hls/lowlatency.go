@@ -0,0 +1,360 @@
+package hls
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// segmentDuration is the duration of the HLS segments, and in low-latency
+// mode the duration its partial segments add up to.
+const segmentDuration = 2 * time.Second
+
+// Low-latency HLS (LL-HLS): FFmpeg cuts partial segments (parts) listed in
+// a parts.m3u8 playlist per rendition, and the playback server groups them
+// into the segments of index.m3u8, with EXT-X-PART tags, a preload hint
+// for the next part and blocking playlist reload. Players that do not
+// know LL-HLS read the same playlist as regular HLS.
+const (
+	partsPlaylist = "parts.m3u8"
+	// partWindow is how many segments, the one being written included,
+	// list their parts.
+	partWindow = 4
+)
+
+var partDuration time.Duration
+
+// SetLowLatency turns low-latency HLS on with parts of duration d, which
+// must divide the 2s segments and be between 200ms and 1s; zero turns it
+// off. Meant to be called once at startup: streams keep the mode they
+// started with.
+func SetLowLatency(d time.Duration) error {
+	if d != 0 && (d < 200*time.Millisecond || d > time.Second || segmentDuration%d != 0) {
+		return fmt.Errorf("invalid HLS part duration %s", d)
+	}
+	partDuration = d
+	return nil
+}
+
+// partRE matches the file names FFmpeg gives parts.
+var partRE = regexp.MustCompile(`^part_(?:\d+_)?\d+\.(?:ts|m4s)$`)
+
+// part is one partial segment listed by FFmpeg.
+type part struct {
+	name     string
+	duration float64
+	// discontinuity is set on the first part after an FFmpeg restart.
+	discontinuity bool
+	// independent is set on the parts starting on a keyframe: only those
+	// start segments.
+	independent bool
+}
+
+// llSegment is a group of consecutive parts forming one segment.
+type llSegment struct {
+	parts    []part
+	complete bool
+}
+
+func (s llSegment) duration() float64 {
+	var d float64
+	for _, p := range s.parts {
+		d += p.duration
+	}
+	return d
+}
+
+// partList is what FFmpeg's parts.m3u8 of a rendition holds.
+type partList struct {
+	// init is the init segment of fragmented MP4 parts.
+	init  string
+	parts []part
+	ended bool
+}
+
+var (
+	partListsMu sync.Mutex
+	// partLists caches the parsed parts playlists by path, until the file
+	// changes.
+	partLists = make(map[string]cachedPartList)
+)
+
+type cachedPartList struct {
+	modTime time.Time
+	size    int64
+	list    *partList
+}
+
+// readPartList parses a parts.m3u8, nil when it does not exist.
+func readPartList(path string) (*partList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	partListsMu.Lock()
+	cached, ok := partLists[path]
+	partListsMu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.list, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	list := parsePartList(string(data))
+	if filepath.Base(path) == partsPlaylist {
+		var known []part
+		if ok {
+			known = cached.list.parts
+		}
+		markIndependent(filepath.Dir(path), list.parts, known)
+	}
+	partListsMu.Lock()
+	partLists[path] = cachedPartList{info.ModTime(), info.Size(), list}
+	partListsMu.Unlock()
+	return list, nil
+}
+
+// forgetPartLists drops the cached parts playlists under dir.
+func forgetPartLists(dir string) {
+	partListsMu.Lock()
+	defer partListsMu.Unlock()
+	for path := range partLists {
+		if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			delete(partLists, path)
+		}
+	}
+}
+
+func parsePartList(data string) *partList {
+	list := &partList{}
+	var duration float64
+	discontinuity := false
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			duration, _ = strconv.ParseFloat(value, 64)
+		case line == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case line == "#EXT-X-ENDLIST":
+			list.ended = true
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			list.init = parseAttrs(strings.TrimPrefix(line, "#EXT-X-MAP:"))["URI"]
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			list.parts = append(list.parts, part{name: line, duration: duration, discontinuity: discontinuity})
+			duration, discontinuity = 0, false
+		}
+	}
+	return list
+}
+
+// markIndependent flags the parts of dir starting on a keyframe. known is
+// an earlier read of the same playlist: a listed part does not change, so
+// only the new ones are read.
+func markIndependent(dir string, parts, known []part) {
+	for i := range parts {
+		if i < len(known) && known[i].name == parts[i].name {
+			parts[i].independent = known[i].independent
+			continue
+		}
+		parts[i].independent = startsWithKeyframe(filepath.Join(dir, parts[i].name))
+	}
+}
+
+// segments groups the parts into segments of at least perSegment parts,
+// starting a new one on the next keyframe part or after a discontinuity.
+// Parts are cut on time, keyframes or not, so a segment that finds no
+// keyframe part is cut at twice that length anyway. The last segment is
+// complete once the next one started, it reached that length or the
+// stream ended.
+func (l *partList) segments(perSegment int) []llSegment {
+	var segments []llSegment
+	for _, p := range l.parts {
+		n := len(segments)
+		if n == 0 || p.discontinuity || segments[n-1].cutBefore(p, perSegment) {
+			if n > 0 {
+				segments[n-1].complete = true
+			}
+			segments = append(segments, llSegment{})
+			n++
+		}
+		segments[n-1].parts = append(segments[n-1].parts, p)
+	}
+	if n := len(segments); n > 0 && (l.ended || len(segments[n-1].parts) >= 2*perSegment) {
+		segments[n-1].complete = true
+	}
+	return segments
+}
+
+// cutBefore reports whether part p starts the segment after s.
+func (s llSegment) cutBefore(p part, perSegment int) bool {
+	return len(s.parts) >= perSegment && p.independent || len(s.parts) >= 2*perSegment
+}
+
+// has reports whether the playlist holds segment msn, or its part partIdx
+// when partIdx is not negative: the condition of a blocking reload.
+func (l *partList) has(segments []llSegment, msn, partIdx int) bool {
+	if l.ended || msn < len(segments)-1 {
+		return true
+	}
+	if msn > len(segments)-1 {
+		return false
+	}
+	seg := segments[msn]
+	if partIdx < 0 {
+		return seg.complete
+	}
+	return seg.complete || partIdx < len(seg.parts)
+}
+
+// nextPart names the part FFmpeg writes next.
+func (l *partList) nextPart() string {
+	if len(l.parts) == 0 {
+		return "part_00000.ts"
+	}
+	m := numberedRE.FindStringSubmatch(l.parts[len(l.parts)-1].name)
+	if m == nil {
+		return ""
+	}
+	n, _ := strconv.Atoi(m[2])
+	return fmt.Sprintf("%s%0*d%s", m[1], len(m[2]), n+1, m[3])
+}
+
+// perSegment is how many parts of partTarget seconds make a segment.
+func perSegment(partTarget float64) int {
+	return max(1, int(math.Round(segmentDuration.Seconds()/partTarget)))
+}
+
+// renderLowLatency writes the LL-HLS media playlist of a rendition.
+func renderLowLatency(l *partList, partTarget float64) string {
+	segments := l.segments(perSegment(partTarget))
+
+	target := segmentDuration.Seconds()
+	maxPart := partTarget
+	for _, s := range segments {
+		target = math.Max(target, s.duration())
+		for _, p := range s.parts {
+			maxPart = math.Max(maxPart, p.duration)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:6\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", maxPart)
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*maxPart)
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	independent := true
+	for _, s := range segments {
+		independent = independent && s.parts[0].independent
+	}
+	if independent {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	if l.init != "" {
+		fmt.Fprintf(&b, "#EXT-X-MAP:URI=%q\n", l.init)
+	}
+	for i, s := range segments {
+		if s.parts[0].discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if !l.ended && i >= len(segments)-partWindow {
+			for _, p := range s.parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=%q", p.duration, p.name)
+				if p.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+		if s.complete {
+			fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg_%d%s\n", s.duration(), i, filepath.Ext(s.parts[0].name))
+		}
+	}
+	if l.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	} else if next := l.nextPart(); next != "" {
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=%q\n", next)
+	}
+	return b.String()
+}
+
+// lowLatencyArgs are the FFmpeg HLS muxer options of a low-latency stream
+// writing parts named after partName to hlsDir: parts are cut on time,
+// keyframes or not.
+func lowLatencyArgs(hlsDir, hlsFlags, partName string) []string {
+	return []string{
+		"-f", "hls",
+		"-hls_time", strconv.FormatFloat(partDuration.Seconds(), 'f', -1, 64),
+		"-hls_list_size", "0",
+		"-hls_playlist_type", "event",
+		"-hls_flags", hlsFlags + "+split_by_time",
+		"-master_pl_name", "master.m3u8",
+		"-hls_segment_filename", filepath.Join(hlsDir, "%v", partName),
+		filepath.Join(hlsDir, "%v", partsPlaylist),
+	}
+}
+
+// finalizeLowLatency turns the parts playlist of a stopped low-latency
+// rendition into a regular index.m3u8 for the replay, and points the
+// master playlist to it.
+func finalizeLowLatency(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, partsPlaylist))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.m3u8"), data, 0644); err != nil {
+		return err
+	}
+	if err := finalizeOnePlaylist(filepath.Join(dir, "index.m3u8")); err != nil {
+		return err
+	}
+	// The replay is served as regular HLS.
+	return os.Remove(filepath.Join(dir, partsPlaylist))
+}
+
+// startsWithKeyframe reports whether the part at path starts on a
+// keyframe, going by the flag FFmpeg writes in it: the random access
+// indicator of the first video packet of MPEG-TS, the sync sample flag of
+// the first sample of fragmented MP4. A part that cannot be read does not.
+func startsWithKeyframe(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	// Both come before the bulk of the media data.
+	data, err := io.ReadAll(io.LimitReader(f, 16<<10))
+	if err != nil {
+		return false
+	}
+	if filepath.Ext(path) == ".m4s" {
+		return fragmentStartsWithSync(data)
+	}
+	return tsStartsWithKeyframe(data)
+}
+
+// rewriteMaster points the variants of a low-latency master playlist to
+// the index.m3u8 the playback server renders.
+func rewriteMaster(master []byte) []byte {
+	return []byte(strings.ReplaceAll(string(master), "/"+partsPlaylist, "/index.m3u8"))
+}
@@ -0,0 +1,248 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLowLatencyPlaylistBlocksUntilThePartIsReady(t *testing.T) {
+	if err := SetLowLatency(500 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLowLatency(0)
+	// Token-less playback; TestPlaybackTokensGuardTheStream covers tokens.
+	SetPlaybackAuth(PlaybackAuthConfig{Optional: true})
+	defer SetPlaybackAuth(PlaybackAuthConfig{})
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "room-ll", "720p")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	parts := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:1\n"
+	addPart := func(i int) {
+		name := fmt.Sprintf("part_%05d.ts", i)
+		// A keyframe every 2s.
+		if err := os.WriteFile(filepath.Join(dir, name), tsPart(i%4 == 0, byte('a'+i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		parts += "#EXTINF:0.500000,\n" + name + "\n"
+		if err := os.WriteFile(filepath.Join(dir, "parts.m3u8"), []byte(parts), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 5 {
+		addPart(i)
+	}
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=2800000\n720p/parts.m3u8\n"
+	if err := os.WriteFile(filepath.Join(root, "room-ll", "master.m3u8"), []byte(master), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewPlaybackServer(root)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	if body := get("/room-ll/master.m3u8").Body.String(); !strings.Contains(body, "720p/index.m3u8") {
+		t.Errorf("master playlist still points to the parts:\n%s", body)
+	}
+	playlist := get("/room-ll/720p/index.m3u8").Body.String()
+	for _, want := range []string{"#EXT-X-PART-INF:PART-TARGET=0.500", "seg_0.ts", `#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part_00005.ts"`} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("playlist lacks %q:\n%s", want, playlist)
+		}
+	}
+	var seg0 []byte
+	for i := range 4 {
+		seg0 = append(seg0, tsPart(i%4 == 0, byte('a'+i))...)
+	}
+	if body := get("/room-ll/720p/seg_0.ts").Body.Bytes(); !bytes.Equal(body, seg0) {
+		t.Errorf("seg_0.ts is not the concatenated parts (%d bytes, want %d)", len(body), len(seg0))
+	}
+	if strings.Contains(playlist, "seg_1.ts") {
+		t.Errorf("segment 1 complete before the next keyframe:\n%s", playlist)
+	}
+	if code := get("/room-ll/720p/index.m3u8?_HLS_msn=5").Code; code != http.StatusBadRequest {
+		t.Errorf("reload far ahead: status %d, want 400", code)
+	}
+
+	// A blocking reload for the next part of the segment being written
+	// is held until FFmpeg lists it.
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- get("/room-ll/720p/index.m3u8?_HLS_msn=1&_HLS_part=1") }()
+	select {
+	case <-done:
+		t.Fatal("blocking reload returned before the part was ready")
+	case <-time.After(200 * time.Millisecond):
+	}
+	addPart(5)
+	select {
+	case w := <-done:
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `URI="part_00005.ts"`) {
+			t.Errorf("blocking reload: status %d\n%s", w.Code, w.Body.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("blocking reload was not released")
+	}
+}
+
+// tsPacket builds an MPEG-TS packet starting a unit, stuffed to size.
+func tsPacket(pid int, adaptation, payload []byte) []byte {
+	pkt := []byte{0x47, 0x40 | byte(pid>>8), byte(pid), 0x10}
+	if adaptation != nil {
+		pkt[3] |= 0x20
+		pkt = append(append(pkt, byte(len(adaptation))), adaptation...)
+	}
+	pkt = append(pkt, payload...)
+	for len(pkt) < tsPacketSize {
+		pkt = append(pkt, 0xff)
+	}
+	return pkt
+}
+
+// tsTable builds the payload of a PSI packet holding one section.
+func tsTable(tableID byte, body []byte) []byte {
+	n := 5 + len(body) + 4
+	section := []byte{0, tableID, 0xb0 | byte(n>>8), byte(n), 0, 1, 0xc1, 0, 0}
+	return append(append(section, body...), 0, 0, 0, 0)
+}
+
+// tsPart builds an MPEG-TS part as FFmpeg writes them: a PAT, a PMT of an
+// H.264 stream on PID 0x100 and an AAC one, then the first video packet,
+// flagged random access on keyframes.
+func tsPart(keyframe bool, payload byte) []byte {
+	pat := tsPacket(0, nil, tsTable(0x00, []byte{0, 1, 0xf0, 0x00}))
+	pmt := tsPacket(0x1000, nil, tsTable(0x02, []byte{
+		0xe1, 0x00, 0xf0, 0x00,
+		0x1b, 0xe1, 0x00, 0xf0, 0x00,
+		0x0f, 0xe1, 0x01, 0xf0, 0x00,
+	}))
+	flags := byte(0)
+	if keyframe {
+		flags = 0x40
+	}
+	video := tsPacket(0x100, []byte{flags}, []byte{0, 0, 1, 0xe0, payload})
+	return slices.Concat(pat, pmt, video)
+}
+
+func TestSegmentsStartOnKeyframeParts(t *testing.T) {
+	list := &partList{}
+	for i := range 18 {
+		list.parts = append(list.parts, part{
+			name:        fmt.Sprintf("part_%05d.ts", i),
+			duration:    0.5,
+			independent: i == 0 || i == 5 || i == 9,
+		})
+	}
+
+	// A segment waits for a keyframe part once it has its 4 parts, and
+	// is cut without one at 8.
+	type shape struct {
+		parts    int
+		complete bool
+	}
+	var got []shape
+	for _, s := range list.segments(4) {
+		got = append(got, shape{len(s.parts), s.complete})
+	}
+	if want := []shape{{5, true}, {4, true}, {8, true}, {1, false}}; !slices.Equal(got, want) {
+		t.Errorf("segments (parts, complete) = %v, want %v", got, want)
+	}
+
+	playlist := renderLowLatency(list, 0.5)
+	if n := strings.Count(playlist, "INDEPENDENT=YES"); n != 3 {
+		t.Errorf("%d independent parts, want the 3 keyframe parts:\n%s", n, playlist)
+	}
+	for _, want := range []string{
+		`#EXT-X-PART:DURATION=0.500,URI="part_00005.ts",INDEPENDENT=YES`,
+		`#EXT-X-PART:DURATION=0.500,URI="part_00006.ts"` + "\n",
+		"#EXTINF:2.500,\nseg_0.ts",
+		"#EXTINF:4.000,\nseg_2.ts",
+	} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("playlist lacks %q:\n%s", want, playlist)
+		}
+	}
+	// The segment cut without a keyframe is not independent.
+	if strings.Contains(playlist, "#EXT-X-INDEPENDENT-SEGMENTS") || strings.Contains(playlist, "seg_3.ts") {
+		t.Errorf("playlist declares the segments independent or lists the last one:\n%s", playlist)
+	}
+}
+
+func TestPartsStartingOnAKeyframe(t *testing.T) {
+	dir := t.TempDir()
+	// trun: flags, a sample, data offset, then the fields given.
+	trun := func(flags uint32, fields ...uint32) []byte {
+		data := binary.BigEndian.AppendUint32(nil, flags)
+		data = binary.BigEndian.AppendUint32(data, 1)
+		data = binary.BigEndian.AppendUint32(data, 0)
+		for _, f := range fields {
+			data = binary.BigEndian.AppendUint32(data, f)
+		}
+		return mp4("trun", data)
+	}
+	// tfhd: flags, track 1, then the fields given.
+	tfhd := func(flags uint32, fields ...uint32) []byte {
+		data := binary.BigEndian.AppendUint32(nil, flags)
+		data = binary.BigEndian.AppendUint32(data, 1)
+		for _, f := range fields {
+			data = binary.BigEndian.AppendUint32(data, f)
+		}
+		return mp4("tfhd", data)
+	}
+	fragment := func(boxes ...[]byte) []byte {
+		return slices.Concat(mp4("styp", []byte("msdh")), mp4("moof", mp4("mfhd", make([]byte, 8)), mp4("traf", boxes...)))
+	}
+	const sync, nonSync = 0x02000000, 0x01010000
+	audioOnly := slices.Concat(
+		tsPacket(0, nil, tsTable(0x00, []byte{0, 1, 0xf0, 0x00})),
+		tsPacket(0x1000, nil, tsTable(0x02, []byte{0xe1, 0x01, 0xf0, 0x00, 0x0f, 0xe1, 0x01, 0xf0, 0x00})),
+	)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"ts keyframe", tsPart(true, 0), true},
+		{"ts delta frame", tsPart(false, 0), false},
+		{"ts without video", audioOnly, true},
+		{"ts cut short", tsPart(true, 0)[:2*tsPacketSize], false},
+		{"ts out of sync", append([]byte{0}, tsPart(true, 0)...), false},
+		{"first sample flags", fragment(tfhd(0x20, nonSync), trun(0x05, sync)), true},
+		{"first sample flags non-sync", fragment(tfhd(0x20, sync), trun(0x05, nonSync)), false},
+		{"sample flags", fragment(tfhd(0), trun(0x701, 3000, 1200, sync)), true},
+		{"sample flags non-sync", fragment(tfhd(0), trun(0x701, 3000, 1200, nonSync)), false},
+		{"tfhd default flags", fragment(tfhd(0x28, 3000, sync), trun(0x301, 3000, 1200)), true},
+		{"tfhd default flags non-sync", fragment(tfhd(0x28, 3000, nonSync), trun(0x301, 3000, 1200)), false},
+		{"no flags", fragment(tfhd(0), trun(0x01)), false},
+		{"trun cut short", fragment(tfhd(0), trun(0x05)), false},
+	} {
+		ext := ".ts"
+		if !strings.HasPrefix(tc.name, "ts") {
+			ext = ".m4s"
+		}
+		path := filepath.Join(dir, "part"+ext)
+		if err := os.WriteFile(path, tc.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := startsWithKeyframe(path); got != tc.want {
+			t.Errorf("%s: startsWithKeyframe = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if startsWithKeyframe(filepath.Join(dir, "missing.ts")) {
+		t.Error("missing part starts on a keyframe")
+	}
+}
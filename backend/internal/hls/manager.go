@@ -1,9 +1,11 @@
 package hls
 
 import (
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -12,6 +14,8 @@ import (
 type Stream struct {
 	RoomID string
 	Stop   func()
+	// renditions names every rendition the stream has encoded so far.
+	renditions []string
 }
 
 var (
@@ -53,36 +57,98 @@ func RegisterToStream(roomID string, stop func()) {
 	}()
 }
 
+// setStreamRenditions records the renditions a stream (re)started with.
+func setStreamRenditions(roomID string, names []string) {
+	mu.Lock()
+	defer mu.Unlock()
+	stream, ok := streams[roomID]
+	if !ok {
+		return
+	}
+	for _, name := range names {
+		if !slices.Contains(stream.renditions, name) {
+			stream.renditions = append(stream.renditions, name)
+		}
+	}
+}
+
+// streamRenditions returns the renditions of a running stream.
+func streamRenditions(roomID string) []string {
+	mu.Lock()
+	defer mu.Unlock()
+	if stream, ok := streams[roomID]; ok {
+		return slices.Clone(stream.renditions)
+	}
+	return nil
+}
+
+// playlistRenditions returns the renditions the master playlist a stream
+// left on disk lists.
+func playlistRenditions(roomID string) []string {
+	data, err := os.ReadFile(filepath.Join("./hls", roomID, "master.m3u8"))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range parseMaster(string(data)) {
+		names = append(names, e.name)
+	}
+	return names
+}
+
 func logSegmentStatus(roomID string) {
-	qualities := []string{"1080p", "720p", "480p", "360p"}
-	
-	for _, quality := range qualities {
-		indexPath := filepath.Join("./hls", roomID, quality, "index.m3u8")
-		data, err := os.ReadFile(indexPath)
+	for _, quality := range streamRenditions(roomID) {
+		kind := "segments"
+		data, err := os.ReadFile(filepath.Join("./hls", roomID, quality, "index.m3u8"))
 		if err != nil {
-			continue
+			kind = "parts"
+			if data, err = os.ReadFile(filepath.Join("./hls", roomID, quality, partsPlaylist)); err != nil {
+				continue
+			}
 		}
 		
 		// Count segments in the playlist
 		lines := strings.Split(string(data), "\n")
 		segmentCount := 0
 		for _, line := range lines {
-			if strings.HasPrefix(line, "segment_") {
+			if line != "" && !strings.HasPrefix(line, "#") {
 				segmentCount++
 			}
 		}
 		
-		log.Printf("[HLS] %s: %d segments ready", quality, segmentCount)
+		log.Printf("[HLS] %s: %d %s ready", quality, segmentCount, kind)
 	}
 }
 
-func finalizePlaylist(roomID string) error {
-	playlists := []string{
-		filepath.Join("./hls", roomID, "master.m3u8"),
-		filepath.Join("./hls", roomID, "1080p", "index.m3u8"),
-		filepath.Join("./hls", roomID, "720p", "index.m3u8"),
-		filepath.Join("./hls", roomID, "480p", "index.m3u8"),
-		filepath.Join("./hls", roomID, "360p", "index.m3u8"),
+// finalizePlaylist closes the playlists of the given renditions, along
+// with the ones the master playlist lists.
+func finalizePlaylist(roomID string, renditions []string) error {
+	playlists := []string{filepath.Join("./hls", roomID, "master.m3u8")}
+	for _, name := range playlistRenditions(roomID) {
+		if !slices.Contains(renditions, name) {
+			renditions = append(renditions, name)
+		}
+	}
+	lowLatency := false
+	for _, name := range renditions {
+		dir := filepath.Join("./hls", roomID, name)
+		if exists(filepath.Join(dir, partsPlaylist)) {
+			lowLatency = true
+			if err := finalizeLowLatency(dir); err != nil {
+				return err
+			}
+		}
+		playlists = append(playlists, filepath.Join(dir, "index.m3u8"))
+	}
+	if lowLatency {
+		// The replay is served statically: its variants are the index.m3u8
+		// written from the parts.
+		masterPath := filepath.Join("./hls", roomID, "master.m3u8")
+		if data, err := os.ReadFile(masterPath); err == nil {
+			if err := os.WriteFile(masterPath, rewriteMaster(data), 0644); err != nil {
+				return err
+			}
+		}
 	}
 
 	for _, playlistPath := range playlists {
@@ -90,6 +156,9 @@ func finalizePlaylist(roomID string) error {
 			return err
 		}
 	}
+	if err := writeManifest(filepath.Join("./hls", roomID)); err != nil && !errors.Is(err, errNotCMAF) {
+		return err
+	}
 
 	log.Printf("[HLS] playlists finalized for room %s", roomID)
 
@@ -130,7 +199,56 @@ func StopStream(roomID string) (string, error) {
 	time.Sleep(2 * time.Second)
 	stream.Stop()
 
-	if err := finalizePlaylist(roomID); err != nil {
+	return archiveStream(roomID, stream.renditions)
+}
+
+// DropStream stops the FFmpeg of roomID running on this instance and
+// removes its live output without archiving it, e.g. when another
+// instance took the room over and keeps streaming it.
+func DropStream(roomID string) {
+	mu.Lock()
+	stream, exists := streams[roomID]
+	delete(streams, roomID)
+	mu.Unlock()
+
+	if exists {
+		stream.Stop()
+	}
+	if err := os.RemoveAll(filepath.Join("./hls", roomID)); err != nil {
+		log.Printf("[HLS] cleanup failed for room %s: %v", roomID, err)
+	}
+	forgetPartLists(filepath.Join("./hls", roomID))
+}
+
+// RecoverReplay turns the segments a stream left on disk without being
+// stopped (e.g. when the server crashed) into a replay. It returns an empty
+// URL when there is nothing to recover.
+func RecoverReplay(roomID string) (string, error) {
+	if IsRunning(roomID) {
+		return "", nil
+	}
+	if _, err := os.Stat(filepath.Join("./hls", roomID)); err != nil {
+		return "", nil
+	}
+	log.Printf("[HLS] recovering leftover segments of room %s", roomID)
+	return archiveStream(roomID, nil)
+}
+
+// Running lists the rooms with a running stream.
+func Running() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	ids := make([]string, 0, len(streams))
+	for id := range streams {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// archiveStream finalizes the playlists of a stopped stream, copies them
+// into a replay and removes the live output.
+func archiveStream(roomID string, renditions []string) (string, error) {
+	if err := finalizePlaylist(roomID, renditions); err != nil {
 		log.Printf("[HLS] failed to finalize playlists for room %s: %v", roomID, err)
 	}
 
@@ -144,10 +262,7 @@ func StopStream(roomID string) (string, error) {
 	if err := os.RemoveAll(filepath.Join("./hls", roomID)); err != nil {
 		log.Printf("[HLS] cleanup failed for room %s: %v", roomID, err)
 	}
-
-	mu.Lock()
-	delete(tokens, roomID)
-	mu.Unlock()
+	forgetPartLists(filepath.Join("./hls", roomID))
 
 	return replayURL, err
 }
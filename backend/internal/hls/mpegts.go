@@ -0,0 +1,97 @@
+package hls
+
+// tsPacketSize is the size of an MPEG-TS packet.
+const tsPacketSize = 188
+
+// tsStartsWithKeyframe reports whether the first PES packet of the video
+// stream of MPEG-TS data has the random access indicator set, as FFmpeg
+// sets it on keyframes. Data without a video stream does: every audio
+// frame stands alone.
+func tsStartsWithKeyframe(data []byte) bool {
+	pmtPID, videoPID := -1, -1
+	for ; len(data) >= tsPacketSize; data = data[tsPacketSize:] {
+		if data[0] != 0x47 {
+			return false
+		}
+		pid := int(data[1]&0x1f)<<8 | int(data[2])
+		unitStart := data[1]&0x40 != 0
+		payload := data[4:tsPacketSize]
+		var adaptation []byte
+		if data[3]&0x20 != 0 {
+			n := int(payload[0])
+			if 1+n > len(payload) {
+				return false
+			}
+			adaptation, payload = payload[1:1+n], payload[1+n:]
+		}
+		if data[3]&0x10 == 0 {
+			payload = nil
+		}
+		if !unitStart {
+			continue
+		}
+		switch pid {
+		case 0:
+			pmtPID = tsProgramMapPID(payload)
+		case pmtPID:
+			var ok bool
+			if videoPID, ok = tsVideoPID(payload); !ok {
+				return false
+			}
+			if videoPID < 0 {
+				return true
+			}
+		case videoPID:
+			return len(adaptation) > 0 && adaptation[0]&0x40 != 0
+		}
+	}
+	return false
+}
+
+// tsSection returns the PSI section starting in a packet payload, without
+// its CRC, nil when it does not fit: FFmpeg writes its tables in a single
+// packet.
+func tsSection(payload []byte) []byte {
+	if len(payload) < 1 || 1+int(payload[0]) > len(payload) {
+		return nil
+	}
+	s := payload[1+int(payload[0]):]
+	if len(s) < 3 {
+		return nil
+	}
+	n := int(s[1]&0x0f)<<8 | int(s[2])
+	if n < 9 || 3+n > len(s) {
+		return nil
+	}
+	return s[:3+n-4]
+}
+
+// tsProgramMapPID returns the PID of the first program map table a PAT
+// lists, -1 if none.
+func tsProgramMapPID(payload []byte) int {
+	s := tsSection(payload)
+	// Programs follow the 8 byte section header; program 0 is the network.
+	for i := 8; len(s) > 0 && i+4 <= len(s); i += 4 {
+		if s[i] != 0 || s[i+1] != 0 {
+			return int(s[i+2]&0x1f)<<8 | int(s[i+3])
+		}
+	}
+	return -1
+}
+
+// tsVideoPID returns the PID of the video stream a PMT lists, -1 if none;
+// ok is false when the PMT cannot be read.
+func tsVideoPID(payload []byte) (pid int, ok bool) {
+	s := tsSection(payload)
+	if len(s) < 12 {
+		return -1, false
+	}
+	// The stream loop follows the PCR PID and the program descriptors.
+	for i := 12 + (int(s[10]&0x0f)<<8 | int(s[11])); i+5 <= len(s); i += 5 + (int(s[i+3]&0x0f)<<8 | int(s[i+4])) {
+		switch s[i] {
+		case 0x01, 0x02, 0x1b, 0x24: // MPEG-1, MPEG-2, H.264, HEVC video
+			return int(s[i+1]&0x1f)<<8 | int(s[i+2]), true
+		}
+	}
+	return -1, true
+}
@@ -0,0 +1,117 @@
+package hls
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RecordedTrack is one track written to disk by the room recorder.
+type RecordedTrack struct {
+	UserID string
+	Path   string
+	Video  bool
+	// Offset is when the track started, from the start of the recording.
+	Offset   time.Duration
+	Duration time.Duration
+	// FrameRate is set for raw H.264, which carries no timestamps.
+	FrameRate float64
+}
+
+// MuxRecording renders the recorded tracks of a room into an MP4 replay,
+// independently of the HLS output. Each participant with video gets a tile
+// of layout for the whole replay, their successive video tracks (e.g. after
+// a reconnection) playing in it at their offset; audio tracks are mixed.
+func MuxRecording(roomID, layout string, tracks []RecordedTrack) (string, error) {
+	replayDir := filepath.Join("./storage/replays", roomID)
+	if err := os.MkdirAll(replayDir, 0755); err != nil {
+		return "", err
+	}
+	output := filepath.Join(replayDir, "recording.mp4")
+
+	var args []string
+	var total time.Duration
+	tileOf := make(map[string]int)
+	var videoInputs [][2]int // input index, tile index
+	var audioInputs []int
+	for i, t := range tracks {
+		if t.FrameRate > 0 {
+			args = append(args, "-r", fmt.Sprintf("%.3f", t.FrameRate))
+		}
+		args = append(args,
+			"-itsoffset", fmt.Sprintf("%.3f", t.Offset.Seconds()),
+			"-i", t.Path,
+		)
+		if end := t.Offset + t.Duration; end > total {
+			total = end
+		}
+		if !t.Video {
+			audioInputs = append(audioInputs, i)
+			continue
+		}
+		tile, ok := tileOf[t.UserID]
+		if !ok {
+			tile = len(tileOf)
+			tileOf[t.UserID] = tile
+		}
+		videoInputs = append(videoInputs, [2]int{i, tile})
+	}
+	if total <= 0 {
+		return "", fmt.Errorf("nothing recorded for room %s", roomID)
+	}
+
+	var parts []string
+	parts = append(parts, fmt.Sprintf("color=c=black:s=%dx%d:r=30:d=%.3f[bg0]", canvasWidth, canvasHeight, total.Seconds()))
+	base := "bg0"
+	tiles := layoutTiles(layout, len(tileOf))
+	for n, v := range videoInputs {
+		tl := tiles[v[1]]
+		parts = append(parts, fmt.Sprintf(
+			"[%d:v]fps=30,scale=w=%d:h=%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1[tile%d]",
+			v[0], tl.w, tl.h, tl.w, tl.h, n))
+		next := fmt.Sprintf("bg%d", n+1)
+		parts = append(parts, fmt.Sprintf("[%s][tile%d]overlay=x=%d:y=%d:eof_action=pass[%s]", base, n, tl.x, tl.y, next))
+		base = next
+	}
+	parts = append(parts, fmt.Sprintf("[%s]null[vout]", base))
+	if len(audioInputs) > 0 {
+		mix := ""
+		for n, in := range audioInputs {
+			parts = append(parts, fmt.Sprintf("[%d:a]aresample=async=1:first_pts=0[mix%d]", in, n))
+			mix += fmt.Sprintf("[mix%d]", n)
+		}
+		mix += fmt.Sprintf("amix=inputs=%d:duration=longest:dropout_transition=0:normalize=0[aout]", len(audioInputs))
+		parts = append(parts, mix)
+	}
+
+	args = append([]string{"-loglevel", "warning", "-y"}, args...)
+	args = append(args,
+		"-filter_complex", strings.Join(parts, ";"),
+		"-map", "[vout]",
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+	)
+	if len(audioInputs) > 0 {
+		args = append(args, "-map", "[aout]", "-c:a", "aac", "-b:a", "128k")
+	}
+	args = append(args,
+		"-t", fmt.Sprintf("%.3f", total.Seconds()),
+		"-movflags", "+faststart",
+		output,
+	)
+
+	log.Printf("[REPLAY] muxing %d recorded tracks of room %s (%s)", len(tracks), roomID, total.Round(time.Second))
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("mux recording: %w", err)
+	}
+
+	publicURL := "/replays-storage/" + roomID + "/recording.mp4"
+	log.Printf("[REPLAY] recording replay generated for room %s: %s", roomID, publicURL)
+	return publicURL, nil
+}
@@ -88,6 +88,9 @@ func GenerateReplay(roomID string) (string, error) {
 	publicURL := "/replays-storage/" + roomID + "/master.m3u8"
 
 	log.Printf("[REPLAY] HLS replay generated for room %s: %s", roomID, publicURL)
+	if _, err := os.Stat(filepath.Join(replayDir, manifestName)); err == nil {
+		log.Printf("[REPLAY] DASH replay generated for room %s: /replays-storage/%s/%s", roomID, roomID, manifestName)
+	}
 
 	return publicURL, nil
 }
\ No newline at end of file
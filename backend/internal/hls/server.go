@@ -0,0 +1,291 @@
+package hls
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pollInterval is how often a held request checks whether the playlist
+// grew.
+const pollInterval = 50 * time.Millisecond
+
+// PlaybackServer serves the HLS output of the rooms under root:
+// <roomID>/master.m3u8, the media playlists and the segments. Regular
+// streams are served as written by FFmpeg; low-latency ones get their
+// index.m3u8 rendered from the parts, with blocking playlist reload
+// (_HLS_msn, _HLS_part) and preload hints held until the part is ready.
+// CMAF streams also get a DASH manifest, <roomID>/manifest.mpd.
+//
+// Requests carry a playback token (?token=) unless tokens were made
+// optional; the playlists served carry it on every URI they list.
+type PlaybackServer struct {
+	root string
+}
+
+// NewPlaybackServer serves the HLS output FFmpeg writes to root.
+func NewPlaybackServer(root string) *PlaybackServer {
+	return &PlaybackServer{root: root}
+}
+
+func (s *PlaybackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := path.Clean("/" + r.URL.Path)
+	roomID, _, _ := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+	if token := r.URL.Query().Get("token"); token != "" || tokenRequired() {
+		if !ValidateToken(roomID, token) {
+			http.Error(w, "invalid or expired playback token", http.StatusForbidden)
+			return
+		}
+	}
+	file := filepath.Join(s.root, filepath.FromSlash(name))
+	dir, base := filepath.Split(file)
+	partsPath := filepath.Join(dir, partsPlaylist)
+
+	switch {
+	case base == "master.m3u8":
+		s.serveMaster(w, r, file)
+	case base == manifestName:
+		s.serveManifest(w, r, file)
+	case base == "index.m3u8" && exists(partsPath):
+		s.serveLowLatencyPlaylist(w, r, partsPath)
+	case strings.HasPrefix(base, "seg_") && exists(partsPath):
+		s.serveSegment(w, r, partsPath, base)
+	case partRE.MatchString(base) && exists(partsPath):
+		s.servePart(w, r, partsPath, file, base)
+	default:
+		s.serveFile(w, r, file)
+	}
+}
+
+// serveMaster serves the master playlist, pointing the variants of a
+// low-latency stream to their rendered playlist.
+func (s *PlaybackServer) serveMaster(w http.ResponseWriter, r *http.Request, file string) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	writePlaylist(w, r, mime.TypeByExtension(".m3u8"), rewriteMaster(data))
+}
+
+// serveManifest serves the DASH manifest of a CMAF stream: the one written
+// when the stream stopped, or else one rendered from its playlists.
+func (s *PlaybackServer) serveManifest(w http.ResponseWriter, r *http.Request, file string) {
+	if exists(file) {
+		s.serveFile(w, r, file)
+		return
+	}
+	data, err := renderManifest(filepath.Dir(file))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	writePlaylist(w, r, mime.TypeByExtension(".mpd"), data)
+}
+
+// serveLowLatencyPlaylist renders the LL-HLS playlist of a rendition, once
+// it holds the segment or part a blocking reload asks for.
+func (s *PlaybackServer) serveLowLatencyPlaylist(w http.ResponseWriter, r *http.Request, partsPath string) {
+	q := r.URL.Query()
+	msn, partIdx := -1, -1
+	if v := q.Get("_HLS_msn"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		msn = n
+	}
+	if v := q.Get("_HLS_part"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || msn < 0 {
+			http.Error(w, "invalid _HLS_part", http.StatusBadRequest)
+			return
+		}
+		partIdx = n
+	}
+
+	list, err := readPartList(partsPath)
+	if err != nil || list == nil {
+		http.NotFound(w, r)
+		return
+	}
+	target := partTarget(list)
+	if msn >= 0 {
+		segments := list.segments(perSegment(target))
+		// A client too far ahead gets an error rather than a long wait.
+		if msn > len(segments)+1 {
+			http.Error(w, "_HLS_msn too far ahead", http.StatusBadRequest)
+			return
+		}
+		ready := waitUntil(r.Context(), 3*segmentDuration, func() bool {
+			if l, err := readPartList(partsPath); err == nil && l != nil {
+				list = l
+			}
+			return list.has(list.segments(perSegment(target)), msn, partIdx)
+		})
+		if !ready {
+			http.Error(w, "playlist not ready", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	writePlaylist(w, r, mime.TypeByExtension(".m3u8"), []byte(renderLowLatency(list, target)))
+}
+
+// serveSegment serves a segment of a low-latency rendition: its parts
+// one after the other.
+func (s *PlaybackServer) serveSegment(w http.ResponseWriter, r *http.Request, partsPath, base string) {
+	ext := filepath.Ext(base)
+	msn, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(base, "seg_"), ext))
+	list, _ := readPartList(partsPath)
+	if err != nil || list == nil {
+		http.NotFound(w, r)
+		return
+	}
+	segments := list.segments(perSegment(partTarget(list)))
+	if msn < 0 || msn >= len(segments) || !segments[msn].complete || filepath.Ext(segments[msn].parts[0].name) != ext {
+		http.NotFound(w, r)
+		return
+	}
+
+	dir := filepath.Dir(partsPath)
+	files := make([]*os.File, 0, len(segments[msn].parts))
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	var size int64
+	for _, p := range segments[msn].parts {
+		f, err := os.Open(filepath.Join(dir, p.name))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		files = append(files, f)
+		info, err := f.Stat()
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		size += info.Size()
+	}
+
+	// MPEG-TS is concatenable, and so are the fragments of fragmented MP4.
+	w.Header().Set("Content-Type", mime.TypeByExtension(ext))
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	for _, f := range files {
+		if _, err := io.Copy(w, f); err != nil {
+			return
+		}
+	}
+}
+
+// servePart serves a part of a low-latency rendition. The part a preload
+// hint announced is held until FFmpeg finished writing it.
+func (s *PlaybackServer) servePart(w http.ResponseWriter, r *http.Request, partsPath, file, base string) {
+	listed := func() bool {
+		list, _ := readPartList(partsPath)
+		if list == nil {
+			return false
+		}
+		for i := len(list.parts) - 1; i >= 0; i-- {
+			if list.parts[i].name == base {
+				return true
+			}
+		}
+		return list.ended
+	}
+	if !listed() && !waitUntil(r.Context(), 3*segmentDuration, listed) {
+		http.NotFound(w, r)
+		return
+	}
+	s.serveFile(w, r, file)
+}
+
+// partTarget is the duration the parts of list were cut at.
+func partTarget(list *partList) float64 {
+	if partDuration > 0 {
+		return partDuration.Seconds()
+	}
+	// The stream outlived a configuration change.
+	if len(list.parts) > 0 && list.parts[0].duration > 0 {
+		return list.parts[0].duration
+	}
+	return segmentDuration.Seconds()
+}
+
+// serveFile serves a file as is; directories are not listed.
+func (s *PlaybackServer) serveFile(w http.ResponseWriter, r *http.Request, file string) {
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	if ext := filepath.Ext(file); ext == ".m3u8" || ext == ".mpd" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		writePlaylist(w, r, mime.TypeByExtension(ext), data)
+		return
+	}
+	http.ServeFile(w, r, file)
+}
+
+// writePlaylist serves a playlist or manifest, its URIs carrying the
+// playback token of the request.
+func writePlaylist(w http.ResponseWriter, r *http.Request, contentType string, data []byte) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		data = withToken(data, token)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(data)
+	}
+}
+
+// waitUntil polls cond until it holds, the timeout expires or the client
+// goes away, and reports whether it held.
+func waitUntil(ctx context.Context, timeout time.Duration, cond func() bool) bool {
+	if cond() {
+		return true
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-deadline:
+			return false
+		case <-ticker.C:
+			if cond() {
+				return true
+			}
+		}
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -1,56 +1,211 @@
 package hls
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-type streamToken struct {
-	ExpiresAt time.Time
+// DefaultPlaybackTokenTTL is how long a playback token lasts when
+// PLAYBACK_TOKEN_TTL_MINUTES is not configured.
+const DefaultPlaybackTokenTTL = 10 * time.Minute
+
+// PlaybackAuthConfig configures the playback tokens.
+type PlaybackAuthConfig struct {
+	// Secret signs the tokens; every instance must share it.
+	Secret string
+	TTL    time.Duration
+	// Optional lets playback through without a token, only checking the
+	// tokens presented. Meant for development: anyone can then hotlink the
+	// streams, and a revoked viewer just drops their token.
+	Optional bool
+}
+
+// PlaybackAuthConfigFromEnv reads PLAYBACK_TOKEN_SECRET,
+// PLAYBACK_TOKEN_TTL_MINUTES and PLAYBACK_TOKENS_OPTIONAL. The secret
+// defaults to one derived from jwtSecret.
+func PlaybackAuthConfigFromEnv(jwtSecret string) PlaybackAuthConfig {
+	cfg := PlaybackAuthConfig{
+		Secret: os.Getenv("PLAYBACK_TOKEN_SECRET"),
+		TTL:    DefaultPlaybackTokenTTL,
+	}
+	cfg.Optional, _ = strconv.ParseBool(os.Getenv("PLAYBACK_TOKENS_OPTIONAL"))
+	if cfg.Secret == "" {
+		// Never sign playback URLs with the JWT key itself.
+		mac := hmac.New(sha256.New, []byte(jwtSecret))
+		mac.Write([]byte("playback-tokens"))
+		cfg.Secret = hex.EncodeToString(mac.Sum(nil))
+	}
+	if v, err := strconv.Atoi(os.Getenv("PLAYBACK_TOKEN_TTL_MINUTES")); err == nil && v > 0 {
+		cfg.TTL = time.Duration(v) * time.Minute
+	}
+	return cfg
 }
 
 var (
-	tokens = make(map[string]map[string]streamToken)
+	tokensMu     sync.Mutex
+	playbackAuth = PlaybackAuthConfig{TTL: DefaultPlaybackTokenTTL}
+	// revocations records, per room ("" for every room), when each
+	// viewer's playback was revoked: their tokens issued until then are
+	// refused. Entries are dropped once those tokens expired anyway.
+	revocations = make(map[string]map[string]time.Time)
 )
 
-func GenerateToken(roomID string, ttl time.Duration) string {
-	b := make([]byte, 16)
-	rand.Read(b)
-	token := hex.EncodeToString(b)
-
-	mu.Lock()
-	defer mu.Unlock()
-
-	if tokens[roomID] == nil {
-		tokens[roomID] = make(map[string]streamToken)
+// SetPlaybackAuth installs the playback token configuration. Meant to be
+// called once at startup.
+func SetPlaybackAuth(cfg PlaybackAuthConfig) {
+	if cfg.TTL <= 0 {
+		cfg.TTL = DefaultPlaybackTokenTTL
 	}
+	tokensMu.Lock()
+	playbackAuth = cfg
+	tokensMu.Unlock()
+}
 
-	tokens[roomID][token] = streamToken{
-		ExpiresAt: time.Now().Add(ttl),
-	}
+// GenerateToken issues a playback token letting userID play the live and
+// replay of a room, valid for the configured TTL but never past notAfter,
+// the expiry of the user's session token. A zero notAfter only applies the
+// TTL. Tokens are signed, not stored: any instance validates them.
+func GenerateToken(roomID, userID string, notAfter time.Time) (string, time.Time) {
+	tokensMu.Lock()
+	cfg := playbackAuth
+	tokensMu.Unlock()
 
-	return token
+	now := time.Now()
+	expiresAt := now.Add(cfg.TTL)
+	if !notAfter.IsZero() && notAfter.Before(expiresAt) {
+		expiresAt = notAfter
+	}
+	nonce := make([]byte, 6)
+	_, _ = rand.Read(nonce)
+	payload := strings.Join([]string{
+		userID,
+		strconv.FormatInt(now.UnixMilli(), 36),
+		strconv.FormatInt(expiresAt.Unix(), 36),
+		base64.RawURLEncoding.EncodeToString(nonce),
+	}, ".")
+	return payload + "." + sign(cfg.Secret, roomID, payload), expiresAt
 }
 
+// ValidateToken reports whether token lets its holder play roomID: it was
+// signed for that room, has not expired and was not revoked.
 func ValidateToken(roomID, token string) bool {
-	mu.Lock()
-	defer mu.Unlock()
-
-	roomTokens := tokens[roomID]
-	if roomTokens == nil {
+	fields := strings.Split(token, ".")
+	if len(fields) != 5 || !tokenUserRE.MatchString(fields[0]) {
 		return false
 	}
-
-	data, ok := roomTokens[token]
-	if !ok {
+	issuedAt, err1 := strconv.ParseInt(fields[1], 36, 64)
+	expiresAt, err2 := strconv.ParseInt(fields[2], 36, 64)
+	if err1 != nil || err2 != nil {
 		return false
 	}
 
-	if time.Now().After(data.ExpiresAt) {
-		delete(roomTokens, token)
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	payload := strings.Join(fields[:4], ".")
+	if !hmac.Equal([]byte(fields[4]), []byte(sign(playbackAuth.Secret, roomID, payload))) {
 		return false
 	}
-
+	if time.Now().After(time.Unix(expiresAt, 0)) {
+		return false
+	}
+	for _, scope := range []string{roomID, ""} {
+		pruneRevocations(scope)
+		if revokedAt, ok := revocations[scope][fields[0]]; ok && !time.UnixMilli(issuedAt).After(revokedAt) {
+			return false
+		}
+	}
 	return true
 }
+
+// RevokeViewer revokes the playback tokens userID was issued until at, for
+// a room or, when roomID is empty, for every room. Revocations are kept in
+// memory: every instance must be told.
+func RevokeViewer(roomID, userID string, at time.Time) {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	pruneRevocations(roomID)
+	if time.Since(at) > playbackAuth.TTL {
+		// The tokens expired already.
+		return
+	}
+	if revocations[roomID] == nil {
+		revocations[roomID] = make(map[string]time.Time)
+	}
+	if at.After(revocations[roomID][userID]) {
+		revocations[roomID][userID] = at
+	}
+}
+
+// PlaybackTokenTTL is the longest a playback token lasts.
+func PlaybackTokenTTL() time.Duration {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	return playbackAuth.TTL
+}
+
+// pruneRevocations drops the revocations of a room whose tokens all
+// expired. Must be called with tokensMu held.
+func pruneRevocations(roomID string) {
+	for userID, revokedAt := range revocations[roomID] {
+		if time.Since(revokedAt) > playbackAuth.TTL {
+			delete(revocations[roomID], userID)
+		}
+	}
+	if len(revocations[roomID]) == 0 {
+		delete(revocations, roomID)
+	}
+}
+
+// tokenUserRE matches the user IDs tokens may carry.
+var tokenUserRE = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func sign(secret, roomID, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(roomID + "/" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// tokenRequired reports whether playback needs a token.
+func tokenRequired() bool {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	return !playbackAuth.Optional
+}
+
+var playlistURIRE = regexp.MustCompile(`(URI|initialization|media)="([^"]*)"`)
+
+// withToken makes every URI of an HLS playlist or DASH manifest carry the
+// playback token.
+func withToken(data []byte, token string) []byte {
+	add := func(uri string) string {
+		if uri == "" {
+			return uri
+		}
+		if strings.Contains(uri, "?") {
+			return uri + "&token=" + token
+		}
+		return uri + "?token=" + token
+	}
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") && !strings.HasPrefix(trimmed, "<") {
+			lines[i] = add(trimmed)
+			continue
+		}
+		lines[i] = playlistURIRE.ReplaceAllStringFunc(line, func(m string) string {
+			sub := playlistURIRE.FindStringSubmatch(m)
+			return sub[1] + `="` + add(sub[2]) + `"`
+		})
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,122 @@
+package hls
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlaybackTokensGuardTheStream(t *testing.T) {
+	SetPlaybackAuth(PlaybackAuthConfig{Secret: "test", TTL: time.Minute})
+	defer SetPlaybackAuth(PlaybackAuthConfig{})
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "room-auth", "720p")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{
+		"../master.m3u8":    "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=2800000\n720p/index.m3u8\n",
+		"index.m3u8":        "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:2.000000,\nsegment_0_000.m4s\n",
+		"segment_0_000.m4s": "media",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := NewPlaybackServer(root)
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	token, _ := GenerateToken("room-auth", "viewer-1", time.Time{})
+	other, _ := GenerateToken("room-other", "viewer-1", time.Time{})
+	expired, _ := GenerateToken("room-auth", "viewer-1", time.Now().Add(-time.Second))
+	for _, target := range []string{
+		"/room-auth/master.m3u8",
+		"/room-auth/master.m3u8?token=" + other,
+		"/room-auth/master.m3u8?token=" + expired,
+		"/room-auth/720p/segment_0_000.m4s?token=" + token[:len(token)-1],
+	} {
+		if code := get(target).Code; code != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", target, code)
+		}
+	}
+
+	if body := get("/room-auth/master.m3u8?token=" + token).Body.String(); !strings.Contains(body, "720p/index.m3u8?token="+token) {
+		t.Errorf("master playlist URIs lack the token:\n%s", body)
+	}
+	playlist := get("/room-auth/720p/index.m3u8?token=" + token).Body.String()
+	for _, want := range []string{`URI="init.mp4?token=` + token + `"`, "segment_0_000.m4s?token=" + token} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("media playlist lacks %s:\n%s", want, playlist)
+		}
+	}
+	if body := get("/room-auth/720p/segment_0_000.m4s?token=" + token).Body.String(); body != "media" {
+		t.Errorf("segment = %q", body)
+	}
+
+	// Revocation voids the tokens issued so far, in that room only.
+	time.Sleep(2 * time.Millisecond)
+	RevokeViewer("room-auth", "viewer-1", time.Now())
+	if code := get("/room-auth/720p/segment_0_000.m4s?token=" + token).Code; code != http.StatusForbidden {
+		t.Errorf("revoked token: status %d, want 403", code)
+	}
+	if !ValidateToken("room-other", other) {
+		t.Error("revocation leaked to another room")
+	}
+	time.Sleep(2 * time.Millisecond)
+	fresh, _ := GenerateToken("room-auth", "viewer-1", time.Time{})
+	if code := get("/room-auth/720p/segment_0_000.m4s?token=" + fresh).Code; code != http.StatusOK {
+		t.Errorf("token issued after the revocation: status %d, want 200", code)
+	}
+}
+
+func TestPlaybackTokensAreRequiredByDefault(t *testing.T) {
+	t.Setenv("PLAYBACK_TOKENS_OPTIONAL", "")
+	SetPlaybackAuth(PlaybackAuthConfigFromEnv("jwt"))
+	defer SetPlaybackAuth(PlaybackAuthConfig{})
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "room-open")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=2800000\n720p/index.m3u8\n"
+	if err := os.WriteFile(filepath.Join(dir, "master.m3u8"), []byte(master), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := NewPlaybackServer(root)
+	get := func() int {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/room-open/master.m3u8", nil))
+		return w.Code
+	}
+
+	if code := get(); code != http.StatusForbidden {
+		t.Errorf("token-less request: status %d, want 403", code)
+	}
+	t.Setenv("PLAYBACK_TOKENS_OPTIONAL", "true")
+	SetPlaybackAuth(PlaybackAuthConfigFromEnv("jwt"))
+	if code := get(); code != http.StatusOK {
+		t.Errorf("token-less request with optional tokens: status %d, want 200", code)
+	}
+}
+
+func TestPlaybackTokensExpireWhileTheLiveRuns(t *testing.T) {
+	SetPlaybackAuth(PlaybackAuthConfig{Secret: "test", TTL: time.Minute})
+	defer SetPlaybackAuth(PlaybackAuthConfig{})
+	RegisterToStream("room-running", func() {})
+	defer DropStream("room-running")
+
+	expired, _ := GenerateToken("room-running", "viewer-1", time.Now().Add(-time.Second))
+	if ValidateToken("room-running", expired) {
+		t.Error("an expired token still plays the running live")
+	}
+}
@@ -60,6 +60,10 @@ func AuthMiddleware(jwtKey []byte, db *gorm.DB) gin.HandlerFunc {
 		}
 
 		c.Set("userId", claims.UserID)
+		if claims.ExpiresAt != nil {
+			// Credentials derived from the session must not outlive it.
+			c.Set("tokenExpiresAt", claims.ExpiresAt.Time)
+		}
 		// Use the role from the database so promotions/demotions apply
 		// immediately instead of waiting for the JWT to expire.
 		c.Set("role", currentUser.Role)
@@ -61,7 +61,7 @@ func liveCountByCountry(db *gorm.DB) map[uint]int64 {
 	var rows []row
 	db.Model(&live.Live{}).
 		Select("country_id, count(*) as count").
-		Where("status IN ?", []string{"scheduled", "live"}).
+		Where("status IN ?", live.ActiveStatuses).
 		Group("country_id").
 		Scan(&rows)
 
@@ -122,7 +122,7 @@ func GetDiscover(db *gorm.DB) gin.HandlerFunc {
 		var dishRows []dishStats
 		db.Model(&live.Live{}).
 			Select("dish_id, count(*) as live_count").
-			Where("status IN ?", []string{"scheduled", "live"}).
+			Where("status IN ?", live.ActiveStatuses).
 			Group("dish_id").
 			Scan(&dishRows)
 
@@ -31,6 +31,7 @@ type LiveDTO struct {
 	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
 	StartedAt   *time.Time `json:"started_at,omitempty"`
 	EndedAt     *time.Time `json:"ended_at,omitempty"`
+	EndReason   string     `json:"end_reason,omitempty"`
 
 	HasReplay   bool   `json:"has_replay"`
 	ReplayURL   string `json:"replay_url,omitempty"`
@@ -4,6 +4,8 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/Foodstream-io/etchebest/internal/modules/user"
+	"github.com/Foodstream-io/etchebest/internal/utils"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
@@ -43,7 +45,7 @@ func GetLives(db *gorm.DB) gin.HandlerFunc {
 		if status != "" && status != "all" {
 			query = query.Where("status = ?", status)
 		} else {
-			query = query.Where("status IN ?", []string{"scheduled", "live"})
+			query = query.Where("status IN ?", ActiveStatuses)
 		}
 
 		if q != "" {
@@ -129,7 +131,7 @@ func GetMyScheduledLive(db *gorm.DB) gin.HandlerFunc {
 		// l'absence de live planifié est un cas normal, pas une erreur.
 		var scheduled []Live
 		if err := db.
-			Where("user_id = ? AND status = ?", userID, "scheduled").
+			Where("user_id = ? AND status = ?", userID, StatusScheduled).
 			Order("COALESCE(scheduled_at, created_at) ASC").
 			Limit(1).
 			Find(&scheduled).Error; err != nil {
@@ -149,3 +151,29 @@ func GetMyScheduledLive(db *gorm.DB) gin.HandlerFunc {
 		}})
 	}
 }
+
+// GetLiveTransitions returns the status history of the live of a room:
+// each transition with its actor, reason and time. Only the host and admins
+// may read it.
+func GetLiveTransitions(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		roomID := c.Param("roomId")
+
+		var live Live
+		if err := db.Select("user_id").Where("room_id = ?", roomID).First(&live).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "live not found"})
+			return
+		}
+		if live.UserID != utils.GetContextString(c, "userId") && c.GetString("role") != user.ADMIN {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only the host can see the live transitions"})
+			return
+		}
+
+		transitions, err := GetTransitions(db, roomID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch live transitions"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"transitions": transitions})
+	}
+}
@@ -0,0 +1,261 @@
+package live
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Live statuses. A live is created scheduled and goes live once its host
+// connects; it is interrupted while the host's connection is down. Ending
+// it goes through processing-replay while its recording is muxed. A live
+// ended before it started is cancelled.
+const (
+	StatusScheduled        = "scheduled"
+	StatusLive             = "live"
+	StatusInterrupted      = "interrupted"
+	StatusProcessingReplay = "processing_replay"
+	StatusEnded            = "ended"
+	StatusCancelled        = "cancelled"
+)
+
+// ActiveStatuses are the statuses of the lives that have not ended.
+var ActiveStatuses = []string{StatusScheduled, StatusLive, StatusInterrupted}
+
+// transitions lists the statuses each status may move to.
+var transitions = map[string][]string{
+	StatusScheduled:        {StatusLive, StatusCancelled},
+	StatusLive:             {StatusInterrupted, StatusProcessingReplay, StatusEnded},
+	StatusInterrupted:      {StatusLive, StatusProcessingReplay, StatusEnded},
+	StatusProcessingReplay: {StatusEnded},
+}
+
+// CanTransition reports whether a live may move from one status to another.
+func CanTransition(from, to string) bool {
+	return slices.Contains(transitions[from], to)
+}
+
+// Reasons of the transitions that do not end a live; ending ones use the
+// EndReason* constants.
+const (
+	ReasonCreated          = "created"
+	ReasonHostStarted      = "host_started"
+	ReasonHostDisconnected = "host_disconnected"
+	ReasonHostReconnected  = "host_reconnected"
+	ReasonReplayProcessed  = "replay_processed"
+)
+
+// ActorSystem is the actor of the transitions the server makes on its own.
+const ActorSystem = "system"
+
+// ErrInvalidTransition is returned when a live cannot move to the status
+// asked for from its current one.
+var ErrInvalidTransition = errors.New("invalid live transition")
+
+// LiveTransition records one status change of a live.
+type LiveTransition struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	LiveID uint   `gorm:"index;not null" json:"live_id"`
+	RoomID string `gorm:"size:100;index" json:"room_id"`
+	From   string `gorm:"size:20" json:"from"`
+	To     string `gorm:"size:20;not null" json:"to"`
+	// Actor is the user who caused the transition, or ActorSystem.
+	Actor  string    `gorm:"size:100" json:"actor"`
+	Reason string    `gorm:"size:30" json:"reason"`
+	At     time.Time `gorm:"index" json:"at"`
+}
+
+var (
+	hooksMu sync.RWMutex
+	hooks   []func(LiveTransition)
+
+	// pending queues the transitions for the dispatcher, which the first
+	// one starts.
+	pendingMu    sync.Mutex
+	pending      []LiveTransition
+	queued       = make(chan struct{}, 1)
+	dispatchOnce sync.Once
+)
+
+// OnTransition registers a hook called after every transition is saved.
+// Hooks run outside of the request that caused the transition, on a single
+// dispatcher: one transition at a time, in the order they were saved, and
+// in registration order. Meant to be called at startup.
+func OnTransition(hook func(LiveTransition)) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	hooks = append(hooks, hook)
+}
+
+// fireHooks queues t for the hooks without waiting for them.
+func fireHooks(t LiveTransition) {
+	hooksMu.RLock()
+	registered := len(hooks)
+	hooksMu.RUnlock()
+	if registered == 0 {
+		return
+	}
+	dispatchOnce.Do(func() { go dispatchHooks() })
+
+	pendingMu.Lock()
+	pending = append(pending, t)
+	pendingMu.Unlock()
+	select {
+	case queued <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchHooks runs the hooks on the queued transitions, oldest first, for
+// the lifetime of the process.
+func dispatchHooks() {
+	for range queued {
+		for {
+			pendingMu.Lock()
+			if len(pending) == 0 {
+				pendingMu.Unlock()
+				break
+			}
+			t := pending[0]
+			pending = pending[1:]
+			pendingMu.Unlock()
+
+			hooksMu.RLock()
+			registered := slices.Clone(hooks)
+			hooksMu.RUnlock()
+			for _, hook := range registered {
+				hook(t)
+			}
+		}
+	}
+}
+
+// Schedule creates a live, scheduled.
+func Schedule(db *gorm.DB, live *Live, actor string) error {
+	live.Status = StatusScheduled
+	var t LiveTransition
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(live).Error; err != nil {
+			return err
+		}
+		t = LiveTransition{LiveID: live.ID, RoomID: live.RoomID, To: StatusScheduled, Actor: actor, Reason: ReasonCreated, At: time.Now()}
+		return tx.Create(&t).Error
+	})
+	if err != nil {
+		return err
+	}
+	fireHooks(t)
+	return nil
+}
+
+// Start puts the scheduled live of a room on air.
+func Start(db *gorm.DB, roomID, actor string) error {
+	return transition(db, roomID, actor, ReasonHostStarted, nil, func(string) string {
+		return StatusLive
+	})
+}
+
+// Interrupt marks a live whose host lost their connection.
+func Interrupt(db *gorm.DB, roomID string) error {
+	return transition(db, roomID, ActorSystem, ReasonHostDisconnected, nil, func(string) string {
+		return StatusInterrupted
+	})
+}
+
+// Resume puts an interrupted live back on air.
+func Resume(db *gorm.DB, roomID, actor string) error {
+	return transition(db, roomID, actor, ReasonHostReconnected, nil, func(string) string {
+		return StatusLive
+	})
+}
+
+// End ends the live of a room for reason (one of the EndReason*
+// constants): a live that never started is cancelled, one whose replay is
+// still being produced waits for it in processing-replay. replayURL, when
+// set, is the live's replay.
+func End(db *gorm.DB, roomID, actor, reason, replayURL string, replayPending bool) error {
+	updates := map[string]any{"end_reason": reason}
+	if replayURL != "" {
+		updates["has_replay"] = true
+		updates["replay_url"] = replayURL
+	}
+	return transition(db, roomID, actor, reason, updates, func(from string) string {
+		switch {
+		case from == StatusScheduled:
+			return StatusCancelled
+		case replayPending:
+			return StatusProcessingReplay
+		default:
+			return StatusEnded
+		}
+	})
+}
+
+// ReplayProcessed ends a live once its replay was produced. replayURL,
+// when set, becomes the live's replay.
+func ReplayProcessed(db *gorm.DB, roomID, replayURL string) error {
+	var updates map[string]any
+	if replayURL != "" {
+		updates = map[string]any{"has_replay": true, "replay_url": replayURL}
+	}
+	return transition(db, roomID, ActorSystem, ReasonReplayProcessed, updates, func(string) string {
+		return StatusEnded
+	})
+}
+
+// transition moves the live of a room to the status next picks from its
+// current one, saving updates along, and records the change.
+func transition(db *gorm.DB, roomID, actor, reason string, updates map[string]any, next func(from string) string) error {
+	var t LiveTransition
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var live Live
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "status", "started_at", "ended_at").
+			Where("room_id = ?", roomID).
+			First(&live).Error; err != nil {
+			return err
+		}
+		to := next(live.Status)
+		if !CanTransition(live.Status, to) {
+			return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, live.Status, to)
+		}
+
+		now := time.Now()
+		fields := map[string]any{"status": to}
+		if to == StatusLive && live.StartedAt == nil {
+			fields["started_at"] = now
+		}
+		if to != StatusLive && to != StatusInterrupted && live.EndedAt == nil {
+			fields["ended_at"] = now
+		}
+		for k, v := range updates {
+			fields[k] = v
+		}
+		if err := tx.Model(&Live{}).Where("id = ?", live.ID).Updates(fields).Error; err != nil {
+			return err
+		}
+
+		t = LiveTransition{LiveID: live.ID, RoomID: roomID, From: live.Status, To: to, Actor: actor, Reason: reason, At: now}
+		return tx.Create(&t).Error
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[LIVE] room %s: %s -> %s by %s (%s)", roomID, t.From, t.To, actor, reason)
+	fireHooks(t)
+	return nil
+}
+
+// GetTransitions returns the status changes of the live of a room, oldest
+// first.
+func GetTransitions(db *gorm.DB, roomID string) ([]LiveTransition, error) {
+	var list []LiveTransition
+	err := db.Where("room_id = ?", roomID).Order("at ASC, id ASC").Find(&list).Error
+	return list, err
+}
@@ -0,0 +1,39 @@
+package live
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHooksSeeTransitionsInOrder(t *testing.T) {
+	var mu sync.Mutex
+	var seen []uint
+	done := make(chan struct{})
+	const transitions = 200
+	OnTransition(func(tr LiveTransition) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, tr.ID)
+		if len(seen) == transitions {
+			close(done)
+		}
+	})
+
+	for id := uint(1); id <= transitions; id++ {
+		fireHooks(LiveTransition{ID: id, RoomID: "room", To: StatusLive})
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hooks did not see every transition")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, id := range seen {
+		if id != uint(i+1) {
+			t.Fatalf("transition %d reached the hooks in position %d", id, i+1)
+		}
+	}
+}
@@ -22,6 +22,7 @@ func LiveToDTO(live Live) LiveDTO {
 		PreviewGIF:     live.PreviewGIF,
 		StartedAt:      live.StartedAt,
 		EndedAt:        live.EndedAt,
+		EndReason:      live.EndReason,
 		HasReplay:      live.HasReplay,
 		ReplayURL:      live.ReplayURL,
 		ReplayViews:    live.ReplayViews,
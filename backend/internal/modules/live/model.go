@@ -8,6 +8,17 @@ import (
 	"time"
 )
 
+// Reasons a live ended, recorded in EndReason.
+const (
+	EndReasonHostEnded    = "host_ended"     // the host ended the live
+	EndReasonLastPeerLeft = "last_peer_left" // every publisher left
+	EndReasonHostTimeout  = "host_timeout"   // the host did not reconnect in time
+	EndReasonNoPeers      = "no_peers"       // reaped: nobody connected for too long
+	EndReasonNoMedia      = "no_media"       // reaped: no media received for too long
+	EndReasonOrphaned     = "orphaned"       // reaped: its room state was lost (crash)
+	EndReasonOverdue      = "overdue"        // reaped: scheduled but never started
+)
+
 type Live struct {
 	ID          uint   `gorm:"primaryKey" json:"id"`
 	RoomID 		string `gorm:"size:100;index" json:"room_id"`
@@ -33,11 +44,17 @@ type Live struct {
 	LikeCount      int `gorm:"default:0" json:"like_count"`
 
 	// Status
-	Status string `gorm:"size:20;not null;default:'scheduled';index:idx_live_country_status,idx_live_status" json:"status"` // "scheduled", "live", "ended"
+	Status string `gorm:"size:20;not null;default:'scheduled';index:idx_live_country_status,idx_live_status" json:"status"` // see Status* constants
+
+	// Audience: see Visibility* constants. Subscriber-only lives play for
+	// the host's followers.
+	Visibility      string `gorm:"size:20;not null;default:'public'" json:"visibility"`
+	SubscribersOnly bool   `gorm:"default:false" json:"subscribers_only"`
 
 	ScheduledAt *time.Time `gorm:"index" json:"scheduled_at,omitempty"`
 	StartedAt   *time.Time `gorm:"index" json:"started_at,omitempty"`
 	EndedAt     *time.Time `json:"ended_at,omitempty"`
+	EndReason   string     `gorm:"size:30" json:"end_reason,omitempty"` // see EndReason* constants
 
 	// Replay
 	HasReplay   bool   `gorm:"default:false;index:idx_live_replay" json:"has_replay"`
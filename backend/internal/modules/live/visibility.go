@@ -0,0 +1,29 @@
+package live
+
+// Live visibilities. Private lives only play for their host, co-hosts and
+// admins; unlisted ones play for anyone, like public ones.
+const (
+	VisibilityPublic   = "public"
+	VisibilityUnlisted = "unlisted"
+	VisibilityPrivate  = "private"
+)
+
+// visibilityLabels maps the labels the clients show to the visibilities.
+var visibilityLabels = map[string]string{
+	"Public":    VisibilityPublic,
+	"Non listé": VisibilityUnlisted,
+	"Privé":     VisibilityPrivate,
+}
+
+// ParseVisibility returns the visibility a client picked, by value or by
+// label, public when it picked none. ok is false for an unknown one.
+func ParseVisibility(v string) (visibility string, ok bool) {
+	switch v {
+	case "":
+		return VisibilityPublic, true
+	case VisibilityPublic, VisibilityUnlisted, VisibilityPrivate:
+		return v, true
+	}
+	visibility, ok = visibilityLabels[v]
+	return visibility, ok
+}
@@ -0,0 +1,216 @@
+package room
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/Foodstream-io/etchebest/internal/hls"
+	userModule "github.com/Foodstream-io/etchebest/internal/modules/user"
+	"github.com/Foodstream-io/etchebest/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v4"
+	"gorm.io/gorm"
+)
+
+type LayoutReq struct {
+	Layout string `json:"layout" binding:"required" example:"pip"`
+}
+
+// updateComposite makes the room's HLS composite match its publishers: one
+// input per participant (host first) with their first audio and main
+// camera track, plus one per additional angle they publish, leaving out
+// what the host muted or disabled. Screen shares come first, so the
+// picture-in-picture layout shows them full size with the cameras inset.
+// The composite starts with the first compatible video track.
+// Must be called with the room lock held.
+func updateComposite(room *Room) {
+	type feed struct {
+		ti    *TrackInfo
+		input string
+		audio bool
+	}
+	var inputs []hls.Input
+	var feeds []feed
+	index := make(map[string]int)
+
+	ordered := make([]*TrackInfo, 0, len(room.Tracks))
+	for _, screens := range []bool{true, false} {
+		for _, host := range []bool{true, false} {
+			for _, ti := range room.Tracks {
+				if (ti.Label == LabelScreen) == screens && (ti.SourceUserID == room.Host) == host {
+					ordered = append(ordered, ti)
+				}
+			}
+		}
+	}
+
+	hasVideo := false
+	for _, ti := range ordered {
+		if isModerated(room, ti) {
+			continue
+		}
+		ci := hlsCodecInfo(ti)
+		isAudio := ti.Track.Kind() == webrtc.RTPCodecTypeAudio
+		if !isAudio && !hls.SupportsVideo(ci) {
+			log.Printf("[HLS] room %s: video of %s left out of the composite: codec %s (WebRTC relay stays prioritized)",
+				room.ID, ti.SourceUserID, ci.CodecName)
+			continue
+		}
+
+		id := compositeInputID(ti)
+		i, ok := index[id]
+		if !ok {
+			i = len(inputs)
+			index[id] = i
+			inputs = append(inputs, hls.Input{ID: id})
+		}
+		switch {
+		case isAudio && inputs[i].Audio == nil:
+			inputs[i].Audio = ci
+		case !isAudio && inputs[i].Video == nil:
+			inputs[i].Video = ci
+			inputs[i].Height = int(ti.sourceHeight.Load())
+			hasVideo = true
+		default:
+			continue
+		}
+		feeds = append(feeds, feed{ti, id, isAudio})
+	}
+
+	if room.Compositor == nil {
+		if !hasVideo || hls.IsRunning(room.ID) {
+			return
+		}
+		log.Println("starting HLS stream for room", room.ID)
+		room.Compositor = hls.NewCompositor(room.ID, room.Layout, room.LadderProfile, func() {
+			requestCompositeKeyframes(room)
+		})
+	}
+
+	writers := room.Compositor.Update(inputs)
+	room.HLSConns = make(map[*TrackInfo]net.Conn, len(feeds))
+	for _, f := range feeds {
+		w := writers[f.input]
+		if w == nil {
+			continue
+		}
+		if f.audio {
+			room.HLSConns[f.ti] = w.AudioConn
+		} else {
+			room.HLSConns[f.ti] = w.VideoConn
+		}
+	}
+}
+
+// refreshComposite updates the composite once a source reported the size
+// of its picture, which bounds the ladder.
+func refreshComposite(room *Room) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if room.closed || room.Compositor == nil {
+		return
+	}
+	updateComposite(room)
+}
+
+// chefTier is the tier whose ladder profile the lives of a chef use.
+func chefTier(u *userModule.User) string {
+	switch {
+	case u.IsFeaturedChef:
+		return "featured"
+	case u.IsVerified:
+		return "verified"
+	}
+	return ""
+}
+
+// compositeInputID names the composite input a track feeds: the
+// publisher's own for their audio and main camera, a separate one for each
+// other angle.
+func compositeInputID(ti *TrackInfo) string {
+	if ti.Track.Kind() == webrtc.RTPCodecTypeAudio || ti.Label == "" || ti.Label == LabelMain {
+		return ti.SourceUserID
+	}
+	return ti.SourceUserID + "/" + ti.Label
+}
+
+// requestCompositeKeyframes asks every video source of the composite for a
+// keyframe, since a restarted FFmpeg cannot decode until it gets one.
+func requestCompositeKeyframes(room *Room) {
+	type source struct {
+		pc   *webrtc.PeerConnection
+		ssrc uint32
+	}
+	var sources []source
+
+	room.mu.Lock()
+	for ti := range room.HLSConns {
+		if ti.Track.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		track := ti.Track
+		if layer := ti.Layers[ti.HLSLayer]; layer != nil {
+			track = layer.Track
+		}
+		sources = append(sources, source{ti.SourcePC, uint32(track.SSRC())})
+	}
+	room.mu.Unlock()
+
+	for _, s := range sources {
+		requestKeyframeBurst(s.pc, s.ssrc)
+	}
+}
+
+// SetRoomLayout godoc
+// @Summary      Set the HLS layout
+// @Description  Choose how the host and co-hosts are arranged in the HLS output: grid, pip or side-by-side (host only)
+// @Tags         rooms
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        request body LayoutReq true "Layout"
+// @Success      200  {object}  map[string]string "layout"
+// @Failure      400  {object}  map[string]string "error: invalid layout"
+// @Failure      403  {object}  map[string]string "error: only the host can change the layout"
+// @Failure      404  {object}  map[string]string "error: room not found"
+// @Router       /api/rooms/{roomId}/layout [put]
+func SetRoomLayout(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req LayoutReq
+		if err := c.ShouldBindJSON(&req); err != nil || !hls.ValidLayout(req.Layout) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid layout"})
+			return
+		}
+
+		room, err := getLiveRoom(db, c.Param("roomId"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+			return
+		}
+		if room.Host != utils.GetContextString(c, "userId") {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only the host can change the layout"})
+			return
+		}
+
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		if room.closed {
+			c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+			return
+		}
+		previous := room.Layout
+		room.Layout = req.Layout
+		if err := SaveRoom(db, room); err != nil {
+			room.Layout = previous
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save layout"})
+			return
+		}
+		if room.Compositor != nil {
+			_ = room.Compositor.SetLayout(req.Layout)
+		}
+		log.Printf("[HLS] room %s layout set to %s", room.ID, req.Layout)
+		c.JSON(http.StatusOK, gin.H{"layout": room.Layout})
+	}
+}
@@ -0,0 +1,210 @@
+package room
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/time/rate"
+)
+
+// The events channel is negotiated out of band: clients open it with
+// createDataChannel("events", {negotiated: true, id: 0}) before their offer.
+const (
+	eventsChannelLabel        = "events"
+	eventsChannelID    uint16 = 0
+)
+
+const (
+	// maxEventSize bounds an event as received, envelope included.
+	maxEventSize = 4096
+	// maxEventBuffered is how much a peer may lag behind before the events
+	// published meanwhile are dropped for it.
+	maxEventBuffered = 1 << 20
+)
+
+// Participant roles, as carried in events.
+const (
+	RoleHost   = "host"
+	RoleCoHost = "cohost"
+)
+
+// Event types carried over the events channel.
+const (
+	EventReaction = "reaction"
+	EventCursor   = "cursor"
+	EventTimer    = "timer"
+	EventCue      = "cue"
+	// EventError is only sent by the server, to the peer whose event was
+	// refused.
+	EventError = "error"
+)
+
+// eventRule says who may publish an event type and how often.
+type eventRule struct {
+	roles []string
+	rate  rate.Limit
+	burst int
+}
+
+var eventRules = map[string]eventRule{
+	EventReaction: {roles: []string{RoleHost, RoleCoHost}, rate: 5, burst: 10},
+	EventCursor:   {roles: []string{RoleHost, RoleCoHost}, rate: 30, burst: 30},
+	EventTimer:    {roles: []string{RoleHost}, rate: 2, burst: 5},
+	EventCue:      {roles: []string{RoleHost}, rate: 2, burst: 5},
+}
+
+// DataEvent is a message of the events channel. Clients send type and
+// data; the server stamps the sender, their role and the time before
+// broadcasting it to the rest of the room.
+type DataEvent struct {
+	Type  string          `json:"type"`
+	From  string          `json:"from,omitempty"`
+	Role  string          `json:"role,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	At    int64           `json:"at,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// eventPeer is one participant's end of the events channel.
+type eventPeer struct {
+	userID string
+	role   string
+	dc     *webrtc.DataChannel
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// allow reports whether the peer is within the rate of eventType.
+func (p *eventPeer) allow(eventType string, rule eventRule) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := p.limiters[eventType]
+	if l == nil {
+		l = rate.NewLimiter(rule.rate, rule.burst)
+		p.limiters[eventType] = l
+	}
+	return l.Allow()
+}
+
+func (p *eventPeer) send(ev DataEvent) {
+	if p.dc.ReadyState() != webrtc.DataChannelStateOpen || p.dc.BufferedAmount() > maxEventBuffered {
+		return
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	_ = p.dc.SendText(string(data))
+}
+
+// eventBus is the pub/sub of a room's events channels.
+type eventBus struct {
+	mu    sync.RWMutex
+	peers map[*webrtc.PeerConnection]*eventPeer
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{peers: make(map[*webrtc.PeerConnection]*eventPeer)}
+}
+
+func (b *eventBus) subscribe(pc *webrtc.PeerConnection, p *eventPeer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.peers[pc] = p
+}
+
+func (b *eventBus) unsubscribe(pc *webrtc.PeerConnection) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.peers, pc)
+}
+
+// publish authorizes, rate-limits and broadcasts an event received from
+// sender. A refused event is answered with an EventError.
+func (b *eventBus) publish(pc *webrtc.PeerConnection, raw []byte) {
+	b.mu.RLock()
+	sender := b.peers[pc]
+	b.mu.RUnlock()
+	if sender == nil {
+		return
+	}
+
+	var ev DataEvent
+	if len(raw) > maxEventSize {
+		sender.send(DataEvent{Type: EventError, Error: "event too large"})
+		return
+	}
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		sender.send(DataEvent{Type: EventError, Error: "invalid event"})
+		return
+	}
+	rule, ok := eventRules[ev.Type]
+	if !ok {
+		sender.send(DataEvent{Type: EventError, Error: "unknown event type " + ev.Type})
+		return
+	}
+	if !slices.Contains(rule.roles, sender.role) {
+		sender.send(DataEvent{Type: EventError, Error: "not allowed to send " + ev.Type + " events"})
+		return
+	}
+	if !sender.allow(ev.Type, rule) {
+		sender.send(DataEvent{Type: EventError, Error: "too many " + ev.Type + " events"})
+		return
+	}
+
+	out := DataEvent{
+		Type: ev.Type,
+		From: sender.userID,
+		Role: sender.role,
+		Data: ev.Data,
+		At:   time.Now().UnixMilli(),
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for peerPC, p := range b.peers {
+		if peerPC != pc {
+			p.send(out)
+		}
+	}
+}
+
+// openEventsChannel opens the negotiated events channel on a participant's
+// PeerConnection and subscribes it to the room's events.
+// Must be called with the room lock held.
+func openEventsChannel(room *Room, userID string, pc *webrtc.PeerConnection) {
+	negotiated := true
+	id := eventsChannelID
+	dc, err := pc.CreateDataChannel(eventsChannelLabel, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	})
+	if err != nil {
+		log.Printf("[EVENTS] room %s: open events channel for %s: %v", room.ID, userID, err)
+		return
+	}
+
+	if room.events == nil {
+		room.events = newEventBus()
+	}
+	bus := room.events
+	role := RoleCoHost
+	if userID == room.Host {
+		role = RoleHost
+	}
+	peer := &eventPeer{userID: userID, role: role, dc: dc, limiters: make(map[string]*rate.Limiter)}
+
+	dc.OnOpen(func() {
+		bus.subscribe(pc, peer)
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		bus.publish(pc, msg.Data)
+	})
+	dc.OnClose(func() {
+		bus.unsubscribe(pc)
+	})
+}
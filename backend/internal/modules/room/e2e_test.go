@@ -0,0 +1,652 @@
+package room
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"gorm.io/gorm"
+)
+
+// The end-to-end harness drives headless pion clients through the HTTP
+// signaling of a room: JSON offers, trickle ICE both ways, polled
+// renegotiation offers, WHEP and disconnects. Clients publish synthetic
+// Opus and H.264 RTP and count what they receive.
+
+const (
+	e2eTimeout = 15 * time.Second
+	// e2eTeardown covers what outlives a room by design: keyframe bursts,
+	// the 2 s wait of StopStream and the HLS status logger.
+	e2eTeardown = 15 * time.Second
+)
+
+var (
+	e2eOpus = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+	e2eH264 = webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeH264,
+		ClockRate:   90000,
+		SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+	}
+)
+
+// Synthetic H.264 NAL units: a STAP-A carrying SPS and PPS, an IDR slice
+// and a non-IDR slice. Nothing decodes them; the relay only looks at the
+// NAL headers.
+var (
+	e2eParams = []byte{0x78,
+		0x00, 0x08, 0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16,
+		0x00, 0x04, 0x68, 0xce, 0x3c, 0x80}
+	e2eIDR       = []byte{0x65, 0x88, 0x84, 0x00, 0x33, 0xff}
+	e2eSlice     = []byte{0x41, 0x9a, 0x02, 0x04, 0x00}
+	e2eOpusFrame = []byte{0xfc, 0xff, 0xfe}
+)
+
+type e2eHarness struct {
+	t      *testing.T
+	db     *gorm.DB
+	router *gin.Engine
+	room   *Room
+}
+
+// newE2EHarness sets up a live room served by the router over a dry-run
+// database. Tests using it fail if goroutines are left running once every
+// client and the room are gone.
+func newE2EHarness(t *testing.T, roomID string, coHosts ...string) *e2eHarness {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("end-to-end WebRTC test")
+	}
+	// The database keeps its connection opener running.
+	db := testDB(t)
+	// Registered first so it runs after every other cleanup.
+	baseline := runtime.NumGoroutine()
+	t.Cleanup(func() { checkGoroutines(t, baseline) })
+
+	// HLS writes under the working directory; recording is left out since
+	// muxing needs FFmpeg.
+	t.Chdir(t.TempDir())
+	SetRecording(false)
+	t.Cleanup(func() { SetRecording(true) })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("userId", c.GetHeader("X-User"))
+		c.Next()
+	})
+	r.POST("/api/webrtc", HandleWebRTC(db, "stun:127.0.0.1:3478", ""))
+	r.GET("/api/webrtc/offers/next", PollRenegotiationOffer(db))
+	r.POST("/api/webrtc/answer", HandleRenegotiationAnswer(db))
+	r.POST("/api/ice", HandleICECandidate(db))
+	r.GET("/api/ice", PollLocalCandidates(db))
+	r.POST("/api/rooms/:roomId/disconnect", HandleDisconnect(db))
+	r.POST("/api/whep/:roomId", HandleWHEP(db, "stun:127.0.0.1:3478", "", DefaultMaxSubscribers))
+	r.DELETE("/api/whep/:roomId/:sessionId", HandleWHEPDelete(db))
+	r.GET("/api/whep/:roomId/:sessionId/offer", PollWHEPOffer(db))
+	r.POST("/api/whep/:roomId/:sessionId/answer", HandleWHEPAnswer(db))
+
+	return &e2eHarness{t: t, db: db, router: r, room: newTestRoom(t, roomID, 4, coHosts...)}
+}
+
+// checkGoroutines waits for the goroutines started since baseline to exit
+// and dumps them if some never do.
+func checkGoroutines(t *testing.T, baseline int) {
+	deadline := time.Now().Add(e2eTeardown)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			var buf bytes.Buffer
+			_ = pprof.Lookup("goroutine").WriteTo(&buf, 1)
+			t.Errorf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-baseline, buf.String())
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (h *e2eHarness) do(method, path, userID, contentType string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("X-User", userID)
+	w := httptest.NewRecorder()
+	h.router.ServeHTTP(w, req)
+	return w
+}
+
+func (h *e2eHarness) doJSON(method, path, userID string, v any) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(v)
+	return h.do(method, path, userID, "application/json", body)
+}
+
+// waitFor polls cond until it holds or the timeout expires.
+func (h *e2eHarness) waitFor(what string, cond func() bool) {
+	h.t.Helper()
+	deadline := time.Now().Add(e2eTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// e2eClient is a headless participant or WHEP viewer.
+type e2eClient struct {
+	h      *e2eHarness
+	userID string
+	pc     *webrtc.PeerConnection
+
+	mu sync.Mutex
+	// joined is set once the answer is applied: client candidates are
+	// held back until then.
+	joined     bool
+	candidates []webrtc.ICECandidateInit
+	// received counts the RTP packets received per kind, fromStream per
+	// stream ID: the publisher's user ID.
+	received   map[webrtc.RTPCodecType]int
+	fromStream map[string]int
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func (h *e2eHarness) newClient(userID string) *e2eClient {
+	h.t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		h.t.Fatalf("%s: new peer connection: %v", userID, err)
+	}
+	c := &e2eClient{
+		h:          h,
+		userID:     userID,
+		pc:         pc,
+		received:   make(map[webrtc.RTPCodecType]int),
+		fromStream: make(map[string]int),
+		done:       make(chan struct{}),
+	}
+	h.t.Cleanup(c.close)
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			if _, _, err := track.ReadRTP(); err != nil {
+				return
+			}
+			c.mu.Lock()
+			c.received[track.Kind()]++
+			c.fromStream[track.StreamID()]++
+			c.mu.Unlock()
+		}
+	})
+	return c
+}
+
+// publish adds an Opus and an H.264 track, fed with synthetic RTP until
+// the client closes.
+func (c *e2eClient) publish() {
+	c.h.t.Helper()
+	audio, err := webrtc.NewTrackLocalStaticRTP(e2eOpus, "audio", c.userID)
+	if err != nil {
+		c.h.t.Fatal(err)
+	}
+	video, err := webrtc.NewTrackLocalStaticRTP(e2eH264, "video", c.userID)
+	if err != nil {
+		c.h.t.Fatal(err)
+	}
+	for _, track := range []*webrtc.TrackLocalStaticRTP{audio, video} {
+		sender, err := c.pc.AddTrack(track)
+		if err != nil {
+			c.h.t.Fatalf("%s: add track: %v", c.userID, err)
+		}
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			for {
+				if _, _, err := sender.ReadRTCP(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		var audioSeq, videoSeq uint16
+		var audioTS, videoTS uint32
+		for tick := 0; ; tick++ {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+			}
+
+			_ = audio.WriteRTP(&rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: audioSeq, Timestamp: audioTS, Marker: audioSeq == 0},
+				Payload: e2eOpusFrame,
+			})
+			audioSeq++
+			audioTS += 960
+
+			// 25 frames per second, a keyframe every second.
+			if tick%2 != 0 {
+				continue
+			}
+			frame := [][]byte{e2eSlice}
+			if tick%50 == 0 {
+				frame = [][]byte{e2eParams, e2eIDR}
+			}
+			for i, payload := range frame {
+				_ = video.WriteRTP(&rtp.Packet{
+					Header:  rtp.Header{Version: 2, SequenceNumber: videoSeq, Timestamp: videoTS, Marker: i == len(frame)-1},
+					Payload: payload,
+				})
+				videoSeq++
+			}
+			videoTS += 3600
+		}
+	}()
+}
+
+// join offers through HandleWebRTC with trickle ICE, then keeps signaling:
+// candidates go both ways and renegotiation offers are answered.
+func (c *e2eClient) join() {
+	h := c.h
+	h.t.Helper()
+	c.pc.OnICECandidate(func(cand *webrtc.ICECandidate) {
+		if cand == nil {
+			return
+		}
+		init := cand.ToJSON()
+		c.mu.Lock()
+		if !c.joined {
+			c.candidates = append(c.candidates, init)
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+		c.sendCandidate(init)
+	})
+
+	// The events channel is negotiated; open our end like browsers do.
+	negotiated := true
+	id := eventsChannelID
+	if _, err := c.pc.CreateDataChannel(eventsChannelLabel, &webrtc.DataChannelInit{Negotiated: &negotiated, ID: &id}); err != nil {
+		h.t.Fatalf("%s: events channel: %v", c.userID, err)
+	}
+	if len(c.pc.GetTransceivers()) == 0 {
+		for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+			if _, err := c.pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionRecvonly,
+			}); err != nil {
+				h.t.Fatal(err)
+			}
+		}
+	}
+
+	offer, err := c.pc.CreateOffer(nil)
+	if err != nil {
+		h.t.Fatalf("%s: create offer: %v", c.userID, err)
+	}
+	if err := c.pc.SetLocalDescription(offer); err != nil {
+		h.t.Fatalf("%s: set offer: %v", c.userID, err)
+	}
+	w := h.doJSON(http.MethodPost, "/api/webrtc?trickle=true&roomId="+h.room.ID, c.userID, offer)
+	if w.Code != http.StatusOK {
+		h.t.Fatalf("%s: join: code=%d body=%s", c.userID, w.Code, w.Body.String())
+	}
+	var resp struct {
+		SDP     string `json:"sdp"`
+		Trickle bool   `json:"trickle"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.Trickle {
+		h.t.Fatalf("%s: join response %s: %v", c.userID, w.Body.String(), err)
+	}
+	if err := c.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: resp.SDP}); err != nil {
+		h.t.Fatalf("%s: set answer: %v", c.userID, err)
+	}
+
+	c.mu.Lock()
+	c.joined = true
+	pending := c.candidates
+	c.candidates = nil
+	c.mu.Unlock()
+	for _, cand := range pending {
+		c.sendCandidate(cand)
+	}
+
+	c.wg.Add(1)
+	go c.signal()
+}
+
+func (c *e2eClient) sendCandidate(cand webrtc.ICECandidateInit) {
+	w := c.h.doJSON(http.MethodPost, "/api/ice?roomId="+c.h.room.ID, c.userID, cand)
+	if w.Code != http.StatusOK {
+		c.h.t.Errorf("%s: send candidate: code=%d body=%s", c.userID, w.Code, w.Body.String())
+	}
+}
+
+// signal polls the server candidates and renegotiation offers, as clients
+// without a WebSocket do.
+func (c *e2eClient) signal() {
+	defer c.wg.Done()
+	h := c.h
+	query := "?roomId=" + h.room.ID
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		w := h.do(http.MethodGet, "/api/ice"+query, c.userID, "", nil)
+		if w.Code == http.StatusOK {
+			var resp struct {
+				Candidates []webrtc.ICECandidateInit `json:"candidates"`
+			}
+			_ = json.Unmarshal(w.Body.Bytes(), &resp)
+			for _, cand := range resp.Candidates {
+				if err := c.pc.AddICECandidate(cand); err != nil {
+					h.t.Errorf("%s: add server candidate: %v", c.userID, err)
+				}
+			}
+		}
+
+		w = h.do(http.MethodGet, "/api/webrtc/offers/next"+query, c.userID, "", nil)
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var offer webrtc.SessionDescription
+		if err := json.Unmarshal(w.Body.Bytes(), &offer); err != nil {
+			h.t.Errorf("%s: decode offer: %v", c.userID, err)
+			continue
+		}
+		if err := c.pc.SetRemoteDescription(offer); err != nil {
+			h.t.Errorf("%s: set renegotiation offer: %v", c.userID, err)
+			continue
+		}
+		answer, err := c.pc.CreateAnswer(nil)
+		if err != nil {
+			h.t.Errorf("%s: create answer: %v", c.userID, err)
+			continue
+		}
+		if err := c.pc.SetLocalDescription(answer); err != nil {
+			h.t.Errorf("%s: set answer: %v", c.userID, err)
+			continue
+		}
+		if w := h.doJSON(http.MethodPost, "/api/webrtc/answer"+query, c.userID, answer); w.Code != http.StatusOK {
+			h.t.Errorf("%s: send answer: code=%d body=%s", c.userID, w.Code, w.Body.String())
+		}
+	}
+}
+
+// watch subscribes through WHEP, without trickle: the offer carries the
+// client candidates. Returns the session path.
+func (c *e2eClient) watch() string {
+	h := c.h
+	h.t.Helper()
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err := c.pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			h.t.Fatal(err)
+		}
+	}
+	offer, err := c.pc.CreateOffer(nil)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(c.pc)
+	if err := c.pc.SetLocalDescription(offer); err != nil {
+		h.t.Fatal(err)
+	}
+	<-gathered
+
+	w := h.do(http.MethodPost, "/api/whep/"+h.room.ID, c.userID, sdpContentType, []byte(c.pc.LocalDescription().SDP))
+	if w.Code != http.StatusCreated {
+		h.t.Fatalf("%s: WHEP: code=%d body=%s", c.userID, w.Code, w.Body.String())
+	}
+	if err := c.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: w.Body.String()}); err != nil {
+		h.t.Fatalf("%s: set WHEP answer: %v", c.userID, err)
+	}
+	return w.Header().Get("Location")
+}
+
+// signalWHEP polls the server offers of a WHEP session and answers them.
+func (c *e2eClient) signalWHEP(session string) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		h := c.h
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+			}
+			w := h.do(http.MethodGet, session+"/offer", c.userID, "", nil)
+			if w.Code != http.StatusOK {
+				continue
+			}
+			if err := c.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: w.Body.String()}); err != nil {
+				h.t.Errorf("%s: set WHEP offer: %v", c.userID, err)
+				continue
+			}
+			answer, err := c.pc.CreateAnswer(nil)
+			if err != nil {
+				h.t.Errorf("%s: create answer: %v", c.userID, err)
+				continue
+			}
+			if err := c.pc.SetLocalDescription(answer); err != nil {
+				h.t.Errorf("%s: set answer: %v", c.userID, err)
+				continue
+			}
+			if w := h.do(http.MethodPost, session+"/answer", c.userID, sdpContentType, []byte(answer.SDP)); w.Code != http.StatusNoContent {
+				h.t.Errorf("%s: send WHEP answer: code=%d body=%s", c.userID, w.Code, w.Body.String())
+			}
+		}
+	}()
+}
+
+// receivesFrom reports whether at least n packets of publisher userID arrived.
+func (c *e2eClient) receivesFrom(userID string, n int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fromStream[userID] >= n
+}
+
+// receives reports whether at least n packets of kind arrived.
+func (c *e2eClient) receives(kind webrtc.RTPCodecType, n int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.received[kind] >= n
+}
+
+func (c *e2eClient) close() {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	close(c.done)
+	_ = c.pc.Close()
+	c.wg.Wait()
+}
+
+// converged reports whether userID has no server offer pending or queued
+// and both ends of their connection are stable.
+func (h *e2eHarness) converged(c *e2eClient) bool {
+	room := h.room
+	room.mu.Lock()
+	_, pending := room.PendingOfferByUser[c.userID]
+	busy := pending || room.RenegotiatingByUser[c.userID] || room.NeedsRenegotiationByUser[c.userID]
+	pc := getPeerConnectionByUser(room, c.userID)
+	room.mu.Unlock()
+	return !busy && pc != nil &&
+		pc.SignalingState() == webrtc.SignalingStateStable &&
+		c.pc.SignalingState() == webrtc.SignalingStateStable
+}
+
+// sendersTo counts the tracks the server sends to userID.
+func (h *e2eHarness) sendersTo(userID string) int {
+	room := h.room
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	pc := getPeerConnectionByUser(room, userID)
+	n := 0
+	for _, ti := range room.Tracks {
+		if _, ok := ti.SendersByPeer[pc]; ok && pc != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func TestE2EMediaFlowsThroughTheRoom(t *testing.T) {
+	h := newE2EHarness(t, "room-e2e", "cohost")
+
+	host := h.newClient("host")
+	host.publish()
+	host.join()
+	h.waitFor("the host to connect", func() bool {
+		return host.pc.ConnectionState() == webrtc.PeerConnectionStateConnected
+	})
+	h.waitFor("the host's tracks to reach the room", func() bool {
+		h.room.mu.Lock()
+		defer h.room.mu.Unlock()
+		return len(h.room.Tracks) == 2
+	})
+
+	// The co-host gets the host's tracks in their answer; the host gets
+	// the co-host's through a renegotiation.
+	cohost := h.newClient("cohost")
+	cohost.publish()
+	cohost.join()
+	h.waitFor("media to flow both ways", func() bool {
+		return host.receives(webrtc.RTPCodecTypeAudio, 10) && host.receives(webrtc.RTPCodecTypeVideo, 10) &&
+			cohost.receives(webrtc.RTPCodecTypeAudio, 10) && cohost.receives(webrtc.RTPCodecTypeVideo, 10)
+	})
+	h.waitFor("renegotiation to converge", func() bool {
+		return h.converged(host) && h.converged(cohost)
+	})
+	if n := h.sendersTo("host"); n != 2 {
+		t.Errorf("host is sent %d tracks, want the co-host's 2", n)
+	}
+
+	viewer := h.newClient("viewer")
+	session := viewer.watch()
+	if !strings.HasPrefix(session, "/api/whep/"+h.room.ID+"/") {
+		t.Fatalf("WHEP session %q", session)
+	}
+	h.waitFor("the viewer to receive media", func() bool {
+		return viewer.receives(webrtc.RTPCodecTypeAudio, 10) && viewer.receives(webrtc.RTPCodecTypeVideo, 10)
+	})
+	if w := h.do(http.MethodDelete, session, "viewer", "", nil); w.Code != http.StatusOK {
+		t.Errorf("end WHEP session: code=%d", w.Code)
+	}
+	viewer.close()
+
+	// The co-host leaves: the room notices the connection drop, removes
+	// their tracks and renegotiates the host.
+	cohost.close()
+	h.waitFor("the co-host to be removed", func() bool {
+		h.room.mu.Lock()
+		defer h.room.mu.Unlock()
+		return getPeerConnectionByUser(h.room, "cohost") == nil && len(h.room.Tracks) == 2
+	})
+	h.waitFor("the host to renegotiate", func() bool {
+		return h.converged(host) && h.sendersTo("host") == 0
+	})
+
+	if w := h.do(http.MethodPost, "/api/rooms/"+h.room.ID+"/disconnect", "host", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("end live: code=%d body=%s", w.Code, w.Body.String())
+	}
+	// The client keeps polling until closed; with the dry-run database a
+	// poll loads an empty room again, so only the ended one is checked.
+	h.room.mu.Lock()
+	closed, conns := h.room.closed, len(h.room.Connections)
+	h.room.mu.Unlock()
+	if !closed || conns != 0 {
+		t.Errorf("room not torn down after the host ended it: closed=%v connections=%d", closed, conns)
+	}
+	host.close()
+}
+
+func TestE2EWHEPSubscriberGetsTracksPublishedLater(t *testing.T) {
+	h := newE2EHarness(t, "room-e2e-whep", "cohost")
+
+	host := h.newClient("host")
+	host.publish()
+	host.join()
+	h.waitFor("the host's tracks to reach the room", func() bool {
+		h.room.mu.Lock()
+		defer h.room.mu.Unlock()
+		return len(h.room.Tracks) == 2
+	})
+
+	viewer := h.newClient("viewer")
+	session := viewer.watch()
+	viewer.signalWHEP(session)
+	h.waitFor("the viewer to receive the host", func() bool {
+		return viewer.receivesFrom("host", 10)
+	})
+
+	// A co-host publishing after the viewer joined reaches it through a
+	// server offer.
+	cohost := h.newClient("cohost")
+	cohost.publish()
+	cohost.join()
+	h.waitFor("the viewer to receive the co-host", func() bool {
+		return viewer.receivesFrom("cohost", 10)
+	})
+
+	// Their tracks are removed from the viewer once they leave.
+	subscriberSenders := func() int {
+		h.room.mu.Lock()
+		defer h.room.mu.Unlock()
+		n := 0
+		for _, ti := range h.room.Tracks {
+			if _, ok := ti.SendersByPeer[h.room.Subscribers[path.Base(session)].PeerCon]; ok {
+				n++
+			}
+		}
+		return n
+	}
+	if n := subscriberSenders(); n != 4 {
+		t.Errorf("viewer is sent %d tracks, want 4", n)
+	}
+	cohost.close()
+	h.waitFor("the viewer to renegotiate without the co-host", func() bool {
+		h.room.mu.Lock()
+		sub := h.room.Subscribers[path.Base(session)]
+		settled := sub != nil && sub.pendingOffer == nil && !sub.renegotiating && !sub.needsRenegotiation
+		h.room.mu.Unlock()
+		return settled && subscriberSenders() == 2 && viewer.pc.SignalingState() == webrtc.SignalingStateStable
+	})
+
+	if w := h.do(http.MethodDelete, session, "viewer", "", nil); w.Code != http.StatusOK {
+		t.Errorf("end WHEP session: code=%d", w.Code)
+	}
+	viewer.close()
+	if w := h.do(http.MethodPost, "/api/rooms/"+h.room.ID+"/disconnect", "host", "", nil); w.Code != http.StatusOK {
+		t.Fatalf("end live: code=%d body=%s", w.Code, w.Body.String())
+	}
+	host.close()
+}
@@ -0,0 +1,440 @@
+package room
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	userModule "github.com/Foodstream-io/etchebest/internal/modules/user"
+	"github.com/Foodstream-io/etchebest/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultInvitationTTL = 24 * time.Hour
+	maxInvitationTTL     = 7 * 24 * time.Hour
+)
+
+type InvitationReq struct {
+	// UserId is the invitee; leave empty to generate a single-use invite link.
+	UserId           string `json:"userId" example:"550e8400-e29b-41d4-a716-446655440001"`
+	ExpiresInMinutes int    `json:"expiresInMinutes" example:"1440"`
+}
+
+// hostedRoom loads the live room and checks that the caller hosts it.
+// Returns nil (and writes the HTTP error) when the caller should abort.
+func hostedRoom(c *gin.Context, db *gorm.DB) *Room {
+	room, err := getLiveRoom(db, c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+		return nil
+	}
+	if room.Host != utils.GetContextString(c, "userId") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the host can manage invitations"})
+		return nil
+	}
+	return room
+}
+
+// roomInvitation loads an invitation of the room in the path.
+// Returns nil (and writes the HTTP error) when the caller should abort.
+func roomInvitation(c *gin.Context, db *gorm.DB) *Invitation {
+	invitation, err := GetInvitationById(db, c.Param("invitationId"))
+	if err != nil || invitation.RoomID != c.Param("roomId") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "invitation not found"})
+		return nil
+	}
+	return invitation
+}
+
+// rejectClosedInvitation answers a request on an invitation that can no
+// longer change state, reloading it first since it may have just moved.
+func rejectClosedInvitation(c *gin.Context, db *gorm.DB, invitation *Invitation) {
+	if current, err := GetInvitationById(db, invitation.ID); err == nil {
+		invitation = current
+	}
+	if invitation.Status == InvitationPending && !time.Now().Before(invitation.ExpiresAt) {
+		if err := ExpireInvitations(db); err != nil {
+			log.Printf("[INVITE] failed to expire invitations: %v", err)
+		}
+		c.JSON(http.StatusGone, gin.H{"error": "invitation expired"})
+		return
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": "invitation is " + invitation.Status})
+}
+
+// notifyInvitation pushes the invitation's new state to the room's
+// WebSocket clients and to the invitee, who is not in the room yet, on
+// their notification sockets.
+func notifyInvitation(invitation *Invitation) {
+	msg := WSMessage{Type: WSTypeInvitation, Invitation: invitation}
+	sendToRoom(invitation.RoomID, msg)
+	if invitation.InviteeID != "" {
+		sendToUserSockets(invitation.InviteeID, msg)
+	}
+}
+
+// InviteCoHost godoc
+// @Summary      Invite a co-host
+// @Description  Invite a user to co-host the room, or generate a single-use invite link when no userId is given (host only)
+// @Tags         rooms
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        request body InvitationReq false "Invitee and expiry"
+// @Success      201  {object}  map[string]interface{} "invitation, and inviteUrl/token for links"
+// @Failure      400  {object}  map[string]string "error: invalid body"
+// @Failure      403  {object}  map[string]string "error: only the host can manage invitations"
+// @Failure      404  {object}  map[string]string "error: room not found or user not found"
+// @Failure      409  {object}  map[string]string "error: user already invited"
+// @Router       /api/rooms/{roomId}/invitations [post]
+func InviteCoHost(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		room := hostedRoom(c, db)
+		if room == nil {
+			return
+		}
+
+		var req InvitationReq
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
+			return
+		}
+
+		ttl := defaultInvitationTTL
+		if req.ExpiresInMinutes > 0 {
+			ttl = min(time.Duration(req.ExpiresInMinutes)*time.Minute, maxInvitationTTL)
+		}
+
+		invitation := Invitation{
+			ID:        uuid.NewString(),
+			RoomID:    room.ID,
+			InviterID: room.Host,
+			Status:    InvitationPending,
+			ExpiresAt: time.Now().Add(ttl),
+		}
+
+		if req.UserId != "" {
+			if req.UserId == room.Host {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "the host cannot invite themselves"})
+				return
+			}
+			if _, err := userModule.GetUserByID(db, req.UserId); err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+				return
+			}
+			invited, err := HasOpenInvitation(db, room.ID, req.UserId)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check invitations"})
+				return
+			}
+			if invited {
+				c.JSON(http.StatusConflict, gin.H{"error": "user already invited"})
+				return
+			}
+			invitation.InviteeID = req.UserId
+		} else {
+			token, err := generateSecretToken()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate invite link"})
+				return
+			}
+			invitation.Token = &token
+		}
+
+		if err := CreateInvitation(db, &invitation); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create invitation"})
+			return
+		}
+		log.Printf("[INVITE] room %s: invitation %s created (invitee=%q)", room.ID, invitation.ID, invitation.InviteeID)
+		notifyInvitation(&invitation)
+
+		res := gin.H{"invitation": invitation}
+		if invitation.Token != nil {
+			res["token"] = *invitation.Token
+			res["inviteUrl"] = "/api/rooms/" + room.ID + "/invite-links/" + *invitation.Token + "/accept"
+		}
+		c.JSON(http.StatusCreated, res)
+	}
+}
+
+// GetRoomInvitations godoc
+// @Summary      List co-host invitations
+// @Description  List every invitation of the room with its current state (host only)
+// @Tags         rooms
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Success      200  {array}   room.Invitation
+// @Failure      403  {object}  map[string]string "error: only the host can manage invitations"
+// @Failure      404  {object}  map[string]string "error: room not found"
+// @Router       /api/rooms/{roomId}/invitations [get]
+func GetRoomInvitations(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		room := hostedRoom(c, db)
+		if room == nil {
+			return
+		}
+
+		if err := ExpireInvitations(db); err != nil {
+			log.Printf("[INVITE] failed to expire invitations: %v", err)
+		}
+		invitations, err := GetInvitationsByRoom(db, room.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get invitations"})
+			return
+		}
+		c.JSON(http.StatusOK, invitations)
+	}
+}
+
+// GetMyInvitations godoc
+// @Summary      List my pending invitations
+// @Description  List the co-host invitations waiting for the current user's answer
+// @Tags         users
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {array}   room.Invitation
+// @Failure      500  {object}  map[string]string "error: failed to get invitations"
+// @Router       /api/users/me/invitations [get]
+func GetMyInvitations(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invitations, err := GetPendingInvitationsForUser(db, utils.GetContextString(c, "userId"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get invitations"})
+			return
+		}
+		c.JSON(http.StatusOK, invitations)
+	}
+}
+
+// RevokeInvitation godoc
+// @Summary      Revoke a co-host invitation
+// @Description  Revoke a pending or accepted invitation; an accepted co-host is disconnected and can no longer publish (host only)
+// @Tags         rooms
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        invitationId path string true "Invitation ID"
+// @Success      200  {object}  room.Invitation
+// @Failure      403  {object}  map[string]string "error: only the host can manage invitations"
+// @Failure      404  {object}  map[string]string "error: invitation not found"
+// @Failure      409  {object}  map[string]string "error: invitation is declined"
+// @Router       /api/rooms/{roomId}/invitations/{invitationId} [delete]
+func RevokeInvitation(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		room := hostedRoom(c, db)
+		if room == nil {
+			return
+		}
+		invitation := roomInvitation(c, db)
+		if invitation == nil {
+			return
+		}
+
+		wasAccepted := invitation.Status == InvitationAccepted
+		ok, err := TransitionInvitation(db, invitation, []string{InvitationPending, InvitationAccepted}, InvitationRevoked)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke invitation"})
+			return
+		}
+		if !ok {
+			rejectClosedInvitation(c, db, invitation)
+			return
+		}
+		log.Printf("[INVITE] room %s: invitation %s revoked", room.ID, invitation.ID)
+		notifyInvitation(invitation)
+
+		if wasAccepted {
+			removeCoHost(db, room, invitation.InviteeID)
+		}
+		c.JSON(http.StatusOK, invitation)
+	}
+}
+
+// removeCoHost withdraws a co-host's right to publish and disconnects them.
+func removeCoHost(db *gorm.DB, room *Room, userID string) {
+	room.mu.Lock()
+	delete(room.CoHosts, userID)
+	var pcs []PeerConnection
+	for _, conn := range room.Connections {
+		if conn.UserID == userID {
+			pcs = append(pcs, conn)
+		}
+	}
+	if slices.Contains(room.Participants, userID) {
+		room.Participants = slices.DeleteFunc(slices.Clone(room.Participants), func(p string) bool {
+			return p == userID
+		})
+		if err := SaveRoom(db, room); err != nil {
+			log.Printf("[INVITE] failed to save room %s after removing co-host: %v", room.ID, err)
+		}
+	}
+	room.mu.Unlock()
+
+	for _, conn := range pcs {
+		onPeerDisconnected(db, room, room.ID, conn.PeerCon)
+	}
+}
+
+// AcceptInvitation godoc
+// @Summary      Accept a co-host invitation
+// @Description  Accept a pending invitation addressed to the current user; once accepted they may publish media in the room
+// @Tags         rooms
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        invitationId path string true "Invitation ID"
+// @Success      200  {object}  room.Invitation
+// @Failure      404  {object}  map[string]string "error: invitation not found"
+// @Failure      409  {object}  map[string]string "error: room is full, or invitation is no longer pending"
+// @Failure      410  {object}  map[string]string "error: invitation expired"
+// @Router       /api/rooms/{roomId}/invitations/{invitationId}/accept [post]
+func AcceptInvitation(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invitation := roomInvitation(c, db)
+		if invitation == nil {
+			return
+		}
+		userID := utils.GetContextString(c, "userId")
+		if invitation.InviteeID != userID {
+			c.JSON(http.StatusNotFound, gin.H{"error": "invitation not found"})
+			return
+		}
+		acceptInvitation(c, db, invitation, userID)
+	}
+}
+
+// AcceptInviteLink godoc
+// @Summary      Accept an invite link
+// @Description  Claim a single-use co-host invite link for the current user
+// @Tags         rooms
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        token path string true "Invite link token"
+// @Success      200  {object}  room.Invitation
+// @Failure      400  {object}  map[string]string "error: the host cannot accept an invite to their own room"
+// @Failure      404  {object}  map[string]string "error: invitation not found"
+// @Failure      409  {object}  map[string]string "error: invite link already used, user already invited, or room is full"
+// @Failure      410  {object}  map[string]string "error: invitation expired"
+// @Router       /api/rooms/{roomId}/invite-links/{token}/accept [post]
+func AcceptInviteLink(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invitation, err := GetInvitationByToken(db, c.Param("token"))
+		if err != nil || invitation.RoomID != c.Param("roomId") {
+			c.JSON(http.StatusNotFound, gin.H{"error": "invitation not found"})
+			return
+		}
+		if invitation.InviteeID != "" {
+			c.JSON(http.StatusConflict, gin.H{"error": "invite link already used"})
+			return
+		}
+
+		userID := utils.GetContextString(c, "userId")
+		if userID == invitation.InviterID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "the host cannot accept an invite to their own room"})
+			return
+		}
+		invited, err := HasOpenInvitation(db, invitation.RoomID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check invitations"})
+			return
+		}
+		if invited {
+			c.JSON(http.StatusConflict, gin.H{"error": "user already invited"})
+			return
+		}
+		acceptInvitation(c, db, invitation, userID)
+	}
+}
+
+// acceptInvitation makes userID a co-host of the invitation's room. The room
+// lock serializes acceptances so the co-host limit cannot be overrun.
+func acceptInvitation(c *gin.Context, db *gorm.DB, invitation *Invitation, userID string) {
+	room, err := getLiveRoom(db, invitation.RoomID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+		return
+	}
+
+	room.mu.Lock()
+	if room.closed {
+		room.mu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+		return
+	}
+	// The host takes one of the MaxParticipants slots.
+	if len(room.CoHosts)+1 >= room.MaxParticipants {
+		room.mu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "room is full"})
+		return
+	}
+
+	invitation.InviteeID = userID
+	ok, err := TransitionInvitation(db, invitation, []string{InvitationPending}, InvitationAccepted)
+	if err != nil {
+		room.mu.Unlock()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to accept invitation"})
+		return
+	}
+	if !ok {
+		room.mu.Unlock()
+		rejectClosedInvitation(c, db, invitation)
+		return
+	}
+	if room.CoHosts == nil {
+		room.CoHosts = make(map[string]bool)
+	}
+	room.CoHosts[userID] = true
+	room.mu.Unlock()
+
+	log.Printf("[INVITE] room %s: %s accepted invitation %s", room.ID, userID, invitation.ID)
+	notifyInvitation(invitation)
+	c.JSON(http.StatusOK, invitation)
+}
+
+// DeclineInvitation godoc
+// @Summary      Decline a co-host invitation
+// @Description  Decline a pending invitation addressed to the current user
+// @Tags         rooms
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        invitationId path string true "Invitation ID"
+// @Success      200  {object}  room.Invitation
+// @Failure      404  {object}  map[string]string "error: invitation not found"
+// @Failure      409  {object}  map[string]string "error: invitation is no longer pending"
+// @Failure      410  {object}  map[string]string "error: invitation expired"
+// @Router       /api/rooms/{roomId}/invitations/{invitationId}/decline [post]
+func DeclineInvitation(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invitation := roomInvitation(c, db)
+		if invitation == nil {
+			return
+		}
+		if invitation.InviteeID != utils.GetContextString(c, "userId") {
+			c.JSON(http.StatusNotFound, gin.H{"error": "invitation not found"})
+			return
+		}
+
+		ok, err := TransitionInvitation(db, invitation, []string{InvitationPending}, InvitationDeclined)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decline invitation"})
+			return
+		}
+		if !ok {
+			rejectClosedInvitation(c, db, invitation)
+			return
+		}
+		log.Printf("[INVITE] room %s: invitation %s declined", invitation.RoomID, invitation.ID)
+		notifyInvitation(invitation)
+		c.JSON(http.StatusOK, invitation)
+	}
+}
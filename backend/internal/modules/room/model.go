@@ -1,6 +1,11 @@
 package room
 
 import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/Foodstream-io/etchebest/internal/hls"
 	"github.com/lib/pq"
 	"github.com/pion/webrtc/v4"
@@ -14,31 +19,152 @@ type TrackInfo struct {
 	PeerPT        map[*webrtc.PeerConnection]uint8
 	SendersByPeer map[*webrtc.PeerConnection]*webrtc.RTPSender // Map senders to peers for cleanup
 	Senders       []*webrtc.RTPSender                          // kept for cleanup
-	Track         *webrtc.TrackRemote
-	SourcePC      *webrtc.PeerConnection
+	// Track is the source track; for simulcast sources it is the first layer
+	// received and only serves for codec/kind/ID lookups.
+	Track    *webrtc.TrackRemote
+	SourcePC *webrtc.PeerConnection
+	// SourceUserID is the participant publishing the track.
+	SourceUserID string
+	// Label tells apart the cameras and screen share of one publisher:
+	// main, overhead or screen.
+	Label string
+	// paused is set while the host has muted (audio) or disabled (video) the
+	// source: its packets are dropped instead of forwarded to peers and HLS.
+	paused atomic.Bool
+	// Layers holds the RID-keyed encodings of a simulcast source (nil otherwise).
+	Layers map[string]*SimulcastLayer
+	// PeerLayer holds each destination peer's layer selection and RTP rewriting state.
+	PeerLayer map[*webrtc.PeerConnection]*layerSelector
+	// HLSLayer is the simulcast layer fed to FFmpeg (the highest one received).
+	HLSLayer string
+	// rebase keeps a non-simulcast track continuous for its receivers when
+	// a reconnected publisher takes over as its source.
+	rebase sourceRebase
+	// peerRebase continues, for the WHEP subscribers whose sender was
+	// switched to this non-simulcast track from another camera, the
+	// sequence the sender wrote so far.
+	peerRebase map[*webrtc.PeerConnection]*sourceRebase
+	// recorder writes the track to disk while the live is recorded.
+	recorder *trackRecorder
+	// sourceHeight is the largest short side of the picture seen on the
+	// track fed to HLS, 0 until its first SPS or keyframe.
+	sourceHeight atomic.Int32
 }
 
 type PeerConnection struct {
 	PeerID  uint `gorm:"primaryKey;autoIncrement"`
 	UserID  string
 	PeerCon *webrtc.PeerConnection
+	// PublishOnly marks WHIP ingest peers: they cannot renegotiate, so no
+	// track is ever attached to them and they are never sent offers.
+	PublishOnly bool
+	// Trickle is set when the client asked for server trickle ICE: SDPs are
+	// sent before gathering completes and candidates follow over signaling.
+	Trickle bool
+}
+
+// Subscriber is a receive-only WHEP viewer.
+type Subscriber struct {
+	UserID  string
+	PeerCon *webrtc.PeerConnection
+	// Camera is the label of the video received from each publisher.
+	Camera string
+	// pendingOffer is the server offer waiting for the subscriber to fetch
+	// and answer it; one offer is in flight at a time, later track changes
+	// set needsRenegotiation.
+	pendingOffer       *webrtc.SessionDescription
+	renegotiating      bool
+	needsRenegotiation bool
 }
 
 type Room struct {
-	ID                       string                               `json:"id" gorm:"primaryKey"`
-	Name                     string                               `json:"name"`
-	Host                     string                               `json:"host"`
-	Participants             pq.StringArray                       `json:"participants" gorm:"type:text[]" swaggertype:"array,string"`
-	Viewers                  int                                  `json:"viewers"`
-	MaxParticipants          int                                  `json:"maxParticipants" gorm:"default:5"`
-	Connections              []PeerConnection                     `json:"-" gorm:"-"`
-	Tracks                   []*TrackInfo                         `json:"-" gorm:"-"`
-	PendingICEByUser         map[string][]webrtc.ICECandidateInit `json:"-" gorm:"-"`
+	// mu guards every runtime (gorm:"-") field below as well as Participants
+	// once the room is live. Each room owns its lock, so signaling in one
+	// room never waits on another. It is a pointer, set when the room is
+	// registered, because gorm copies the model while saving it.
+	mu *sync.Mutex
+	// closed is set once the room has been torn down; late joiners are refused.
+	closed bool
+
+	ID              string         `json:"id" gorm:"primaryKey"`
+	Name            string         `json:"name"`
+	Host            string         `json:"host"`
+	Participants    pq.StringArray `json:"participants" gorm:"type:text[]" swaggertype:"array,string"`
+	Viewers         int            `json:"viewers"`
+	MaxParticipants int            `json:"maxParticipants" gorm:"default:5"`
+	// Layout arranges the publishers in the HLS composite (grid, pip, side-by-side).
+	Layout string `json:"layout" gorm:"default:grid"`
+	// LadderProfile names the HLS transcoding ladder of the room's live.
+	LadderProfile string `json:"ladderProfile" gorm:"size:50"`
+	// IngestToken is the bearer token OBS/hardware encoders present to the WHIP endpoint.
+	IngestToken      string                               `json:"-" gorm:"size:64"`
+	Connections      []PeerConnection                     `json:"-" gorm:"-"`
+	Tracks           []*TrackInfo                         `json:"-" gorm:"-"`
+	PendingICEByUser map[string][]webrtc.ICECandidateInit `json:"-" gorm:"-"`
+	// LocalICEByUser buffers server candidates for trickle clients without a WebSocket yet.
+	LocalICEByUser           map[string][]webrtc.ICECandidateInit `json:"-" gorm:"-"`
+	LocalICEDoneByUser       map[string]bool                      `json:"-" gorm:"-"`
 	PendingOfferByUser       map[string]webrtc.SessionDescription `json:"-" gorm:"-"`
 	RenegotiatingByUser      map[string]bool                      `json:"-" gorm:"-"`
 	NeedsRenegotiationByUser map[string]bool                      `json:"-" gorm:"-"`
-	HLSWriter                *hls.HLSWriter                       `json:"-" gorm:"-"`
+	// Compositor renders every publisher into the room's HLS output.
+	Compositor *hls.Compositor `json:"-" gorm:"-"`
+	// HLSConns maps each track fed to the composite to its FFmpeg input.
+	HLSConns map[*TrackInfo]net.Conn `json:"-" gorm:"-"`
+	// WHIPSessions maps a WHIP resource ID to its ingest PeerConnection.
+	WHIPSessions map[string]*webrtc.PeerConnection `json:"-" gorm:"-"`
+	// Subscribers maps a WHEP resource ID to its receive-only PeerConnection.
+	// They are not participants and are not part of Connections.
+	Subscribers map[string]*Subscriber `json:"-" gorm:"-"`
+	// CoHosts holds the users whose co-host invitation was accepted; with the
+	// host, they are the only ones allowed to publish media.
+	CoHosts map[string]bool `json:"-" gorm:"-"`
+	// Moderation holds the host's mute/video decisions per co-host; they
+	// apply to tracks published later too.
+	Moderation map[string]ModerationState `json:"-" gorm:"-"`
+	// TrackLabelsByUser holds the labels each publisher sent for their
+	// tracks, keyed by track or stream ID.
+	TrackLabelsByUser map[string]map[string]string `json:"-" gorm:"-"`
 	// HostPeerCon is the PeerConnection of the room host (publisher).
-	// Only tracks received from this peer are relayed and fed to HLS.
 	HostPeerCon *webrtc.PeerConnection `json:"-" gorm:"-"`
+	// lastActivity is when a peer last joined or media was last received;
+	// the reaper ends rooms idle for too long.
+	lastActivity time.Time
+	// hostGrace ends the live unless the host, whose connection dropped,
+	// comes back before it fires.
+	hostGrace *time.Timer
+	// recording writes the published tracks to disk, for the replay.
+	recording *recording
+	// events is the pub/sub of the participants' events channels.
+	events *eventBus
+}
+
+// ModerationState is what the host turned off for a co-host.
+type ModerationState struct {
+	AudioMuted    bool `json:"audioMuted"`
+	VideoDisabled bool `json:"videoDisabled"`
+}
+
+// Invitation statuses.
+const (
+	InvitationPending  = "pending"
+	InvitationAccepted = "accepted"
+	InvitationDeclined = "declined"
+	InvitationRevoked  = "revoked"
+	InvitationExpired  = "expired"
+)
+
+// Invitation asks a user to co-host a room. Link invitations have no
+// invitee until someone claims their single-use token.
+type Invitation struct {
+	ID          string     `json:"id" gorm:"primaryKey"`
+	RoomID      string     `json:"roomId" gorm:"index"`
+	InviterID   string     `json:"inviterId"`
+	InviteeID   string     `json:"inviteeId,omitempty" gorm:"index"`
+	Token       *string    `json:"-" gorm:"uniqueIndex;size:64"`
+	Status      string     `json:"status" gorm:"index;default:pending"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	RespondedAt *time.Time `json:"respondedAt,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
 }
@@ -0,0 +1,270 @@
+package room
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/Foodstream-io/etchebest/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v4"
+	"gorm.io/gorm"
+)
+
+// Moderation actions, as broadcast in WSTypeModeration messages.
+const (
+	ModerationMute         = "mute"
+	ModerationUnmute       = "unmute"
+	ModerationDisableVideo = "disable-video"
+	ModerationEnableVideo  = "enable-video"
+	ModerationKick         = "kick"
+)
+
+// ModerationEvent tells the room's participants what the host did to whom.
+type ModerationEvent struct {
+	Action string `json:"action"`
+	UserID string `json:"userId"`
+}
+
+// isModerated reports whether the host turned off the source of ti.
+// Must be called with the room lock held.
+func isModerated(room *Room, ti *TrackInfo) bool {
+	state := room.Moderation[ti.SourceUserID]
+	if ti.Track.Kind() == webrtc.RTPCodecTypeAudio {
+		return state.AudioMuted
+	}
+	return state.VideoDisabled
+}
+
+// moderatedCoHost loads the live room, checks that the caller hosts it and
+// that the target in the path is one of its co-hosts.
+// Returns nil (and writes the HTTP error) when the caller should abort.
+func moderatedCoHost(c *gin.Context, db *gorm.DB) (*Room, string) {
+	room, err := getLiveRoom(db, c.Param("roomId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+		return nil, ""
+	}
+	if room.Host != utils.GetContextString(c, "userId") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the host can moderate the room"})
+		return nil, ""
+	}
+	userID := c.Param("userId")
+	if userID == room.Host {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the host cannot moderate themselves"})
+		return nil, ""
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if room.closed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+		return nil, ""
+	}
+	if !room.CoHosts[userID] {
+		c.JSON(http.StatusNotFound, gin.H{"error": "co-host not found"})
+		return nil, ""
+	}
+	return room, userID
+}
+
+// setModeration records the host's decision for a co-host, pauses or
+// resumes the forwarding of their matching tracks and tells the room.
+func setModeration(c *gin.Context, db *gorm.DB, action string) {
+	room, userID := moderatedCoHost(c, db)
+	if room == nil {
+		return
+	}
+
+	type resumed struct {
+		pc   *webrtc.PeerConnection
+		ssrc uint32
+	}
+	var keyframes []resumed
+
+	room.mu.Lock()
+	// They may have been removed since moderatedCoHost checked.
+	if room.closed || !room.CoHosts[userID] {
+		room.mu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "co-host not found"})
+		return
+	}
+	state := room.Moderation[userID]
+	switch action {
+	case ModerationMute, ModerationUnmute:
+		state.AudioMuted = action == ModerationMute
+	case ModerationDisableVideo, ModerationEnableVideo:
+		state.VideoDisabled = action == ModerationDisableVideo
+	}
+	if room.Moderation == nil {
+		room.Moderation = make(map[string]ModerationState)
+	}
+	if state == (ModerationState{}) {
+		delete(room.Moderation, userID)
+	} else {
+		room.Moderation[userID] = state
+	}
+
+	for _, ti := range room.Tracks {
+		if ti.SourceUserID != userID {
+			continue
+		}
+		paused := isModerated(room, ti)
+		// The packets dropped while paused must not show as a gap: the
+		// resumed stream continues the sequence its receivers last saw,
+		// as after a layer switch. Rebased while still paused, so no
+		// packet goes out with the old offsets.
+		if !paused && ti.paused.Load() {
+			ti.resyncReceivers()
+		}
+		// Receivers need a fresh keyframe to decode resumed video.
+		if ti.paused.Swap(paused) && !paused && ti.Track.Kind() == webrtc.RTPCodecTypeVideo {
+			if len(ti.Layers) == 0 {
+				keyframes = append(keyframes, resumed{ti.SourcePC, uint32(ti.Track.SSRC())})
+			}
+			for _, layer := range ti.Layers {
+				keyframes = append(keyframes, resumed{ti.SourcePC, uint32(layer.Track.SSRC())})
+			}
+		}
+	}
+	// What the host turned off also leaves the HLS composite.
+	updateComposite(room)
+	room.mu.Unlock()
+
+	for _, k := range keyframes {
+		go requestKeyframeBurst(k.pc, k.ssrc)
+	}
+
+	log.Printf("[MODERATION] room %s: host applied %s to %s", room.ID, action, userID)
+	event := ModerationEvent{Action: action, UserID: userID}
+	sendToRoom(room.ID, WSMessage{Type: WSTypeModeration, Moderation: &event})
+	c.JSON(http.StatusOK, gin.H{"userId": userID, "moderation": state})
+}
+
+// flushModerationState tells a newly connected client which co-hosts are
+// currently muted or have their video disabled.
+// Must be called with the room lock held.
+func flushModerationState(room *Room, wsClient *WSClientConn) {
+	for userID, state := range room.Moderation {
+		if state.AudioMuted {
+			wsClient.send(WSMessage{Type: WSTypeModeration, Moderation: &ModerationEvent{Action: ModerationMute, UserID: userID}})
+		}
+		if state.VideoDisabled {
+			wsClient.send(WSMessage{Type: WSTypeModeration, Moderation: &ModerationEvent{Action: ModerationDisableVideo, UserID: userID}})
+		}
+	}
+}
+
+// MuteParticipant godoc
+// @Summary      Mute a co-host
+// @Description  Stop forwarding a co-host's audio to the other participants and to HLS (host only)
+// @Tags         rooms
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        userId path string true "Co-host user ID"
+// @Success      200  {object}  map[string]interface{} "userId and moderation state"
+// @Failure      400  {object}  map[string]string "error: the host cannot moderate themselves"
+// @Failure      403  {object}  map[string]string "error: only the host can moderate the room"
+// @Failure      404  {object}  map[string]string "error: room not found or co-host not found"
+// @Router       /api/rooms/{roomId}/participants/{userId}/mute [post]
+func MuteParticipant(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		setModeration(c, db, ModerationMute)
+	}
+}
+
+// UnmuteParticipant godoc
+// @Summary      Unmute a co-host
+// @Description  Resume forwarding a muted co-host's audio (host only)
+// @Tags         rooms
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        userId path string true "Co-host user ID"
+// @Success      200  {object}  map[string]interface{} "userId and moderation state"
+// @Failure      400  {object}  map[string]string "error: the host cannot moderate themselves"
+// @Failure      403  {object}  map[string]string "error: only the host can moderate the room"
+// @Failure      404  {object}  map[string]string "error: room not found or co-host not found"
+// @Router       /api/rooms/{roomId}/participants/{userId}/unmute [post]
+func UnmuteParticipant(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		setModeration(c, db, ModerationUnmute)
+	}
+}
+
+// DisableParticipantVideo godoc
+// @Summary      Disable a co-host's video
+// @Description  Stop forwarding a co-host's video to the other participants and to HLS (host only)
+// @Tags         rooms
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        userId path string true "Co-host user ID"
+// @Success      200  {object}  map[string]interface{} "userId and moderation state"
+// @Failure      400  {object}  map[string]string "error: the host cannot moderate themselves"
+// @Failure      403  {object}  map[string]string "error: only the host can moderate the room"
+// @Failure      404  {object}  map[string]string "error: room not found or co-host not found"
+// @Router       /api/rooms/{roomId}/participants/{userId}/disable-video [post]
+func DisableParticipantVideo(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		setModeration(c, db, ModerationDisableVideo)
+	}
+}
+
+// EnableParticipantVideo godoc
+// @Summary      Enable a co-host's video
+// @Description  Resume forwarding a disabled co-host's video (host only)
+// @Tags         rooms
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        userId path string true "Co-host user ID"
+// @Success      200  {object}  map[string]interface{} "userId and moderation state"
+// @Failure      400  {object}  map[string]string "error: the host cannot moderate themselves"
+// @Failure      403  {object}  map[string]string "error: only the host can moderate the room"
+// @Failure      404  {object}  map[string]string "error: room not found or co-host not found"
+// @Router       /api/rooms/{roomId}/participants/{userId}/enable-video [post]
+func EnableParticipantVideo(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		setModeration(c, db, ModerationEnableVideo)
+	}
+}
+
+// KickParticipant godoc
+// @Summary      Remove a co-host
+// @Description  Disconnect a co-host and revoke their invitation so they cannot rejoin (host only)
+// @Tags         rooms
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        userId path string true "Co-host user ID"
+// @Success      200  {object}  map[string]string "message: participant removed"
+// @Failure      400  {object}  map[string]string "error: the host cannot moderate themselves"
+// @Failure      403  {object}  map[string]string "error: only the host can moderate the room"
+// @Failure      404  {object}  map[string]string "error: room not found or co-host not found"
+// @Router       /api/rooms/{roomId}/participants/{userId}/kick [post]
+func KickParticipant(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		room, userID := moderatedCoHost(c, db)
+		if room == nil {
+			return
+		}
+
+		// Revoke first: once the invitation is gone a reloaded room will
+		// not list them as a co-host again.
+		if err := RevokeCoHostInvitations(db, room.ID, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove participant"})
+			return
+		}
+
+		room.mu.Lock()
+		delete(room.Moderation, userID)
+		room.mu.Unlock()
+		removeCoHost(db, room, userID)
+
+		log.Printf("[MODERATION] room %s: host removed %s", room.ID, userID)
+		event := ModerationEvent{Action: ModerationKick, UserID: userID}
+		sendToRoom(room.ID, WSMessage{Type: WSTypeModeration, Moderation: &event})
+		c.JSON(http.StatusOK, gin.H{"message": "participant removed"})
+	}
+}
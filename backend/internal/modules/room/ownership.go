@@ -0,0 +1,78 @@
+package room
+
+import (
+	"log"
+
+	"github.com/Foodstream-io/etchebest/internal/hls"
+)
+
+// Ownership records which backend instance serves each live room when
+// several instances share the database.
+type Ownership interface {
+	// Release gives up this instance's claim on a room that ended.
+	Release(roomID string)
+	// Owned lists the rooms this instance serves.
+	Owned() []string
+	// Claim takes over a room no instance serves and reports whether this
+	// instance serves it now.
+	Claim(roomID string) bool
+}
+
+// ownership is the room registry wired at startup. Tests run without one,
+// which leaves it nil.
+var ownership Ownership
+
+// SetOwnership wires the room registry. Call it before serving requests.
+func SetOwnership(o Ownership) {
+	ownership = o
+}
+
+// EvictRoom drops the local state of a room another instance took over.
+// Peers are closed so clients reconnect through the new owner; the database
+// is left alone since the room is still live there.
+func EvictRoom(roomID string) {
+	room := lookupLiveRoom(roomID)
+	if room == nil {
+		return
+	}
+
+	room.mu.Lock()
+	conns := room.Connections
+	subscribers := takeSubscribers(room)
+	recording := takeRecording(room)
+	room.Connections = nil
+	room.Tracks = nil
+	room.HostPeerCon = nil
+	room.Compositor = nil
+	room.HLSConns = nil
+	unregisterLiveRoom(room)
+	room.mu.Unlock()
+
+	for _, pc := range conns {
+		closePeerConnection(pc)
+	}
+	for _, pc := range subscribers {
+		_ = pc.Close()
+	}
+	if recording != nil {
+		recording.discard()
+	}
+	hls.DropStream(roomID)
+	closeRoomWebSockets(roomID)
+	log.Printf("[CLUSTER] evicted room %s (%d peers, %d viewers)", roomID, len(conns), len(subscribers))
+}
+
+// closeRoomWebSockets drops the signaling sockets of a room so clients
+// reconnect, landing on the current owner.
+func closeRoomWebSockets(roomID string) {
+	wsConnMu.Lock()
+	clients := make([]*WSClientConn, 0, len(wsConnections[roomID]))
+	for _, c := range wsConnections[roomID] {
+		clients = append(clients, c)
+	}
+	wsConnMu.Unlock()
+
+	for _, c := range clients {
+		c.close()
+	}
+}
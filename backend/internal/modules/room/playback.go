@@ -0,0 +1,217 @@
+package room
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/Foodstream-io/etchebest/internal/hls"
+	liveModule "github.com/Foodstream-io/etchebest/internal/modules/live"
+	userModule "github.com/Foodstream-io/etchebest/internal/modules/user"
+	"github.com/Foodstream-io/etchebest/internal/utils"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// revocationSyncInterval is how often every instance loads the playback
+// revocations: a revoked token stops playing within that delay.
+const revocationSyncInterval = 5 * time.Second
+
+// PlaybackRevocation records that the playback tokens a viewer was issued
+// for a room until RevokedAt are void. Every instance validates tokens, so
+// revocations go through the database. A viewer revoked by someone else
+// (the host or an admin) gets no new token for the room.
+type PlaybackRevocation struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	RoomID    string    `json:"roomId" gorm:"not null;index"`
+	UserID    string    `json:"userId" gorm:"not null;index"`
+	RevokedBy string    `json:"revokedBy" gorm:"not null"`
+	RevokedAt time.Time `json:"revokedAt" gorm:"not null;index"`
+}
+
+// PlaybackTokenResponse is a playback token and the URLs it opens.
+type PlaybackTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// HLSURL is the live master playlist. CMAF streams serve their DASH
+	// manifest next to it, as manifest.mpd.
+	HLSURL string `json:"hlsUrl"`
+	// ReplayURL is the replay master playlist, once there is one.
+	ReplayURL string `json:"replayUrl,omitempty"`
+}
+
+// StartPlaybackRevocationSync loads the recent playback revocations, and
+// the bans, into the token validation until ctx is cancelled.
+func StartPlaybackRevocationSync(ctx context.Context, db *gorm.DB) {
+	go func() {
+		ticker := time.NewTicker(revocationSyncInterval)
+		defer ticker.Stop()
+		for {
+			syncPlaybackRevocations(db)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func syncPlaybackRevocations(db *gorm.DB) {
+	// Older revocations only concern expired tokens.
+	since := time.Now().Add(-hls.PlaybackTokenTTL())
+
+	var revoked []PlaybackRevocation
+	if err := db.Where("revoked_at > ?", since).Find(&revoked).Error; err != nil {
+		log.Printf("[PLAYBACK] load revocations: %v", err)
+		return
+	}
+	for _, r := range revoked {
+		hls.RevokeViewer(r.RoomID, r.UserID, r.RevokedAt)
+	}
+
+	// A banned user's tokens stop playing in every room.
+	var banned []userModule.User
+	if err := db.Select("id", "banned_at").Where("is_banned = ? AND banned_at > ?", true, since).Find(&banned).Error; err != nil {
+		log.Printf("[PLAYBACK] load bans: %v", err)
+		return
+	}
+	for _, u := range banned {
+		hls.RevokeViewer("", u.ID, *u.BannedAt)
+	}
+}
+
+// IssuePlaybackToken godoc
+// @Summary      Get a playback token
+// @Description  Issue a short-lived token letting the current user play the live and the replay of a room over HLS or DASH, when they are in its audience: the host, co-hosts and admins always are; others unless the live is private, is for the host's subscribers only or their playback was revoked. Players pass it as the token query parameter; the playlists served then carry it on every URL. Fetch a new one before expiresAt.
+// @Tags         rooms
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Success      200  {object}  PlaybackTokenResponse
+// @Failure      401  {object}  map[string]string "error: unauthorized"
+// @Failure      403  {object}  map[string]string "error: your playback of this live was revoked, this live is private or this live is for the host's subscribers only"
+// @Failure      404  {object}  map[string]string "error: live not found"
+// @Failure      500  {object}  map[string]string "error: failed to issue playback token"
+// @Router       /api/rooms/{roomId}/playback-tokens [post]
+func IssuePlaybackToken(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := utils.GetContextString(c, "userId")
+		if userID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		roomID := c.Param("roomId")
+
+		var live liveModule.Live
+		if err := db.Select("room_id", "user_id", "status", "replay_url", "visibility", "subscribers_only").
+			Where("room_id = ? AND status <> ?", roomID, liveModule.StatusCancelled).
+			First(&live).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "live not found"})
+			return
+		}
+		if status, refusal := audienceRefusal(db, &live, userID, c.GetString("role")); refusal != "" {
+			if status == http.StatusInternalServerError {
+				refusal = "failed to issue playback token"
+			}
+			c.JSON(status, gin.H{"error": refusal})
+			return
+		}
+
+		token, expiresAt := hls.GenerateToken(roomID, userID, c.GetTime("tokenExpiresAt"))
+		res := PlaybackTokenResponse{
+			Token:     token,
+			ExpiresAt: expiresAt,
+			HLSURL:    "/api/hls/" + roomID + "/master.m3u8?token=" + token,
+		}
+		if live.ReplayURL != "" {
+			res.ReplayURL = live.ReplayURL + "?token=" + token
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// audienceRefusal reports why userID may not watch a live, with the HTTP
+// status to answer, or an empty reason when they may. The host, co-hosts
+// and admins always may; others not when the live is private, is for the
+// host's followers only or their playback was revoked by someone else.
+func audienceRefusal(db *gorm.DB, live *liveModule.Live, userID, role string) (int, string) {
+	if userID == live.UserID || role == userModule.ADMIN {
+		return 0, ""
+	}
+	coHosts, err := GetCoHostIds(db, live.RoomID)
+	if err != nil {
+		return http.StatusInternalServerError, "failed to load the co-hosts"
+	}
+	if slices.Contains(coHosts, userID) {
+		return 0, ""
+	}
+
+	var revoked int64
+	if err := db.Model(&PlaybackRevocation{}).
+		Where("room_id = ? AND user_id = ? AND revoked_by <> ?", live.RoomID, userID, userID).
+		Count(&revoked).Error; err != nil {
+		return http.StatusInternalServerError, "failed to load the revocations"
+	}
+	switch {
+	case revoked > 0:
+		return http.StatusForbidden, "your playback of this live was revoked"
+	case live.Visibility == liveModule.VisibilityPrivate:
+		return http.StatusForbidden, "this live is private"
+	case live.SubscribersOnly:
+		viewer, err := userModule.GetUserByID(db, userID)
+		if err != nil {
+			return http.StatusInternalServerError, "failed to load the viewer"
+		}
+		if !slices.Contains(viewer.FollowingIDS, live.UserID) {
+			return http.StatusForbidden, "this live is for the host's subscribers only"
+		}
+	}
+	return 0, ""
+}
+
+// RevokePlaybackTokens godoc
+// @Summary      Revoke playback tokens
+// @Description  Void the playback tokens a viewer was issued for a room so far, on every instance within seconds. Viewers may revoke their own tokens; the host and admins anyone's, and the viewer then gets no new token for the room.
+// @Tags         rooms
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        userId path string true "Viewer user ID"
+// @Success      200  {object}  map[string]string "message: playback revoked"
+// @Failure      403  {object}  map[string]string "error: only the host can revoke playback"
+// @Failure      404  {object}  map[string]string "error: live not found"
+// @Failure      500  {object}  map[string]string "error: failed to revoke playback"
+// @Router       /api/rooms/{roomId}/playback-tokens/{userId} [delete]
+func RevokePlaybackTokens(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		roomID := c.Param("roomId")
+		viewerID := c.Param("userId")
+		currentUserID := utils.GetContextString(c, "userId")
+
+		var live liveModule.Live
+		if err := db.Select("room_id", "user_id").Where("room_id = ?", roomID).First(&live).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "live not found"})
+			return
+		}
+		if viewerID != currentUserID && live.UserID != currentUserID && c.GetString("role") != userModule.ADMIN {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only the host can revoke playback"})
+			return
+		}
+
+		revocation := PlaybackRevocation{RoomID: roomID, UserID: viewerID, RevokedBy: currentUserID, RevokedAt: time.Now()}
+		if err := db.Create(&revocation).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke playback"})
+			return
+		}
+		// Other instances apply it at their next sync.
+		hls.RevokeViewer(roomID, viewerID, revocation.RevokedAt)
+
+		log.Printf("[PLAYBACK] room %s: %s revoked the playback of %s", roomID, currentUserID, viewerID)
+		c.JSON(http.StatusOK, gin.H{"message": "playback revoked"})
+	}
+}
@@ -0,0 +1,270 @@
+package room
+
+import (
+	"context"
+	"log"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/Foodstream-io/etchebest/internal/hls"
+	liveModule "github.com/Foodstream-io/etchebest/internal/modules/live"
+	"gorm.io/gorm"
+)
+
+const reaperInterval = time.Minute
+
+// ReaperConfig tunes the background job ending abandoned rooms and stale
+// scheduled lives.
+type ReaperConfig struct {
+	// IdleTimeout ends a room that had no peer joining and no media for
+	// that long, and a live whose room state was lost for that long.
+	IdleTimeout time.Duration
+	// ScheduledGrace ends a scheduled live still not started that long
+	// after its scheduled time.
+	ScheduledGrace time.Duration
+}
+
+// ReaperConfigFromEnv reads ROOM_IDLE_TIMEOUT_MINUTES (default 10) and
+// SCHEDULED_LIVE_GRACE_MINUTES (default 120).
+func ReaperConfigFromEnv() ReaperConfig {
+	cfg := ReaperConfig{
+		IdleTimeout:    10 * time.Minute,
+		ScheduledGrace: 2 * time.Hour,
+	}
+	if v, err := strconv.Atoi(os.Getenv("ROOM_IDLE_TIMEOUT_MINUTES")); err == nil && v > 0 {
+		cfg.IdleTimeout = time.Duration(v) * time.Minute
+	}
+	if v, err := strconv.Atoi(os.Getenv("SCHEDULED_LIVE_GRACE_MINUTES")); err == nil && v > 0 {
+		cfg.ScheduledGrace = time.Duration(v) * time.Minute
+	}
+	return cfg
+}
+
+// reaper ends what nobody will end anymore: rooms without peers or media,
+// lives whose room state was lost with a crashed instance, and scheduled
+// lives that never started. An instance only ends the rooms it serves; the
+// ones nobody serves are claimed first.
+type reaper struct {
+	db  *gorm.DB
+	cfg ReaperConfig
+	// detachedSince is when each live room was first seen without any
+	// state on this instance.
+	detachedSince map[string]time.Time
+}
+
+// activeLive is a live that has not ended.
+type activeLive struct {
+	RoomID string
+	Status string
+	// DueAt is when the live was scheduled, or created when not scheduled.
+	DueAt time.Time
+}
+
+// StartReaper sweeps the rooms every minute until ctx is cancelled. A sweep
+// that panics is logged and the next one runs as usual.
+func StartReaper(ctx context.Context, db *gorm.DB, cfg ReaperConfig) {
+	log.Printf("[REAPER] ending rooms idle for %s and scheduled lives overdue by %s", cfg.IdleTimeout, cfg.ScheduledGrace)
+	r := &reaper{db: db, cfg: cfg, detachedSince: make(map[string]time.Time)}
+	go func() {
+		ticker := time.NewTicker(reaperInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.supervisedSweep()
+			}
+		}
+	}()
+}
+
+func (r *reaper) supervisedSweep() {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("[REAPER] sweep panicked: %v\n%s", p, debug.Stack())
+		}
+	}()
+	r.sweep(time.Now())
+}
+
+func (r *reaper) sweep(now time.Time) {
+	// Lives whose room row is gone cannot be served anymore.
+	var orphaned []string
+	if err := r.db.Model(&liveModule.Live{}).
+		Where("status IN ? AND NOT EXISTS (SELECT 1 FROM rooms WHERE rooms.id = lives.room_id)", liveModule.ActiveStatuses).
+		Pluck("room_id", &orphaned).Error; err != nil {
+		log.Printf("[REAPER] failed to list lives without a room: %v", err)
+	}
+	for _, roomID := range orphaned {
+		if err := liveModule.End(r.db, roomID, liveModule.ActorSystem, liveModule.EndReasonOrphaned, "", false); err != nil {
+			log.Printf("[REAPER] failed to end live of room %s without a room: %v", roomID, err)
+		}
+	}
+	if len(orphaned) > 0 {
+		log.Printf("[REAPER] ended %d lives without a room", len(orphaned))
+	}
+
+	var lives []activeLive
+	if err := r.db.Model(&liveModule.Live{}).
+		Select("room_id, status, COALESCE(scheduled_at, created_at) AS due_at").
+		Where("status IN ?", liveModule.ActiveStatuses).
+		Scan(&lives).Error; err != nil {
+		log.Printf("[REAPER] failed to list active lives: %v", err)
+		return
+	}
+	byRoom := make(map[string]activeLive, len(lives))
+	for _, l := range lives {
+		byRoom[l.RoomID] = l
+	}
+
+	var served map[string]bool
+	if ownership != nil {
+		served = make(map[string]bool)
+		for _, id := range ownership.Owned() {
+			served[id] = true
+		}
+	}
+	serves := func(roomID string) bool {
+		if served == nil || served[roomID] {
+			return true
+		}
+		if ownership.Claim(roomID) {
+			served[roomID] = true
+			log.Printf("[REAPER] claimed unserved room %s", roomID)
+			return true
+		}
+		return false
+	}
+
+	r.reapLoadedRooms(now, byRoom, serves)
+	r.reapDetachedLives(now, lives, serves)
+
+	// FFmpeg must not outlive its room.
+	for _, roomID := range hls.Running() {
+		if lookupLiveRoom(roomID) == nil {
+			log.Printf("[REAPER] stopping HLS of room %s, which is not live here", roomID)
+			if _, err := hls.StopStream(roomID); err != nil {
+				log.Printf("[REAPER] stop HLS for room %s: %v", roomID, err)
+			}
+		}
+	}
+}
+
+// overdue reports whether a scheduled live should have started long ago.
+func (r *reaper) overdue(now time.Time, l activeLive) bool {
+	return l.Status == liveModule.StatusScheduled && now.Sub(l.DueAt) > r.cfg.ScheduledGrace
+}
+
+// reapLoadedRooms ends the rooms of this instance that are idle, or whose
+// scheduled live is overdue. A stale copy of a room served elsewhere is
+// dropped instead.
+func (r *reaper) reapLoadedRooms(now time.Time, byRoom map[string]activeLive, serves func(string) bool) {
+	roomsMu.Lock()
+	rooms := make([]*Room, 0, len(liveRooms))
+	for _, room := range liveRooms {
+		rooms = append(rooms, room)
+	}
+	roomsMu.Unlock()
+
+	for _, room := range rooms {
+		l, hasLive := byRoom[room.ID]
+
+		room.mu.Lock()
+		idle := now.Sub(room.lastActivity) > r.cfg.IdleTimeout
+		reason := ""
+		switch {
+		case room.closed:
+		case hasLive && r.overdue(now, l):
+			reason = liveModule.EndReasonOverdue
+		case hasLive && l.Status == liveModule.StatusScheduled:
+			// Waiting for its host to start it.
+		case idle && len(room.Connections) == 0:
+			reason = liveModule.EndReasonNoPeers
+		case idle:
+			reason = liveModule.EndReasonNoMedia
+		}
+		room.mu.Unlock()
+		if reason == "" {
+			continue
+		}
+
+		if !serves(room.ID) {
+			log.Printf("[REAPER] dropping stale copy of room %s, served by another instance", room.ID)
+			EvictRoom(room.ID)
+			continue
+		}
+
+		room.mu.Lock()
+		if room.closed {
+			room.mu.Unlock()
+			continue
+		}
+		log.Printf("[REAPER] ending room %s: %s", room.ID, reason)
+		conns, subscribers := endRoom(r.db, room, reason)
+		room.mu.Unlock()
+
+		for _, pc := range conns {
+			closePeerConnection(pc)
+		}
+		for _, pc := range subscribers {
+			_ = pc.Close()
+		}
+		closeRoomWebSockets(room.ID)
+	}
+}
+
+// reapDetachedLives ends the lives no instance holds state for: overdue
+// scheduled ones right away, running ones once they stayed detached for
+// IdleTimeout, which leaves their peers time to rejoin after a crash.
+func (r *reaper) reapDetachedLives(now time.Time, lives []activeLive, serves func(string) bool) {
+	detached := make(map[string]bool, len(lives))
+	for _, l := range lives {
+		if lookupLiveRoom(l.RoomID) != nil {
+			continue
+		}
+		reason := ""
+		switch {
+		case r.overdue(now, l):
+			reason = liveModule.EndReasonOverdue
+		case l.Status != liveModule.StatusScheduled:
+			detached[l.RoomID] = true
+			since, ok := r.detachedSince[l.RoomID]
+			if !ok {
+				r.detachedSince[l.RoomID] = now
+			} else if now.Sub(since) > r.cfg.IdleTimeout {
+				reason = liveModule.EndReasonOrphaned
+			}
+		}
+		if reason == "" || !serves(l.RoomID) {
+			continue
+		}
+		delete(r.detachedSince, l.RoomID)
+		log.Printf("[REAPER] ending detached room %s: %s", l.RoomID, reason)
+		endDetachedRoom(r.db, l.RoomID, reason)
+	}
+	for roomID := range r.detachedSince {
+		if !detached[roomID] {
+			delete(r.detachedSince, roomID)
+		}
+	}
+}
+
+// endDetachedRoom ends a live whose room has no state on this instance,
+// turning what its stream left on disk into the replay.
+func endDetachedRoom(db *gorm.DB, roomID, reason string) {
+	replayURL, err := hls.RecoverReplay(roomID)
+	if err != nil {
+		log.Printf("[REAPER] failed to recover the replay of room %s: %v", roomID, err)
+	}
+	markLiveAsEndedByRoomID(db, roomID, liveModule.ActorSystem, replayURL, reason, false)
+	if err := DeleteRoomById(db, roomID); err != nil {
+		log.Printf("[REAPER] failed to delete room %s: %v", roomID, err)
+	}
+	if ownership != nil {
+		ownership.Release(roomID)
+	}
+	closeRoomWebSockets(roomID)
+}
@@ -0,0 +1,372 @@
+package room
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	liveModule "github.com/Foodstream-io/etchebest/internal/modules/live"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"gorm.io/gorm"
+)
+
+// DefaultHostReconnectGrace is how long a live waits for a host whose
+// connection dropped before it ends.
+const DefaultHostReconnectGrace = 30 * time.Second
+
+var hostReconnectGrace = DefaultHostReconnectGrace
+
+// rebindSettle is how long a reconnected host's new connection has, once
+// established, to publish again the tracks its previous one left behind.
+// The ones still unmatched then are removed from the room.
+var rebindSettle = 5 * time.Second
+
+// SetHostReconnectGrace sets how long the room, its HLS composite and the
+// viewers' connections survive a dropped host connection. Zero disables the
+// grace window: the host's session ends as soon as their connection drops.
+// Meant to be called once at startup.
+func SetHostReconnectGrace(d time.Duration) {
+	hostReconnectGrace = d
+}
+
+// Host connection states, as broadcast in WSTypeHostStatus messages.
+const (
+	HostStatusReconnecting = "reconnecting"
+	HostStatusConnected    = "connected"
+)
+
+// HostStatusEvent tells the room that the host's connection dropped or came
+// back. Deadline is when the live ends if the host is still away.
+type HostStatusEvent struct {
+	State    string     `json:"state"`
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+// awaitHost starts the grace window when the host's connection becomes
+// disconnected or failed, instead of tearing it down. A failed connection is
+// sent an ICE restart offer. Returns false when pc is not the host's or the
+// grace window is disabled, in which case the peer is cleaned up as usual.
+func awaitHost(db *gorm.DB, room *Room, pc *webrtc.PeerConnection, state webrtc.PeerConnectionState) bool {
+	if hostReconnectGrace <= 0 {
+		return false
+	}
+
+	room.mu.Lock()
+	if room.closed || room.HostPeerCon != pc {
+		room.mu.Unlock()
+		return false
+	}
+	publishOnly := false
+	for _, conn := range room.Connections {
+		if conn.PeerCon == pc {
+			publishOnly = conn.PublishOnly
+			break
+		}
+	}
+	var event *HostStatusEvent
+	if room.hostGrace == nil {
+		deadline := time.Now().Add(hostReconnectGrace)
+		var timer *time.Timer
+		timer = time.AfterFunc(hostReconnectGrace, func() {
+			room.mu.Lock()
+			expired := room.hostGrace == timer
+			room.mu.Unlock()
+			if expired {
+				endAbandonedLive(db, room, timer)
+			}
+		})
+		room.hostGrace = timer
+		event = &HostStatusEvent{State: HostStatusReconnecting, Deadline: &deadline}
+		log.Printf("[RECONNECT] room %s: host connection %s, waiting %s for them to come back",
+			room.ID, state, hostReconnectGrace)
+	}
+	host := room.Host
+	room.mu.Unlock()
+
+	if event != nil {
+		sendToRoom(room.ID, WSMessage{Type: WSTypeHostStatus, HostStatus: event})
+		if err := liveModule.Interrupt(db, room.ID); err != nil && !errors.Is(err, liveModule.ErrInvalidTransition) {
+			log.Printf("[RECONNECT] room %s: failed to mark the live as interrupted: %v", room.ID, err)
+		}
+	}
+	// WHIP encoders restart ICE on their own through PATCH.
+	if state == webrtc.PeerConnectionStateFailed && !publishOnly {
+		go requestRenegotiationOffer(room, host, pc)
+	}
+	return true
+}
+
+// hostReconnected ends the grace window once the host's current connection
+// is established again, be it after an ICE restart or on a new PeerConnection.
+func hostReconnected(db *gorm.DB, room *Room, pc *webrtc.PeerConnection) {
+	room.mu.Lock()
+	if room.hostGrace == nil || room.HostPeerCon != pc {
+		room.mu.Unlock()
+		return
+	}
+	room.hostGrace.Stop()
+	room.hostGrace = nil
+	host := room.Host
+	detached := false
+	for _, ti := range room.Tracks {
+		if ti.SourcePC == nil && ti.SourceUserID == host {
+			detached = true
+			break
+		}
+	}
+	room.mu.Unlock()
+
+	if detached {
+		time.AfterFunc(rebindSettle, func() { pruneDetachedTracks(room, pc) })
+	}
+	log.Printf("[RECONNECT] room %s: host is back", room.ID)
+	sendToRoom(room.ID, WSMessage{Type: WSTypeHostStatus, HostStatus: &HostStatusEvent{State: HostStatusConnected}})
+	if err := liveModule.Resume(db, room.ID, host); err != nil && !errors.Is(err, liveModule.ErrInvalidTransition) {
+		log.Printf("[RECONNECT] room %s: failed to put the live back on air: %v", room.ID, err)
+	}
+}
+
+// pruneDetachedTracks removes the tracks of the host's previous connection
+// that pc, their reconnected one, did not publish again, so that receivers
+// stop waiting on senders nothing feeds anymore. Nothing happens if the host
+// dropped or left again meanwhile.
+func pruneDetachedTracks(room *Room, pc *webrtc.PeerConnection) {
+	room.mu.Lock()
+	if room.closed || room.HostPeerCon != pc || room.hostGrace != nil {
+		room.mu.Unlock()
+		return
+	}
+	kept := make([]*TrackInfo, 0, len(room.Tracks))
+	touched := make(map[*webrtc.PeerConnection]bool)
+	for _, ti := range room.Tracks {
+		if ti.SourcePC == nil && ti.SourceUserID == room.Host {
+			removeTrackFromPeers(ti, touched)
+			continue
+		}
+		kept = append(kept, ti)
+	}
+	if len(kept) == len(room.Tracks) {
+		room.mu.Unlock()
+		return
+	}
+	log.Printf("[RECONNECT] room %s: removing %d tracks the host did not publish again", room.ID, len(room.Tracks)-len(kept))
+	room.Tracks = kept
+	updateComposite(room)
+
+	var targets []renegotiationTarget
+	for _, conn := range room.Connections {
+		if conn.PeerCon != nil && !conn.PublishOnly && touched[conn.PeerCon] {
+			targets = append(targets, renegotiationTarget{userID: conn.UserID, pc: conn.PeerCon})
+		}
+	}
+	targets = append(targets, subscriberTargets(room, touched)...)
+	room.mu.Unlock()
+
+	for _, target := range targets {
+		go target.renegotiate(room)
+	}
+}
+
+// stopHostGrace cancels a pending grace window.
+// Must be called with the room lock held.
+func stopHostGrace(room *Room) {
+	if room.hostGrace != nil {
+		room.hostGrace.Stop()
+		room.hostGrace = nil
+	}
+}
+
+// endAbandonedLive ends the live when the grace window expired without the
+// host coming back.
+func endAbandonedLive(db *gorm.DB, room *Room, timer *time.Timer) {
+	room.mu.Lock()
+	if room.closed || room.hostGrace != timer {
+		room.mu.Unlock()
+		return
+	}
+	room.hostGrace = nil
+	log.Printf("[RECONNECT] room %s: host did not come back within %s, ending the live", room.ID, hostReconnectGrace)
+	conns, subscribers := endRoom(db, room, liveModule.EndReasonHostTimeout)
+	room.mu.Unlock()
+
+	for _, pc := range conns {
+		closePeerConnection(pc)
+	}
+	for _, pc := range subscribers {
+		_ = pc.Close()
+	}
+}
+
+// replaceAwaitedHost retires the dropped connection of a host reconnecting on
+// a new PeerConnection. The tracks it published stay in the room, detached
+// from any source, so that the new connection's tracks are bound into them
+// and the viewers keep their senders. Nothing happens outside the grace
+// window.
+// Must be called with the room lock held.
+func replaceAwaitedHost(room *Room) {
+	old := room.HostPeerCon
+	if room.hostGrace == nil || old == nil {
+		return
+	}
+
+	updated := make([]PeerConnection, 0, len(room.Connections))
+	for _, conn := range room.Connections {
+		if conn.PeerCon != old {
+			updated = append(updated, conn)
+		}
+	}
+	room.Connections = updated
+	room.HostPeerCon = nil
+	for sessionID, sessionPC := range room.WHIPSessions {
+		if sessionPC == old {
+			delete(room.WHIPSessions, sessionID)
+		}
+	}
+	// Signaling state of the old connection must not leak into the new one.
+	// Buffered remote candidates already belong to the new connection.
+	delete(room.LocalICEByUser, room.Host)
+	delete(room.LocalICEDoneByUser, room.Host)
+	delete(room.PendingOfferByUser, room.Host)
+	delete(room.RenegotiatingByUser, room.Host)
+	delete(room.NeedsRenegotiationByUser, room.Host)
+
+	for _, ti := range room.Tracks {
+		if ti.SourcePC == old {
+			ti.SourcePC = nil
+			continue
+		}
+		delete(ti.LocalTracks, old)
+		delete(ti.PeerPT, old)
+		delete(ti.SendersByPeer, old)
+		delete(ti.PeerLayer, old)
+		delete(ti.peerRebase, old)
+	}
+
+	log.Printf("[RECONNECT] room %s: host reconnecting on a new connection", room.ID)
+	// The old connection is no longer registered, so its Closed state
+	// change does not tear anything down.
+	go func() { _ = old.Close() }()
+}
+
+// rebindHostTrack binds a track received on a reconnected publisher's
+// connection into the TrackInfo its previous connection left behind, matched
+// on kind, label, codec and simulcast. Forwarding then resumes on the viewers'
+// existing senders without renegotiation. Returns nil when there is no such
+// TrackInfo.
+// Must be called with the room lock held.
+func rebindHostTrack(room *Room, pc *webrtc.PeerConnection, track *webrtc.TrackRemote) *TrackInfo {
+	userID := ""
+	for _, conn := range room.Connections {
+		if conn.PeerCon == pc {
+			userID = conn.UserID
+			break
+		}
+	}
+	if userID == "" {
+		return nil
+	}
+
+	simulcast := track.RID() != ""
+	label := resolveTrackLabel(room, userID, track)
+	for _, ti := range room.Tracks {
+		if ti.SourcePC != nil || ti.SourceUserID != userID || ti.Track.Kind() != track.Kind() ||
+			ti.Label != label || (ti.Layers != nil) != simulcast ||
+			!strings.EqualFold(ti.Track.Codec().MimeType, track.Codec().MimeType) {
+			continue
+		}
+
+		ti.Track = track
+		ti.SourcePC = pc
+		if simulcast {
+			ti.Layers = map[string]*SimulcastLayer{
+				track.RID(): {RID: track.RID(), Track: track},
+			}
+			ti.HLSLayer = track.RID()
+		}
+		ti.resyncReceivers()
+		updateComposite(room)
+		log.Printf("[RECONNECT] room %s: %s track of %s bound to the new connection", room.ID, track.Kind(), userID)
+		return ti
+	}
+	return nil
+}
+
+// resyncReceivers makes the next packets forwarded from ti continue the
+// sequence its receivers last saw. Callers hold room.mu.
+func (ti *TrackInfo) resyncReceivers() {
+	if len(ti.Layers) == 0 {
+		ti.rebase.resync()
+	}
+	for _, sel := range ti.PeerLayer {
+		sel.resync()
+	}
+}
+
+// sourceRebase keeps the sequence numbers and timestamps a non-simulcast
+// track's receivers see continuous when its source is replaced by the one of
+// a reconnected publisher.
+type sourceRebase struct {
+	mu sync.Mutex
+
+	pending   bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+}
+
+// resync makes the next packet continue the sequence written so far.
+func (r *sourceRebase) resync() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending = !r.lastWrite.IsZero()
+}
+
+// position returns the last sequence number and timestamp written, and when
+// (zero before the first packet).
+func (r *sourceRebase) position() (uint16, uint32, time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastSeq, r.lastTS, r.lastWrite
+}
+
+// continueFrom makes the next packet follow seq and ts, written at the
+// given time, as the next one written after them.
+func (r *sourceRebase) continueFrom(seq uint16, ts uint32, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastSeq, r.lastTS, r.lastWrite = seq, ts, at
+	r.pending = !at.IsZero()
+}
+
+// apply rewrites pkt into the continuous sequence, clockRate being the
+// track's RTP clock rate.
+func (r *sourceRebase) apply(pkt *rtp.Packet, clockRate uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pending {
+		elapsed := time.Since(r.lastWrite)
+		if elapsed <= 0 {
+			elapsed = time.Millisecond
+		}
+		nextTS := r.lastTS + uint32(elapsed.Milliseconds()*int64(clockRate)/1000) + 1
+		r.seqOffset = r.lastSeq + 1 - pkt.SequenceNumber
+		r.tsOffset = nextTS - pkt.Timestamp
+		r.pending = false
+	}
+
+	pkt.SequenceNumber += r.seqOffset
+	pkt.Timestamp += r.tsOffset
+	// Retransmissions of older packets do not move the sequence back.
+	if !r.lastWrite.IsZero() && int16(pkt.SequenceNumber-r.lastSeq) <= 0 {
+		return
+	}
+	r.lastSeq = pkt.SequenceNumber
+	r.lastTS = pkt.Timestamp
+	r.lastWrite = time.Now()
+}
@@ -0,0 +1,351 @@
+package room
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Foodstream-io/etchebest/internal/hls"
+	liveModule "github.com/Foodstream-io/etchebest/internal/modules/live"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/h264writer"
+	"github.com/pion/webrtc/v4/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+	"gorm.io/gorm"
+)
+
+// recordingsDir holds the raw tracks of the lives being recorded.
+const recordingsDir = "./storage/recordings"
+
+// reorderWindow is how many packets a recorded track holds while waiting
+// for a missing one (lost, or being retransmitted) before skipping it.
+const reorderWindow = 128
+
+var recordingEnabled = true
+
+// SetRecording turns the native recording of lives on or off. Meant to be
+// called once at startup.
+func SetRecording(enabled bool) {
+	recordingEnabled = enabled
+}
+
+// recording writes every track published in a room to disk while the live
+// runs, straight from the relay: it does not depend on the HLS output, so
+// lives FFmpeg could not composite still get a replay.
+type recording struct {
+	roomID    string
+	dir       string
+	startedAt time.Time
+	tracks    []*trackRecorder
+}
+
+// trackRecorder writes one published track into a container: IVF for VP8,
+// VP9 and AV1, Ogg for Opus, Annex B for H.264.
+type trackRecorder struct {
+	mu sync.Mutex
+
+	userID string
+	video  bool
+	path   string
+	writer media.Writer
+	// red marks an Opus RED source: only the primary encoding is written.
+	red bool
+	// sel follows the top layer of a simulcast source.
+	sel     *layerSelector
+	reorder reorderBuffer
+	closed  bool
+
+	clockRate uint32
+	startedAt time.Time
+	lastWrite time.Time
+	// frames and span (in clock units) give raw H.264 its frame rate.
+	h264   bool
+	frames int
+	span   uint64
+	lastTS uint32
+}
+
+// recordTrack starts recording a newly published track, starting the
+// room's recording with its first track. Tracks in a codec no writer
+// supports are left out.
+// Must be called with the room lock held.
+func recordTrack(room *Room, ti *TrackInfo) {
+	if !recordingEnabled {
+		return
+	}
+	if room.recording == nil {
+		room.recording = &recording{
+			roomID:    room.ID,
+			dir:       filepath.Join(recordingsDir, room.ID, time.Now().UTC().Format("20060102-150405")),
+			startedAt: time.Now(),
+		}
+		if err := os.MkdirAll(room.recording.dir, 0755); err != nil {
+			log.Printf("[RECORDING] room %s: %v", room.ID, err)
+			room.recording = nil
+			return
+		}
+	}
+	rec := room.recording
+
+	codec := ti.Track.Codec()
+	r := &trackRecorder{
+		// Other angles than the main camera get their own tile.
+		userID:    compositeInputID(ti),
+		video:     ti.Track.Kind() == webrtc.RTPCodecTypeVideo,
+		red:       isRED(codec),
+		clockRate: codec.ClockRate,
+	}
+	name := fmt.Sprintf("%02d-%s-%s", len(rec.tracks), ti.SourceUserID, ti.Track.Kind())
+	var err error
+	switch mime := strings.ToLower(codec.MimeType); {
+	case mime == strings.ToLower(webrtc.MimeTypeOpus) || r.red:
+		r.path = filepath.Join(rec.dir, name+".ogg")
+		channels := codec.Channels
+		if channels == 0 {
+			channels = 2
+		}
+		r.writer, err = oggwriter.New(r.path, codec.ClockRate, channels)
+	case mime == strings.ToLower(webrtc.MimeTypeH264):
+		r.path = filepath.Join(rec.dir, name+".h264")
+		r.h264 = true
+		r.writer, err = h264writer.New(r.path)
+	case mime == strings.ToLower(webrtc.MimeTypeVP8),
+		mime == strings.ToLower(webrtc.MimeTypeVP9),
+		mime == strings.ToLower(webrtc.MimeTypeAV1):
+		r.path = filepath.Join(rec.dir, name+".ivf")
+		r.writer, err = ivfwriter.New(r.path,
+			ivfwriter.WithCodec(canonicalMimeType(mime)),
+			ivfwriter.WithFrameRate(1, codec.ClockRate),
+			ivfwriter.WithDirectPTS())
+	default:
+		log.Printf("[RECORDING] room %s: %s track of %s not recorded: codec %s", room.ID, ti.Track.Kind(), ti.SourceUserID, codec.MimeType)
+		return
+	}
+	if err != nil {
+		log.Printf("[RECORDING] room %s: create %s: %v", room.ID, r.path, err)
+		return
+	}
+	if ti.Layers != nil {
+		r.sel = newLayerSelector(ti.HLSLayer, codec.ClockRate)
+	}
+
+	ti.recorder = r
+	rec.tracks = append(rec.tracks, r)
+	log.Printf("[RECORDING] room %s: recording %s track of %s to %s", room.ID, ti.Track.Kind(), ti.SourceUserID, r.path)
+}
+
+// canonicalMimeType returns the mime type spelling the IVF writer expects.
+func canonicalMimeType(mime string) string {
+	for _, m := range []string{webrtc.MimeTypeVP8, webrtc.MimeTypeVP9, webrtc.MimeTypeAV1} {
+		if strings.EqualFold(m, mime) {
+			return m
+		}
+	}
+	return mime
+}
+
+// write records pkt, received on simulcast layer rid ("" otherwise).
+// Packets are reordered first: the writers expect them in sequence.
+func (r *trackRecorder) write(rid string, pkt *rtp.Packet, keyframe bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+
+	// The packet outlives the relay's read buffer in the reorder window.
+	p := *pkt
+	p.Payload = append([]byte(nil), pkt.Payload...)
+	if r.sel != nil && !r.sel.rewrite(rid, &p, keyframe) {
+		return
+	}
+	if r.red {
+		_, primary, ok := redPrimary(p.Payload)
+		if !ok {
+			return
+		}
+		p.Payload = primary
+	}
+	r.reorder.push(&p, r.writeOrdered)
+}
+
+// writeOrdered hands one in-sequence packet to the container writer.
+// Must be called with r.mu held.
+func (r *trackRecorder) writeOrdered(pkt *rtp.Packet) {
+	now := time.Now()
+	if r.startedAt.IsZero() {
+		r.startedAt = now
+	} else if d := int32(pkt.Timestamp - r.lastTS); d > 0 {
+		r.span += uint64(d)
+	}
+	r.lastTS = pkt.Timestamp
+	r.lastWrite = now
+	if r.h264 && pkt.Marker {
+		r.frames++
+	}
+	if err := r.writer.WriteRTP(pkt); err != nil {
+		log.Printf("[RECORDING] write %s: %v", r.path, err)
+	}
+}
+
+// close flushes and closes the container.
+func (r *trackRecorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.reorder.flush(r.writeOrdered)
+	if err := r.writer.Close(); err != nil {
+		log.Printf("[RECORDING] close %s: %v", r.path, err)
+	}
+}
+
+// recorded describes the track for muxing, ok being false when nothing
+// was written.
+func (r *trackRecorder) recorded(startedAt time.Time) (hls.RecordedTrack, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.startedAt.IsZero() {
+		return hls.RecordedTrack{}, false
+	}
+	t := hls.RecordedTrack{
+		UserID:   r.userID,
+		Path:     r.path,
+		Video:    r.video,
+		Offset:   r.startedAt.Sub(startedAt),
+		Duration: r.lastWrite.Sub(r.startedAt),
+	}
+	if r.h264 && r.span > 0 && r.clockRate > 0 {
+		t.FrameRate = float64(r.frames) / (float64(r.span) / float64(r.clockRate))
+	}
+	return t, true
+}
+
+// takeRecording detaches the room's recording, if any, for its tracks to
+// be closed once the room lock is released.
+// Must be called with the room lock held.
+func takeRecording(room *Room) *recording {
+	rec := room.recording
+	room.recording = nil
+	for _, ti := range room.Tracks {
+		ti.recorder = nil
+	}
+	return rec
+}
+
+// finish closes the recorded tracks and, when HLS left no replay, muxes
+// them into one laid out like the composite. The raw tracks are removed
+// once muxed or when HLS already produced the replay.
+func (rec *recording) finish(db *gorm.DB, layout string, hasReplay bool) {
+	// The live waits in processing-replay until this returns, with or
+	// without a replay from the recording.
+	replayURL := ""
+	defer func() {
+		if err := liveModule.ReplayProcessed(db, rec.roomID, replayURL); err != nil {
+			log.Printf("[RECORDING] failed to end the live of room %s: %v", rec.roomID, err)
+		}
+	}()
+
+	var tracks []hls.RecordedTrack
+	for _, r := range rec.tracks {
+		r.close()
+		if t, ok := r.recorded(rec.startedAt); ok {
+			tracks = append(tracks, t)
+		}
+	}
+	if hasReplay || len(tracks) == 0 {
+		if err := os.RemoveAll(rec.dir); err != nil {
+			log.Printf("[RECORDING] cleanup failed for room %s: %v", rec.roomID, err)
+		}
+		return
+	}
+
+	muxedURL, err := hls.MuxRecording(rec.roomID, layout, tracks)
+	if err != nil {
+		log.Printf("[RECORDING] room %s: %v (raw tracks kept in %s)", rec.roomID, err, rec.dir)
+		return
+	}
+	if err := os.RemoveAll(rec.dir); err != nil {
+		log.Printf("[RECORDING] cleanup failed for room %s: %v", rec.roomID, err)
+	}
+	replayURL = muxedURL
+}
+
+// discard closes and removes the recorded tracks of a room that moved to
+// another instance, which records it from then on.
+func (rec *recording) discard() {
+	for _, r := range rec.tracks {
+		r.close()
+	}
+	if err := os.RemoveAll(rec.dir); err != nil {
+		log.Printf("[RECORDING] cleanup failed for room %s: %v", rec.roomID, err)
+	}
+	log.Printf("[RECORDING] room %s left this instance, raw tracks dropped", rec.roomID)
+}
+
+// reorderBuffer puts the packets of a track back in sequence order. A
+// missing packet is waited for until reorderWindow packets are pending,
+// then skipped.
+type reorderBuffer struct {
+	started bool
+	next    uint16
+	pending map[uint16]*rtp.Packet
+}
+
+func (b *reorderBuffer) push(pkt *rtp.Packet, emit func(*rtp.Packet)) {
+	if !b.started {
+		b.started = true
+		b.next = pkt.SequenceNumber
+		b.pending = make(map[uint16]*rtp.Packet)
+	}
+	if int16(pkt.SequenceNumber-b.next) < 0 {
+		return // late duplicate or retransmission of a skipped packet
+	}
+	b.pending[pkt.SequenceNumber] = pkt
+	b.drain(emit)
+	for len(b.pending) > reorderWindow {
+		b.skip()
+		b.drain(emit)
+	}
+}
+
+// flush writes out everything pending, skipping over gaps.
+func (b *reorderBuffer) flush(emit func(*rtp.Packet)) {
+	for len(b.pending) > 0 {
+		b.skip()
+		b.drain(emit)
+	}
+}
+
+func (b *reorderBuffer) drain(emit func(*rtp.Packet)) {
+	for {
+		pkt, ok := b.pending[b.next]
+		if !ok {
+			return
+		}
+		delete(b.pending, b.next)
+		emit(pkt)
+		b.next++
+	}
+}
+
+// skip moves past a missing packet to the oldest pending one.
+func (b *reorderBuffer) skip() {
+	first := true
+	var oldest uint16
+	for seq := range b.pending {
+		if first || int16(seq-oldest) < 0 {
+			oldest = seq
+			first = false
+		}
+	}
+	b.next = oldest
+}
@@ -0,0 +1,100 @@
+package room
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/Foodstream-io/etchebest/internal/hls"
+	"github.com/pion/webrtc/v4"
+)
+
+// mimeTypeRED is Opus with redundant encoding (RFC 2198): each packet also
+// carries the previous frames, so audio survives isolated losses.
+const mimeTypeRED = "audio/red"
+
+// opusCapability is what viewers that did not negotiate RED receive instead.
+var opusCapability = webrtc.RTPCodecCapability{
+	MimeType:    webrtc.MimeTypeOpus,
+	ClockRate:   48000,
+	Channels:    2,
+	SDPFmtpLine: "minptime=10;useinbandfec=1",
+}
+
+// registerRED offers RED over the default Opus payload type. Browsers only
+// negotiate it when their Opus uses that payload type too.
+func registerRED(me *webrtc.MediaEngine) error {
+	return me.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    mimeTypeRED,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "111/111",
+		},
+		PayloadType: 63,
+	}, webrtc.RTPCodecTypeAudio)
+}
+
+func isRED(codec webrtc.RTPCodecParameters) bool {
+	return strings.EqualFold(codec.MimeType, mimeTypeRED)
+}
+
+// resolveTrackCodec picks the codec a destination peer receives ti with.
+// RED sources fall back to plain Opus for peers that did not negotiate RED;
+// the relay then forwards only the primary encoding.
+func resolveTrackCodec(pc *webrtc.PeerConnection, ti *TrackInfo) (webrtc.RTPCodecCapability, uint8) {
+	codec := ti.Track.Codec()
+	if isRED(codec) {
+		if _, _, ok := findCodec(pc, func(c webrtc.RTPCodecParameters) bool { return isRED(c) }); !ok {
+			return resolveCodec(pc, webrtc.MimeTypeOpus, opusCapability)
+		}
+	}
+	return resolveCodec(pc, codec.MimeType, codec.RTPCodecCapability)
+}
+
+// redPrimary returns the payload type and data of the primary (most recent)
+// encoding of a RED payload.
+func redPrimary(payload []byte) (uint8, []byte, bool) {
+	offset, redundant := 0, 0
+	for {
+		if offset >= len(payload) {
+			return 0, nil, false
+		}
+		// The last block header is a single byte with F=0.
+		if payload[offset]&0x80 == 0 {
+			pt := payload[offset] & 0x7F
+			offset++
+			if offset+redundant > len(payload) {
+				return 0, nil, false
+			}
+			return pt, payload[offset+redundant:], true
+		}
+		if offset+4 > len(payload) {
+			return 0, nil, false
+		}
+		redundant += int(binary.BigEndian.Uint16(payload[offset+2:offset+4]) & 0x3FF)
+		offset += 4
+	}
+}
+
+// hlsCodecInfo describes what the relay feeds FFmpeg for ti: the primary
+// Opus encoding of a RED source, the source codec otherwise.
+func hlsCodecInfo(ti *TrackInfo) *hls.CodecInfo {
+	codec := ti.Track.Codec()
+	if !isRED(codec) {
+		return buildCodecInfo(codec)
+	}
+	pt := uint64(111)
+	if primary, _, found := strings.Cut(codec.SDPFmtpLine, "/"); found {
+		if v, err := strconv.ParseUint(primary, 10, 7); err == nil {
+			pt = v
+		}
+	}
+	return &hls.CodecInfo{
+		PayloadType: uint8(pt),
+		CodecName:   "opus",
+		ClockRate:   opusCapability.ClockRate,
+		Channels:    opusCapability.Channels,
+		FmtpLine:    opusCapability.SDPFmtpLine,
+	}
+}
@@ -1,6 +1,8 @@
 package room
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -43,3 +45,115 @@ func DeleteRoomById(db *gorm.DB, id string) error {
 	}
 	return nil
 }
+
+func CreateInvitation(db *gorm.DB, invitation *Invitation) error {
+	if err := db.Create(invitation).Error; err != nil {
+		return err
+	}
+	return nil
+}
+
+func GetInvitationById(db *gorm.DB, id string) (*Invitation, error) {
+	var invitation Invitation
+
+	if err := db.First(&invitation, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+func GetInvitationByToken(db *gorm.DB, token string) (*Invitation, error) {
+	var invitation Invitation
+
+	if err := db.First(&invitation, "token = ?", token).Error; err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+func GetInvitationsByRoom(db *gorm.DB, roomID string) ([]Invitation, error) {
+	var invitations []Invitation
+
+	if err := db.Where("room_id = ?", roomID).Order("created_at DESC").Find(&invitations).Error; err != nil {
+		return invitations, err
+	}
+	return invitations, nil
+}
+
+func GetPendingInvitationsForUser(db *gorm.DB, userID string) ([]Invitation, error) {
+	var invitations []Invitation
+
+	if err := db.Where("invitee_id = ? AND status = ? AND expires_at > ?", userID, InvitationPending, time.Now()).
+		Order("created_at DESC").
+		Find(&invitations).Error; err != nil {
+		return invitations, err
+	}
+	return invitations, nil
+}
+
+// GetCoHostIds returns the users whose invitation to roomID was accepted.
+func GetCoHostIds(db *gorm.DB, roomID string) ([]string, error) {
+	var ids []string
+
+	if err := db.Model(&Invitation{}).
+		Where("room_id = ? AND status = ?", roomID, InvitationAccepted).
+		Pluck("invitee_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// HasOpenInvitation reports whether userID already holds a pending or
+// accepted invitation to roomID.
+func HasOpenInvitation(db *gorm.DB, roomID, userID string) (bool, error) {
+	var count int64
+
+	err := db.Model(&Invitation{}).
+		Where("room_id = ? AND invitee_id = ?", roomID, userID).
+		Where("status = ? OR (status = ? AND expires_at > ?)", InvitationAccepted, InvitationPending, time.Now()).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// TransitionInvitation moves an invitation out of one of the from statuses.
+// It returns false when the invitation was no longer in such a state, so
+// concurrent responses cannot both succeed.
+func TransitionInvitation(db *gorm.DB, invitation *Invitation, from []string, to string) (bool, error) {
+	now := time.Now()
+	res := db.Model(&Invitation{}).
+		Where("id = ? AND status IN ?", invitation.ID, from).
+		Where("status <> ? OR expires_at > ?", InvitationPending, now).
+		Updates(map[string]any{
+			"status":       to,
+			"invitee_id":   invitation.InviteeID,
+			"responded_at": now,
+		})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, nil
+	}
+	invitation.Status = to
+	invitation.RespondedAt = &now
+	return true, nil
+}
+
+// ExpireInvitations marks the pending invitations past their deadline.
+func ExpireInvitations(db *gorm.DB) error {
+	return db.Model(&Invitation{}).
+		Where("status = ? AND expires_at <= ?", InvitationPending, time.Now()).
+		Update("status", InvitationExpired).Error
+}
+
+// RevokeCoHostInvitations revokes every pending or accepted invitation of
+// userID to roomID, so they can no longer join it.
+func RevokeCoHostInvitations(db *gorm.DB, roomID, userID string) error {
+	return db.Model(&Invitation{}).
+		Where("room_id = ? AND invitee_id = ? AND status IN ?", roomID, userID,
+			[]string{InvitationPending, InvitationAccepted}).
+		Updates(map[string]any{
+			"status":       InvitationRevoked,
+			"responded_at": time.Now(),
+		}).Error
+}
@@ -0,0 +1,492 @@
+package room
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// videoHeight returns the short side of the picture an RTP payload
+// announces: from the SPS for H.264, from the keyframe header for VP8 and
+// VP9 (or the scalability structure of the VP9 payload descriptor), from
+// the sequence header for AV1. It returns 0 for any other payload, codec,
+// or malformed data.
+func videoHeight(mimeType string, payload []byte) int {
+	var w, h int
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		sps := h264SPSNAL(payload)
+		if sps == nil {
+			return 0
+		}
+		w, h = parseH264SPSSize(sps)
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		w, h = parseVP8KeyframeSize(payload)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		w, h = parseVP9Size(payload)
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		w, h = parseAV1SequenceHeaderSize(payload)
+	}
+	return min(w, h)
+}
+
+// h264SPSNAL returns the SPS NAL unit of an H.264 RTP payload, sent alone
+// or in a STAP-A, or nil.
+func h264SPSNAL(payload []byte) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+	switch payload[0] & 0x1f {
+	case 7:
+		return payload
+	case 24:
+		offset := 1
+		for offset+2 <= len(payload) {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if size == 0 || offset+size > len(payload) {
+				return nil
+			}
+			if payload[offset]&0x1f == 7 {
+				return payload[offset : offset+size]
+			}
+			offset += size
+		}
+	}
+	return nil
+}
+
+// bitReader reads a bitstream MSB first. newBitReader makes one for the
+// RBSP of an H.264 NAL unit, skipping its emulation prevention bytes.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  bool
+}
+
+func newBitReader(nal []byte) *bitReader {
+	rbsp := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return &bitReader{data: rbsp}
+}
+
+func (r *bitReader) bit() uint {
+	if r.pos >= len(r.data)*8 {
+		r.err = true
+		return 0
+	}
+	b := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint(b)
+}
+
+func (r *bitReader) bits(n int) uint {
+	var v uint
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bit() == 0 {
+		if r.err || zeros > 31 {
+			r.err = true
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// uvlc reads an AV1 variable length code (AV1 bitstream 4.10.3).
+func (r *bitReader) uvlc() uint {
+	zeros := 0
+	for r.bit() == 0 {
+		if r.err {
+			return 0
+		}
+		zeros++
+	}
+	if zeros >= 32 {
+		return 1<<32 - 1
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v&1 == 1 {
+		return int(v+1) / 2
+	}
+	return -int(v / 2)
+}
+
+// parseH264SPSSize returns the cropped picture size an SPS NAL unit
+// (ITU-T H.264 7.3.2.1.1) describes, 0x0 when it cannot be parsed.
+func parseH264SPSSize(nal []byte) (int, int) {
+	r := newBitReader(nal)
+	r.bits(8) // NAL header
+	profile := r.bits(8)
+	r.bits(16) // constraint flags, level
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormat := uint(1)
+	separateColourPlanes := uint(0)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			separateColourPlanes = r.bit()
+		}
+		r.ue()  // bit_depth_luma_minus8
+		r.ue()  // bit_depth_chroma_minus8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		scalingMatrix := r.bit()
+		if scalingMatrix == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size && next != 0; j++ {
+					next = (last + r.se() + 256) % 256
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	pocType := r.ue()
+	switch pocType {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		cycle := r.ue()
+		if cycle > 255 {
+			return 0, 0
+		}
+		for i := uint(0); i < cycle; i++ {
+			r.se()
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+	widthMBs := r.ue() + 1
+	heightMapUnits := r.ue() + 1
+	frameMBsOnly := r.bit()
+	if frameMBsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint
+	if r.bit() == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.err {
+		return 0, 0
+	}
+
+	// Crop offsets are in chroma samples (7.4.2.1.1).
+	cropX, cropY := uint(1), 2-frameMBsOnly
+	if separateColourPlanes == 0 && chromaFormat != 0 {
+		subWidth, subHeight := uint(2), uint(2)
+		switch chromaFormat {
+		case 2:
+			subHeight = 1
+		case 3:
+			subWidth, subHeight = 1, 1
+		}
+		cropX, cropY = subWidth, subHeight*(2-frameMBsOnly)
+	}
+	width := widthMBs*16 - cropX*(cropLeft+cropRight)
+	height := (2-frameMBsOnly)*heightMapUnits*16 - cropY*(cropTop+cropBottom)
+	if int(width) <= 0 || int(height) <= 0 || width > 16384 || height > 16384 {
+		return 0, 0
+	}
+	return int(width), int(height)
+}
+
+// parseVP8KeyframeSize returns the picture size of the VP8 keyframe a
+// payload starts (RFC 6386 9.1), 0x0 for any other payload.
+func parseVP8KeyframeSize(payload []byte) (int, int) {
+	if !isVP8Keyframe(payload) {
+		return 0, 0
+	}
+	// Skip the payload descriptor, as isVP8Keyframe does.
+	offset := 1
+	if payload[0]&0x80 != 0 {
+		x := payload[offset]
+		offset++
+		if x&0x80 != 0 {
+			if payload[offset]&0x80 != 0 {
+				offset += 2
+			} else {
+				offset++
+			}
+		}
+		if x&0x40 != 0 {
+			offset++
+		}
+		if x&0x20 != 0 || x&0x10 != 0 {
+			offset++
+		}
+	}
+	// 3-byte frame tag, 3-byte start code, then 14-bit width and height.
+	frame := payload[offset:]
+	if len(frame) < 10 || frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return 0, 0
+	}
+	width := int(frame[6]) | int(frame[7]&0x3f)<<8
+	height := int(frame[8]) | int(frame[9]&0x3f)<<8
+	return width, height
+}
+
+// parseVP9Size returns the picture size a VP9 RTP payload announces, 0x0
+// when it announces none: the largest spatial layer of the scalability
+// structure of its payload descriptor (RFC 9628 4.2), or else the frame
+// size of the keyframe it starts (VP9 bitstream 6.2).
+func parseVP9Size(payload []byte) (int, int) {
+	if len(payload) < 1 {
+		return 0, 0
+	}
+	flags := payload[0]
+	offset := 1
+	if flags&0x80 != 0 { // I: picture ID
+		if offset >= len(payload) {
+			return 0, 0
+		}
+		if payload[offset]&0x80 != 0 {
+			offset += 2
+		} else {
+			offset++
+		}
+	}
+	if flags&0x20 != 0 { // L: layer indices, TL0PICIDX in non-flexible mode
+		offset++
+		if flags&0x10 == 0 {
+			offset++
+		}
+	}
+	if flags&0x10 != 0 && flags&0x40 != 0 { // F and P: reference indices
+		for i := 0; i < 3; i++ {
+			if offset >= len(payload) {
+				return 0, 0
+			}
+			more := payload[offset]&0x01 != 0
+			offset++
+			if !more {
+				break
+			}
+		}
+	}
+	if offset > len(payload) {
+		return 0, 0
+	}
+
+	if flags&0x02 != 0 { // V: scalability structure
+		if offset >= len(payload) {
+			return 0, 0
+		}
+		layers := int(payload[offset]>>5) + 1
+		if payload[offset]&0x10 == 0 { // Y: no resolutions
+			return 0, 0
+		}
+		offset++
+		if offset+4*layers > len(payload) {
+			return 0, 0
+		}
+		last := payload[offset+4*(layers-1):]
+		return int(last[0])<<8 | int(last[1]), int(last[2])<<8 | int(last[3])
+	}
+
+	// B without P: the payload starts an intra frame.
+	if flags&0x08 == 0 || flags&0x40 != 0 {
+		return 0, 0
+	}
+	r := &bitReader{data: payload[offset:]}
+	if r.bits(2) != 2 { // frame_marker
+		return 0, 0
+	}
+	profile := r.bit() | r.bit()<<1
+	if profile == 3 {
+		r.bit() // reserved_zero
+	}
+	if r.bit() == 1 || r.bit() != 0 { // show_existing_frame, frame_type
+		return 0, 0
+	}
+	r.bits(2) // show_frame, error_resilient_mode
+	if r.bits(24) != 0x498342 {
+		return 0, 0
+	}
+	if profile >= 2 {
+		r.bit() // ten_or_twelve_bit
+	}
+	if r.bits(3) != 7 { // color_space other than CS_RGB
+		r.bit() // color_range
+		if profile == 1 || profile == 3 {
+			r.bits(3) // subsampling_x, subsampling_y, reserved_zero
+		}
+	} else if profile == 1 || profile == 3 {
+		r.bit() // reserved_zero
+	}
+	width, height := r.bits(16)+1, r.bits(16)+1
+	if r.err {
+		return 0, 0
+	}
+	return int(width), int(height)
+}
+
+// AV1 OBU types (AV1 bitstream 6.2.2).
+const av1OBUSequenceHeader = 1
+
+// parseAV1SequenceHeaderSize returns the maximum picture size the sequence
+// header carried by an AV1 RTP payload announces, 0x0 when it carries none.
+// Encoders send one with every keyframe, as the first OBU of the packet
+// starting it.
+func parseAV1SequenceHeaderSize(payload []byte) (int, int) {
+	if len(payload) < 2 {
+		return 0, 0
+	}
+	// Aggregation header: Z, Y, W, N (AV1 RTP 4.4).
+	aggregation := payload[0]
+	count := int(aggregation >> 4 & 0x03)
+	offset := 1
+	for i := 0; offset < len(payload); i++ {
+		size := len(payload) - offset
+		if count == 0 || i < count-1 {
+			v, n := leb128(payload[offset:])
+			if n == 0 {
+				return 0, 0
+			}
+			offset += n
+			size = int(v)
+		}
+		if size > len(payload)-offset {
+			return 0, 0
+		}
+		obu := payload[offset : offset+size]
+		offset += size
+		// The first element continues an OBU of the previous packet.
+		if i == 0 && aggregation&0x80 != 0 {
+			continue
+		}
+		if len(obu) < 1 || obu[0]>>3&0x0f != av1OBUSequenceHeader {
+			continue
+		}
+		header := 1
+		if obu[0]&0x04 != 0 { // obu_extension_flag
+			header++
+		}
+		if obu[0]&0x02 != 0 { // obu_has_size_field
+			if header > len(obu) {
+				return 0, 0
+			}
+			_, n := leb128(obu[header:])
+			if n == 0 {
+				return 0, 0
+			}
+			header += n
+		}
+		if header > len(obu) {
+			return 0, 0
+		}
+		return parseAV1SequenceHeader(obu[header:])
+	}
+	return 0, 0
+}
+
+// leb128 decodes an unsigned LEB128 value, returning the bytes it took
+// (0 when malformed).
+func leb128(data []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8 && i < len(data); i++ {
+		v |= uint64(data[i]&0x7f) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// parseAV1SequenceHeader returns max_frame_width and max_frame_height of a
+// sequence header OBU payload (AV1 bitstream 5.5.1).
+func parseAV1SequenceHeader(data []byte) (int, int) {
+	r := &bitReader{data: data}
+	r.bits(3) // seq_profile
+	r.bit()   // still_picture
+	// reduced_still_picture_header
+	if r.bit() == 1 {
+		r.bits(5) // seq_level_idx[0]
+	} else {
+		decoderModelInfo := false
+		bufferDelayLength := 0
+		if r.bit() == 1 { // timing_info_present_flag
+			r.bits(32) // num_units_in_display_tick
+			r.bits(32) // time_scale
+			// equal_picture_interval
+			if r.bit() == 1 {
+				r.uvlc() // num_ticks_per_picture_minus_1
+			}
+			decoderModelInfo = r.bit() == 1
+			if decoderModelInfo {
+				bufferDelayLength = int(r.bits(5)) + 1
+				r.bits(32) // num_units_in_decoding_tick
+				r.bits(10) // buffer_removal_time_length_minus_1, frame_presentation_time_length_minus_1
+			}
+		}
+		initialDisplayDelay := r.bit() == 1
+		operatingPoints := int(r.bits(5)) + 1
+		for i := 0; i < operatingPoints && !r.err; i++ {
+			r.bits(12) // operating_point_idc
+			// seq_level_idx
+			if r.bits(5) > 7 {
+				r.bit() // seq_tier
+			}
+			if decoderModelInfo && r.bit() == 1 { // decoder_model_present_for_this_op
+				r.bits(2 * bufferDelayLength) // decoder_buffer_delay, encoder_buffer_delay
+				r.bit()                       // low_delay_mode_flag
+			}
+			if initialDisplayDelay && r.bit() == 1 {
+				r.bits(4) // initial_display_delay_minus_1
+			}
+		}
+	}
+	widthBits := int(r.bits(4)) + 1
+	heightBits := int(r.bits(4)) + 1
+	width, height := r.bits(widthBits)+1, r.bits(heightBits)+1
+	if r.err {
+		return 0, 0
+	}
+	return int(width), int(height)
+}
@@ -0,0 +1,126 @@
+package room
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// expGolomb writes the fields of a test H.264 SPS.
+type expGolomb struct {
+	bits []byte
+}
+
+func (w *expGolomb) u(n int, v uint) {
+	for i := n - 1; i >= 0; i-- {
+		w.bits = append(w.bits, byte(v>>i&1))
+	}
+}
+
+func (w *expGolomb) ue(v uint) {
+	n := 0
+	for (v+1)>>n > 1 {
+		n++
+	}
+	w.u(n, 0)
+	w.u(n+1, v+1)
+}
+
+func (w *expGolomb) nal() []byte {
+	w.u(1, 1) // rbsp_stop_one_bit
+	out := make([]byte, (len(w.bits)+7)/8)
+	for i, b := range w.bits {
+		out[i/8] |= b << (7 - i%8)
+	}
+	return out
+}
+
+func TestSourceHeightIsReadFromThePayload(t *testing.T) {
+	// Baseline 1280x720.
+	var baseline expGolomb
+	baseline.u(8, 0x67)
+	baseline.u(24, 66<<16|0xc0<<8|31)
+	for _, v := range []uint{0, 0, 2, 1} { // sps id, frame num, poc type, refs
+		baseline.ue(v)
+	}
+	baseline.u(1, 0)
+	baseline.ue(79)
+	baseline.ue(44)
+	baseline.u(3, 0b110) // frame_mbs_only, direct_8x8, no cropping
+	baseline.u(1, 0)     // no VUI
+
+	// High 1920x1088 cropped to 1080, in a STAP-A.
+	var high expGolomb
+	high.u(8, 0x67)
+	high.u(24, 100<<16|40)
+	for _, v := range []uint{0, 1, 0, 0} { // sps id, chroma 4:2:0, bit depths
+		high.ue(v)
+	}
+	// No transform bypass, no scaling matrix.
+	high.u(2, 0)
+	for _, v := range []uint{0, 0, 0, 1} { // frame num, poc type 0, poc lsb, refs
+		high.ue(v)
+	}
+	high.u(1, 0)
+	high.ue(119)
+	high.ue(67)
+	high.u(3, 0b111) // frame_mbs_only, direct_8x8, cropping
+	for _, v := range []uint{0, 0, 0, 4} {
+		high.ue(v)
+	}
+	high.u(1, 0)
+	sps := high.nal()
+	stapA := append([]byte{0x78, 0, byte(len(sps))}, sps...)
+
+	// VP8 keyframe, 640x360.
+	vp8 := []byte{0x10, 0x50, 0x2a, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0x68, 0x01}
+
+	// VP9 with a scalability structure announcing 1280x720, then a
+	// profile 0 keyframe of 640x360 and an inter frame.
+	vp9SS := []byte{0x8a, 0x01, 0x10, 0x05, 0x00, 0x02, 0xd0}
+	var vp9Header expGolomb
+	vp9Header.u(8, 0x82) // frame marker, profile 0, keyframe, shown
+	vp9Header.u(24, 0x498342)
+	vp9Header.u(4, 0) // color space, range
+	vp9Header.u(16, 639)
+	vp9Header.u(16, 359)
+	vp9Key := append([]byte{0x08}, vp9Header.nal()...)
+	vp9Inter := append([]byte{0x48}, vp9Header.nal()...)
+
+	// AV1 sequence header of a 1920x1080 stream, alone in its packet.
+	var av1Header expGolomb
+	av1Header.u(3, 0)  // seq_profile
+	av1Header.u(4, 0)  // still, reduced, timing info, initial display delay
+	av1Header.u(5, 0)  // one operating point
+	av1Header.u(12, 0) // operating_point_idc
+	av1Header.u(5, 8)  // seq_level_idx
+	av1Header.u(1, 0)  // seq_tier
+	av1Header.u(4, 10) // frame_width_bits_minus_1
+	av1Header.u(4, 10) // frame_height_bits_minus_1
+	av1Header.u(11, 1919)
+	av1Header.u(11, 1079)
+	av1 := append([]byte{0x18, 0x08}, av1Header.nal()...)
+
+	for _, tc := range []struct {
+		mime    string
+		payload []byte
+		want    int
+	}{
+		{webrtc.MimeTypeH264, baseline.nal(), 720},
+		{webrtc.MimeTypeH264, stapA, 1080},
+		{webrtc.MimeTypeH264, e2eIDR, 0},
+		{webrtc.MimeTypeH264, e2eParams[:8], 0},
+		{webrtc.MimeTypeVP8, vp8, 360},
+		{webrtc.MimeTypeVP8, vp8[:8], 0},
+		{webrtc.MimeTypeVP9, vp9SS, 720},
+		{webrtc.MimeTypeVP9, vp9SS[:5], 0},
+		{webrtc.MimeTypeVP9, vp9Key, 360},
+		{webrtc.MimeTypeVP9, vp9Inter, 0},
+		{webrtc.MimeTypeAV1, av1, 1080},
+		{webrtc.MimeTypeAV1, av1[:4], 0},
+	} {
+		if got := videoHeight(tc.mime, tc.payload); got != tc.want {
+			t.Errorf("videoHeight(%s, % x) = %d, want %d", tc.mime, tc.payload, got, tc.want)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package room
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -18,8 +20,11 @@ import (
 	"github.com/Foodstream-io/etchebest/internal/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v4"
 	"gorm.io/gorm"
 )
@@ -31,22 +36,40 @@ type Request struct {
 	Tags            []string `json:"tags"`
 	Level           string   `json:"level"`
 	DurationMinutes int      `json:"durationMinutes"`
-	Visibility      string   `json:"visibility"`
-	ThumbnailURL    string   `json:"thumbnailUrl"`
-	Status          string   `json:"status"`
-	ScheduledAt     *string  `json:"scheduledAt"`
-}
-
-type AddParticipantReq struct {
-	RoomId string `json:"roomId" binding:"required" example:"550e8400-e29b-41d4-a716-446655440000"`
-	UserId string `json:"userId" binding:"required" example:"550e8400-e29b-41d4-a716-446655440001"`
+	// Visibility is public (default), unlisted or private, or the label
+	// the clients show for it.
+	Visibility   string `json:"visibility"`
+	ThumbnailURL string `json:"thumbnailUrl"`
+	// SubsOnly restricts playback to the host's followers.
+	SubsOnly bool `json:"subsOnly"`
+	// Status is what the host means to do with the live: "scheduled"
+	// (default), "draft", or "live" to start right away. Lives are always
+	// created scheduled and go live once their host connects.
+	Status      string  `json:"status"`
+	ScheduledAt *string `json:"scheduledAt"`
+	// Layout of the HLS composite: grid (default), pip or side-by-side.
+	Layout string `json:"layout"`
+	// LadderProfile picks the HLS transcoding ladder; by default the one
+	// of the chef's tier, the only one admins do not pick for others.
+	LadderProfile string `json:"ladderProfile"`
 }
 
+// liveRooms registers the in-memory rooms. roomsMu only guards the map
+// itself: room state is guarded by each Room's own lock. A room lock may be
+// held while taking roomsMu, never the other way around.
 var (
-	mu        sync.Mutex
+	roomsMu   sync.Mutex
 	liveRooms = make(map[string]*Room)
 )
 
+// renegotiationRetryDelay spaces a new server offer after a client rollback,
+// so both sides do not collide again.
+const renegotiationRetryDelay = time.Second
+
+// nackCacheSize is how many packets are kept per outgoing stream to answer
+// NACKs: about two seconds of 720p video, enough for mobile round trips.
+const nackCacheSize = 2048
+
 func normalizeFmtp(fmtp string) string {
 	fmtp = strings.TrimSpace(strings.ToLower(fmtp))
 	if fmtp == "" {
@@ -113,46 +136,87 @@ func findCodec(
 
 // getLiveRoom returns the shared in-memory Room pointer.
 // If not yet tracked, it loads from the DB and registers it.
+// Safe for concurrent use; the caller locks the returned room itself.
 func getLiveRoom(db *gorm.DB, id string) (*Room, error) {
-	if r, ok := liveRooms[id]; ok {
+	if r := lookupLiveRoom(id); r != nil {
 		return r, nil
 	}
 	r, err := GetRoomById(db, id)
 	if err != nil {
 		return nil, err
 	}
+	coHosts, err := GetCoHostIds(db, id)
+	if err != nil {
+		return nil, err
+	}
+	r.CoHosts = make(map[string]bool, len(coHosts))
+	for _, userID := range coHosts {
+		r.CoHosts[userID] = true
+	}
+
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	// Another request may have registered the room while we hit the DB.
+	if existing, ok := liveRooms[id]; ok {
+		return existing, nil
+	}
+	r.mu = new(sync.Mutex)
+	r.lastActivity = time.Now()
 	liveRooms[id] = r
 	return r, nil
 }
 
-func removeLiveRoom(id string) {
-	delete(liveRooms, id)
+// lookupLiveRoom returns the registered room without touching the DB.
+func lookupLiveRoom(id string) *Room {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	return liveRooms[id]
 }
 
-func markLiveAsEndedByRoomID(db *gorm.DB, roomID string, replayURL string) {
-	now := time.Now()
+// registerLiveRoom makes a freshly created room the shared instance.
+func registerLiveRoom(r *Room) {
+	if r.mu == nil {
+		r.mu = new(sync.Mutex)
+	}
+	r.lastActivity = time.Now()
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	liveRooms[r.ID] = r
+}
 
-	updates := map[string]any{
-		"status":   "ended",
-		"ended_at": now,
+// removeLiveRoom ends a room on this instance: it is unregistered and its
+// ownership released. Must be called with the room's lock held.
+func removeLiveRoom(room *Room) {
+	unregisterLiveRoom(room)
+	if ownership != nil {
+		ownership.Release(room.ID)
 	}
+}
 
-	if replayURL != "" {
-		updates["has_replay"] = true
-		updates["replay_url"] = replayURL
+// unregisterLiveRoom marks the room closed and drops it from the registry.
+// Must be called with the room's lock held.
+func unregisterLiveRoom(room *Room) {
+	room.closed = true
+	stopHostGrace(room)
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	if liveRooms[room.ID] == room {
+		delete(liveRooms, room.ID)
 	}
+}
 
-	if err := db.Model(&liveModule.Live{}).
-		Where("room_id = ? AND status != ?", roomID, "ended").
-		Updates(updates).Error; err != nil {
+// markLiveAsEndedByRoomID ends the room's live, recording who ended it and
+// why (one of the liveModule.EndReason* constants). A live whose recording
+// is still to be muxed waits for its replay in processing-replay.
+func markLiveAsEndedByRoomID(db *gorm.DB, roomID, actor, replayURL, reason string, replayPending bool) {
+	if err := liveModule.End(db, roomID, actor, reason, replayURL, replayPending); err != nil && !errors.Is(err, liveModule.ErrInvalidTransition) {
 		log.Printf("failed to mark live as ended for room %s: %v", roomID, err)
 	}
-	log.Printf("[LIVE END] room=%s updates=%+v", roomID, updates)
 }
 
 func getPeerConnectionByUser(room *Room, userID string) *webrtc.PeerConnection {
 	for _, conn := range room.Connections {
-		if conn.UserID == userID {
+		if conn.UserID == userID && !conn.PublishOnly {
 			return conn.PeerCon
 		}
 	}
@@ -160,14 +224,14 @@ func getPeerConnectionByUser(room *Room, userID string) *webrtc.PeerConnection {
 }
 
 // requestRenegotiationOffer creates and queues a server offer for one user.
-// The offer is fetched by the client via polling and answered through
-// HandleRenegotiationAnswer.
+// The offer is pushed over WebSocket (or fetched by the client via polling)
+// and answered over WebSocket or through HandleRenegotiationAnswer.
 func requestRenegotiationOffer(room *Room, userID string, pc *webrtc.PeerConnection) {
 	if room == nil || pc == nil || userID == "" {
 		return
 	}
 
-	mu.Lock()
+	room.mu.Lock()
 	if room.PendingOfferByUser == nil {
 		room.PendingOfferByUser = make(map[string]webrtc.SessionDescription)
 	}
@@ -180,45 +244,53 @@ func requestRenegotiationOffer(room *Room, userID string, pc *webrtc.PeerConnect
 
 	if _, hasPendingOffer := room.PendingOfferByUser[userID]; hasPendingOffer {
 		room.NeedsRenegotiationByUser[userID] = true
-		mu.Unlock()
+		room.mu.Unlock()
 		return
 	}
 	if room.RenegotiatingByUser[userID] {
 		room.NeedsRenegotiationByUser[userID] = true
-		mu.Unlock()
+		room.mu.Unlock()
 		return
 	}
 	room.RenegotiatingByUser[userID] = true
-	mu.Unlock()
+	trickle := peerUsesTrickle(room, userID)
+	room.mu.Unlock()
 
 	defer func() {
-		mu.Lock()
+		room.mu.Lock()
 		if room.RenegotiatingByUser != nil {
 			room.RenegotiatingByUser[userID] = false
 		}
-		mu.Unlock()
+		room.mu.Unlock()
 	}()
 
 	if pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
 		return
 	}
 	if pc.SignalingState() != webrtc.SignalingStateStable {
-		mu.Lock()
+		room.mu.Lock()
 		if room.NeedsRenegotiationByUser != nil {
 			room.NeedsRenegotiationByUser[userID] = true
 		}
-		mu.Unlock()
+		room.mu.Unlock()
 		return
 	}
 
-	offer, err := pc.CreateOffer(nil)
+	// A connection that lost ICE connectivity gets new credentials with the
+	// offer, so the client can restore it without a new PeerConnection.
+	var options *webrtc.OfferOptions
+	if s := pc.ICEConnectionState(); s == webrtc.ICEConnectionStateFailed || s == webrtc.ICEConnectionStateDisconnected {
+		options = &webrtc.OfferOptions{ICERestart: true}
+		log.Printf("[RECONNECT] restarting ICE for user %s", userID)
+	}
+	offer, err := pc.CreateOffer(options)
 	if err != nil {
 		log.Printf("CreateOffer (renegotiation) failed for user %s: %v", userID, err)
-		mu.Lock()
+		room.mu.Lock()
 		if room.NeedsRenegotiationByUser != nil {
 			room.NeedsRenegotiationByUser[userID] = true
 		}
-		mu.Unlock()
+		room.mu.Unlock()
 		return
 	}
 
@@ -229,30 +301,37 @@ func requestRenegotiationOffer(room *Room, userID string, pc *webrtc.PeerConnect
 		}
 	}
 
-	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	// Trickle clients get the offer right away; their candidates follow
+	// over the signaling channel.
+	var gatherComplete <-chan struct{}
+	if !trickle {
+		gatherComplete = webrtc.GatheringCompletePromise(pc)
+	}
 	if err := pc.SetLocalDescription(offer); err != nil {
 		log.Printf("SetLocalDescription (renegotiation) failed for user %s: %v", userID, err)
-		mu.Lock()
+		room.mu.Lock()
 		if room.NeedsRenegotiationByUser != nil {
 			room.NeedsRenegotiationByUser[userID] = true
 		}
-		mu.Unlock()
+		room.mu.Unlock()
 		return
 	}
-	<-gatherComplete
+	if gatherComplete != nil {
+		<-gatherComplete
+	}
 
 	local := pc.LocalDescription()
 	if local == nil {
-		mu.Lock()
+		room.mu.Lock()
 		if room.NeedsRenegotiationByUser != nil {
 			room.NeedsRenegotiationByUser[userID] = true
 		}
-		mu.Unlock()
+		room.mu.Unlock()
 		return
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
+	room.mu.Lock()
+	defer room.mu.Unlock()
 	if getPeerConnectionByUser(room, userID) != pc {
 		return
 	}
@@ -354,6 +433,7 @@ func GetAllRooms(db *gorm.DB) gin.HandlerFunc {
 // @Success      200  {object}  map[string]interface{} "roomId and message (Room created or Room joined)"
 // @Failure      400  {object}  map[string]string "error: Room name is required"
 // @Failure      401  {object}  map[string]string "error: Unauthorized"
+// @Failure      403  {object}  map[string]string "error: only admins can pick another ladder profile"
 // @Failure      500  {object}  map[string]string "error: Failed to create room"
 // @Router       /api/rooms [post]
 
@@ -365,6 +445,32 @@ func CreateNewRoom(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		if req.Layout == "" {
+			req.Layout = hls.LayoutGrid
+		}
+		if !hls.ValidLayout(req.Layout) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid layout"})
+			return
+		}
+
+		if req.LadderProfile != "" && !hls.ValidProfile(req.LadderProfile) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ladder profile"})
+			return
+		}
+
+		switch req.Status {
+		case "", "draft", liveModule.StatusScheduled, liveModule.StatusLive:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status"})
+			return
+		}
+
+		visibility, ok := liveModule.ParseVisibility(req.Visibility)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid visibility"})
+			return
+		}
+
 		currentUserId := utils.GetContextString(c, "userId")
 
 		currentUser, err := userModule.GetUserByID(db, currentUserId)
@@ -373,10 +479,19 @@ func CreateNewRoom(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		// Ladders cost transcoding: chefs get the one of their tier.
+		tierProfile := hls.ProfileForTier(chefTier(currentUser))
+		if req.LadderProfile == "" {
+			req.LadderProfile = tierProfile
+		} else if req.LadderProfile != tierProfile && c.GetString("role") != userModule.ADMIN {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only admins can pick another ladder profile"})
+			return
+		}
+
 		var existingLive liveModule.Live
 
 		if err := db.
-			Where("user_id = ? AND status IN ?", currentUser.ID, []string{"live", "scheduled"}).
+			Where("user_id = ? AND status IN ?", currentUser.ID, liveModule.ActiveStatuses).
 			First(&existingLive).Error; err == nil {
 			c.JSON(http.StatusConflict, gin.H{
 				"error": "you already have an active or scheduled live",
@@ -391,6 +506,8 @@ func CreateNewRoom(db *gorm.DB) gin.HandlerFunc {
 			Participants:    pq.StringArray{currentUserId},
 			Viewers:         0,
 			MaxParticipants: 6,
+			Layout:          req.Layout,
+			LadderProfile:   req.LadderProfile,
 		}
 
 		if err := CreateRoom(db, &room); err != nil {
@@ -426,11 +543,6 @@ func CreateNewRoom(db *gorm.DB) gin.HandlerFunc {
 			resolvedTags = append(resolvedTags, existingTag)
 		}
 
-		status := req.Status
-		if status == "" {
-			status = "scheduled"
-		}
-
 		dishName := ""
 		if len(req.Tags) > 0 {
 			dishName = req.Tags[0]
@@ -446,10 +558,9 @@ func CreateNewRoom(db *gorm.DB) gin.HandlerFunc {
 			scheduledAt = &parsed
 		}
 
-		var startedAt *time.Time
-		if status == "live" {
+		if req.Status == liveModule.StatusLive && scheduledAt == nil {
 			now := time.Now()
-			startedAt = &now
+			scheduledAt = &now
 		}
 
 		title := strings.TrimSpace(req.Title)
@@ -458,30 +569,28 @@ func CreateNewRoom(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		newLive := liveModule.Live{
-			RoomID:         room.ID,
-			Title:          title,
-			Description:    req.Description,
-			DishName:       dishName,
-			UserID:         currentUser.ID,
-			Status:         status,
-			ThumbnailURL:   req.ThumbnailURL,
-			Duration:       req.DurationMinutes * 60,
-			CurrentViewers: 0,
-			ViewCount:      0,
-			LikeCount:      0,
-			StartedAt:      startedAt,
-			Tags:           resolvedTags,
-			ScheduledAt: scheduledAt,
-		}
-
-		if err := db.Create(&newLive).Error; err != nil {
+			RoomID:          room.ID,
+			Title:           title,
+			Description:     req.Description,
+			DishName:        dishName,
+			UserID:          currentUser.ID,
+			ThumbnailURL:    req.ThumbnailURL,
+			Duration:        req.DurationMinutes * 60,
+			CurrentViewers:  0,
+			ViewCount:       0,
+			LikeCount:       0,
+			Tags:            resolvedTags,
+			ScheduledAt:     scheduledAt,
+			Visibility:      visibility,
+			SubscribersOnly: req.SubsOnly,
+		}
+
+		if err := liveModule.Schedule(db, &newLive, currentUserId); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create live"})
 			return
 		}
 
-		mu.Lock()
-		liveRooms[room.ID] = &room
-		mu.Unlock()
+		registerLiveRoom(&room)
 
 		c.JSON(http.StatusOK, gin.H{
 			"roomId":  room.ID,
@@ -493,7 +602,7 @@ func CreateNewRoom(db *gorm.DB) gin.HandlerFunc {
 
 // ReserveRoom godoc
 // @Summary      Reserve a spot in a room
-// @Description  Reserve a participant slot in a room in advance
+// @Description  Reserve a participant slot in a room in advance (host and accepted co-hosts only)
 // @Tags         rooms
 // @Accept       json
 // @Produce      json
@@ -502,7 +611,7 @@ func CreateNewRoom(db *gorm.DB) gin.HandlerFunc {
 // @Success      200  {object}  map[string]string "message: reserved successfully, or you already reserved this room"
 // @Failure      400  {object}  map[string]string "error: RoomID is required"
 // @Failure      401  {object}  map[string]string "error: Unauthorized"
-// @Failure      403  {object}  map[string]string "error: Room full, cannot reserve"
+// @Failure      403  {object}  map[string]string "error: Room full, cannot reserve, or not invited to co-host"
 // @Failure      404  {object}  map[string]string "error: Room not found"
 // @Failure      500  {object}  map[string]string "error: Failed to save reservation"
 // @Router       /api/rooms/{roomId}/reserve [post]
@@ -510,13 +619,22 @@ func ReserveRoom(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		roomId := c.Param("roomId")
 
-		room, err := GetRoomById(db, roomId)
+		// Work on the shared live room so the participant list seen by
+		// signaling stays in sync with the database.
+		room, err := getLiveRoom(db, roomId)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "room " + roomId + " not found"})
 			return
 		}
 
 		currentUserId := utils.GetContextString(c, "userId")
+
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		if !canPublish(room, currentUserId) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "you have not been invited to co-host this room"})
+			return
+		}
 		for _, p := range room.Participants {
 			if p == currentUserId {
 				c.JSON(http.StatusOK, gin.H{"message": "you already reserved this room"})
@@ -532,85 +650,24 @@ func ReserveRoom(db *gorm.DB) gin.HandlerFunc {
 		room.Participants = append(room.Participants, currentUserId)
 		err = SaveRoom(db, room)
 		if err != nil {
+			room.Participants = room.Participants[:len(room.Participants)-1]
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save reservation"})
 			return
 		}
 
 		// Notify existing participants to renegotiate (so they can receive the new participant's stream)
-		mu.Lock()
-		liveRoom, getRoomErr := getLiveRoom(db, roomId)
-		if getRoomErr == nil && liveRoom != nil {
-			log.Printf("[RESERVE_ROOM] triggering renegotiation for new participant %s in room %s", currentUserId, roomId)
-			for _, conn := range liveRoom.Connections {
-				// Skip the new participant themselves
-				if conn.UserID != currentUserId && conn.PeerCon != nil {
-					go requestRenegotiationOffer(liveRoom, conn.UserID, conn.PeerCon)
-				}
+		log.Printf("[RESERVE_ROOM] triggering renegotiation for new participant %s in room %s", currentUserId, roomId)
+		for _, conn := range room.Connections {
+			// Skip the new participant themselves
+			if conn.UserID != currentUserId && conn.PeerCon != nil && !conn.PublishOnly {
+				go requestRenegotiationOffer(room, conn.UserID, conn.PeerCon)
 			}
 		}
-		mu.Unlock()
 
 		c.JSON(http.StatusOK, gin.H{"message": "reserved successfully"})
 	}
 }
 
-// AddParticipant godoc
-// @Summary      Add participant to room
-// @Description  Add a user as a participant to a specific room
-// @Tags         rooms
-// @Accept       json
-// @Produce      json
-// @Security     BearerAuth
-// @Param        request body AddParticipantReq true "Room and user IDs"
-// @Success      200  {object}  map[string]string "status: Participant added or Already participant"
-// @Failure      400  {object}  map[string]string "error: Invalid body"
-// @Failure      401  {object}  map[string]string "error: Unauthorized"
-// @Failure      404  {object}  map[string]string "error: Room not found"
-// @Router       /api/rooms/participant [post]
-func AddParticipant(db *gorm.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var req AddParticipantReq
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body"})
-			return
-		}
-
-		room, err := GetRoomById(db, req.RoomId)
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
-			return
-		}
-
-		if slices.Contains(room.Participants, req.UserId) {
-			c.JSON(http.StatusOK, gin.H{"status": "already participant"})
-			return
-		}
-
-		room.Participants = append(room.Participants, req.UserId)
-		err = SaveRoom(db, room)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save reservation"})
-			return
-		}
-
-		// Notify existing participants to renegotiate (so they can receive the new participant's stream)
-		mu.Lock()
-		liveRoom, getRoomErr := getLiveRoom(db, req.RoomId)
-		if getRoomErr == nil && liveRoom != nil {
-			log.Printf("[ADD_PARTICIPANT] triggering renegotiation for new participant %s in room %s", req.UserId, req.RoomId)
-			for _, conn := range liveRoom.Connections {
-				// Skip the new participant themselves
-				if conn.UserID != req.UserId && conn.PeerCon != nil {
-					go requestRenegotiationOffer(liveRoom, conn.UserID, conn.PeerCon)
-				}
-			}
-		}
-		mu.Unlock()
-
-		c.JSON(http.StatusOK, gin.H{"status": "participant added"})
-	}
-}
-
 // HandleDisconnect godoc
 // @Summary      Disconnect from room
 // @Description  Close all WebRTC connections and clean up room resources
@@ -628,56 +685,82 @@ func HandleDisconnect(db *gorm.DB) gin.HandlerFunc {
 		roomId := c.Param("roomId")
 		currentUserID := utils.GetContextString(c, "userId")
 
-		mu.Lock()
 		room, err := getLiveRoom(db, roomId)
 		if err != nil {
-			mu.Unlock()
 			c.JSON(http.StatusOK, gin.H{"message": "disconnected successfully"})
 			return
 		}
 
+		room.mu.Lock()
 		if room.Host != currentUserID {
-			mu.Unlock()
+			room.mu.Unlock()
 			c.JSON(http.StatusForbidden, gin.H{
 				"error": "only the host can end this live",
 			})
 			return
 		}
 
-		// Snapshot connections so we can close them outside the lock
-		conns := make([]PeerConnection, len(room.Connections))
-		copy(conns, room.Connections)
-
-		// Tear down room state
-		replayURL, replayErr := hls.StopStream(roomId)
-		log.Printf("[DISCONNECT] room=%s replayURL=%q replayErr=%v", roomId, replayURL, replayErr)
-		if replayErr != nil {
-			log.Printf("failed to generate replay for room %s: %v", roomId, replayErr)
-		}
-		room.Connections = nil
-		room.Tracks = nil
-		room.HostPeerCon = nil
-		room.HLSWriter = nil
-		removeLiveRoom(roomId)
-
-		markLiveAsEndedByRoomID(db, roomId, replayURL)
-
-		if err := DeleteRoomById(db, roomId); err != nil {
-			log.Printf("HandleDisconnect: failed to delete room %s: %v", roomId, err)
-		} else {
-			log.Printf("HandleDisconnect: room %s deleted", roomId)
-		}
-		mu.Unlock()
+		conns, subscribers := endRoom(db, room, liveModule.EndReasonHostEnded)
+		room.mu.Unlock()
 
 		// Close peer connections outside the lock
 		for _, pc := range conns {
 			closePeerConnection(pc)
 		}
+		for _, pc := range subscribers {
+			_ = pc.Close()
+		}
 
 		c.JSON(http.StatusOK, gin.H{"message": "disconnected successfully"})
 	}
 }
 
+// endActor is who ends a room's live for reason: its host when they hung
+// up, the server otherwise.
+func endActor(room *Room, reason string) string {
+	if reason == liveModule.EndReasonHostEnded {
+		return room.Host
+	}
+	return liveModule.ActorSystem
+}
+
+// endRoom ends the live of a room: HLS is stopped (producing the replay),
+// the live is marked ended for reason and the room deleted. It returns the
+// peers to close once the lock is released.
+// Must be called with the room lock held.
+func endRoom(db *gorm.DB, room *Room, reason string) ([]PeerConnection, []*webrtc.PeerConnection) {
+	// Snapshot connections so we can close them outside the lock
+	conns := make([]PeerConnection, len(room.Connections))
+	copy(conns, room.Connections)
+	subscribers := takeSubscribers(room)
+
+	// Tear down room state
+	replayURL, replayErr := hls.StopStream(room.ID)
+	log.Printf("[DISCONNECT] room=%s replayURL=%q replayErr=%v", room.ID, replayURL, replayErr)
+	if replayErr != nil {
+		log.Printf("failed to generate replay for room %s: %v", room.ID, replayErr)
+	}
+	recording := takeRecording(room)
+	room.Connections = nil
+	room.Tracks = nil
+	room.HostPeerCon = nil
+	room.Compositor = nil
+	room.HLSConns = nil
+	removeLiveRoom(room)
+
+	markLiveAsEndedByRoomID(db, room.ID, endActor(room, reason), replayURL, reason, recording != nil)
+	if recording != nil {
+		go recording.finish(db, room.Layout, replayURL != "")
+	}
+
+	if err := DeleteRoomById(db, room.ID); err != nil {
+		log.Printf("endRoom: failed to delete room %s: %v", room.ID, err)
+	} else {
+		log.Printf("endRoom: room %s deleted", room.ID)
+	}
+	return conns, subscribers
+}
+
 // HandleICECandidate godoc
 // @Summary      Handle ICE candidates
 // @Description  Add ICE candidates for WebRTC connection establishment
@@ -710,39 +793,51 @@ func HandleICECandidate(db *gorm.DB) gin.HandlerFunc {
 		log.Printf("received ICE candidate for room %s: %s", roomID, candidate.Candidate)
 		userID := utils.GetContextString(c, "userId")
 
-		mu.Lock()
-		defer mu.Unlock()
-
 		room, err := getLiveRoom(db, roomID)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
 			return
 		}
 
-		if room.PendingICEByUser == nil {
-			room.PendingICEByUser = make(map[string][]webrtc.ICECandidateInit)
+		buffered, err := addRemoteCandidate(room, userID, candidate)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add ICE candidate"})
+			return
 		}
-
-		for _, pc := range room.Connections {
-			if pc.UserID != userID {
-				continue
-			}
-			if err := pc.PeerCon.AddICECandidate(candidate); err != nil {
-				log.Printf("failed to add ICE candidate for user %s: %v", userID, err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add ICE candidate"})
-				return
-			}
-			c.JSON(http.StatusOK, gin.H{"status": "candidate added"})
+		if buffered {
+			c.JSON(http.StatusOK, gin.H{"status": "candidate buffered"})
 			return
 		}
+		c.JSON(http.StatusOK, gin.H{"status": "candidate added"})
+	}
+}
 
+// addRemoteCandidate adds a client ICE candidate to the user's PeerConnection,
+// or buffers it until the PeerConnection exists. Shared by the REST endpoint
+// and the WebSocket signaling channel.
+func addRemoteCandidate(room *Room, userID string, candidate webrtc.ICECandidateInit) (bool, error) {
+	room.mu.Lock()
+	pc := getPeerConnectionByUser(room, userID)
+	if pc == nil {
+		if room.PendingICEByUser == nil {
+			room.PendingICEByUser = make(map[string][]webrtc.ICECandidateInit)
+		}
 		room.PendingICEByUser[userID] = append(room.PendingICEByUser[userID], candidate)
 		log.Printf("no peer connection yet for user %s, buffered candidate (pending: %d)", userID, len(room.PendingICEByUser[userID]))
-		c.JSON(http.StatusOK, gin.H{"status": "candidate buffered"})
+		room.mu.Unlock()
+		return true, nil
 	}
+	room.mu.Unlock()
+
+	if err := pc.AddICECandidate(candidate); err != nil {
+		log.Printf("failed to add ICE candidate for user %s: %v", userID, err)
+		return false, err
+	}
+	return false, nil
 }
 
 // PollRenegotiationOffer returns a pending server offer for the caller, if any.
+// Compatibility mode for clients without WebSocket signaling.
 func PollRenegotiationOffer(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		roomID := c.Query("roomId")
@@ -753,15 +848,14 @@ func PollRenegotiationOffer(db *gorm.DB) gin.HandlerFunc {
 
 		userID := utils.GetContextString(c, "userId")
 
-		mu.Lock()
 		room, err := getLiveRoom(db, roomID)
 		if err != nil {
-			mu.Unlock()
 			c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
 			return
 		}
+		room.mu.Lock()
 		offer, ok := room.PendingOfferByUser[userID]
-		mu.Unlock()
+		room.mu.Unlock()
 
 		if !ok {
 			c.Status(http.StatusNoContent)
@@ -775,7 +869,69 @@ func PollRenegotiationOffer(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+var errPeerNotFound = errors.New("peer connection not found")
+
+// applyRenegotiationAnswer applies a client answer to the server offer pending
+// for userID and sends the next offer if more changes queued up meanwhile.
+// Shared by the REST endpoint and the WebSocket signaling channel.
+func applyRenegotiationAnswer(room *Room, userID string, answer webrtc.SessionDescription) error {
+	room.mu.Lock()
+	pc := getPeerConnectionByUser(room, userID)
+	room.mu.Unlock()
+	if pc == nil {
+		return errPeerNotFound
+	}
+
+	if err := pc.SetRemoteDescription(answer); err != nil {
+		log.Printf("SetRemoteDescription (renegotiation answer) failed for user %s: %v", userID, err)
+		return err
+	}
+
+	room.mu.Lock()
+	if room.PendingOfferByUser != nil {
+		delete(room.PendingOfferByUser, userID)
+	}
+	needsAnotherOffer := room.NeedsRenegotiationByUser != nil && room.NeedsRenegotiationByUser[userID]
+	if needsAnotherOffer {
+		room.NeedsRenegotiationByUser[userID] = false
+	}
+	room.mu.Unlock()
+
+	if needsAnotherOffer {
+		go requestRenegotiationOffer(room, userID, pc)
+	}
+	return nil
+}
+
+// rollbackRenegotiationOffer discards the server offer the client rejected
+// (e.g. on glare) and schedules a fresh one once signaling is stable again.
+func rollbackRenegotiationOffer(room *Room, userID string) error {
+	room.mu.Lock()
+	pc := getPeerConnectionByUser(room, userID)
+	if room.PendingOfferByUser != nil {
+		delete(room.PendingOfferByUser, userID)
+	}
+	room.mu.Unlock()
+	if pc == nil {
+		return errPeerNotFound
+	}
+
+	if pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		if err := pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			log.Printf("rollback failed for user %s: %v", userID, err)
+			return err
+		}
+	}
+
+	// The rolled back offer still carried pending track changes.
+	time.AfterFunc(renegotiationRetryDelay, func() {
+		requestRenegotiationOffer(room, userID, pc)
+	})
+	return nil
+}
+
 // HandleRenegotiationAnswer applies a client answer for a pending server offer.
+// Compatibility mode for clients without WebSocket signaling.
 func HandleRenegotiationAnswer(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		roomID := c.Query("roomId")
@@ -796,45 +952,21 @@ func HandleRenegotiationAnswer(db *gorm.DB) gin.HandlerFunc {
 
 		userID := utils.GetContextString(c, "userId")
 
-		mu.Lock()
 		room, err := getLiveRoom(db, roomID)
 		if err != nil {
-			mu.Unlock()
 			c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
 			return
 		}
 
-		pc := getPeerConnectionByUser(room, userID)
-		if pc == nil {
-			mu.Unlock()
-			c.JSON(http.StatusNotFound, gin.H{"error": "peer connection not found"})
-			return
-		}
-
-		mu.Unlock()
-
-		if err := pc.SetRemoteDescription(answer); err != nil {
+		if err := applyRenegotiationAnswer(room, userID, answer); err != nil {
+			if errors.Is(err, errPeerNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "peer connection not found"})
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set remote description"})
 			return
 		}
 
-		mu.Lock()
-		if room.PendingOfferByUser != nil {
-			delete(room.PendingOfferByUser, userID)
-		}
-		mu.Unlock()
-
-		mu.Lock()
-		needsAnotherOffer := room.NeedsRenegotiationByUser != nil && room.NeedsRenegotiationByUser[userID]
-		if needsAnotherOffer {
-			room.NeedsRenegotiationByUser[userID] = false
-		}
-		mu.Unlock()
-
-		if needsAnotherOffer {
-			go requestRenegotiationOffer(room, userID, pc)
-		}
-
 		c.JSON(http.StatusOK, gin.H{"status": "answer applied"})
 	}
 }
@@ -843,10 +975,27 @@ func HandleRenegotiationAnswer(db *gorm.DB) gin.HandlerFunc {
 // HandleWebRTC helpers
 // ---------------------------------------------------------------------------
 
-// ensureParticipant checks if the user is already a participant; if not it
-// auto-adds them when there is room. Returns an HTTP error and false when the
-// caller should abort.
+// canPublish reports whether userID may send media to the room: the host
+// and the users whose co-host invitation was accepted.
+// Must be called with the room lock held.
+func canPublish(room *Room, userID string) bool {
+	return userID != "" && (userID == room.Host || room.CoHosts[userID])
+}
+
+// ensureParticipant checks that the user is the host or an accepted co-host
+// and adds them to the participants when there is room. Returns an HTTP
+// error and false when the caller should abort.
 func ensureParticipant(c *gin.Context, db *gorm.DB, room *Room, userID string) bool {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if room.closed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+		return false
+	}
+	if !canPublish(room, userID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the host and accepted co-hosts can join this room"})
+		return false
+	}
 	for _, p := range room.Participants {
 		if p == userID {
 			return true
@@ -858,6 +1007,7 @@ func ensureParticipant(c *gin.Context, db *gorm.DB, room *Room, userID string) b
 	}
 	room.Participants = append(room.Participants, userID)
 	if err := SaveRoom(db, room); err != nil {
+		room.Participants = room.Participants[:len(room.Participants)-1]
 		log.Printf("failed to save participant: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to join room"})
 		return false
@@ -878,10 +1028,40 @@ func newPeerConnection(stunURL, webrtcIP string) (*webrtc.PeerConnection, error)
 	if err := me.RegisterDefaultCodecs(); err != nil {
 		return nil, err
 	}
+	// MID and RID header extensions let pion demultiplex simulcast layers.
+	for _, uri := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI, sdp.SDESRepairRTPStreamIDURI} {
+		if err := me.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := registerRED(me); err != nil {
+		return nil, err
+	}
+
+	// NACK: publishers' losses are requested again from them, and viewers'
+	// NACKs are served from the packet cache the responder keeps per
+	// outgoing stream (as RTX when negotiated). TWCC feedback lets the
+	// publishers' congestion control adapt to the uplink. The stats
+	// interceptor fills the RTP stream stats read by the sampler.
+	ir := &interceptor.Registry{}
+	if err := webrtc.ConfigureNackWithOptions(me, ir, nil, nack.ResponderSize(nackCacheSize)); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureRTCPReports(ir); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureTWCCSender(me, ir); err != nil {
+		return nil, err
+	}
+	if err := webrtc.ConfigureStatsInterceptor(ir); err != nil {
+		return nil, err
+	}
 
 	api := webrtc.NewAPI(
 		webrtc.WithSettingEngine(se),
 		webrtc.WithMediaEngine(me),
+		webrtc.WithInterceptorRegistry(ir),
 	)
 	return api.NewPeerConnection(webrtc.Configuration{
 		ICEServers: []webrtc.ICEServer{{URLs: []string{stunURL}}},
@@ -890,12 +1070,16 @@ func newPeerConnection(stunURL, webrtcIP string) (*webrtc.PeerConnection, error)
 
 // registerPeer adds the PeerConnection to the room, marks the host, and
 // returns any buffered ICE candidates for this user that should be flushed later.
-// Must be called with mu held.
-func registerPeer(pc *webrtc.PeerConnection, room *Room, userID string) []webrtc.ICECandidateInit {
+// Must be called with the room lock held.
+func registerPeer(pc *webrtc.PeerConnection, room *Room, userID string, trickle bool) []webrtc.ICECandidateInit {
+	if userID == room.Host {
+		replaceAwaitedHost(room)
+	}
 	if room.HostPeerCon == nil && userID == room.Host {
 		room.HostPeerCon = pc
 	}
-	room.Connections = append(room.Connections, PeerConnection{UserID: userID, PeerCon: pc})
+	room.Connections = append(room.Connections, PeerConnection{UserID: userID, PeerCon: pc, Trickle: trickle})
+	room.lastActivity = time.Now()
 
 	if room.PendingICEByUser == nil {
 		return nil
@@ -923,8 +1107,27 @@ func buildCodecInfo(codec webrtc.RTPCodecParameters) *hls.CodecInfo {
 	return ci
 }
 
-func attachExistingTracks(pc *webrtc.PeerConnection, room *Room) {
+// attachExistingTracks sends pc the room's tracks it does not receive yet
+// and returns how many it added.
+// Must be called with the room lock held.
+func attachExistingTracks(pc *webrtc.PeerConnection, room *Room) int {
+	added := 0
+	userID := ""
+	for _, conn := range room.Connections {
+		if conn.PeerCon == pc {
+			userID = conn.UserID
+			break
+		}
+	}
 	for _, ti := range room.Tracks {
+		// The user's own tracks left by their previous connection are bound
+		// to what this one publishes, not sent back to them.
+		if ti.SourcePC == nil && ti.SourceUserID == userID {
+			continue
+		}
+		if _, ok := ti.SendersByPeer[pc]; ok || !receivesTrack(room, pc, ti) {
+			continue
+		}
 		if ti.LocalTracks == nil {
 			ti.LocalTracks = make(map[*webrtc.PeerConnection]*webrtc.TrackLocalStaticRTP)
 		}
@@ -934,8 +1137,8 @@ func attachExistingTracks(pc *webrtc.PeerConnection, room *Room) {
 		if ti.SendersByPeer == nil {
 			ti.SendersByPeer = make(map[*webrtc.PeerConnection]*webrtc.RTPSender)
 		}
-		cap, pt := resolveCodec(pc, ti.Track.Codec().MimeType, ti.Track.Codec().RTPCodecCapability)
-		lt, err := webrtc.NewTrackLocalStaticRTP(cap, ti.Track.ID()+"-"+uuid.New().String(), ti.Track.StreamID())
+		cap, pt := resolveTrackCodec(pc, ti)
+		lt, err := webrtc.NewTrackLocalStaticRTP(cap, localTrackID(ti), ti.Track.StreamID())
 		if err != nil {
 			log.Printf("attachExistingTracks: create local track: %v", err)
 			continue
@@ -945,11 +1148,18 @@ func attachExistingTracks(pc *webrtc.PeerConnection, room *Room) {
 			log.Printf("attachExistingTracks: add track: %v", err)
 			continue
 		}
-		startRTCPDrain(sender)
 		ti.LocalTracks[pc] = lt
 		ti.PeerPT[pc] = pt
 		ti.SendersByPeer[pc] = sender
 		ti.Senders = append(ti.Senders, sender)
+		added++
+
+		if ti.Layers != nil {
+			attachSimulcastSender(room, ti, pc, sender)
+			requestLayerKeyframe(ti.SourcePC, ti.sortedLayers(), ti.PeerLayer[pc].Target())
+			continue
+		}
+		startSenderRTCPReader(room, sender, pc)
 
 		// Request a keyframe immediately so this new peer can decode the video
 		if ti.Track.Kind() == webrtc.RTPCodecTypeVideo && ti.SourcePC != nil {
@@ -958,60 +1168,31 @@ func attachExistingTracks(pc *webrtc.PeerConnection, room *Room) {
 			}})
 		}
 	}
+	return added
 }
 
-func startRTCPDrain(sender *webrtc.RTPSender) {
-	if sender == nil {
-		return
-	}
-	go func() {
-		rtcpBuf := make([]byte, 1500)
-		for {
-			if _, _, err := sender.Read(rtcpBuf); err != nil {
-				return
-			}
-		}
-	}()
-}
-
-// hlsState holds per-handler state for lazy HLS initialisation inside OnTrack.
-type hlsState struct {
-	audio      *hls.CodecInfo
-	video      *hls.CodecInfo
-	trackCount int
+// renegotiationTarget is a peer to send a new offer to: a participant or,
+// when sessionID is set, a WHEP subscriber.
+type renegotiationTarget struct {
+	userID    string
+	pc        *webrtc.PeerConnection
+	sessionID string
 }
 
-// tryStartHLS starts the HLS pipeline once both audio and video tracks have
-// been received. Must be called with mu held.
-func (h *hlsState) tryStartHLS(room *Room, roomID string) {
-	if h.trackCount < 2 || room.HLSWriter != nil || hls.IsRunning(roomID) {
-		return
-	}
-	if h.video == nil {
-		return
-	}
-	if !strings.EqualFold(h.video.CodecName, "h264") {
-		log.Printf("[HLS] skip start for room %s: codec %s (WebRTC relay stays prioritized)", roomID, h.video.CodecName)
-		return
-	}
-	// log.Println("starting HLS stream for room", roomID)
-	log.Println("starting HLS stream for room", roomID)
-	writer, _, err := hls.Start(roomID, h.audio, h.video)
-	if err != nil {
-		log.Printf("failed to start HLS: %v", err)
+// renegotiate sends the target a new offer, over the signaling channel of
+// participants or the offer resource of WHEP sessions.
+func (t renegotiationTarget) renegotiate(room *Room) {
+	if t.sessionID != "" {
+		requestSubscriberOffer(room, t.sessionID)
 		return
 	}
-	room.HLSWriter = writer
+	requestRenegotiationOffer(room, t.userID, t.pc)
 }
 
 // broadcastTrackToPeers creates per-peer LocalTracks for a newly received
-// source track and registers them in the TrackInfo.
-// Must be called with mu held.
-type renegotiationTarget struct {
-	userID string
-	pc     *webrtc.PeerConnection
-}
-
+// source track and registers them in the TrackInfo. WHEP subscribers get
+// it too when it is one they watch.
+// Must be called with the room lock held.
 func broadcastTrackToPeers(ti *TrackInfo, room *Room, sourcePc *webrtc.PeerConnection) []renegotiationTarget {
 	targetByUser := make(map[string]*webrtc.PeerConnection)
 
@@ -1021,13 +1202,13 @@ func broadcastTrackToPeers(ti *TrackInfo, room *Room, sourcePc *webrtc.PeerConne
 	}
 
 	for _, other := range room.Connections {
-		if other.PeerCon == sourcePc {
+		if other.PeerCon == sourcePc || other.PublishOnly {
 			continue
 		}
 
-		cap, pt := resolveCodec(other.PeerCon, ti.Track.Codec().MimeType, ti.Track.Codec().RTPCodecCapability)
+		cap, pt := resolveTrackCodec(other.PeerCon, ti)
 
-		lt, err := webrtc.NewTrackLocalStaticRTP(cap, ti.Track.ID()+"-"+uuid.NewString(), ti.Track.StreamID())
+		lt, err := webrtc.NewTrackLocalStaticRTP(cap, localTrackID(ti), ti.Track.StreamID())
 		if err != nil {
 			log.Printf("broadcastTrackToPeers: create track: %v", err)
 			continue
@@ -1038,7 +1219,11 @@ func broadcastTrackToPeers(ti *TrackInfo, room *Room, sourcePc *webrtc.PeerConne
 			log.Printf("broadcastTrackToPeers: add track to peer: %v", err)
 			continue
 		}
-		startRTCPDrain(sender)
+		if ti.Layers != nil {
+			attachSimulcastSender(room, ti, other.PeerCon, sender)
+		} else {
+			startSenderRTCPReader(room, sender, other.PeerCon)
+		}
 
 		if ti.Track.Kind() == webrtc.RTPCodecTypeVideo {
 			requestKeyframeBurst(sourcePc, uint32(ti.Track.SSRC()))
@@ -1055,10 +1240,30 @@ func broadcastTrackToPeers(ti *TrackInfo, room *Room, sourcePc *webrtc.PeerConne
 	for userID, pc := range targetByUser {
 		targets = append(targets, renegotiationTarget{userID: userID, pc: pc})
 	}
+	targets = append(targets, subscriberTargets(room, nil)...)
 
 	return targets
 }
 
+// removeTrackFromPeers removes the senders of ti from every peer receiving
+// it and records those peers in touched.
+// Must be called with the room lock held.
+func removeTrackFromPeers(ti *TrackInfo, touched map[*webrtc.PeerConnection]bool) {
+	if len(ti.SendersByPeer) == 0 {
+		return
+	}
+	log.Printf("Removing track from %d receiving peers", len(ti.SendersByPeer))
+	for otherPc, sender := range ti.SendersByPeer {
+		if otherPc == nil || sender == nil {
+			continue
+		}
+		touched[otherPc] = true
+		if err := otherPc.RemoveTrack(sender); err != nil {
+			log.Printf("RemoveTrack failed: %v", err)
+		}
+	}
+}
+
 func requestKeyframeBurst(pc *webrtc.PeerConnection, ssrc uint32) {
 	if pc == nil || ssrc == 0 {
 		return
@@ -1076,10 +1281,28 @@ func requestKeyframeBurst(pc *webrtc.PeerConnection, ssrc uint32) {
 	}()
 }
 
-// peerTrack pairs a LocalTrack with the payload type to stamp on outgoing packets.
+// peerTrack pairs a LocalTrack with the payload type to stamp on outgoing packets
+// and, for simulcast sources, the peer's layer selector.
 type peerTrack struct {
-	lt *webrtc.TrackLocalStaticRTP
-	pt uint8
+	lt  *webrtc.TrackLocalStaticRTP
+	pt  uint8
+	sel *layerSelector
+	// rebase continues the sequence of a sender switched to this track.
+	rebase *sourceRebase
+	// unwrapRED forwards only the primary encoding of a RED source to a
+	// peer that receives plain Opus.
+	unwrapRED bool
+}
+
+// findSimulcastTrack returns the TrackInfo already created for another layer
+// of the same simulcast source track, if any. Must be called with the room lock held.
+func findSimulcastTrack(room *Room, pc *webrtc.PeerConnection, track *webrtc.TrackRemote) *TrackInfo {
+	for _, ti := range room.Tracks {
+		if ti.SourcePC == pc && ti.Layers != nil && ti.Track.ID() == track.ID() {
+			return ti
+		}
+	}
+	return nil
 }
 
 // isH264Keyframe returns true if the H264 RTP payload starts an IDR (keyframe) NAL.
@@ -1357,13 +1580,13 @@ func isH264SliceData(payload []byte) bool {
 }
 
 // startTrackRelay reads RTP packets from the source track and fans them out to
-// every subscribed peer (rewriting the PT) and, when isHLSSource is true,
-// to FFmpeg for HLS. Only the host's relay goroutine should set isHLSSource;
-// all other goroutines must leave it false so they never touch the shared HLSWriter.
-func startTrackRelay(track *webrtc.TrackRemote, ti *TrackInfo, room *Room, pc *webrtc.PeerConnection, isHLSSource bool) {
+// every subscribed peer (rewriting the PT) and, when the track is part of
+// the room's HLS composite, to its FFmpeg input.
+func startTrackRelay(track *webrtc.TrackRemote, ti *TrackInfo, room *Room, pc *webrtc.PeerConnection) {
 	buf := make([]byte, 4096)
-	var cachedWriter *hls.HLSWriter
+	var hlsConn net.Conn
 	var cachedPeers []peerTrack
+	var recorder *trackRecorder
 	pktCount := 0
 	isAudio := track.Kind() == webrtc.RTPCodecTypeAudio
 	hlsGotKeyframe := false
@@ -1374,6 +1597,12 @@ func startTrackRelay(track *webrtc.TrackRemote, ti *TrackInfo, room *Room, pc *w
 	hlsReceivedPPS := false              // Track if we've received and forwarded PPS
 	hlsParamsGateOpenTime := time.Time{} // Time when we started waiting for params
 	var ffmpegVideoSeqNum uint16 = 0
+	rid := track.RID()
+	var layer *SimulcastLayer
+	layerBytes := 0
+	layerWindowStart := time.Now()
+	feedsHLS := false
+	red := isRED(track.Codec())
 
 	// Request a keyframe immediately so that both HLS and all WebRTC
 	// receiving peers get a clean start for the video feed.
@@ -1382,7 +1611,7 @@ func startTrackRelay(track *webrtc.TrackRemote, ti *TrackInfo, room *Room, pc *w
 	}
 
 	for {
-		n, _, err := track.Read(buf)
+		n, attributes, err := track.Read(buf)
 		if err != nil {
 			log.Println("track ended:", err)
 			return
@@ -1396,53 +1625,135 @@ func startTrackRelay(track *webrtc.TrackRemote, ti *TrackInfo, room *Room, pc *w
 		origPT := pkt.PayloadType
 		pktCount++
 
-		// Ignore retransmission/non-primary video packets for peer fanout.
-		// Reinjecting RTX payload as media causes decoder corruption on receivers
-		// (symptom: briefly unmuted, then permanently muted/black).
+		if rid != "" && layer != nil {
+			layerBytes += n
+			if elapsed := time.Since(layerWindowStart); elapsed >= time.Second {
+				layer.bitrate.Store(uint64(float64(layerBytes*8) / elapsed.Seconds()))
+				layerBytes = 0
+				layerWindowStart = time.Now()
+			}
+		}
+
+		// Packets the NACK generator got back over RTX are handed over
+		// unwrapped, with the media PT and sequence number, and repair the
+		// viewers' streams too. Anything else with another PT is RTX pion
+		// could not unwrap: reinjecting it as media corrupts the receivers'
+		// decoders (symptom: briefly unmuted, then permanently muted/black).
 		if !isAudio && origPT != uint8(track.Codec().PayloadType) {
 			continue
 		}
+		repaired := attributes != nil && attributes.Get(webrtc.AttributeRtxSequenceNumber) != nil
 
 		// Refresh the peer snapshot every ~100 packets to reduce lock contention.
 		// Also refresh immediately on the first packet.
 		if pktCount%100 == 1 {
-			mu.Lock()
+			room.mu.Lock()
 			cachedPeers = make([]peerTrack, 0, len(ti.LocalTracks))
 			for pc, lt := range ti.LocalTracks {
 				pt := ti.PeerPT[pc]
 				if pt == 0 {
 					pt = origPT
 				}
-				cachedPeers = append(cachedPeers, peerTrack{lt, pt})
+				unwrap := red && !strings.EqualFold(lt.Codec().MimeType, mimeTypeRED)
+				cachedPeers = append(cachedPeers, peerTrack{lt, pt, ti.PeerLayer[pc], ti.peerRebase[pc], unwrap})
+			}
+			hlsConn = room.HLSConns[ti]
+			feedsHLS = hlsConn != nil
+			recorder = ti.recorder
+			if recorder != nil && recorder.sel != nil {
+				recorder.sel.follow(ti.HLSLayer)
 			}
-			cachedWriter = room.HLSWriter
-			mu.Unlock()
+			room.lastActivity = time.Now()
+			if rid != "" {
+				layer = ti.Layers[rid]
+				// Only the highest simulcast layer feeds FFmpeg.
+				feedsHLS = feedsHLS && ti.HLSLayer == rid
+			}
+			room.mu.Unlock()
+		}
+
+		// Muted or disabled by the host: nothing reaches the peers or HLS.
+		if ti.paused.Load() {
+			continue
+		}
+		if rid == "" {
+			ti.rebase.apply(&pkt, track.Codec().ClockRate)
+		}
+
+		keyframe := false
+		if rid != "" && !isAudio {
+			keyframe = isVideoKeyframe(track.Codec().MimeType, pkt.Payload)
+		}
+
+		if recorder != nil {
+			recorder.write(rid, &pkt, keyframe)
+		}
+
+		var primaryPT uint8
+		var primary []byte
+		hasPrimary := false
+		if red {
+			primaryPT, primary, hasPrimary = redPrimary(pkt.Payload)
 		}
 
 		// Fan-out with per-peer PT rewriting. Different peers may negotiate
 		// different payload types for the same codec (e.g. VP8 PT=96 vs PT=98).
+		// Simulcast peers only receive their selected layer, with SSRC and
+		// sequence numbers rewritten into a single continuous stream.
 		for _, p := range cachedPeers {
 			pktCopy := pkt
+			if p.sel != nil && !p.sel.rewrite(rid, &pktCopy, keyframe) {
+				continue
+			}
+			if p.rebase != nil {
+				p.rebase.apply(&pktCopy, track.Codec().ClockRate)
+			}
+			if p.unwrapRED {
+				if !hasPrimary {
+					continue
+				}
+				pktCopy.Payload = primary
+			}
 			pktCopy.PayloadType = p.pt
 			if err := p.lt.WriteRTP(&pktCopy); err != nil {
 				// peer track may have been removed — will be caught on next refresh
 			}
 		}
 
-		// Feed FFmpeg for HLS — only from the designated host relay goroutine.
-		if !isHLSSource || cachedWriter == nil {
+		// Feed this track's input of the HLS composite.
+		if !feedsHLS {
 			continue
 		}
 
-		if isAudio && cachedWriter.AudioConn != nil {
-			_, _ = cachedWriter.AudioConn.Write(buf[:n])
-		} else if !isAudio && cachedWriter.VideoConn != nil {
-			// Skip RTX retransmission packets (different PT, 2-byte OSN header).
-			if origPT != uint8(track.Codec().PayloadType) {
+		if isAudio {
+			if !red {
+				_, _ = hlsConn.Write(buf[:n])
+				continue
+			}
+			// FFmpeg does not read RED: it gets the primary Opus encoding.
+			if !hasPrimary {
+				continue
+			}
+			pkt.PayloadType = primaryPT
+			pkt.Payload = primary
+			if data, err := pkt.Marshal(); err == nil {
+				_, _ = hlsConn.Write(data)
+			}
+		} else {
+			// FFmpeg's sequence numbers are rewritten in arrival order, where
+			// a late retransmission would be out of place.
+			if repaired {
 				continue
 			}
 			mimeType := strings.ToLower(track.Codec().MimeType)
 
+			// The ladder has no rendition above the source picture.
+			if h := videoHeight(mimeType, pkt.Payload); h > int(ti.sourceHeight.Load()) {
+				ti.sourceHeight.Store(int32(h))
+				log.Printf("[HLS] room %s: video of %s is %dp", room.ID, ti.SourceUserID, h)
+				go refreshComposite(room)
+			}
+
 			// Request periodic keyframes to recover faster after packet loss.
 			if pktCount-pliLastPkt >= 150 {
 				pliLastPkt = pktCount
@@ -1539,13 +1850,9 @@ func startTrackRelay(track *webrtc.TrackRemote, ti *TrackInfo, room *Room, pc *w
 					continue
 				}
 			} else {
-				// For VP8 or other codecs, simpler logic: just wait for first keyframe
-				var isKF bool
-				if strings.Contains(mimeType, "vp8") {
-					isKF = isVP8Keyframe(pkt.Payload)
-				} else {
-					isKF = true // default
-				}
+				// VP8, VP9 and AV1 carry their parameters in the keyframe:
+				// just hold video until the first one.
+				isKF := isVideoKeyframe(mimeType, pkt.Payload)
 
 				if isKF && hlsKeyframeTime.IsZero() {
 					hlsKeyframeTime = time.Now()
@@ -1563,7 +1870,7 @@ func startTrackRelay(track *webrtc.TrackRemote, ti *TrackInfo, room *Room, pc *w
 			if strings.Contains(mimeType, "h264") && len(pkt.Payload) > 0 {
 				nalType := pkt.Payload[0] & 0x1f
 				if nalType == 24 { // STAP-A - deserialize into separate RTP packets
-					if extractAndSendAllSTAPAUnits(pkt.Payload, cachedWriter.VideoConn, &pkt, &ffmpegVideoSeqNum) {
+					if extractAndSendAllSTAPAUnits(pkt.Payload, hlsConn, &pkt, &ffmpegVideoSeqNum) {
 						log.Printf("[HLS] Deserialized STAP-A packet (skipping aggregated form)")
 						// Successfully extracted and sent all units - skip the original STAP-A
 						continue
@@ -1576,7 +1883,7 @@ func startTrackRelay(track *webrtc.TrackRemote, ti *TrackInfo, room *Room, pc *w
 			ffmpegVideoSeqNum++
 			data, err := pkt.Marshal()
 			if err == nil {
-				_, _ = cachedWriter.VideoConn.Write(data)
+				_, _ = hlsConn.Write(data)
 			}
 		}
 	}
@@ -1585,7 +1892,7 @@ func startTrackRelay(track *webrtc.TrackRemote, ti *TrackInfo, room *Room, pc *w
 // onPeerDisconnected cleans up room state when a peer leaves.
 // It is safe to call multiple times for the same PC (idempotent).
 func onPeerDisconnected(db *gorm.DB, room *Room, roomID string, pc *webrtc.PeerConnection) {
-	mu.Lock()
+	room.mu.Lock()
 
 	// Guard: if this PC is not in the connection list, it was already cleaned up.
 	found := false
@@ -1600,12 +1907,15 @@ func onPeerDisconnected(db *gorm.DB, room *Room, roomID string, pc *webrtc.PeerC
 		}
 	}
 	if !found {
-		mu.Unlock()
+		room.mu.Unlock()
 		return // already cleaned up by a previous state-change event
 	}
 
 	log.Printf("peer disconnected from room %s", roomID)
 	room.Connections = updated
+	if room.events != nil {
+		room.events.unsubscribe(pc)
+	}
 	if disconnectedUserID != "" {
 		// Remove participant from the participants list
 		updatedParticipants := make(pq.StringArray, 0, len(room.Participants))
@@ -1624,6 +1934,8 @@ func onPeerDisconnected(db *gorm.DB, room *Room, roomID string, pc *webrtc.PeerC
 		if room.PendingICEByUser != nil {
 			delete(room.PendingICEByUser, disconnectedUserID)
 		}
+		delete(room.LocalICEByUser, disconnectedUserID)
+		delete(room.LocalICEDoneByUser, disconnectedUserID)
 		if room.PendingOfferByUser != nil {
 			delete(room.PendingOfferByUser, disconnectedUserID)
 		}
@@ -1639,27 +1951,20 @@ func onPeerDisconnected(db *gorm.DB, room *Room, roomID string, pc *webrtc.PeerC
 	if room.HostPeerCon == pc {
 		room.HostPeerCon = nil
 	}
+	for sessionID, sessionPC := range room.WHIPSessions {
+		if sessionPC == pc {
+			delete(room.WHIPSessions, sessionID)
+		}
+	}
 
 	// Remove per-peer LocalTracks for the disconnecting peer AND remove TrackInfos sourced from this peer
 	updatedTracks := make([]*TrackInfo, 0, len(room.Tracks))
+	lostTrack := make(map[*webrtc.PeerConnection]bool)
 	for _, ti := range room.Tracks {
 		// If this track came from the disconnecting peer, remove it completely
 		// and also remove the senders from all other peers
-		if ti.SourcePC == pc {
-			// Remove senders from all peers that were receiving this track
-			if ti.SendersByPeer != nil {
-				log.Printf("Removing track from %d receiving peers", len(ti.SendersByPeer))
-				for otherPc, sender := range ti.SendersByPeer {
-					if otherPc != nil && sender != nil {
-						err := otherPc.RemoveTrack(sender)
-						if err != nil {
-							log.Printf("RemoveTrack failed: %v", err)
-						} else {
-							log.Printf("RemoveTrack succeeded for peer")
-						}
-					}
-				}
-			}
+		if ti.SourcePC == pc || (ti.SourcePC == nil && ti.SourceUserID == disconnectedUserID) {
+			removeTrackFromPeers(ti, lostTrack)
 			log.Printf("Skipping track from disconnected peer (track will be removed from room)")
 			continue
 		}
@@ -1674,32 +1979,50 @@ func onPeerDisconnected(db *gorm.DB, room *Room, roomID string, pc *webrtc.PeerC
 		if ti.SendersByPeer != nil {
 			delete(ti.SendersByPeer, pc)
 		}
+		if ti.PeerLayer != nil {
+			delete(ti.PeerLayer, pc)
+		}
+		delete(ti.peerRebase, pc)
 		updatedTracks = append(updatedTracks, ti)
 	}
 	room.Tracks = updatedTracks
 	log.Printf("After cleanup: room has %d tracks", len(room.Tracks))
+	updateComposite(room)
 
 	// Prepare renegotiation targets for remaining peers
 	var renegotiationTargets []renegotiationTarget
 	for _, conn := range room.Connections {
-		if conn.PeerCon != nil {
+		if conn.PeerCon != nil && !conn.PublishOnly {
 			renegotiationTargets = append(renegotiationTargets, renegotiationTarget{
 				userID: conn.UserID,
 				pc:     conn.PeerCon,
 			})
 		}
 	}
+	renegotiationTargets = append(renegotiationTargets, subscriberTargets(room, lostTrack)...)
 
+	var subscribers []*webrtc.PeerConnection
 	empty := len(room.Connections) == 0
 	if empty {
+		subscribers = takeSubscribers(room)
 		replayURL, replayErr := hls.StopStream(roomID)
 		if replayErr != nil {
 			log.Printf("failed to generate replay for room %s: %v", roomID, replayErr)
 		}
+		recording := takeRecording(room)
 		room.Tracks = nil
-		removeLiveRoom(roomID)
+		room.Compositor = nil
+		room.HLSConns = nil
+		removeLiveRoom(room)
 
-		markLiveAsEndedByRoomID(db, roomID, replayURL)
+		actor := disconnectedUserID
+		if actor == "" {
+			actor = liveModule.ActorSystem
+		}
+		markLiveAsEndedByRoomID(db, roomID, actor, replayURL, liveModule.EndReasonLastPeerLeft, recording != nil)
+		if recording != nil {
+			go recording.finish(db, room.Layout, replayURL != "")
+		}
 
 		if err := DeleteRoomById(db, roomID); err != nil {
 			log.Printf("failed to delete room %s: %v", roomID, err)
@@ -1707,11 +2030,16 @@ func onPeerDisconnected(db *gorm.DB, room *Room, roomID string, pc *webrtc.PeerC
 			log.Printf("room %s deleted (last peer left)", roomID)
 		}
 	}
-	mu.Unlock()
+	room.mu.Unlock()
+
+	// WHEP subscribers cannot outlive the room
+	for _, sub := range subscribers {
+		_ = sub.Close()
+	}
 
 	// Trigger renegotiation for remaining peers outside the lock
 	for _, target := range renegotiationTargets {
-		go requestRenegotiationOffer(room, target.userID, target.pc)
+		go target.renegotiate(room)
 	}
 
 	// Close the peer connection itself (outside the lock to avoid deadlocks).
@@ -1727,18 +2055,108 @@ func onPeerDisconnected(db *gorm.DB, room *Room, roomID string, pc *webrtc.PeerC
 	log.Println("peerConnection closed and cleaned up")
 }
 
+// markLiveAsStartedByRoomID moves a scheduled live to "live" once its host
+// starts publishing. A live already on air is left as is.
+func markLiveAsStartedByRoomID(db *gorm.DB, roomID, actor string) {
+	if err := liveModule.Start(db, roomID, actor); err != nil && !errors.Is(err, liveModule.ErrInvalidTransition) {
+		log.Printf("Failed to transition live status to live for room %s: %v", roomID, err)
+	}
+}
+
+// bindPeerHandlers wires OnTrack (fan-out to the other peers, HLS composite)
+// and OnConnectionStateChange (cleanup) on a freshly registered PeerConnection.
+// It is shared by the JSON signaling path and the WHIP/WHEP endpoints.
+func bindPeerHandlers(db *gorm.DB, room *Room, roomID string, peerConnection *webrtc.PeerConnection) {
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		log.Printf("track received: %s codec=%s PT=%d (StreamID: %s)",
+			track.Kind().String(), track.Codec().MimeType,
+			track.Codec().PayloadType, track.StreamID())
+
+		// We no longer strictly ignore tracks from non-hosts. All participants can co-stream.
+
+		// Layers of one simulcast track fire OnTrack concurrently, so finding
+		// and creating their shared TrackInfo happens under a single lock.
+		// Additional layers only add a relay goroutine, not a new fan-out.
+		room.mu.Lock()
+		if room.closed {
+			room.mu.Unlock()
+			return
+		}
+		if ti := rebindHostTrack(room, peerConnection, track); ti != nil {
+			room.mu.Unlock()
+			go startTrackRelay(track, ti, room, peerConnection)
+			return
+		}
+		if track.RID() != "" {
+			if ti := findSimulcastTrack(room, peerConnection, track); ti != nil {
+				ti.Layers[track.RID()] = &SimulcastLayer{RID: track.RID(), Track: track}
+				ti.HLSLayer = ti.topLayerRID()
+				room.mu.Unlock()
+				log.Printf("[SIMULCAST] layer %s added to track %s", track.RID(), track.ID())
+				go startTrackRelay(track, ti, room, peerConnection)
+				return
+			}
+		}
+
+		// Create TrackInfo and fan out to all existing peers
+		ti := &TrackInfo{
+			LocalTracks:   make(map[*webrtc.PeerConnection]*webrtc.TrackLocalStaticRTP),
+			PeerPT:        make(map[*webrtc.PeerConnection]uint8),
+			SendersByPeer: make(map[*webrtc.PeerConnection]*webrtc.RTPSender),
+			Senders:       []*webrtc.RTPSender{},
+			Track:         track,
+			SourcePC:      peerConnection,
+		}
+		for _, conn := range room.Connections {
+			if conn.PeerCon == peerConnection {
+				ti.SourceUserID = conn.UserID
+				break
+			}
+		}
+		ti.Label = resolveTrackLabel(room, ti.SourceUserID, track)
+		ti.paused.Store(isModerated(room, ti))
+		if track.RID() != "" {
+			ti.Layers = map[string]*SimulcastLayer{
+				track.RID(): {RID: track.RID(), Track: track},
+			}
+			ti.PeerLayer = make(map[*webrtc.PeerConnection]*layerSelector)
+			ti.HLSLayer = track.RID()
+		}
+		room.Tracks = append(room.Tracks, ti)
+		recordTrack(room, ti)
+		updateComposite(room)
+		renegotiationTargets := broadcastTrackToPeers(ti, room, peerConnection)
+		room.mu.Unlock()
+
+		for _, target := range renegotiationTargets {
+			go target.renegotiate(room)
+		}
+
+		// Start the relay goroutine.
+		go startTrackRelay(track, ti, room, peerConnection)
+	})
+
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("connection state has changed: %s", state.String())
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			hostReconnected(db, room, peerConnection)
+		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+			// The host gets a grace window to come back before the live ends.
+			if !awaitHost(db, room, peerConnection, state) {
+				onPeerDisconnected(db, room, roomID, peerConnection)
+			}
+		case webrtc.PeerConnectionStateClosed:
+			onPeerDisconnected(db, room, roomID, peerConnection)
+		}
+	})
+}
+
 // applyRemoteDescription sets the remote SDP and flushes buffered ICE candidates.
 // Must be called before attachExistingTracks so that resolveCodec can read the
 // negotiated payload types from the receiver parameters.
 // Returns false (and writes the HTTP error) on failure.
 func applyRemoteDescription(c *gin.Context, pc *webrtc.PeerConnection, offer webrtc.SessionDescription, pending []webrtc.ICECandidateInit) bool {
-	// Log ICE candidates for debugging
-	pc.OnICECandidate(func(cand *webrtc.ICECandidate) {
-		if cand != nil {
-			log.Printf("ICE candidate gathered: %s", cand.String())
-		}
-	})
-
 	if err := pc.SetRemoteDescription(offer); err != nil {
 		log.Printf("SetRemoteDescription: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set remote description"})
@@ -1754,30 +2172,45 @@ func applyRemoteDescription(c *gin.Context, pc *webrtc.PeerConnection, offer web
 	return true
 }
 
-// finalizeAnswer creates the SDP answer, waits for ICE gathering and responds.
-// Must be called after attachExistingTracks (tracks must already be added before
-// CreateAnswer so they appear in the answer SDP).
-// Returns false (and writes the HTTP error) on failure.
-func finalizeAnswer(c *gin.Context, pc *webrtc.PeerConnection) bool {
+// createAnswer creates the SDP answer and sets it as the local description.
+// Unless trickle is set it waits for ICE gathering so the returned SDP embeds
+// every candidate.
+func createAnswer(pc *webrtc.PeerConnection, trickle bool) (*webrtc.SessionDescription, error) {
 	answer, err := pc.CreateAnswer(nil)
 	if err != nil {
-		log.Printf("CreateAnswer: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create answer"})
-		return false
+		return nil, fmt.Errorf("create answer: %w", err)
 	}
 
-	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	var gatherComplete <-chan struct{}
+	if !trickle {
+		gatherComplete = webrtc.GatheringCompletePromise(pc)
+	}
 	if err = pc.SetLocalDescription(answer); err != nil {
-		log.Printf("SetLocalDescription: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set local description"})
+		return nil, fmt.Errorf("set local description: %w", err)
+	}
+	if gatherComplete != nil {
+		<-gatherComplete
+	}
+
+	return pc.LocalDescription(), nil
+}
+
+// finalizeAnswer creates the SDP answer, waits for ICE gathering (unless the
+// client uses trickle ICE) and responds.
+// Must be called after attachExistingTracks (tracks must already be added before
+// CreateAnswer so they appear in the answer SDP).
+// Returns false (and writes the HTTP error) on failure.
+func finalizeAnswer(c *gin.Context, pc *webrtc.PeerConnection, trickle bool) bool {
+	final, err := createAnswer(pc, trickle)
+	if err != nil {
+		log.Printf("finalizeAnswer: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create answer"})
 		return false
 	}
-	<-gatherComplete
 
-	final := pc.LocalDescription()
 	log.Printf("Answer SDP type=%s length=%d", final.Type.String(), len(final.SDP))
 	log.Printf("Answer SDP:\n%s", final.SDP)
-	c.JSON(http.StatusOK, gin.H{"sdp": final.SDP})
+	c.JSON(http.StatusOK, gin.H{"sdp": final.SDP, "trickle": trickle})
 	return true
 }
 
@@ -1787,12 +2220,13 @@ func finalizeAnswer(c *gin.Context, pc *webrtc.PeerConnection) bool {
 
 // HandleWebRTC godoc
 // @Summary      Establish WebRTC connection
-// @Description  Create WebRTC peer connection for video streaming (participants only)
+// @Description  Create WebRTC peer connection for video streaming (participants only). The server also opens a negotiated "events" data channel (id 0) carrying reactions, cursor, timer and cue events for the room; clients create it with {negotiated: true, id: 0} before their offer. Tracks are labeled main, overhead or screen through trackLabels (keyed by track or stream ID) or by IDs starting with the label
 // @Tags         webrtc
 // @Accept       json
 // @Produce      json
 // @Param        roomId query string true "Room ID"
-// @Param        offer body object true "WebRTC Session Description (SDP offer)"
+// @Param        trickle query bool false "Return the answer before ICE gathering completes and trickle server candidates"
+// @Param        offer body WebRTCOffer true "WebRTC Session Description (SDP offer) and optional track labels"
 // @Success      200  {object}  map[string]string "sdp: SDP answer"
 // @Failure      400  {object}  map[string]string "error: Room ID is required or Invalid offer"
 // @Failure      401  {object}  map[string]string "error: Unauthorized"
@@ -1809,9 +2243,7 @@ func HandleWebRTC(db *gorm.DB, STUNServerURL string, webrtcIP string) gin.Handle
 		}
 
 		// 1. Load room
-		mu.Lock()
 		room, err := getLiveRoom(db, roomID)
-		mu.Unlock()
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
 			return
@@ -1823,25 +2255,24 @@ func HandleWebRTC(db *gorm.DB, STUNServerURL string, webrtcIP string) gin.Handle
 			return
 		}
 
-		// If the user is the host, transition the live status from "scheduled" to "live"
+		// If the user is the host, put the scheduled live on air
 		if userID == room.Host {
-			now := time.Now()
-			if err := db.Model(&liveModule.Live{}).
-				Where("room_id = ? AND status = ?", roomID, "scheduled").
-				Updates(map[string]any{
-					"status":     "live",
-					"started_at": &now,
-				}).Error; err != nil {
-				log.Printf("Failed to transition live status to live for room %s: %v", roomID, err)
-			}
+			markLiveAsStartedByRoomID(db, roomID, userID)
 		}
 
 		// 3. Parse SDP offer
-		var offer webrtc.SessionDescription
-		if err := c.ShouldBindJSON(&offer); err != nil {
+		var req WebRTCOffer
+		if err := c.ShouldBindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		for _, label := range req.TrackLabels {
+			if !validTrackLabel(label) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid track label"})
+				return
+			}
+		}
+		offer := req.SessionDescription
 
 		// 4. Create PeerConnection
 		pc, err := newPeerConnection(STUNServerURL, webrtcIP)
@@ -1853,69 +2284,30 @@ func HandleWebRTC(db *gorm.DB, STUNServerURL string, webrtcIP string) gin.Handle
 		// 5. Register peer in room and buffer pending ICE candidates.
 		//    We do NOT call attachExistingTracks here yet — resolveCodec needs
 		//    the remote description to read negotiated payload types.
-		mu.Lock()
-		pending := registerPeer(pc, room, userID)
-		mu.Unlock()
+		//    Clients opting into trickle ICE (?trickle=true) get their SDPs
+		//    without waiting for gathering; server candidates follow over
+		//    the WebSocket (or GET /api/ice).
+		trickle := c.Query("trickle") == "true"
+		room.mu.Lock()
+		if room.closed {
+			// The last peer left while we were setting up.
+			room.mu.Unlock()
+			_ = pc.Close()
+			c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+			return
+		}
+		pending := registerPeer(pc, room, userID, trickle)
+		openEventsChannel(room, userID, pc)
+		// Labels are in place before OnTrack fires for the offered tracks.
+		if setTrackLabels(room, userID, req.TrackLabels) {
+			updateComposite(room)
+		}
+		room.mu.Unlock()
 
-		// 6. OnTrack — handle incoming media from the publisher
-		hlsCtx := &hlsState{}
+		// 6-7. OnTrack fan-out / HLS and cleanup on disconnect
 		peerConnection := pc // capture for closures
-
-		peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-			log.Printf("track received: %s codec=%s PT=%d (StreamID: %s)",
-				track.Kind().String(), track.Codec().MimeType,
-				track.Codec().PayloadType, track.StreamID())
-
-			// We no longer strictly ignore tracks from non-hosts. All participants can co-stream.
-
-			// Register codec for HLS (Only register HLS for the host stream)
-			ci := buildCodecInfo(track.Codec())
-			mu.Lock()
-			isHost := room.HostPeerCon == peerConnection
-			if isHost {
-				if track.Kind() == webrtc.RTPCodecTypeAudio {
-					hlsCtx.audio = ci
-				} else {
-					hlsCtx.video = ci
-				}
-				hlsCtx.trackCount++
-				hlsCtx.tryStartHLS(room, roomID)
-			}
-			mu.Unlock()
-
-			// Create TrackInfo and fan out to all existing peers
-			ti := &TrackInfo{
-				LocalTracks:   make(map[*webrtc.PeerConnection]*webrtc.TrackLocalStaticRTP),
-				PeerPT:        make(map[*webrtc.PeerConnection]uint8),
-				SendersByPeer: make(map[*webrtc.PeerConnection]*webrtc.RTPSender),
-				Senders:       []*webrtc.RTPSender{},
-				Track:         track,
-				SourcePC:      peerConnection,
-			}
-			var renegotiationTargets []renegotiationTarget
-			mu.Lock()
-			room.Tracks = append(room.Tracks, ti)
-			renegotiationTargets = broadcastTrackToPeers(ti, room, peerConnection)
-			mu.Unlock()
-
-			for _, target := range renegotiationTargets {
-				go requestRenegotiationOffer(room, target.userID, target.pc)
-			}
-
-			// Start the relay goroutine.
-			// isHost is captured from the enclosing OnTrack closure.
-			go startTrackRelay(track, ti, room, peerConnection, isHost)
-		})
-
-		// 7. OnConnectionStateChange — cleanup on disconnect
-		peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-			log.Printf("connection state has changed: %s", state.String())
-			if state == webrtc.PeerConnectionStateDisconnected ||
-				state == webrtc.PeerConnectionStateFailed ||
-				state == webrtc.PeerConnectionStateClosed {
-				onPeerDisconnected(db, room, roomID, peerConnection)
-			}
-		})
+		bindPeerHandlers(db, room, roomID, peerConnection)
+		bindLocalCandidates(room, userID, peerConnection, trickle)
 
 		// 8a. Apply remote description first — this populates receiver codec parameters
 		//     so that resolveCodec (called in attachExistingTracks below) can read
@@ -1925,11 +2317,11 @@ func HandleWebRTC(db *gorm.DB, STUNServerURL string, webrtcIP string) gin.Handle
 		}
 
 		// 8b. NOW attach existing tracks — resolveCodec will find the right PT.
-		mu.Lock()
+		room.mu.Lock()
 		attachExistingTracks(peerConnection, room)
-		mu.Unlock()
+		room.mu.Unlock()
 
 		// 8c. Build and send the SDP answer (includes the newly added tracks).
-		finalizeAnswer(c, peerConnection)
+		finalizeAnswer(c, peerConnection, trickle)
 	}
 }
@@ -0,0 +1,746 @@
+package room
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Foodstream-io/etchebest/internal/hls"
+	liveModule "github.com/Foodstream-io/etchebest/internal/modules/live"
+	userModule "github.com/Foodstream-io/etchebest/internal/modules/user"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB returns a gorm handle that builds statements without executing
+// them, so room state can be exercised without a running Postgres.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{
+		DSN: "host=127.0.0.1 port=1 user=test dbname=test sslmode=disable",
+	}), &gorm.Config{
+		DryRun:                 true,
+		DisableAutomaticPing:   true,
+		SkipDefaultTransaction: true,
+		Logger:                 logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("open dry-run db: %v", err)
+	}
+	return db
+}
+
+func newTestRoom(t *testing.T, id string, maxParticipants int, coHosts ...string) *Room {
+	t.Helper()
+	r := &Room{ID: id, Name: id, Host: "host", MaxParticipants: maxParticipants, CoHosts: make(map[string]bool)}
+	for _, userID := range coHosts {
+		r.CoHosts[userID] = true
+	}
+	registerLiveRoom(r)
+	t.Cleanup(func() {
+		roomsMu.Lock()
+		delete(liveRooms, id)
+		roomsMu.Unlock()
+	})
+	return r
+}
+
+func newTestRouter(db *gorm.DB) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("userId", c.GetHeader("X-User"))
+		c.Next()
+	})
+	r.POST("/api/webrtc", HandleWebRTC(db, "stun:127.0.0.1:3478", "127.0.0.1"))
+	r.POST("/api/rooms/:roomId/participants/:userId/kick", KickParticipant(db))
+	r.GET("/api/rooms/:roomId/stats", GetRoomStats())
+	return r
+}
+
+// join negotiates a client PeerConnection for userID through
+// HandleWebRTC (trickle mode, so no wait on candidate gathering).
+func join(router *gin.Engine, roomID, userID string) (*webrtc.PeerConnection, int, error) {
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if _, err := client.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendrecv,
+		}); err != nil {
+			return client, 0, err
+		}
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		return client, 0, err
+	}
+	if err := client.SetLocalDescription(offer); err != nil {
+		return client, 0, err
+	}
+
+	body, _ := json.Marshal(offer)
+	req := httptest.NewRequest(http.MethodPost, "/api/webrtc?roomId="+roomID+"&trickle=true", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-User", userID)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		return client, w.Code, nil
+	}
+
+	var resp struct {
+		SDP string `json:"sdp"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		return client, w.Code, err
+	}
+	answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: resp.SDP}
+	return client, w.Code, client.SetRemoteDescription(answer)
+}
+
+func serverPeer(room *Room, userID string) *webrtc.PeerConnection {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	return getPeerConnectionByUser(room, userID)
+}
+
+// answerPendingOffer plays the client side of one polling renegotiation round.
+func answerPendingOffer(room *Room, userID string, client *webrtc.PeerConnection) error {
+	room.mu.Lock()
+	offer, ok := room.PendingOfferByUser[userID]
+	room.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := client.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	answer, err := client.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	if err := client.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	return applyRenegotiationAnswer(room, userID, answer)
+}
+
+func TestConcurrentJoinsRenegotiationsAndDisconnects(t *testing.T) {
+	db := testDB(t)
+	router := newTestRouter(db)
+	const peers = 8
+	coHosts := make([]string, peers)
+	for i := range peers {
+		coHosts[i] = fmt.Sprintf("user-%d", i)
+	}
+	room := newTestRoom(t, "room-concurrency", 16, coHosts...)
+	clients := make([]*webrtc.PeerConnection, peers)
+	var wg sync.WaitGroup
+	for i := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			userID := fmt.Sprintf("user-%d", i)
+			client, code, err := join(router, room.ID, userID)
+			clients[i] = client
+			if err != nil || code != http.StatusOK {
+				t.Errorf("join %s: code=%d err=%v", userID, code, err)
+				return
+			}
+			// Renegotiate while the other peers are still joining.
+			requestRenegotiationOffer(room, userID, serverPeer(room, userID))
+		}()
+	}
+	wg.Wait()
+	t.Cleanup(func() {
+		for _, c := range clients {
+			if c != nil {
+				_ = c.Close()
+			}
+		}
+	})
+
+	room.mu.Lock()
+	if got := len(room.Connections); got != peers {
+		t.Fatalf("connections = %d, want %d", got, peers)
+	}
+	if got := len(room.Participants); got != peers {
+		t.Fatalf("participants = %d, want %d", got, peers)
+	}
+	room.mu.Unlock()
+
+	// Answer the queued offers while new ones are requested concurrently.
+	for i := range peers {
+		wg.Add(2)
+		userID := fmt.Sprintf("user-%d", i)
+		go func() {
+			defer wg.Done()
+			if err := answerPendingOffer(room, userID, clients[i]); err != nil {
+				t.Logf("answer %s: %v", userID, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			requestRenegotiationOffer(room, userID, serverPeer(room, userID))
+		}()
+	}
+	wg.Wait()
+
+	// Every peer leaves at once; cleanup is triggered twice per peer, as
+	// both the state-change callback and an explicit leave may fire.
+	pcs := make([]*webrtc.PeerConnection, peers)
+	for i := range peers {
+		pcs[i] = serverPeer(room, fmt.Sprintf("user-%d", i))
+	}
+	for _, pc := range pcs {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			onPeerDisconnected(db, room, room.ID, pc)
+		}()
+		go func() {
+			defer wg.Done()
+			onPeerDisconnected(db, room, room.ID, pc)
+		}()
+	}
+	wg.Wait()
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if len(room.Connections) != 0 {
+		t.Errorf("connections left after disconnect: %d", len(room.Connections))
+	}
+	if !room.closed {
+		t.Error("room not closed after last peer left")
+	}
+	if lookupLiveRoom(room.ID) != nil {
+		t.Error("room still registered after last peer left")
+	}
+}
+
+func TestJoinClosedRoomIsRefused(t *testing.T) {
+	db := testDB(t)
+	router := newTestRouter(db)
+	room := newTestRoom(t, "room-closed", 4)
+
+	room.mu.Lock()
+	removeLiveRoom(room)
+	room.mu.Unlock()
+	// A request that resolved the room before teardown must not resurrect it.
+	registerLiveRoom(room)
+
+	client, code, err := join(router, room.ID, "late")
+	if client != nil {
+		defer client.Close()
+	}
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	if code != http.StatusNotFound {
+		t.Fatalf("join closed room: code=%d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestRoomsDoNotShareLocks(t *testing.T) {
+	db := testDB(t)
+	router := newTestRouter(db)
+	busy := newTestRoom(t, "room-busy", 4)
+	idle := newTestRoom(t, "room-idle", 4, "cohost")
+
+	busy.mu.Lock()
+	defer busy.mu.Unlock()
+
+	done := make(chan struct{})
+	var client *webrtc.PeerConnection
+	var code int
+	var err error
+	go func() {
+		defer close(done)
+		client, code, err = join(router, idle.ID, "cohost")
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("join blocked on another room's lock")
+	}
+	if client != nil {
+		defer client.Close()
+	}
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("join: code=%d err=%v", code, err)
+	}
+	if pc := serverPeer(idle, "cohost"); pc != nil {
+		defer pc.Close()
+	}
+}
+
+func TestOnlyAcceptedCoHostsCanJoin(t *testing.T) {
+	db := testDB(t)
+	router := newTestRouter(db)
+	room := newTestRoom(t, "room-invites", 4, "cohost")
+
+	client, code, err := join(router, room.ID, "stranger")
+	if client != nil {
+		defer client.Close()
+	}
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	if code != http.StatusForbidden {
+		t.Fatalf("uninvited join: code=%d, want %d", code, http.StatusForbidden)
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	if slices.Contains(room.Participants, "stranger") {
+		t.Error("uninvited user was added to the participants")
+	}
+}
+
+func TestKickedCoHostCannotRejoin(t *testing.T) {
+	db := testDB(t)
+	router := newTestRouter(db)
+	room := newTestRoom(t, "room-kick", 4, "cohost")
+
+	for _, user := range []string{"host", "cohost"} {
+		client, code, err := join(router, room.ID, user)
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("join %s: code=%d err=%v", user, code, err)
+		}
+		defer client.Close()
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/rooms/"+room.ID+"/participants/cohost/kick", nil)
+	req.Header.Set("X-User", "host")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("kick: code=%d body=%s", w.Code, w.Body.String())
+	}
+	if serverPeer(room, "cohost") != nil {
+		t.Error("kicked co-host is still connected")
+	}
+
+	client, code, err := join(router, room.ID, "cohost")
+	if client != nil {
+		defer client.Close()
+	}
+	if err != nil {
+		t.Fatalf("rejoin: %v", err)
+	}
+	if code != http.StatusForbidden {
+		t.Fatalf("rejoin after kick: code=%d, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestInviteeIsNotifiedOutsideTheRoom(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/notifications", func(c *gin.Context) {
+		c.Set("userId", c.Query("user"))
+	}, HandleNotificationSocket())
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/notifications?user=invitee", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	// The socket is registered once the ping is answered.
+	if err := conn.WriteJSON(WSMessage{Type: WSTypePing}); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != WSTypePong {
+		t.Fatalf("ping: msg=%+v err=%v", msg, err)
+	}
+
+	notifyInvitation(&Invitation{ID: "inv-other", RoomID: "room-invite", InviteeID: "someone-else", Status: InvitationPending})
+	notifyInvitation(&Invitation{ID: "inv", RoomID: "room-invite", InviteeID: "invitee", Status: InvitationPending})
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if msg.Type != WSTypeInvitation || msg.Invitation == nil || msg.Invitation.ID != "inv" {
+		t.Fatalf("got %+v, want the invitation addressed to the user", msg)
+	}
+}
+
+func TestRoomStatsAreSampledForTheHost(t *testing.T) {
+	db := testDB(t)
+	router := newTestRouter(db)
+	room := newTestRoom(t, "room-stats", 4, "cohost")
+
+	for _, user := range []string{"host", "cohost"} {
+		client, code, err := join(router, room.ID, user)
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("join %s: code=%d err=%v", user, code, err)
+		}
+		defer client.Close()
+	}
+	sampleAllRooms(nil)
+
+	get := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/rooms/"+room.ID+"/stats", nil)
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("cohost"); w.Code != http.StatusForbidden {
+		t.Errorf("co-host stats: code=%d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w := get("host")
+	if w.Code != http.StatusOK {
+		t.Fatalf("host stats: code=%d body=%s", w.Code, w.Body.String())
+	}
+	var res struct {
+		Samples []StatsSample `json:"samples"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("decode stats: %v", err)
+	}
+	if len(res.Samples) != 1 || len(res.Samples[0].Peers) != 2 {
+		t.Fatalf("got %+v, want one sample with two peers", res.Samples)
+	}
+}
+
+func TestHostReconnectsWithinGraceWindow(t *testing.T) {
+	SetHostReconnectGrace(300 * time.Millisecond)
+	t.Cleanup(func() { SetHostReconnectGrace(DefaultHostReconnectGrace) })
+
+	db := testDB(t)
+	router := newTestRouter(db)
+	room := newTestRoom(t, "room-reconnect", 4, "cohost")
+
+	for _, user := range []string{"host", "cohost"} {
+		client, code, err := join(router, room.ID, user)
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("join %s: code=%d err=%v", user, code, err)
+		}
+		defer client.Close()
+	}
+	dropped := serverPeer(room, "host")
+	if !awaitHost(db, room, dropped, webrtc.PeerConnectionStateDisconnected) {
+		t.Fatal("host connection drop did not start the grace window")
+	}
+
+	client, code, err := join(router, room.ID, "host")
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("host rejoin: code=%d err=%v", code, err)
+	}
+	defer client.Close()
+
+	room.mu.Lock()
+	replaced := room.HostPeerCon != nil && room.HostPeerCon != dropped
+	hostConns := 0
+	for _, conn := range room.Connections {
+		if conn.UserID == "host" {
+			hostConns++
+		}
+	}
+	room.mu.Unlock()
+	if !replaced || hostConns != 1 {
+		t.Fatalf("host connection not replaced: replaced=%v connections=%d", replaced, hostConns)
+	}
+	if serverPeer(room, "cohost") == nil {
+		t.Fatal("co-host lost their connection during the grace window")
+	}
+
+	// The new connection never reaches connected here, so the window
+	// expires and ends the live.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		room.mu.Lock()
+		closed := room.closed
+		room.mu.Unlock()
+		if closed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("live not ended after the grace window expired")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestTracksNotPublishedAgainAreRemovedAfterReconnect(t *testing.T) {
+	db := testDB(t)
+	router := newTestRouter(db)
+	room := newTestRoom(t, "room-rebind", 4, "cohost")
+
+	for _, user := range []string{"host", "cohost"} {
+		client, code, err := join(router, room.ID, user)
+		if err != nil || code != http.StatusOK {
+			t.Fatalf("join %s: code=%d err=%v", user, code, err)
+		}
+		defer client.Close()
+	}
+	cohostPC := serverPeer(room, "cohost")
+	local, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "screen", "host-screen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := cohostPC.AddTrack(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The host's previous connection published a screen share the
+	// reconnected one did not bring back.
+	room.mu.Lock()
+	room.Tracks = append(room.Tracks, &TrackInfo{
+		SourceUserID:  "host",
+		Label:         LabelScreen,
+		SendersByPeer: map[*webrtc.PeerConnection]*webrtc.RTPSender{cohostPC: sender},
+	})
+	hostPC := room.HostPeerCon
+	room.mu.Unlock()
+
+	pruneDetachedTracks(room, hostPC)
+
+	room.mu.Lock()
+	remaining := len(room.Tracks)
+	room.mu.Unlock()
+	if remaining != 0 {
+		t.Errorf("room still has %d tracks", remaining)
+	}
+	for _, s := range cohostPC.GetSenders() {
+		if s == sender && s.Track() != nil {
+			t.Error("the co-host still receives the detached track")
+		}
+	}
+}
+
+func TestReaperEndsIdleRooms(t *testing.T) {
+	db := testDB(t)
+	idle := newTestRoom(t, "room-idle", 4)
+	active := newTestRoom(t, "room-active", 4)
+
+	r := &reaper{db: db, cfg: ReaperConfig{IdleTimeout: time.Minute, ScheduledGrace: time.Hour}, detachedSince: make(map[string]time.Time)}
+	serves := func(string) bool { return true }
+	r.reapLoadedRooms(time.Now().Add(30*time.Second), nil, serves)
+	if lookupLiveRoom(idle.ID) == nil || lookupLiveRoom(active.ID) == nil {
+		t.Fatal("rooms ended before the idle timeout")
+	}
+
+	active.mu.Lock()
+	active.lastActivity = time.Now().Add(2 * time.Minute)
+	active.mu.Unlock()
+	r.reapLoadedRooms(time.Now().Add(2*time.Minute), nil, serves)
+	if lookupLiveRoom(idle.ID) != nil {
+		t.Error("idle room was not ended")
+	}
+	if lookupLiveRoom(active.ID) == nil {
+		t.Error("active room was ended")
+	}
+}
+
+func TestRedPrimaryReturnsTheLatestEncoding(t *testing.T) {
+	// One redundant block of 3 bytes (PT 111, offset 960), then the primary.
+	payload := []byte{0x80 | 111, 0x0F, 0x00, 0x03, 111, 1, 2, 3, 4, 5}
+	pt, data, ok := redPrimary(payload)
+	if !ok || pt != 111 || !bytes.Equal(data, []byte{4, 5}) {
+		t.Fatalf("got pt=%d data=%v ok=%v", pt, data, ok)
+	}
+
+	if _, _, ok := redPrimary([]byte{0x80 | 111, 0x0F, 0x00, 0x09, 111, 1}); ok {
+		t.Error("truncated redundant block accepted")
+	}
+}
+
+func TestResumedTrackContinuesTheSequence(t *testing.T) {
+	ti := &TrackInfo{}
+	forward := func(seq uint16, ts uint32) *rtp.Packet {
+		pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: ts}}
+		ti.rebase.apply(pkt, 90000)
+		return pkt
+	}
+	for seq := uint16(100); seq < 110; seq++ {
+		forward(seq, uint32(seq)*3000)
+	}
+
+	// Packets 110 to 499 were dropped while the host had paused the track.
+	ti.resyncReceivers()
+	pkt := forward(500, 500*3000)
+	if pkt.SequenceNumber != 110 {
+		t.Errorf("first packet after resume has sequence %d, want 110", pkt.SequenceNumber)
+	}
+	if pkt.Timestamp <= 109*3000 {
+		t.Errorf("first packet after resume has timestamp %d, want it after %d", pkt.Timestamp, 109*3000)
+	}
+	if pkt := forward(501, 501*3000); pkt.SequenceNumber != 111 {
+		t.Errorf("next packet has sequence %d, want 111", pkt.SequenceNumber)
+	}
+}
+
+func TestSwitchedCameraContinuesTheSequence(t *testing.T) {
+	pc := &webrtc.PeerConnection{}
+	main := &TrackInfo{}
+	for seq := uint16(1000); seq < 1010; seq++ {
+		main.rebase.apply(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: uint32(seq) * 3000}}, 90000)
+	}
+
+	// To a simulcast camera: its first keyframe follows what main sent.
+	seq, ts, at := main.sentPosition(pc)
+	overhead := &TrackInfo{PeerLayer: map[*webrtc.PeerConnection]*layerSelector{pc: newLayerSelector("h", 90000)}}
+	overhead.PeerLayer[pc].continueFrom(seq, ts, at)
+	delta := &rtp.Packet{Header: rtp.Header{SequenceNumber: 7, Timestamp: 70}}
+	if overhead.PeerLayer[pc].rewrite("h", delta, false) {
+		t.Error("a delta frame was forwarded before the first keyframe")
+	}
+	key := &rtp.Packet{Header: rtp.Header{SequenceNumber: 8, Timestamp: 80}}
+	if !overhead.PeerLayer[pc].rewrite("h", key, true) || key.SequenceNumber != 1010 || key.Timestamp <= 1009*3000 {
+		t.Fatalf("first keyframe of the simulcast camera: seq=%d ts=%d", key.SequenceNumber, key.Timestamp)
+	}
+
+	// And back to a non-simulcast one.
+	seq, ts, at = overhead.sentPosition(pc)
+	screen := &TrackInfo{}
+	rebase := &sourceRebase{}
+	rebase.continueFrom(seq, ts, at)
+	pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: 40000, Timestamp: 5}}
+	screen.rebase.apply(pkt, 90000)
+	rebase.apply(pkt, 90000)
+	if pkt.SequenceNumber != 1011 || pkt.Timestamp <= key.Timestamp {
+		t.Errorf("first packet of the non-simulcast camera: seq=%d ts=%d", pkt.SequenceNumber, pkt.Timestamp)
+	}
+}
+
+func TestRecorderReordersPackets(t *testing.T) {
+	var b reorderBuffer
+	var got []uint16
+	emit := func(p *rtp.Packet) { got = append(got, p.SequenceNumber) }
+	for _, seq := range []uint16{65534, 0, 65535, 1, 3} {
+		b.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}, emit)
+	}
+	if !slices.Equal(got, []uint16{65534, 65535, 0, 1}) {
+		t.Fatalf("in order: got %v", got)
+	}
+
+	// 2 never comes: it is skipped once the window is full.
+	for i := 0; i < reorderWindow; i++ {
+		b.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(4 + i)}}, emit)
+	}
+	want := 4 + reorderWindow + 1 // 3 and the window
+	if len(got) != want || got[4] != 3 {
+		t.Fatalf("gap not skipped: got %d packets, %v...", len(got), got[:6])
+	}
+	b.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 2}}, emit)
+	if len(got) != want {
+		t.Error("late packet written after its gap was skipped")
+	}
+}
+
+func TestSimulcastLayersRankByQuality(t *testing.T) {
+	for _, rids := range [][]string{{"l", "m", "h"}, {"q", "h", "f"}, {"low", "mid", "high"}} {
+		// Whatever order the layers arrive in, the last RID is the top one.
+		for _, arrival := range [][]string{rids, {rids[2], rids[1], rids[0]}, {rids[1], rids[2], rids[0]}} {
+			ti := &TrackInfo{Layers: make(map[string]*SimulcastLayer)}
+			for _, rid := range arrival {
+				ti.Layers[rid] = &SimulcastLayer{RID: rid}
+			}
+			var got []string
+			for _, l := range ti.sortedLayers() {
+				got = append(got, l.RID)
+			}
+			if !slices.Equal(got, rids) || ti.topLayerRID() != rids[2] {
+				t.Errorf("layers %v sorted as %v, top %q", arrival, got, ti.topLayerRID())
+			}
+		}
+	}
+	if simulcastRank("h") <= simulcastRank("m") || simulcastRank("m") <= simulcastRank("l") {
+		t.Error("h, m and l do not rank apart")
+	}
+}
+
+func TestTrackLabelsFromIDs(t *testing.T) {
+	for id, want := range map[string]string{
+		"screen-5f1c":   LabelScreen,
+		"Overhead_cam":  LabelOverhead,
+		"hands":         LabelOverhead,
+		"main":          LabelMain,
+		"{3a9e-77b0}":   "",
+		"screenshare-1": "",
+	} {
+		if got := labelFromID(id); got != want {
+			t.Errorf("labelFromID(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestOnlyAdminsPickAnotherLadderProfile(t *testing.T) {
+	profile := hls.Profile{Renditions: []hls.Rendition{{Name: "4k", Width: 3840, Height: 2160, VideoBitrate: "16000k", MaxRate: "18000k", BufSize: "32000k", Level: "5.1", AudioBitrate: "192k"}}}
+	if err := hls.SetLadders(hls.LadderConfig{Profiles: map[string]hls.Profile{"premium": profile}}); err != nil {
+		t.Fatal(err)
+	}
+	defer hls.SetLadders(hls.LadderConfig{})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/rooms", func(c *gin.Context) {
+		c.Set("userId", "chef")
+		c.Set("role", c.GetHeader("X-Role"))
+	}, CreateNewRoom(testDB(t)))
+	create := func(role, ladder string) int {
+		body, _ := json.Marshal(Request{Name: "room", LadderProfile: ladder})
+		req := httptest.NewRequest(http.MethodPost, "/api/rooms", bytes.NewReader(body))
+		req.Header.Set("X-Role", role)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := create("USER", "premium"); code != http.StatusForbidden {
+		t.Errorf("chef picking a profile above their tier: code=%d, want 403", code)
+	}
+	for _, tc := range []struct{ role, ladder string }{{"USER", ""}, {"USER", hls.DefaultProfile}, {userModule.ADMIN, "premium"}} {
+		if code := create(tc.role, tc.ladder); code == http.StatusForbidden {
+			t.Errorf("%s picking %q was refused", tc.role, tc.ladder)
+		}
+	}
+}
+
+func TestStrangersAreRefusedPlaybackOfRestrictedLives(t *testing.T) {
+	db := testDB(t)
+	private := &liveModule.Live{RoomID: "room-private", UserID: "host", Visibility: liveModule.VisibilityPrivate}
+	for _, tc := range []struct {
+		userID, role string
+		want         int
+	}{
+		{"stranger", "USER", http.StatusForbidden},
+		{"host", "USER", 0},
+		{"moderator", userModule.ADMIN, 0},
+	} {
+		if status, refusal := audienceRefusal(db, private, tc.userID, tc.role); status != tc.want {
+			t.Errorf("%s on a private live: status %d (%q), want %d", tc.userID, status, refusal, tc.want)
+		}
+	}
+
+	followersOnly := &liveModule.Live{RoomID: "room-subs", UserID: "host", Visibility: liveModule.VisibilityPublic, SubscribersOnly: true}
+	if status, _ := audienceRefusal(db, followersOnly, "stranger", "USER"); status != http.StatusForbidden {
+		t.Errorf("stranger on a subscriber-only live: status %d, want 403", status)
+	}
+	public := &liveModule.Live{RoomID: "room-public", UserID: "host", Visibility: liveModule.VisibilityPublic}
+	if status, refusal := audienceRefusal(db, public, "stranger", "USER"); status != 0 {
+		t.Errorf("stranger on a public live: status %d (%q), want none", status, refusal)
+	}
+}
@@ -0,0 +1,405 @@
+package room
+
+import (
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	// Fraction lost is expressed in 1/256 units in receiver reports.
+	layerDownLossThreshold = 25 // ~10% loss: step down one layer
+	layerUpLossThreshold   = 5  // ~2% loss: allowed to step up again
+	layerUpStableDuration  = 5 * time.Second
+	layerDownCooldown      = 2 * time.Second
+	// Headroom required between a layer bitrate and the receiver estimate.
+	layerBitrateHeadroom = 1.15
+)
+
+// SimulcastLayer is one RID-identified encoding of a simulcast source track.
+type SimulcastLayer struct {
+	RID   string
+	Track *webrtc.TrackRemote
+	// bitrate is the measured incoming bitrate in bits per second.
+	bitrate atomic.Uint64
+}
+
+// Bitrate returns the last measured incoming bitrate of the layer.
+func (l *SimulcastLayer) Bitrate() uint64 {
+	return l.bitrate.Load()
+}
+
+// simulcastRank orders RIDs from lowest to highest quality. Browsers and
+// encoders use "q/h/f", "l/m/h", "low/mid/high" or numeric RIDs. "h" is the
+// middle layer of the first scheme and the top one of the second: it ranks
+// between "m" and "f", which keeps both orders.
+func simulcastRank(rid string) int {
+	switch strings.ToLower(rid) {
+	case "q", "l", "low", "quarter":
+		return 0
+	case "m", "mid", "half", "medium":
+		return 1
+	case "h":
+		return 2
+	case "f", "high", "full", "hi":
+		return 3
+	}
+	if n, err := strconv.Atoi(rid); err == nil {
+		return n
+	}
+	return 1
+}
+
+// sortedLayers returns the layers from lowest to highest quality.
+// Must be called with the room lock held.
+func (ti *TrackInfo) sortedLayers() []*SimulcastLayer {
+	layers := make([]*SimulcastLayer, 0, len(ti.Layers))
+	for _, l := range ti.Layers {
+		layers = append(layers, l)
+	}
+	// RIDs of equal rank are ordered by name, not by arrival.
+	slices.SortFunc(layers, func(a, b *SimulcastLayer) int {
+		if d := simulcastRank(a.RID) - simulcastRank(b.RID); d != 0 {
+			return d
+		}
+		return strings.Compare(a.RID, b.RID)
+	})
+	return layers
+}
+
+// topLayerRID returns the RID of the highest-quality layer received so far.
+// Must be called with the room lock held.
+func (ti *TrackInfo) topLayerRID() string {
+	layers := ti.sortedLayers()
+	if len(layers) == 0 {
+		return ""
+	}
+	return layers[len(layers)-1].RID
+}
+
+// isVideoKeyframe reports whether an RTP payload is a point where a decoder
+// can start (or switch layers) for the given codec.
+func isVideoKeyframe(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeH264):
+		// SPS precedes the IDR in the same access unit: switching on it makes
+		// sure the receiver gets the new layer's parameter sets.
+		return isH264SPS(payload) || isH264Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return isVP9Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return isAV1Keyframe(payload)
+	}
+	return false
+}
+
+// isAV1Keyframe reads the AV1 RTP aggregation header and returns true if the
+// packet starts a new coded video sequence (N=1), which begins with a
+// sequence header and a key frame.
+func isAV1Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// Z=0: the first OBU element is not a continuation of a previous packet.
+	return payload[0]&0x80 == 0 && payload[0]&0x08 != 0
+}
+
+// isVP9Keyframe parses a VP9 RTP payload descriptor and returns true if the
+// packet starts a frame that is not inter-predicted (P=0, B=1).
+func isVP9Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	return payload[0]&0x40 == 0 && payload[0]&0x08 != 0
+}
+
+// layerSelector picks the simulcast layer forwarded to one destination peer
+// and rewrites sequence numbers and timestamps so that the receiver sees a
+// single continuous stream across layer switches. SSRC and payload type are
+// stamped by the destination TrackLocalStaticRTP binding.
+type layerSelector struct {
+	mu sync.Mutex
+
+	current string // RID being forwarded, "" until the first keyframe
+	target  string // RID we want to forward next
+
+	started   bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+	clockRate uint32
+
+	fractionLost     uint8
+	estimatedBitrate uint64
+	lossLowSince     time.Time
+	lastDown         time.Time
+}
+
+func newLayerSelector(initial string, clockRate uint32) *layerSelector {
+	if clockRate == 0 {
+		clockRate = 90000
+	}
+	return &layerSelector{target: initial, clockRate: clockRate}
+}
+
+// Target returns the RID the selector wants to forward.
+func (s *layerSelector) Target() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.target
+}
+
+// follow sets the RID the selector switches to on its next keyframe.
+func (s *layerSelector) follow(rid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.target = rid
+}
+
+// resync makes the selector wait for a keyframe of its target layer and
+// continue the sequence written so far from it, as after a layer switch.
+func (s *layerSelector) resync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = ""
+}
+
+// position returns the last sequence number and timestamp written, and when
+// (zero before the first packet).
+func (s *layerSelector) position() (uint16, uint32, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		return 0, 0, time.Time{}
+	}
+	return s.lastSeq, s.lastTS, s.lastWrite
+}
+
+// continueFrom makes the selector's first keyframe follow seq and ts,
+// written at the given time, as after a layer switch.
+func (s *layerSelector) continueFrom(seq uint16, ts uint32, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if at.IsZero() {
+		return
+	}
+	s.lastSeq, s.lastTS, s.lastWrite = seq, ts, at
+	s.started = true
+	s.current = ""
+}
+
+// rewrite decides whether pkt (received on layer rid) is forwarded to this
+// peer and, if so, rewrites its sequence number and timestamp in place.
+// Switches to the target layer only happen on keyframes.
+func (s *layerSelector) rewrite(rid string, pkt *rtp.Packet, keyframe bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rid == s.target && rid != s.current && keyframe {
+		if s.started {
+			elapsed := time.Since(s.lastWrite)
+			if elapsed <= 0 {
+				elapsed = time.Millisecond
+			}
+			nextTS := s.lastTS + uint32(elapsed.Milliseconds()*int64(s.clockRate)/1000) + 1
+			s.seqOffset = s.lastSeq + 1 - pkt.SequenceNumber
+			s.tsOffset = nextTS - pkt.Timestamp
+		}
+		if s.current != "" {
+			log.Printf("[SIMULCAST] switching layer %s -> %s", s.current, rid)
+		}
+		s.current = rid
+		s.started = true
+	}
+
+	if !s.started || rid != s.current {
+		return false
+	}
+
+	pkt.SequenceNumber += s.seqOffset
+	pkt.Timestamp += s.tsOffset
+	// Header extensions carry the publisher's RID/MID ids, which mean nothing
+	// (or something else) in the subscriber's negotiated extmap.
+	pkt.Extension = false
+	pkt.Extensions = nil
+
+	s.lastSeq = pkt.SequenceNumber
+	s.lastTS = pkt.Timestamp
+	s.lastWrite = time.Now()
+	return true
+}
+
+// evaluate updates the target layer from the latest receiver feedback and the
+// measured layer bitrates (lowest first). Returns true when the target changed.
+func (s *layerSelector) evaluate(layers []*SimulcastLayer) bool {
+	if len(layers) == 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := slices.IndexFunc(layers, func(l *SimulcastLayer) bool { return l.RID == s.target })
+	if idx < 0 {
+		idx = len(layers) - 1
+	}
+	now := time.Now()
+	next := idx
+
+	// Highest layer that fits in the receiver's bandwidth estimate.
+	fits := len(layers) - 1
+	if s.estimatedBitrate > 0 {
+		fits = 0
+		for i, l := range layers {
+			if float64(l.Bitrate())*layerBitrateHeadroom <= float64(s.estimatedBitrate) {
+				fits = i
+			}
+		}
+	}
+
+	switch {
+	case s.fractionLost >= layerDownLossThreshold && idx > 0:
+		if now.Sub(s.lastDown) >= layerDownCooldown {
+			next = idx - 1
+		}
+	case fits < idx:
+		next = fits
+	case s.fractionLost <= layerUpLossThreshold && fits > idx:
+		if !s.lossLowSince.IsZero() && now.Sub(s.lossLowSince) >= layerUpStableDuration {
+			next = idx + 1
+		}
+	}
+
+	if next == idx && layers[idx].RID == s.target {
+		return false
+	}
+	if next < idx {
+		s.lastDown = now
+	}
+	s.lossLowSince = time.Time{}
+	s.target = layers[next].RID
+	return true
+}
+
+// onReceiverFeedback records the packet loss and bandwidth estimate
+// reported by the destination peer.
+func (s *layerSelector) onReceiverFeedback(fractionLost *uint8, bitrate uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fractionLost != nil {
+		s.fractionLost = *fractionLost
+		if s.fractionLost <= layerUpLossThreshold {
+			if s.lossLowSince.IsZero() {
+				s.lossLowSince = time.Now()
+			}
+		} else {
+			s.lossLowSince = time.Time{}
+		}
+	}
+	if bitrate > 0 {
+		s.estimatedBitrate = bitrate
+	}
+}
+
+// startSenderRTCPReader reads the RTCP feedback of a sender. For simulcast
+// tracks, receiver reports and REMB estimates drive the layer selector, and
+// keyframe requests are forwarded to the layer the peer is switching to;
+// for other video tracks keyframe requests go to the source. The track is
+// looked up on every report since a WHEP subscriber switching cameras
+// moves the sender to another source, simulcast or not.
+func startSenderRTCPReader(room *Room, sender *webrtc.RTPSender, pc *webrtc.PeerConnection) {
+	if sender == nil {
+		return
+	}
+	go func() {
+		for {
+			packets, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+
+			var fractionLost *uint8
+			var bitrate uint64
+			keyframeRequested := false
+			for _, p := range packets {
+				switch pkt := p.(type) {
+				case *rtcp.ReceiverReport:
+					for _, report := range pkt.Reports {
+						loss := report.FractionLost
+						fractionLost = &loss
+					}
+				case *rtcp.ReceiverEstimatedMaximumBitrate:
+					bitrate = uint64(pkt.Bitrate)
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					keyframeRequested = true
+				}
+			}
+			room.mu.Lock()
+			var sel *layerSelector
+			var layers []*SimulcastLayer
+			var sourcePC *webrtc.PeerConnection
+			var sourceSSRC uint32
+			for _, ti := range room.Tracks {
+				if ti.SendersByPeer[pc] == sender {
+					sel = ti.PeerLayer[pc]
+					layers = ti.sortedLayers()
+					sourcePC = ti.SourcePC
+					if ti.Track != nil && ti.Track.Kind() == webrtc.RTPCodecTypeVideo {
+						sourceSSRC = uint32(ti.Track.SSRC())
+					}
+					break
+				}
+			}
+			room.mu.Unlock()
+			if sel == nil {
+				if keyframeRequested && sourcePC != nil && sourceSSRC != 0 {
+					_ = sourcePC.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: sourceSSRC}})
+				}
+				continue
+			}
+
+			sel.onReceiverFeedback(fractionLost, bitrate)
+			if sel.evaluate(layers) {
+				keyframeRequested = true
+			}
+			if keyframeRequested {
+				requestLayerKeyframe(sourcePC, layers, sel.Target())
+			}
+		}
+	}()
+}
+
+// requestLayerKeyframe sends a PLI for the given simulcast layer.
+func requestLayerKeyframe(pc *webrtc.PeerConnection, layers []*SimulcastLayer, rid string) {
+	if pc == nil {
+		return
+	}
+	for _, l := range layers {
+		if l.RID == rid {
+			_ = pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(l.Track.SSRC())}})
+			return
+		}
+	}
+}
+
+// attachSimulcastSender registers the layer selector of a destination peer
+// and starts reading its RTCP feedback. Must be called with the room lock held.
+func attachSimulcastSender(room *Room, ti *TrackInfo, pc *webrtc.PeerConnection, sender *webrtc.RTPSender) {
+	if ti.PeerLayer == nil {
+		ti.PeerLayer = make(map[*webrtc.PeerConnection]*layerSelector)
+	}
+	ti.PeerLayer[pc] = newLayerSelector(ti.topLayerRID(), ti.Track.Codec().ClockRate)
+	startSenderRTCPReader(room, sender, pc)
+}
@@ -0,0 +1,347 @@
+package room
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	userModule "github.com/Foodstream-io/etchebest/internal/modules/user"
+	"github.com/Foodstream-io/etchebest/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	statsInterval = 5 * time.Second
+	// statsHistorySize keeps the last five minutes of samples per room.
+	statsHistorySize = 60
+	// statsRetention is how long the history of an ended room stays
+	// available for diagnosis.
+	statsRetention = 15 * time.Minute
+)
+
+// Peer roles in stats samples.
+const (
+	StatsRoleHost   = "host"
+	StatsRoleCoHost = "co-host"
+	StatsRoleViewer = "viewer"
+)
+
+// CandidateStats describes one end of the selected ICE candidate pair.
+type CandidateStats struct {
+	IP       string `json:"ip"`
+	Port     int32  `json:"port"`
+	Protocol string `json:"protocol"`
+	Type     string `json:"type"`
+}
+
+// CandidatePairStats is the ICE candidate pair carrying a peer's media.
+type CandidatePairStats struct {
+	State  string          `json:"state"`
+	Local  *CandidateStats `json:"local,omitempty"`
+	Remote *CandidateStats `json:"remote,omitempty"`
+}
+
+// PeerStats is the health of one PeerConnection over the last interval.
+// Inbound is media the server receives from the peer, outbound what it
+// sends to the peer; the remote figures are the peer's receiver reports.
+type PeerStats struct {
+	UserID          string  `json:"userId,omitempty"`
+	Role            string  `json:"role"`
+	State           string  `json:"state"`
+	InboundBitrate  uint64  `json:"inboundBitrate"`
+	OutboundBitrate uint64  `json:"outboundBitrate"`
+	PacketsReceived uint64  `json:"packetsReceived"`
+	PacketsLost     int64   `json:"packetsLost"`
+	PacketLoss      float64 `json:"packetLoss"`
+	Jitter          float64 `json:"jitter"`
+	// RemotePacketLoss and RemoteJitter are the worst values the peer
+	// reported for the streams it receives.
+	RemotePacketLoss float64 `json:"remotePacketLoss"`
+	RemoteJitter     float64 `json:"remoteJitter"`
+	// RTT is in seconds, like the jitters.
+	RTT           float64             `json:"rtt"`
+	NACKSent      uint32              `json:"nackSent"`
+	PLISent       uint32              `json:"pliSent"`
+	NACKReceived  uint32              `json:"nackReceived"`
+	PLIReceived   uint32              `json:"pliReceived"`
+	CandidatePair *CandidatePairStats `json:"candidatePair,omitempty"`
+}
+
+// StatsSample is the state of every peer of a room at one point in time.
+type StatsSample struct {
+	Time  time.Time   `json:"time"`
+	Peers []PeerStats `json:"peers"`
+}
+
+// roomStats is the sample history of one room.
+type roomStats struct {
+	host    string
+	samples []StatsSample
+	endedAt time.Time
+}
+
+var (
+	statsMu      sync.Mutex
+	statsHistory = make(map[string]*roomStats)
+)
+
+// peerCounters are the cumulative counters of a peer at the previous sample.
+type peerCounters struct {
+	at              time.Time
+	bytesReceived   uint64
+	bytesSent       uint64
+	packetsReceived uint64
+	packetsLost     int64
+}
+
+// statsTarget is a PeerConnection to sample.
+type statsTarget struct {
+	userID string
+	role   string
+	pc     *webrtc.PeerConnection
+}
+
+// StartStatsSampler samples the RTC statistics of every live room until ctx
+// is cancelled.
+func StartStatsSampler(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+		previous := make(map[*webrtc.PeerConnection]peerCounters)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				previous = sampleAllRooms(previous)
+			}
+		}
+	}()
+}
+
+// sampleAllRooms records a sample for each live room and returns the
+// counters to diff the next samples against.
+func sampleAllRooms(previous map[*webrtc.PeerConnection]peerCounters) map[*webrtc.PeerConnection]peerCounters {
+	roomsMu.Lock()
+	rooms := make([]*Room, 0, len(liveRooms))
+	for _, r := range liveRooms {
+		rooms = append(rooms, r)
+	}
+	roomsMu.Unlock()
+
+	current := make(map[*webrtc.PeerConnection]peerCounters)
+	live := make(map[string]bool, len(rooms))
+	for _, room := range rooms {
+		live[room.ID] = true
+
+		room.mu.Lock()
+		host := room.Host
+		targets := make([]statsTarget, 0, len(room.Connections)+len(room.Subscribers))
+		for _, conn := range room.Connections {
+			role := StatsRoleCoHost
+			if conn.UserID == room.Host {
+				role = StatsRoleHost
+			}
+			targets = append(targets, statsTarget{conn.UserID, role, conn.PeerCon})
+		}
+		for _, sub := range room.Subscribers {
+			targets = append(targets, statsTarget{sub.UserID, StatsRoleViewer, sub.PeerCon})
+		}
+		room.mu.Unlock()
+
+		sample := StatsSample{Time: time.Now(), Peers: make([]PeerStats, 0, len(targets))}
+		for _, t := range targets {
+			stats, counters := samplePeer(t, previous[t.pc])
+			current[t.pc] = counters
+			sample.Peers = append(sample.Peers, stats)
+		}
+		recordStats(room.ID, host, sample)
+		sendToUser(room.ID, host, WSMessage{Type: WSTypeStats, Stats: &sample})
+	}
+
+	pruneStats(live)
+	return current
+}
+
+// samplePeer reads the stats report of one PeerConnection.
+func samplePeer(t statsTarget, prev peerCounters) (PeerStats, peerCounters) {
+	now := time.Now()
+	stats := PeerStats{
+		UserID: t.userID,
+		Role:   t.role,
+		State:  t.pc.ConnectionState().String(),
+	}
+	counters := peerCounters{at: now}
+
+	report := t.pc.GetStats()
+	var transport *webrtc.TransportStats
+	var pairs []webrtc.ICECandidatePairStats
+	candidates := make(map[string]webrtc.ICECandidateStats)
+	for _, s := range report {
+		switch s := s.(type) {
+		case webrtc.InboundRTPStreamStats:
+			counters.bytesReceived += s.BytesReceived
+			counters.packetsReceived += uint64(s.PacketsReceived)
+			counters.packetsLost += int64(s.PacketsLost)
+			stats.Jitter = max(stats.Jitter, s.Jitter)
+			stats.NACKSent += s.NACKCount
+			stats.PLISent += s.PLICount
+		case webrtc.OutboundRTPStreamStats:
+			counters.bytesSent += s.BytesSent
+			stats.NACKReceived += s.NACKCount
+			stats.PLIReceived += s.PLICount
+		case webrtc.RemoteInboundRTPStreamStats:
+			stats.RemotePacketLoss = max(stats.RemotePacketLoss, s.FractionLost)
+			stats.RemoteJitter = max(stats.RemoteJitter, s.Jitter)
+			stats.RTT = max(stats.RTT, s.RoundTripTime)
+		case webrtc.TransportStats:
+			transport = &s
+		case webrtc.ICECandidatePairStats:
+			pairs = append(pairs, s)
+		case webrtc.ICECandidateStats:
+			candidates[s.ID] = s
+		}
+	}
+	stats.PacketsReceived = counters.packetsReceived
+	stats.PacketsLost = counters.packetsLost
+
+	if !prev.at.IsZero() {
+		if elapsed := now.Sub(prev.at).Seconds(); elapsed > 0 {
+			if counters.bytesReceived >= prev.bytesReceived {
+				stats.InboundBitrate = uint64(float64(counters.bytesReceived-prev.bytesReceived) * 8 / elapsed)
+			}
+			if counters.bytesSent >= prev.bytesSent {
+				stats.OutboundBitrate = uint64(float64(counters.bytesSent-prev.bytesSent) * 8 / elapsed)
+			}
+		}
+		received := int64(counters.packetsReceived) - int64(prev.packetsReceived)
+		lost := counters.packetsLost - prev.packetsLost
+		if received >= 0 && lost > 0 {
+			stats.PacketLoss = float64(lost) / float64(received+lost)
+		}
+	}
+
+	if pair := selectedPair(transport, pairs); pair != nil {
+		if pair.CurrentRoundTripTime > 0 {
+			stats.RTT = pair.CurrentRoundTripTime
+		}
+		stats.CandidatePair = &CandidatePairStats{
+			State:  string(pair.State),
+			Local:  candidateStats(candidates, pair.LocalCandidateID),
+			Remote: candidateStats(candidates, pair.RemoteCandidateID),
+		}
+	}
+	return stats, counters
+}
+
+// selectedPair returns the candidate pair the transport selected, falling
+// back to the nominated pair.
+func selectedPair(transport *webrtc.TransportStats, pairs []webrtc.ICECandidatePairStats) *webrtc.ICECandidatePairStats {
+	if transport != nil && transport.SelectedCandidatePairID != "" {
+		for i := range pairs {
+			if pairs[i].ID == transport.SelectedCandidatePairID {
+				return &pairs[i]
+			}
+		}
+	}
+	for i := range pairs {
+		if pairs[i].Nominated && pairs[i].State == webrtc.StatsICECandidatePairStateSucceeded {
+			return &pairs[i]
+		}
+	}
+	return nil
+}
+
+func candidateStats(candidates map[string]webrtc.ICECandidateStats, id string) *CandidateStats {
+	c, ok := candidates[id]
+	if !ok {
+		return nil
+	}
+	return &CandidateStats{IP: c.IP, Port: c.Port, Protocol: c.Protocol, Type: c.CandidateType.String()}
+}
+
+// recordStats appends a sample to the room's history, dropping the oldest
+// beyond statsHistorySize.
+func recordStats(roomID, host string, sample StatsSample) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	h := statsHistory[roomID]
+	if h == nil {
+		h = &roomStats{}
+		statsHistory[roomID] = h
+	}
+	h.host = host
+	h.endedAt = time.Time{}
+	h.samples = append(h.samples, sample)
+	if len(h.samples) > statsHistorySize {
+		h.samples = append([]StatsSample(nil), h.samples[len(h.samples)-statsHistorySize:]...)
+	}
+}
+
+// pruneStats marks the history of rooms no longer live as ended and drops
+// the ones ended for longer than statsRetention.
+func pruneStats(live map[string]bool) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	now := time.Now()
+	for id, h := range statsHistory {
+		if live[id] {
+			continue
+		}
+		if h.endedAt.IsZero() {
+			h.endedAt = now
+		} else if now.Sub(h.endedAt) > statsRetention {
+			delete(statsHistory, id)
+		}
+	}
+}
+
+// GetRoomStats godoc
+// @Summary      Get room RTC statistics
+// @Description  Per-peer bitrate, packet loss, jitter, RTT, NACK/PLI counts and selected ICE candidate pair, sampled every few seconds; the last minutes are kept, also shortly after the room ended (host or admin only)
+// @Tags         rooms
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Success      200  {object}  map[string]interface{} "roomId, intervalSeconds, endedAt and samples (oldest first)"
+// @Failure      403  {object}  map[string]string "error: only the host or an admin can view room stats"
+// @Failure      404  {object}  map[string]string "error: no stats for this room"
+// @Router       /api/rooms/{roomId}/stats [get]
+func GetRoomStats() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		roomID := c.Param("roomId")
+
+		statsMu.Lock()
+		h := statsHistory[roomID]
+		var host string
+		var samples []StatsSample
+		var endedAt *time.Time
+		if h != nil {
+			host = h.host
+			samples = append([]StatsSample(nil), h.samples...)
+			if !h.endedAt.IsZero() {
+				ended := h.endedAt
+				endedAt = &ended
+			}
+		}
+		statsMu.Unlock()
+
+		if h == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no stats for this room"})
+			return
+		}
+		if host != utils.GetContextString(c, "userId") && c.GetString("role") != userModule.ADMIN {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only the host or an admin can view room stats"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"roomId":          roomID,
+			"intervalSeconds": int(statsInterval / time.Second),
+			"endedAt":         endedAt,
+			"samples":         samples,
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package room
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Foodstream-io/etchebest/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"gorm.io/gorm"
+)
+
+// Track labels tell apart the cameras and screen share of one publisher.
+const (
+	LabelMain     = "main"
+	LabelOverhead = "overhead"
+	LabelScreen   = "screen"
+)
+
+func validTrackLabel(label string) bool {
+	switch label {
+	case LabelMain, LabelOverhead, LabelScreen:
+		return true
+	}
+	return false
+}
+
+// labelFromID reads a label from a track or stream ID such as
+// "screen-1a2b" or "overhead". "hands" stands for the overhead camera.
+func labelFromID(id string) string {
+	token := strings.ToLower(id)
+	if i := strings.IndexAny(token, "-_:/ "); i >= 0 {
+		token = token[:i]
+	}
+	switch token {
+	case LabelScreen, LabelOverhead, LabelMain:
+		return token
+	case "hands":
+		return LabelOverhead
+	}
+	return ""
+}
+
+// resolveTrackLabel labels a track published by userID: labels sent as
+// signaling metadata come first, keyed by track or stream ID, then the IDs
+// themselves; anything else is the main camera.
+// Must be called with the room lock held.
+func resolveTrackLabel(room *Room, userID string, track *webrtc.TrackRemote) string {
+	labels := room.TrackLabelsByUser[userID]
+	for _, id := range []string{track.ID(), track.StreamID()} {
+		if label, ok := labels[id]; ok {
+			return label
+		}
+	}
+	for _, id := range []string{track.ID(), track.StreamID()} {
+		if label := labelFromID(id); label != "" {
+			return label
+		}
+	}
+	return LabelMain
+}
+
+// setTrackLabels records the labels userID sent for their tracks and
+// relabels the ones already published. Returns whether any changed.
+// Must be called with the room lock held.
+func setTrackLabels(room *Room, userID string, labels map[string]string) bool {
+	if len(labels) == 0 {
+		return false
+	}
+	if room.TrackLabelsByUser == nil {
+		room.TrackLabelsByUser = make(map[string]map[string]string)
+	}
+	if room.TrackLabelsByUser[userID] == nil {
+		room.TrackLabelsByUser[userID] = make(map[string]string)
+	}
+	for id, label := range labels {
+		room.TrackLabelsByUser[userID][id] = label
+	}
+
+	changed := false
+	for _, ti := range room.Tracks {
+		if ti.SourceUserID != userID {
+			continue
+		}
+		if label := resolveTrackLabel(room, userID, ti.Track); label != ti.Label {
+			ti.Label = label
+			changed = true
+		}
+	}
+	return changed
+}
+
+// viewedVideo returns the video track of publisher userID a viewer asking
+// for camera receives: the one with that label, else the main camera, else
+// any of theirs.
+// Must be called with the room lock held.
+func viewedVideo(room *Room, userID, camera string) *TrackInfo {
+	var main, other *TrackInfo
+	for _, ti := range room.Tracks {
+		if ti.SourceUserID != userID || ti.Track.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		switch {
+		case ti.Label == camera:
+			return ti
+		case ti.Label == LabelMain && main == nil:
+			main = ti
+		case other == nil:
+			other = ti
+		}
+	}
+	if main != nil {
+		return main
+	}
+	return other
+}
+
+// receivesTrack reports whether pc is sent ti. WHEP subscribers receive
+// every audio track but only the video of the camera they chose for each
+// publisher; participants receive everything.
+// Must be called with the room lock held.
+func receivesTrack(room *Room, pc *webrtc.PeerConnection, ti *TrackInfo) bool {
+	if ti.Track.Kind() != webrtc.RTPCodecTypeVideo {
+		return true
+	}
+	for _, sub := range room.Subscribers {
+		if sub.PeerCon == pc {
+			return viewedVideo(room, ti.SourceUserID, sub.Camera) == ti
+		}
+	}
+	return true
+}
+
+// switchSubscriberCamera re-points the video senders of a WHEP subscriber
+// to the camera it now asks for, without renegotiation: the new track must
+// share the codec negotiated for the sender, other switches are left to
+// syncSubscriberTracks. The new camera's packets continue the sequence
+// numbers and timestamps the sender wrote so far, and the sender's RTCP
+// reader follows it, simulcast or not. Returns the keyframe requests to
+// send.
+// Must be called with the room lock held.
+func switchSubscriberCamera(room *Room, sub *Subscriber, camera string) []keyframeRequest {
+	sub.Camera = camera
+	pc := sub.PeerCon
+
+	var requests []keyframeRequest
+	for _, current := range room.Tracks {
+		sender := current.SendersByPeer[pc]
+		if sender == nil || current.Track.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		next := viewedVideo(room, current.SourceUserID, camera)
+		if next == nil || next == current {
+			continue
+		}
+		cap, pt := resolveTrackCodec(pc, next)
+		if old, ok := current.LocalTracks[pc]; !ok || pt == 0 || !strings.EqualFold(old.Codec().MimeType, cap.MimeType) {
+			log.Printf("[WHEP] room %s: switching to the %s camera of %s needs renegotiation: codec %s",
+				room.ID, next.Label, next.SourceUserID, next.Track.Codec().MimeType)
+			continue
+		}
+		lt, err := webrtc.NewTrackLocalStaticRTP(cap, current.LocalTracks[pc].ID(), current.LocalTracks[pc].StreamID())
+		if err != nil {
+			log.Printf("[WHEP] switch camera: create track: %v", err)
+			continue
+		}
+		if err := sender.ReplaceTrack(lt); err != nil {
+			log.Printf("[WHEP] switch camera: replace track: %v", err)
+			continue
+		}
+
+		seq, ts, at := current.sentPosition(pc)
+		delete(current.LocalTracks, pc)
+		delete(current.PeerPT, pc)
+		delete(current.SendersByPeer, pc)
+		delete(current.PeerLayer, pc)
+		delete(current.peerRebase, pc)
+		if next.LocalTracks == nil {
+			next.LocalTracks = make(map[*webrtc.PeerConnection]*webrtc.TrackLocalStaticRTP)
+		}
+		if next.PeerPT == nil {
+			next.PeerPT = make(map[*webrtc.PeerConnection]uint8)
+		}
+		if next.SendersByPeer == nil {
+			next.SendersByPeer = make(map[*webrtc.PeerConnection]*webrtc.RTPSender)
+		}
+		next.LocalTracks[pc] = lt
+		next.PeerPT[pc] = pt
+		next.SendersByPeer[pc] = sender
+		if next.Layers != nil {
+			if next.PeerLayer == nil {
+				next.PeerLayer = make(map[*webrtc.PeerConnection]*layerSelector)
+			}
+			sel := newLayerSelector(next.topLayerRID(), next.Track.Codec().ClockRate)
+			sel.continueFrom(seq, ts, at)
+			next.PeerLayer[pc] = sel
+		} else {
+			if next.peerRebase == nil {
+				next.peerRebase = make(map[*webrtc.PeerConnection]*sourceRebase)
+			}
+			rebase := &sourceRebase{}
+			rebase.continueFrom(seq, ts, at)
+			next.peerRebase[pc] = rebase
+		}
+
+		track := next.Track
+		if layer := next.Layers[next.topLayerRID()]; layer != nil {
+			track = layer.Track
+		}
+		requests = append(requests, keyframeRequest{next.SourcePC, uint32(track.SSRC())})
+		log.Printf("[WHEP] room %s: subscriber switched to the %s camera of %s", room.ID, next.Label, next.SourceUserID)
+	}
+	return requests
+}
+
+// sentPosition returns the last sequence number and timestamp ti wrote to
+// pc, and when.
+// Must be called with the room lock held.
+func (ti *TrackInfo) sentPosition(pc *webrtc.PeerConnection) (uint16, uint32, time.Time) {
+	if sel := ti.PeerLayer[pc]; sel != nil {
+		return sel.position()
+	}
+	if rebase := ti.peerRebase[pc]; rebase != nil {
+		return rebase.position()
+	}
+	return ti.rebase.position()
+}
+
+// keyframeRequest asks a source for a keyframe.
+type keyframeRequest struct {
+	pc   *webrtc.PeerConnection
+	ssrc uint32
+}
+
+// WebRTCOffer is the SDP offer of a participant, with optional labels for
+// the tracks it carries.
+type WebRTCOffer struct {
+	webrtc.SessionDescription
+	// TrackLabels maps track or stream IDs to main, overhead or screen.
+	TrackLabels map[string]string `json:"trackLabels,omitempty"`
+}
+
+// TrackLabelsReq labels the caller's tracks.
+type TrackLabelsReq struct {
+	// Labels maps track or stream IDs to main, overhead or screen.
+	Labels map[string]string `json:"labels" binding:"required"`
+}
+
+// CameraReq selects the camera a WHEP subscriber receives.
+type CameraReq struct {
+	Camera string `json:"camera" binding:"required" example:"overhead"`
+}
+
+// RoomTrack describes one published track.
+type RoomTrack struct {
+	UserID    string `json:"userId"`
+	Kind      string `json:"kind"`
+	Label     string `json:"label"`
+	Codec     string `json:"codec"`
+	Simulcast bool   `json:"simulcast"`
+}
+
+// GetRoomTracks godoc
+// @Summary      List published tracks
+// @Description  Tracks published in the live room with their label (main, overhead or screen), so viewers can pick a camera. Tracks sent to participants have IDs starting with their label.
+// @Tags         rooms
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Success      200  {array}   RoomTrack
+// @Failure      404  {object}  map[string]string "error: room not found"
+// @Router       /api/rooms/{roomId}/tracks [get]
+func GetRoomTracks(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		room, err := getLiveRoom(db, c.Param("roomId"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+			return
+		}
+
+		room.mu.Lock()
+		tracks := make([]RoomTrack, 0, len(room.Tracks))
+		for _, ti := range room.Tracks {
+			if ti.SourcePC == nil {
+				continue
+			}
+			tracks = append(tracks, RoomTrack{
+				UserID:    ti.SourceUserID,
+				Kind:      ti.Track.Kind().String(),
+				Label:     ti.Label,
+				Codec:     ti.Track.Codec().MimeType,
+				Simulcast: ti.Layers != nil,
+			})
+		}
+		room.mu.Unlock()
+
+		c.JSON(http.StatusOK, tracks)
+	}
+}
+
+// SetTrackLabels godoc
+// @Summary      Label my tracks
+// @Description  Label the caller's tracks, by track or stream ID, as main, overhead or screen. Applies to the tracks already published and to the ones to come; labels can also be sent in the trackLabels field of the WebRTC offer.
+// @Tags         rooms
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        request body TrackLabelsReq true "Labels"
+// @Success      200  {object}  map[string]string "message: track labels updated"
+// @Failure      400  {object}  map[string]string "error: invalid track label"
+// @Failure      403  {object}  map[string]string "error: only participants can label tracks"
+// @Failure      404  {object}  map[string]string "error: room not found"
+// @Router       /api/rooms/{roomId}/tracks/labels [put]
+func SetTrackLabels(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req TrackLabelsReq
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		for _, label := range req.Labels {
+			if !validTrackLabel(label) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid track label"})
+				return
+			}
+		}
+
+		room, err := getLiveRoom(db, c.Param("roomId"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+			return
+		}
+		userID := utils.GetContextString(c, "userId")
+
+		room.mu.Lock()
+		if !canPublish(room, userID) {
+			room.mu.Unlock()
+			c.JSON(http.StatusForbidden, gin.H{"error": "only participants can label tracks"})
+			return
+		}
+		if setTrackLabels(room, userID, req.Labels) {
+			updateComposite(room)
+		}
+		room.mu.Unlock()
+
+		c.JSON(http.StatusOK, gin.H{"message": "track labels updated"})
+	}
+}
+
+// SetWHEPCamera godoc
+// @Summary      Choose a camera
+// @Description  Switch the video a WHEP subscriber receives from each publisher to their main, overhead or screen track, without renegotiation when the codecs match and through a server offer otherwise. Publishers without that track keep sending their main camera.
+// @Tags         webrtc
+// @Accept       json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        sessionId path string true "WHEP session ID"
+// @Param        request body CameraReq true "Camera"
+// @Success      204
+// @Failure      400  {string}  string "invalid camera"
+// @Failure      404  {string}  string "session not found"
+// @Router       /api/whep/{roomId}/{sessionId}/camera [put]
+func SetWHEPCamera(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CameraReq
+		if err := c.ShouldBindJSON(&req); err != nil || !validTrackLabel(req.Camera) {
+			c.String(http.StatusBadRequest, "invalid camera")
+			return
+		}
+
+		room, sub := whepSession(c, db)
+		if sub == nil {
+			return
+		}
+		room.mu.Lock()
+		sub.Camera = req.Camera
+		renegotiate := syncSubscriberTracks(room, sub)
+		room.mu.Unlock()
+
+		if renegotiate {
+			go requestSubscriberOffer(room, c.Param("sessionId"))
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// localTrackID names the track a peer receives for ti, starting with its
+// label so clients can tell the cameras of a publisher apart.
+func localTrackID(ti *TrackInfo) string {
+	label := ti.Label
+	if label == "" {
+		label = LabelMain
+	}
+	return label + "-" + ti.Track.ID() + "-" + uuid.NewString()
+}
@@ -0,0 +1,132 @@
+package room
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/Foodstream-io/etchebest/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v4"
+	"gorm.io/gorm"
+)
+
+// WSTypeEndOfCandidates tells a trickle client that the server finished
+// gathering its local candidates.
+const WSTypeEndOfCandidates = "end-of-candidates"
+
+// peerUsesTrickle reports whether userID's PeerConnection opted into server
+// trickle ICE. Must be called with the room lock held.
+func peerUsesTrickle(room *Room, userID string) bool {
+	for _, conn := range room.Connections {
+		if conn.UserID == userID && !conn.PublishOnly {
+			return conn.Trickle
+		}
+	}
+	return false
+}
+
+// bindLocalCandidates logs the server's gathered ICE candidates and, for
+// trickle clients, forwards each one over the WebSocket signaling channel
+// (or buffers it for the client to fetch) followed by end-of-candidates.
+// Must be set before the local description so no candidate is missed.
+func bindLocalCandidates(room *Room, userID string, pc *webrtc.PeerConnection, trickle bool) {
+	pc.OnICECandidate(func(cand *webrtc.ICECandidate) {
+		if cand != nil {
+			log.Printf("ICE candidate gathered: %s", cand.String())
+		}
+		if !trickle {
+			return
+		}
+
+		// Registration of the user's WebSocket flushes the buffer under the room lock,
+		// so holding it here guarantees no candidate falls in between.
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		if getPeerConnectionByUser(room, userID) != pc {
+			return
+		}
+
+		msg := WSMessage{Type: WSTypeEndOfCandidates}
+		if cand != nil {
+			init := cand.ToJSON()
+			msg = WSMessage{Type: WSTypeCandidate, Candidate: &init}
+		}
+		if _, seq := sendToUser(room.ID, userID, msg); seq != 0 {
+			return
+		}
+
+		if room.LocalICEByUser == nil {
+			room.LocalICEByUser = make(map[string][]webrtc.ICECandidateInit)
+		}
+		if room.LocalICEDoneByUser == nil {
+			room.LocalICEDoneByUser = make(map[string]bool)
+		}
+		if cand == nil {
+			room.LocalICEDoneByUser[userID] = true
+			return
+		}
+		room.LocalICEDoneByUser[userID] = false
+		room.LocalICEByUser[userID] = append(room.LocalICEByUser[userID], *msg.Candidate)
+	})
+}
+
+// takeLocalCandidates returns and clears the server candidates buffered for
+// userID and whether gathering has completed. Must be called with the room lock held.
+func takeLocalCandidates(room *Room, userID string) ([]webrtc.ICECandidateInit, bool) {
+	candidates := room.LocalICEByUser[userID]
+	done := room.LocalICEDoneByUser[userID]
+	delete(room.LocalICEByUser, userID)
+	delete(room.LocalICEDoneByUser, userID)
+	return candidates, done
+}
+
+// flushLocalCandidates sends the buffered server candidates to a freshly
+// connected WebSocket client. Must be called with the room lock held.
+func flushLocalCandidates(room *Room, wsClient *WSClientConn) {
+	candidates, done := takeLocalCandidates(room, wsClient.userID)
+	for i := range candidates {
+		wsClient.send(WSMessage{Type: WSTypeCandidate, Candidate: &candidates[i]})
+	}
+	if done {
+		wsClient.send(WSMessage{Type: WSTypeEndOfCandidates})
+	}
+}
+
+// PollLocalCandidates godoc
+// @Summary      Fetch server ICE candidates
+// @Description  Returns the server candidates gathered for the caller's trickle PeerConnection that were not delivered over WebSocket (compatibility mode)
+// @Tags         webrtc
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId query string true "Room ID"
+// @Success      200  {object}  map[string]interface{} "candidates and endOfCandidates"
+// @Failure      400  {object}  map[string]string "error: room ID is required"
+// @Failure      404  {object}  map[string]string "error: room not found"
+// @Router       /api/ice [get]
+func PollLocalCandidates(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		roomID := c.Query("roomId")
+		if roomID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "room ID is required"})
+			return
+		}
+		userID := utils.GetContextString(c, "userId")
+
+		room, err := getLiveRoom(db, roomID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+			return
+		}
+		room.mu.Lock()
+		candidates, done := takeLocalCandidates(room, userID)
+		room.mu.Unlock()
+
+		if candidates == nil {
+			candidates = []webrtc.ICECandidateInit{}
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"candidates":      candidates,
+			"endOfCandidates": done,
+		})
+	}
+}
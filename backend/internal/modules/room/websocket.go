@@ -2,21 +2,75 @@ package room
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	liveModule "github.com/Foodstream-io/etchebest/internal/modules/live"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v4"
 	"gorm.io/gorm"
 )
 
+// WebSocket signaling message types.
+//
+// Server -> client: offer, candidate, end-of-candidates, invitation, ack,
+// error, pong.
+// Client -> server: answer, candidate, rollback, ack, ping.
+//
+// The notification socket of a user, outside any room, only carries
+// invitation, ack, error and pong down and ack and ping up.
+//
+// Every message carries a per-direction sequence number ("seq"). The receiver
+// acknowledges it with {"type":"ack","ack":<seq>}, or answers with
+// {"type":"error","ack":<seq>,"error":...} when it could not be applied.
+// Duplicated client messages (seq already seen) are acknowledged again but
+// not re-applied. Offers that are not acknowledged in time are also queued
+// for the REST polling fallback.
+const (
+	WSTypeOffer     = "offer"
+	WSTypeAnswer    = "answer"
+	WSTypeCandidate = "candidate"
+	WSTypeRollback  = "rollback"
+	WSTypeAck       = "ack"
+	WSTypeError     = "error"
+	WSTypePing      = "ping"
+	WSTypePong      = "pong"
+	// WSTypeInvitation carries a co-host invitation whenever its state changes.
+	WSTypeInvitation = "invitation"
+	// WSTypeModeration announces a host moderation action on a co-host.
+	WSTypeModeration = "moderation"
+	// WSTypeStats pushes the room's latest RTC statistics to the host.
+	WSTypeStats = "stats"
+	// WSTypeHostStatus announces that the host's connection dropped or came back.
+	WSTypeHostStatus = "host-status"
+	// WSTypeLiveStatus announces a change in the status of the room's live.
+	WSTypeLiveStatus = "live-status"
+)
+
+// wsAckTimeout is how long an offer may stay unacknowledged before it is
+// also made available through PollRenegotiationOffer.
+const wsAckTimeout = 5 * time.Second
+
 // WSMessage represents messages sent over WebSocket
 type WSMessage struct {
-	Type  string                     `json:"type"`
-	Offer *webrtc.SessionDescription `json:"offer,omitempty"`
-	Error string                     `json:"error,omitempty"`
+	Type       string                     `json:"type"`
+	Seq        uint64                     `json:"seq,omitempty"`
+	Ack        uint64                     `json:"ack,omitempty"`
+	Offer      *webrtc.SessionDescription `json:"offer,omitempty"`
+	Answer     *webrtc.SessionDescription `json:"answer,omitempty"`
+	Candidate  *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	Invitation *Invitation                `json:"invitation,omitempty"`
+	Moderation *ModerationEvent           `json:"moderation,omitempty"`
+	Stats      *StatsSample               `json:"stats,omitempty"`
+	HostStatus *HostStatusEvent           `json:"hostStatus,omitempty"`
+	LiveStatus *liveModule.LiveTransition `json:"liveStatus,omitempty"`
+	Error      string                     `json:"error,omitempty"`
 }
 
 // WSClientConn stores WebSocket connection per user
@@ -26,6 +80,13 @@ type WSClientConn struct {
 	roomID   string
 	sendChan chan WSMessage
 	done     chan struct{}
+
+	// seq numbers server messages; lastClientSeq is only touched by the reader.
+	seq           atomic.Uint64
+	lastClientSeq uint64
+
+	ackMu   sync.Mutex
+	unacked map[uint64]WSMessage
 }
 
 // wsConnections maps roomId -> userId -> *WSClientConn
@@ -34,6 +95,13 @@ var (
 	wsConnections = make(map[string]map[string]*WSClientConn)
 )
 
+// userSockets holds the notification sockets of each user, one per device:
+// they reach users who are in no room, such as invited co-hosts.
+var (
+	userSocketsMu sync.RWMutex
+	userSockets   = make(map[string]map[*WSClientConn]bool)
+)
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -42,8 +110,10 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
-// HandleWebSocketOffer handles WebSocket connections for renegotiation offers
-// @Summary	Establish WebSocket connection for receiving renegotiation offers
+// HandleWebSocketOffer handles the WebSocket signaling channel: server offers
+// and candidates go down, client answers, candidates and rollbacks come up.
+// The REST answer/ICE/polling endpoints remain as a compatibility mode.
+// @Summary	Establish WebSocket signaling connection (offers, answers, trickle ICE, rollback)
 // @Tags		WebRTC
 // @Param		roomId	query	string	true	"Room ID"
 // @Success	101	"Switching Protocols"
@@ -76,10 +146,12 @@ func HandleWebSocketOffer(db *gorm.DB) gin.HandlerFunc {
 			c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
 			return
 		}
-		log.Printf("[WS] room %s found, has %d connections", roomID, len(room.Connections))
 
 		// Verify user is in this room
-		if !isUserInRoom(room, userID) {
+		room.mu.Lock()
+		log.Printf("[WS] room %s found, has %d connections", roomID, len(room.Connections))
+		inRoom := isUserInRoom(room, userID)
+		if !inRoom {
 			log.Printf("[WS] user %s NOT in room %s. Connections: %v", userID, roomID,
 				func(conns []PeerConnection) []string {
 					var userIDs []string
@@ -88,6 +160,9 @@ func HandleWebSocketOffer(db *gorm.DB) gin.HandlerFunc {
 					}
 					return userIDs
 				}(room.Connections))
+		}
+		room.mu.Unlock()
+		if !inRoom {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "user not in room"})
 			return
 		}
@@ -104,15 +179,21 @@ func HandleWebSocketOffer(db *gorm.DB) gin.HandlerFunc {
 			conn:     conn,
 			userID:   userID,
 			roomID:   roomID,
-			sendChan: make(chan WSMessage, 10),
+			sendChan: make(chan WSMessage, 32),
 			done:     make(chan struct{}),
+			unacked:  make(map[uint64]WSMessage),
 		}
 
-		// Register connection
+		// Register connection and deliver the server candidates gathered
+		// before the socket was open.
+		room.mu.Lock()
 		registerWSConnection(wsClient)
+		flushLocalCandidates(room, wsClient)
+		flushModerationState(room, wsClient)
+		room.mu.Unlock()
 
 		// Handle the connection
-		go handleWSConnection(wsClient)
+		go handleWSConnection(db, wsClient)
 
 		log.Printf("[WS] User %s connected to room %s", userID, roomID)
 	}
@@ -151,29 +232,15 @@ func unregisterWSConnection(wsClient *WSClientConn) {
 }
 
 // handleWSConnection reads and writes to the WebSocket
-func handleWSConnection(wsClient *WSClientConn) {
+func handleWSConnection(db *gorm.DB, wsClient *WSClientConn) {
 	defer func() {
 		unregisterWSConnection(wsClient)
 		wsClient.close()
 		log.Printf("[WS] User %s disconnected from room %s", wsClient.userID, wsClient.roomID)
 	}()
 
-	// Start message sender goroutine
-	go func() {
-		for {
-			select {
-			case msg := <-wsClient.sendChan:
-				if err := wsClient.conn.WriteJSON(msg); err != nil {
-					log.Printf("[WS] write error: %v", err)
-					return
-				}
-			case <-wsClient.done:
-				return
-			}
-		}
-	}()
+	go wsClient.writeLoop()
 
-	// Read messages from client (currently just for keepalive/pings)
 	for {
 		_, data, err := wsClient.conn.ReadMessage()
 		if err != nil {
@@ -183,42 +250,262 @@ func handleWSConnection(wsClient *WSClientConn) {
 			return
 		}
 
-		// Handle any incoming messages if needed
 		var msg WSMessage
-		if err := json.Unmarshal(data, &msg); err == nil {
-			// Currently just acknowledge, can be extended later
-			log.Printf("[WS] received message type: %s", msg.Type)
+		if err := json.Unmarshal(data, &msg); err != nil {
+			wsClient.send(WSMessage{Type: WSTypeError, Error: "invalid message"})
+			continue
+		}
+
+		if msg.Seq != 0 {
+			if msg.Seq <= wsClient.lastClientSeq {
+				// Retransmitted by the client: already applied, just ack again.
+				wsClient.send(WSMessage{Type: WSTypeAck, Ack: msg.Seq})
+				continue
+			}
+			wsClient.lastClientSeq = msg.Seq
+		}
+
+		if err := handleWSMessage(db, wsClient, msg); err != nil {
+			log.Printf("[WS] %s from user %s failed: %v", msg.Type, wsClient.userID, err)
+			wsClient.send(WSMessage{Type: WSTypeError, Ack: msg.Seq, Error: err.Error()})
+			continue
+		}
+		if msg.Seq != 0 && msg.Type != WSTypeAck {
+			wsClient.send(WSMessage{Type: WSTypeAck, Ack: msg.Seq})
 		}
 	}
 }
 
-// sendOfferToUser sends a renegotiation offer to a user via WebSocket
-func sendOfferToUser(roomID, userID string, offer *webrtc.SessionDescription) bool {
+// writeLoop writes the queued messages until the connection closes.
+func (wsc *WSClientConn) writeLoop() {
+	for {
+		select {
+		case msg := <-wsc.sendChan:
+			if err := wsc.conn.WriteJSON(msg); err != nil {
+				log.Printf("[WS] write error: %v", err)
+				return
+			}
+		case <-wsc.done:
+			return
+		}
+	}
+}
+
+// HandleNotificationSocket opens the current user's notification socket:
+// co-host invitations addressed to them are pushed there whenever their
+// state changes, before they join any room. Users connected to another
+// instance than the room's find them through GET /api/users/me/invitations.
+// @Summary	Open the notification WebSocket (co-host invitations)
+// @Tags		users
+// @Success	101	"Switching Protocols"
+// @Failure	401	{object}	map[string]string	"Unauthorized"
+// @Router		/api/users/me/notifications [get]
+func HandleNotificationSocket() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("userId")
+		if userID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "not authenticated"})
+			return
+		}
+
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			log.Printf("[WS] upgrade failed: %v", err)
+			return
+		}
+		wsClient := &WSClientConn{
+			conn:     conn,
+			userID:   userID,
+			sendChan: make(chan WSMessage, 32),
+			done:     make(chan struct{}),
+			unacked:  make(map[uint64]WSMessage),
+		}
+
+		userSocketsMu.Lock()
+		if userSockets[userID] == nil {
+			userSockets[userID] = make(map[*WSClientConn]bool)
+		}
+		userSockets[userID][wsClient] = true
+		userSocketsMu.Unlock()
+
+		go handleNotificationSocket(wsClient)
+		log.Printf("[WS] user %s opened their notification socket", userID)
+	}
+}
+
+func handleNotificationSocket(wsClient *WSClientConn) {
+	defer func() {
+		userSocketsMu.Lock()
+		delete(userSockets[wsClient.userID], wsClient)
+		if len(userSockets[wsClient.userID]) == 0 {
+			delete(userSockets, wsClient.userID)
+		}
+		userSocketsMu.Unlock()
+		wsClient.close()
+	}()
+
+	go wsClient.writeLoop()
+
+	for {
+		var msg WSMessage
+		if err := wsClient.conn.ReadJSON(&msg); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				wsClient.send(WSMessage{Type: WSTypeError, Error: "invalid message"})
+				continue
+			}
+			return
+		}
+		switch msg.Type {
+		case WSTypeAck:
+		case WSTypePing:
+			wsClient.send(WSMessage{Type: WSTypePong})
+		default:
+			wsClient.send(WSMessage{Type: WSTypeError, Ack: msg.Seq, Error: fmt.Sprintf("unknown message type %q", msg.Type)})
+		}
+	}
+}
+
+// sendToUserSockets queues msg for every notification socket of a user.
+func sendToUserSockets(userID string, msg WSMessage) {
+	userSocketsMu.RLock()
+	clients := make([]*WSClientConn, 0, len(userSockets[userID]))
+	for wsClient := range userSockets[userID] {
+		clients = append(clients, wsClient)
+	}
+	userSocketsMu.RUnlock()
+
+	for _, wsClient := range clients {
+		wsClient.send(msg)
+	}
+}
+
+// handleWSMessage applies one client signaling message.
+func handleWSMessage(db *gorm.DB, wsClient *WSClientConn, msg WSMessage) error {
+	switch msg.Type {
+	case WSTypeAck:
+		wsClient.ackMu.Lock()
+		delete(wsClient.unacked, msg.Ack)
+		wsClient.ackMu.Unlock()
+		return nil
+	case WSTypePing:
+		wsClient.send(WSMessage{Type: WSTypePong})
+		return nil
+	}
+
+	room, err := getLiveRoom(db, wsClient.roomID)
+	if err != nil {
+		return errors.New("room not found")
+	}
+
+	switch msg.Type {
+	case WSTypeAnswer:
+		if msg.Answer == nil || msg.Answer.Type != webrtc.SDPTypeAnswer {
+			return errors.New("expected SDP answer")
+		}
+		return applyRenegotiationAnswer(room, wsClient.userID, *msg.Answer)
+	case WSTypeCandidate:
+		if msg.Candidate == nil {
+			return errors.New("missing candidate")
+		}
+		_, err := addRemoteCandidate(room, wsClient.userID, *msg.Candidate)
+		return err
+	case WSTypeRollback:
+		return rollbackRenegotiationOffer(room, wsClient.userID)
+	}
+	return fmt.Errorf("unknown message type %q", msg.Type)
+}
+
+// send stamps msg with the next server sequence number and queues it.
+// Returns the sequence number, or 0 if the message could not be queued.
+func (wsc *WSClientConn) send(msg WSMessage) uint64 {
+	msg.Seq = wsc.seq.Add(1)
+	select {
+	case wsc.sendChan <- msg:
+		return msg.Seq
+	case <-wsc.done:
+		return 0
+	default:
+		log.Printf("[WS] send channel full for user %s in room %s", wsc.userID, wsc.roomID)
+		return 0
+	}
+}
+
+// sendToUser queues a message for a user's WebSocket, if connected.
+func sendToUser(roomID, userID string, msg WSMessage) (*WSClientConn, uint64) {
 	wsConnMu.RLock()
 	wsClient, exists := wsConnections[roomID][userID]
 	wsConnMu.RUnlock()
 
 	if !exists {
-		log.Printf("[WS] no active connection for user %s in room %s", userID, roomID)
-		return false
+		return nil, 0
 	}
+	return wsClient, wsClient.send(msg)
+}
 
-	msg := WSMessage{
-		Type:  "offer",
-		Offer: offer,
+// BroadcastLiveStatus tells the clients of a room that its live changed
+// status. Meant to be registered with liveModule.OnTransition.
+func BroadcastLiveStatus(t liveModule.LiveTransition) {
+	sendToRoom(t.RoomID, WSMessage{Type: WSTypeLiveStatus, LiveStatus: &t})
+}
+
+// sendToRoom queues msg for every WebSocket client of a room.
+func sendToRoom(roomID string, msg WSMessage) {
+	wsConnMu.RLock()
+	clients := make([]*WSClientConn, 0, len(wsConnections[roomID]))
+	for _, wsClient := range wsConnections[roomID] {
+		clients = append(clients, wsClient)
 	}
+	wsConnMu.RUnlock()
 
-	select {
-	case wsClient.sendChan <- msg:
-		log.Printf("[WS] sent offer to user %s in room %s", userID, roomID)
-		return true
-	case <-wsClient.done:
-		log.Printf("[WS] connection closed for user %s in room %s", userID, roomID)
-		return false
-	default:
-		log.Printf("[WS] send channel full for user %s in room %s", userID, roomID)
+	for _, wsClient := range clients {
+		wsClient.send(msg)
+	}
+}
+
+// sendOfferToUser sends a renegotiation offer to a user via WebSocket.
+// If the client does not acknowledge it in time, the offer is also stored
+// for the polling fallback.
+func sendOfferToUser(roomID, userID string, offer *webrtc.SessionDescription) bool {
+	msg := WSMessage{Type: WSTypeOffer, Offer: offer}
+	wsClient, seq := sendToUser(roomID, userID, msg)
+	if seq == 0 {
+		log.Printf("[WS] could not send offer to user %s in room %s", userID, roomID)
 		return false
 	}
+	log.Printf("[WS] sent offer seq=%d to user %s in room %s", seq, userID, roomID)
+
+	wsClient.ackMu.Lock()
+	wsClient.unacked[seq] = msg
+	wsClient.ackMu.Unlock()
+
+	time.AfterFunc(wsAckTimeout, func() {
+		wsClient.ackMu.Lock()
+		_, pending := wsClient.unacked[seq]
+		delete(wsClient.unacked, seq)
+		wsClient.ackMu.Unlock()
+		if !pending {
+			return
+		}
+
+		log.Printf("[WS] offer seq=%d not acknowledged by user %s, storing it for polling", seq, userID)
+		room := lookupLiveRoom(roomID)
+		if room == nil {
+			return
+		}
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		// Only the latest local offer is still answerable.
+		pc := getPeerConnectionByUser(room, userID)
+		if pc == nil || pc.PendingLocalDescription() == nil || pc.PendingLocalDescription().SDP != offer.SDP {
+			return
+		}
+		if room.PendingOfferByUser == nil {
+			room.PendingOfferByUser = make(map[string]webrtc.SessionDescription)
+		}
+		room.PendingOfferByUser[userID] = *offer
+	})
+	return true
 }
 
 // close closes the WebSocket connection
@@ -232,7 +519,8 @@ func (wsc *WSClientConn) close() {
 	wsc.conn.Close()
 }
 
-// isUserInRoom checks if a user is connected to a room
+// isUserInRoom checks if a user is connected to a room.
+// Must be called with the room's lock held.
 func isUserInRoom(room *Room, userID string) bool {
 	if room == nil {
 		return false
@@ -0,0 +1,451 @@
+package room
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	liveModule "github.com/Foodstream-io/etchebest/internal/modules/live"
+	"github.com/Foodstream-io/etchebest/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"gorm.io/gorm"
+)
+
+// DefaultMaxSubscribers is the per-room WHEP admission limit used when
+// WHEP_MAX_SUBSCRIBERS is not configured.
+const DefaultMaxSubscribers = 50
+
+// detachPeerFromTracks removes every per-peer LocalTrack/sender registered for
+// pc. Must be called with the room lock held.
+func detachPeerFromTracks(room *Room, pc *webrtc.PeerConnection) {
+	for _, ti := range room.Tracks {
+		if ti.LocalTracks != nil {
+			delete(ti.LocalTracks, pc)
+		}
+		if ti.PeerPT != nil {
+			delete(ti.PeerPT, pc)
+		}
+		if ti.SendersByPeer != nil {
+			delete(ti.SendersByPeer, pc)
+		}
+		if ti.PeerLayer != nil {
+			delete(ti.PeerLayer, pc)
+		}
+		delete(ti.peerRebase, pc)
+	}
+}
+
+// removeSubscriber tears down a WHEP subscriber. It is idempotent: the
+// session is only cleaned up by the first caller.
+func removeSubscriber(room *Room, sessionID string) {
+	room.mu.Lock()
+	sub, ok := room.Subscribers[sessionID]
+	if !ok {
+		room.mu.Unlock()
+		return
+	}
+	delete(room.Subscribers, sessionID)
+	detachPeerFromTracks(room, sub.PeerCon)
+	room.mu.Unlock()
+
+	if sub.PeerCon.ConnectionState() != webrtc.PeerConnectionStateClosed {
+		_ = sub.PeerCon.Close()
+	}
+	log.Printf("[WHEP] subscriber %s left room %s", sessionID, room.ID)
+}
+
+// takeSubscribers empties the WHEP subscriber list and returns the removed
+// PeerConnections so they can be closed outside the lock.
+// Must be called with the room lock held.
+func takeSubscribers(room *Room) []*webrtc.PeerConnection {
+	pcs := make([]*webrtc.PeerConnection, 0, len(room.Subscribers))
+	for _, sub := range room.Subscribers {
+		pcs = append(pcs, sub.PeerCon)
+	}
+	room.Subscribers = nil
+	return pcs
+}
+
+// syncSubscriberTracks makes a WHEP subscriber receive what it watches once
+// tracks came or went: its video senders are re-pointed to the camera it
+// chose when the codec allows, the videos it no longer watches are removed
+// and the tracks it misses are added. Returns whether it needs a new offer.
+// Must be called with the room lock held.
+func syncSubscriberTracks(room *Room, sub *Subscriber) bool {
+	pc := sub.PeerCon
+	for _, r := range switchSubscriberCamera(room, sub, sub.Camera) {
+		requestKeyframeBurst(r.pc, r.ssrc)
+	}
+	changed := false
+	for _, ti := range room.Tracks {
+		sender, ok := ti.SendersByPeer[pc]
+		if !ok || receivesTrack(room, pc, ti) {
+			continue
+		}
+		if err := pc.RemoveTrack(sender); err != nil {
+			log.Printf("[WHEP] room %s: remove track: %v", room.ID, err)
+		}
+		delete(ti.LocalTracks, pc)
+		delete(ti.PeerPT, pc)
+		delete(ti.SendersByPeer, pc)
+		delete(ti.PeerLayer, pc)
+		delete(ti.peerRebase, pc)
+		changed = true
+	}
+	return attachExistingTracks(pc, room) > 0 || changed
+}
+
+// subscriberTargets syncs every WHEP subscriber with the room's tracks and
+// returns the ones needing a new offer: those given or refused a track, and
+// those in lostTrack, whose senders were removed along with their track.
+// Must be called with the room lock held.
+func subscriberTargets(room *Room, lostTrack map[*webrtc.PeerConnection]bool) []renegotiationTarget {
+	var targets []renegotiationTarget
+	for sessionID, sub := range room.Subscribers {
+		if syncSubscriberTracks(room, sub) || lostTrack[sub.PeerCon] {
+			targets = append(targets, renegotiationTarget{pc: sub.PeerCon, sessionID: sessionID})
+		}
+	}
+	return targets
+}
+
+// requestSubscriberOffer creates a server offer for a WHEP subscriber whose
+// tracks changed and leaves it for the subscriber to poll. WHEP sessions do
+// not trickle server candidates: the offer waits for gathering.
+func requestSubscriberOffer(room *Room, sessionID string) {
+	room.mu.Lock()
+	sub := room.Subscribers[sessionID]
+	if sub == nil {
+		room.mu.Unlock()
+		return
+	}
+	if sub.pendingOffer != nil || sub.renegotiating {
+		sub.needsRenegotiation = true
+		room.mu.Unlock()
+		return
+	}
+	sub.renegotiating = true
+	sub.needsRenegotiation = false
+	pc := sub.PeerCon
+	room.mu.Unlock()
+
+	offer, err := createSubscriberOffer(pc)
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	sub.renegotiating = false
+	if room.Subscribers[sessionID] != sub {
+		return
+	}
+	if err != nil {
+		log.Printf("[WHEP] room %s: offer to subscriber %s: %v", room.ID, sessionID, err)
+		sub.needsRenegotiation = true
+		return
+	}
+	sub.pendingOffer = offer
+	log.Printf("[WHEP] room %s: offer pending for subscriber %s", room.ID, sessionID)
+}
+
+var errSignalingBusy = errors.New("signaling is not stable")
+
+func createSubscriberOffer(pc *webrtc.PeerConnection) (*webrtc.SessionDescription, error) {
+	if pc.SignalingState() != webrtc.SignalingStateStable {
+		return nil, errSignalingBusy
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return nil, err
+	}
+	<-gatherComplete
+	return pc.LocalDescription(), nil
+}
+
+// settleSubscriber sends the offer track changes queued while a WHEP
+// subscriber was busy negotiating.
+func settleSubscriber(room *Room, sessionID string) {
+	room.mu.Lock()
+	sub := room.Subscribers[sessionID]
+	queued := sub != nil && sub.needsRenegotiation && sub.pendingOffer == nil && !sub.renegotiating
+	room.mu.Unlock()
+	if queued {
+		go requestSubscriberOffer(room, sessionID)
+	}
+}
+
+// HandleWHEP godoc
+// @Summary      WHEP playback
+// @Description  WebRTC-HTTP Egress Protocol endpoint: accepts a receive-only SDP offer and answers with the room's current tracks, one video per publisher from the chosen camera, to the live's audience. Subscribers are not participants and have their own admission limit.
+// @Tags         webrtc
+// @Accept       application/sdp
+// @Produce      application/sdp
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        camera query string false "Camera to receive from each publisher: main (default), overhead or screen"
+// @Success      201  {string}  string "SDP answer, Location header points to the WHEP session"
+// @Failure      400  {string}  string "invalid camera"
+// @Failure      403  {string}  string "this live is private"
+// @Failure      404  {string}  string "room not found"
+// @Failure      415  {string}  string "expected application/sdp"
+// @Failure      503  {string}  string "room is full or not publishing yet"
+// @Router       /api/whep/{roomId} [post]
+func HandleWHEP(db *gorm.DB, STUNServerURL string, webrtcIP string, maxSubscribers int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		roomID := c.Param("roomId")
+		userID := utils.GetContextString(c, "userId")
+
+		camera := c.DefaultQuery("camera", LabelMain)
+		if !validTrackLabel(camera) {
+			c.String(http.StatusBadRequest, "invalid camera")
+			return
+		}
+
+		offerSDP, ok := readSDPBody(c, sdpContentType)
+		if !ok {
+			return
+		}
+
+		room, err := getLiveRoom(db, roomID)
+		if err != nil {
+			c.String(http.StatusNotFound, "room not found")
+			return
+		}
+		var live liveModule.Live
+		if err := db.Select("room_id", "user_id", "visibility", "subscribers_only").
+			Where("room_id = ? AND status <> ?", roomID, liveModule.StatusCancelled).
+			First(&live).Error; err != nil {
+			c.String(http.StatusNotFound, "room not found")
+			return
+		}
+		if status, refusal := audienceRefusal(db, &live, userID, c.GetString("role")); refusal != "" {
+			c.String(status, refusal)
+			return
+		}
+		room.mu.Lock()
+		full := len(room.Subscribers) >= maxSubscribers
+		publishing := len(room.Tracks) > 0
+		room.mu.Unlock()
+
+		if full {
+			c.Header("Retry-After", "30")
+			c.String(http.StatusServiceUnavailable, "room is full")
+			return
+		}
+		// Tracks published later come through server offers, but a player
+		// with nothing to play yet is better off retrying.
+		if !publishing {
+			c.Header("Retry-After", "5")
+			c.String(http.StatusServiceUnavailable, "room is not publishing yet")
+			return
+		}
+
+		pc, err := newPeerConnection(STUNServerURL, webrtcIP)
+		if err != nil {
+			log.Printf("[WHEP] new peer connection: %v", err)
+			c.String(http.StatusInternalServerError, "failed to create peer connection")
+			return
+		}
+
+		offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offerSDP}
+		if err := pc.SetRemoteDescription(offer); err != nil {
+			log.Printf("[WHEP] SetRemoteDescription: %v", err)
+			_ = pc.Close()
+			c.String(http.StatusBadRequest, "invalid SDP offer")
+			return
+		}
+
+		sessionID := uuid.NewString()
+		room.mu.Lock()
+		if room.closed {
+			room.mu.Unlock()
+			_ = pc.Close()
+			c.String(http.StatusNotFound, "room not found")
+			return
+		}
+		if len(room.Subscribers) >= maxSubscribers {
+			room.mu.Unlock()
+			_ = pc.Close()
+			c.Header("Retry-After", "30")
+			c.String(http.StatusServiceUnavailable, "room is full")
+			return
+		}
+		if room.Subscribers == nil {
+			room.Subscribers = make(map[string]*Subscriber)
+		}
+		room.Subscribers[sessionID] = &Subscriber{UserID: userID, PeerCon: pc, Camera: camera}
+		attachExistingTracks(pc, room)
+		room.mu.Unlock()
+
+		pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+			if state == webrtc.PeerConnectionStateFailed ||
+				state == webrtc.PeerConnectionStateClosed {
+				removeSubscriber(room, sessionID)
+			}
+		})
+
+		answer, err := createAnswer(pc, false)
+		if err != nil {
+			log.Printf("[WHEP] %v", err)
+			removeSubscriber(room, sessionID)
+			c.String(http.StatusInternalServerError, "failed to create answer")
+			return
+		}
+
+		// Tracks published while answering are offered right away.
+		settleSubscriber(room, sessionID)
+
+		log.Printf("[WHEP] subscriber %s joined room %s", sessionID, roomID)
+		c.Header("Location", "/api/whep/"+roomID+"/"+sessionID)
+		c.Header("ETag", `"`+sdpAttribute(answer.SDP, "ice-ufrag")+`"`)
+		c.Data(http.StatusCreated, sdpContentType, []byte(answer.SDP))
+	}
+}
+
+// whepSession resolves the caller's WHEP subscriber.
+// Returns nil (and writes the HTTP error) when the caller should abort.
+func whepSession(c *gin.Context, db *gorm.DB) (*Room, *Subscriber) {
+	userID := utils.GetContextString(c, "userId")
+
+	room, err := getLiveRoom(db, c.Param("roomId"))
+	if err != nil {
+		c.String(http.StatusNotFound, "room not found")
+		return nil, nil
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	sub, ok := room.Subscribers[c.Param("sessionId")]
+	if !ok || sub.UserID != userID {
+		c.String(http.StatusNotFound, "session not found")
+		return nil, nil
+	}
+	return room, sub
+}
+
+// HandleWHEPPatch godoc
+// @Summary      WHEP trickle ICE
+// @Description  Add trickled ICE candidates (application/trickle-ice-sdpfrag) to a WHEP session. ICE restarts are not supported.
+// @Tags         webrtc
+// @Accept       application/trickle-ice-sdpfrag
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        sessionId path string true "WHEP session ID"
+// @Success      204
+// @Failure      400  {string}  string "invalid candidate"
+// @Failure      404  {string}  string "session not found"
+// @Failure      422  {string}  string "ICE restart is not supported"
+// @Router       /api/whep/{roomId}/{sessionId} [patch]
+func HandleWHEPPatch(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, sub := whepSession(c, db)
+		if sub == nil {
+			return
+		}
+		applyTrickleICE(c, sub.PeerCon)
+	}
+}
+
+// HandleWHEPDelete godoc
+// @Summary      End a WHEP session
+// @Description  Stop watching: closes the subscriber PeerConnection and frees its admission slot
+// @Tags         webrtc
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        sessionId path string true "WHEP session ID"
+// @Success      200
+// @Failure      404  {string}  string "session not found"
+// @Router       /api/whep/{roomId}/{sessionId} [delete]
+func HandleWHEPDelete(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		room, sub := whepSession(c, db)
+		if sub == nil {
+			return
+		}
+		removeSubscriber(room, c.Param("sessionId"))
+		c.Status(http.StatusOK)
+	}
+}
+
+// PollWHEPOffer godoc
+// @Summary      Poll a WHEP server offer
+// @Description  Return the SDP offer the server made to a WHEP subscriber after publishers added or removed tracks (screen shares, reconnects), or 204 when there is none. Answer it through the answer endpoint.
+// @Tags         webrtc
+// @Produce      application/sdp
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        sessionId path string true "WHEP session ID"
+// @Success      200  {string}  string "SDP offer"
+// @Success      204
+// @Failure      404  {string}  string "session not found"
+// @Router       /api/whep/{roomId}/{sessionId}/offer [get]
+func PollWHEPOffer(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		room, sub := whepSession(c, db)
+		if sub == nil {
+			return
+		}
+		room.mu.Lock()
+		offer := sub.pendingOffer
+		room.mu.Unlock()
+
+		if offer == nil {
+			c.Status(http.StatusNoContent)
+			return
+		}
+		c.Data(http.StatusOK, sdpContentType, []byte(offer.SDP))
+	}
+}
+
+// HandleWHEPAnswer godoc
+// @Summary      Answer a WHEP server offer
+// @Description  Apply the subscriber's SDP answer to the pending server offer
+// @Tags         webrtc
+// @Accept       application/sdp
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Param        sessionId path string true "WHEP session ID"
+// @Success      204
+// @Failure      400  {string}  string "invalid SDP answer"
+// @Failure      404  {string}  string "session not found"
+// @Failure      409  {string}  string "no offer pending"
+// @Failure      415  {string}  string "expected application/sdp"
+// @Router       /api/whep/{roomId}/{sessionId}/answer [post]
+func HandleWHEPAnswer(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		answerSDP, ok := readSDPBody(c, sdpContentType)
+		if !ok {
+			return
+		}
+		room, sub := whepSession(c, db)
+		if sub == nil {
+			return
+		}
+		sessionID := c.Param("sessionId")
+
+		room.mu.Lock()
+		pending := sub.pendingOffer != nil
+		room.mu.Unlock()
+		if !pending {
+			c.String(http.StatusConflict, "no offer pending")
+			return
+		}
+
+		answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answerSDP}
+		if err := sub.PeerCon.SetRemoteDescription(answer); err != nil {
+			log.Printf("[WHEP] room %s: answer of subscriber %s: %v", room.ID, sessionID, err)
+			c.String(http.StatusBadRequest, "invalid SDP answer")
+			return
+		}
+		room.mu.Lock()
+		sub.pendingOffer = nil
+		room.mu.Unlock()
+
+		settleSubscriber(room, sessionID)
+		c.Status(http.StatusNoContent)
+	}
+}
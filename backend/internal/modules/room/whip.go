@@ -0,0 +1,341 @@
+package room
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Foodstream-io/etchebest/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+	"gorm.io/gorm"
+)
+
+const (
+	sdpContentType      = "application/sdp"
+	trickleICEFragType  = "application/trickle-ice-sdpfrag"
+	maxWHIPBodySize     = 64 * 1024
+	secretTokenByteSize = 24
+)
+
+func generateSecretToken() (string, error) {
+	b := make([]byte, secretTokenByteSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header.
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+// authorizeIngest loads the live room and checks the per-room ingest token.
+// Returns nil (and writes the HTTP error) when the caller should abort.
+func authorizeIngest(c *gin.Context, db *gorm.DB, roomID string) *Room {
+	token := bearerToken(c)
+
+	room, err := getLiveRoom(db, roomID)
+	if err != nil {
+		c.String(http.StatusNotFound, "room not found")
+		return nil
+	}
+
+	room.mu.Lock()
+	ingestToken := room.IngestToken
+	room.mu.Unlock()
+
+	if token == "" || ingestToken == "" ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(ingestToken)) != 1 {
+		c.Header("WWW-Authenticate", `Bearer realm="whip"`)
+		c.String(http.StatusUnauthorized, "invalid ingest token")
+		return nil
+	}
+	return room
+}
+
+// readSDPBody reads an SDP (or SDP fragment) body with the expected content type.
+func readSDPBody(c *gin.Context, contentType string) (string, bool) {
+	if !strings.HasPrefix(strings.ToLower(c.ContentType()), contentType) {
+		c.String(http.StatusUnsupportedMediaType, "expected "+contentType)
+		return "", false
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWHIPBodySize))
+	if err != nil || len(body) == 0 {
+		c.String(http.StatusBadRequest, "invalid body")
+		return "", false
+	}
+	return string(body), true
+}
+
+// sdpAttribute returns the value of the first "a=<name>:" line of an SDP blob.
+func sdpAttribute(sdp, name string) string {
+	prefix := "a=" + name + ":"
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix)
+		}
+	}
+	return ""
+}
+
+// CreateIngestToken godoc
+// @Summary      Create WHIP ingest credentials
+// @Description  Generate (or rotate) the per-room bearer token used by OBS and hardware encoders to publish over WHIP (host only)
+// @Tags         webrtc
+// @Produce      json
+// @Security     BearerAuth
+// @Param        roomId path string true "Room ID"
+// @Success      200  {object}  map[string]string "whipUrl and token"
+// @Failure      403  {object}  map[string]string "error: only the host can publish to this room"
+// @Failure      404  {object}  map[string]string "error: room not found"
+// @Failure      500  {object}  map[string]string "error: failed to save ingest token"
+// @Router       /api/rooms/{roomId}/ingest-token [post]
+func CreateIngestToken(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		roomID := c.Param("roomId")
+		currentUserID := utils.GetContextString(c, "userId")
+
+		room, err := getLiveRoom(db, roomID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "room not found"})
+			return
+		}
+
+		room.mu.Lock()
+		defer room.mu.Unlock()
+		if room.Host != currentUserID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only the host can publish to this room"})
+			return
+		}
+
+		token, err := generateSecretToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate ingest token"})
+			return
+		}
+		room.IngestToken = token
+		if err := SaveRoom(db, room); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save ingest token"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"whipUrl": "/api/whip/" + roomID,
+			"token":   token,
+		})
+	}
+}
+
+// HandleWHIP godoc
+// @Summary      WHIP ingest
+// @Description  WebRTC-HTTP Ingestion Protocol endpoint: accepts an SDP offer from OBS or a hardware encoder and publishes it as the room host
+// @Tags         webrtc
+// @Accept       application/sdp
+// @Produce      application/sdp
+// @Param        roomId path string true "Room ID"
+// @Param        Authorization header string true "Bearer <ingest token>"
+// @Success      201  {string}  string "SDP answer, Location header points to the WHIP session"
+// @Failure      401  {string}  string "invalid ingest token"
+// @Failure      404  {string}  string "room not found"
+// @Failure      409  {string}  string "host is already publishing"
+// @Failure      415  {string}  string "expected application/sdp"
+// @Router       /api/whip/{roomId} [post]
+func HandleWHIP(db *gorm.DB, STUNServerURL string, webrtcIP string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		roomID := c.Param("roomId")
+
+		room := authorizeIngest(c, db, roomID)
+		if room == nil {
+			return
+		}
+
+		offerSDP, ok := readSDPBody(c, sdpContentType)
+		if !ok {
+			return
+		}
+
+		pc, err := newPeerConnection(STUNServerURL, webrtcIP)
+		if err != nil {
+			log.Printf("[WHIP] new peer connection: %v", err)
+			c.String(http.StatusInternalServerError, "failed to create peer connection")
+			return
+		}
+
+		// A WHIP publisher always takes the host slot, so refuse when the host
+		// is already publishing from the app or from another encoder, unless
+		// that connection dropped and the live is waiting for the host.
+		sessionID := uuid.NewString()
+		room.mu.Lock()
+		if room.closed {
+			room.mu.Unlock()
+			_ = pc.Close()
+			c.String(http.StatusNotFound, "room not found")
+			return
+		}
+		replaceAwaitedHost(room)
+		if room.HostPeerCon != nil {
+			room.mu.Unlock()
+			_ = pc.Close()
+			c.String(http.StatusConflict, "host is already publishing")
+			return
+		}
+		room.HostPeerCon = pc
+		room.Connections = append(room.Connections, PeerConnection{
+			UserID:      room.Host,
+			PeerCon:     pc,
+			PublishOnly: true,
+		})
+		room.lastActivity = time.Now()
+		if room.WHIPSessions == nil {
+			room.WHIPSessions = make(map[string]*webrtc.PeerConnection)
+		}
+		room.WHIPSessions[sessionID] = pc
+		room.mu.Unlock()
+
+		markLiveAsStartedByRoomID(db, roomID, room.Host)
+		bindPeerHandlers(db, room, roomID, pc)
+
+		offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offerSDP}
+		if err := pc.SetRemoteDescription(offer); err != nil {
+			log.Printf("[WHIP] SetRemoteDescription: %v", err)
+			onPeerDisconnected(db, room, roomID, pc)
+			c.String(http.StatusBadRequest, "invalid SDP offer")
+			return
+		}
+
+		answer, err := createAnswer(pc, false)
+		if err != nil {
+			log.Printf("[WHIP] %v", err)
+			onPeerDisconnected(db, room, roomID, pc)
+			c.String(http.StatusInternalServerError, "failed to create answer")
+			return
+		}
+
+		log.Printf("[WHIP] session %s publishing to room %s", sessionID, roomID)
+		c.Header("Location", "/api/whip/"+roomID+"/"+sessionID)
+		c.Header("ETag", `"`+sdpAttribute(answer.SDP, "ice-ufrag")+`"`)
+		c.Data(http.StatusCreated, sdpContentType, []byte(answer.SDP))
+	}
+}
+
+// whipSession resolves the PeerConnection of an authorized WHIP resource.
+// Returns nil (and writes the HTTP error) when the caller should abort.
+func whipSession(c *gin.Context, db *gorm.DB) (*Room, *webrtc.PeerConnection) {
+	roomID := c.Param("roomId")
+	room := authorizeIngest(c, db, roomID)
+	if room == nil {
+		return nil, nil
+	}
+
+	room.mu.Lock()
+	pc := room.WHIPSessions[c.Param("sessionId")]
+	room.mu.Unlock()
+	if pc == nil {
+		c.String(http.StatusNotFound, "session not found")
+		return nil, nil
+	}
+	return room, pc
+}
+
+// HandleWHIPPatch godoc
+// @Summary      WHIP trickle ICE
+// @Description  Add trickled ICE candidates (application/trickle-ice-sdpfrag) to a WHIP session. ICE restarts are not supported.
+// @Tags         webrtc
+// @Accept       application/trickle-ice-sdpfrag
+// @Param        roomId path string true "Room ID"
+// @Param        sessionId path string true "WHIP session ID"
+// @Param        Authorization header string true "Bearer <ingest token>"
+// @Success      204
+// @Failure      400  {string}  string "invalid candidate"
+// @Failure      404  {string}  string "session not found"
+// @Failure      422  {string}  string "ICE restart is not supported"
+// @Router       /api/whip/{roomId}/{sessionId} [patch]
+func HandleWHIPPatch(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, pc := whipSession(c, db)
+		if pc == nil {
+			return
+		}
+
+		applyTrickleICE(c, pc)
+	}
+}
+
+// applyTrickleICE adds the candidates of a trickle-ice-sdpfrag PATCH body to pc
+// and writes the HTTP response. ICE restarts are rejected with 422.
+func applyTrickleICE(c *gin.Context, pc *webrtc.PeerConnection) {
+	frag, ok := readSDPBody(c, trickleICEFragType)
+	if !ok {
+		return
+	}
+
+	if remote := pc.RemoteDescription(); remote != nil {
+		ufrag := sdpAttribute(frag, "ice-ufrag")
+		if ufrag != "" && ufrag != sdpAttribute(remote.SDP, "ice-ufrag") {
+			c.String(http.StatusUnprocessableEntity, "ICE restart is not supported")
+			return
+		}
+	}
+
+	var mid *string
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			m := strings.TrimPrefix(line, "a=mid:")
+			mid = &m
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    mid,
+			}
+			if err := pc.AddICECandidate(candidate); err != nil {
+				log.Printf("trickle ICE: add candidate: %v", err)
+				c.String(http.StatusBadRequest, "invalid candidate")
+				return
+			}
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// HandleWHIPDelete godoc
+// @Summary      End a WHIP session
+// @Description  Stop publishing: closes the ingest PeerConnection and releases the host slot
+// @Tags         webrtc
+// @Param        roomId path string true "Room ID"
+// @Param        sessionId path string true "WHIP session ID"
+// @Param        Authorization header string true "Bearer <ingest token>"
+// @Success      200
+// @Failure      404  {string}  string "session not found"
+// @Router       /api/whip/{roomId}/{sessionId} [delete]
+func HandleWHIPDelete(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		room, pc := whipSession(c, db)
+		if pc == nil {
+			return
+		}
+
+		room.mu.Lock()
+		delete(room.WHIPSessions, c.Param("sessionId"))
+		room.mu.Unlock()
+
+		onPeerDisconnected(db, room, room.ID, pc)
+		log.Printf("[WHIP] session %s ended for room %s", c.Param("sessionId"), room.ID)
+		c.Status(http.StatusOK)
+	}
+}
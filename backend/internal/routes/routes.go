@@ -3,6 +3,7 @@ package routes
 import (
 	"net/http"
 	"os"
+	"strconv"
 
 	"github.com/Foodstream-io/etchebest/internal/modules/chat"
 
@@ -18,13 +19,16 @@ import (
 	ginSwagger "github.com/swaggo/gin-swagger"
 
 	"github.com/Foodstream-io/etchebest/internal/auth"
+	"github.com/Foodstream-io/etchebest/internal/cluster"
+	"github.com/Foodstream-io/etchebest/internal/hls"
 	"github.com/Foodstream-io/etchebest/internal/middleware"
+	"github.com/Foodstream-io/etchebest/internal/turnserver"
 	"gorm.io/gorm"
 
 	"github.com/gin-gonic/gin"
 )
 
-func Routes(r *gin.Engine, db *gorm.DB, jwtToken string, stunServerURL string, webrtcIP string) {
+func Routes(r *gin.Engine, db *gorm.DB, jwtToken string, stunServerURL string, webrtcIP string, registry *cluster.Registry, turnServer *turnserver.Server) {
 	r.Use(middleware.CorsHandler())
 	bJwtToken := []byte(jwtToken)
 	const usersMePath = "/users/me"
@@ -34,6 +38,11 @@ func Routes(r *gin.Engine, db *gorm.DB, jwtToken string, stunServerURL string, w
 	googleClientSecret := os.Getenv("GOOGLE_CLIENT_SECRET")
 	googleRedirectURI := os.Getenv("GOOGLE_REDIRECT_URI")
 
+	whepMaxSubscribers := room.DefaultMaxSubscribers
+	if v, err := strconv.Atoi(os.Getenv("WHEP_MAX_SUBSCRIBERS")); err == nil && v > 0 {
+		whepMaxSubscribers = v
+	}
+
 	// facebookAppID := os.Getenv("FACEBOOK_APP_ID")
 	// facebookAppSecret := os.Getenv("FACEBOOK_APP_SECRET")
 	// facebookRedirectURI := os.Getenv("FACEBOOK_REDIRECT_URI")
@@ -97,31 +106,95 @@ func Routes(r *gin.Engine, db *gorm.DB, jwtToken string, stunServerURL string, w
 	api.GET("/users/me/activities", activity.GetMyActivities(db))
 	api.GET("/users/me/scheduled-live", live.GetMyScheduledLive(db))
 
+	// Live room state lives on the instance that owns the room: requests
+	// reaching another instance are proxied to the owner. Only joining a
+	// room claims it when no instance serves it.
+	byRoomParam := registry.RouteToOwner(cluster.RoomIDParam("roomId"))
+	byRoomQuery := registry.RouteToOwner(cluster.RoomIDQuery("roomId"))
+	joinByRoomParam := registry.ClaimOrRouteToOwner(cluster.RoomIDParam("roomId"))
+	joinByRoomQuery := registry.ClaimOrRouteToOwner(cluster.RoomIDQuery("roomId"))
+
 	// Rooms
 	api.GET("/rooms", room.GetAllRooms(db))
 	api.POST("/rooms", room.CreateNewRoom(db))
-	api.POST("/rooms/:roomId/reserve", room.ReserveRoom(db))
-	api.POST("/rooms/participant", room.AddParticipant(db))
-	api.POST("/rooms/:roomId/disconnect", room.HandleDisconnect(db))
+	api.POST("/rooms/:roomId/reserve", joinByRoomParam, room.ReserveRoom(db))
+	api.POST("/rooms/:roomId/disconnect", byRoomParam, room.HandleDisconnect(db))
+	api.PUT("/rooms/:roomId/layout", byRoomParam, room.SetRoomLayout(db))
+	api.GET("/rooms/:roomId/stats", byRoomParam, room.GetRoomStats())
+	api.GET("/rooms/:roomId/tracks", byRoomParam, room.GetRoomTracks(db))
+	api.PUT("/rooms/:roomId/tracks/labels", byRoomParam, room.SetTrackLabels(db))
+
+	// Co-host invitations
+	api.POST("/rooms/:roomId/invitations", byRoomParam, room.InviteCoHost(db))
+	api.GET("/rooms/:roomId/invitations", byRoomParam, room.GetRoomInvitations(db))
+	api.DELETE("/rooms/:roomId/invitations/:invitationId", byRoomParam, room.RevokeInvitation(db))
+	api.POST("/rooms/:roomId/invitations/:invitationId/accept", byRoomParam, room.AcceptInvitation(db))
+	api.POST("/rooms/:roomId/invitations/:invitationId/decline", byRoomParam, room.DeclineInvitation(db))
+	api.POST("/rooms/:roomId/invite-links/:token/accept", byRoomParam, room.AcceptInviteLink(db))
+	api.GET("/users/me/invitations", room.GetMyInvitations(db))
+	api.GET("/users/me/notifications", room.HandleNotificationSocket())
+
+	// Host moderation of co-hosts
+	api.POST("/rooms/:roomId/participants/:userId/mute", byRoomParam, room.MuteParticipant(db))
+	api.POST("/rooms/:roomId/participants/:userId/unmute", byRoomParam, room.UnmuteParticipant(db))
+	api.POST("/rooms/:roomId/participants/:userId/disable-video", byRoomParam, room.DisableParticipantVideo(db))
+	api.POST("/rooms/:roomId/participants/:userId/enable-video", byRoomParam, room.EnableParticipantVideo(db))
+	api.POST("/rooms/:roomId/participants/:userId/kick", byRoomParam, room.KickParticipant(db))
 
 	// Chat
 	api.GET("/rooms/:roomId/chat", chat.GetAllChatsByRoom(db))
 	api.POST("/rooms/:roomId/chat", chat.CreateNewChat(db))
 	admin.DELETE("/rooms/:roomId/chats/:chatId", chat.DeleteChat(db))
 
+	// ICE servers for RTCPeerConnection, with TURN credentials of the user
+	api.GET("/ice-servers", turnserver.GetICEServers(stunServerURL, turnServer))
+
 	// WebRTC - WebSocket must be on /api (so it gets token from query param via middleware)
-	api.POST("/webrtc", room.HandleWebRTC(db, stunServerURL, webrtcIP))
-	api.GET("/webrtc/offers", room.HandleWebSocketOffer(db))
-	api.GET("/webrtc/offers/next", room.PollRenegotiationOffer(db))
-	api.POST("/webrtc/answer", room.HandleRenegotiationAnswer(db))
-	api.POST("/ice", room.HandleICECandidate(db))
+	api.POST("/webrtc", joinByRoomQuery, room.HandleWebRTC(db, stunServerURL, webrtcIP))
+	api.GET("/webrtc/offers", byRoomQuery, room.HandleWebSocketOffer(db))
+	api.GET("/webrtc/offers/next", byRoomQuery, room.PollRenegotiationOffer(db))
+	api.POST("/webrtc/answer", byRoomQuery, room.HandleRenegotiationAnswer(db))
+	api.POST("/ice", byRoomQuery, room.HandleICECandidate(db))
+	api.GET("/ice", byRoomQuery, room.PollLocalCandidates(db))
+
+	// WHIP ingest (OBS / hardware encoders authenticate with the per-room ingest token)
+	api.POST("/rooms/:roomId/ingest-token", byRoomParam, room.CreateIngestToken(db))
+	r.POST("/api/whip/:roomId", joinByRoomParam, room.HandleWHIP(db, stunServerURL, webrtcIP))
+	r.PATCH("/api/whip/:roomId/:sessionId", byRoomParam, room.HandleWHIPPatch(db))
+	r.DELETE("/api/whip/:roomId/:sessionId", byRoomParam, room.HandleWHIPDelete(db))
+
+	// WHEP playback (receive-only subscribers, not counted as participants)
+	api.POST("/whep/:roomId", joinByRoomParam, room.HandleWHEP(db, stunServerURL, webrtcIP, whepMaxSubscribers))
+	api.PATCH("/whep/:roomId/:sessionId", byRoomParam, room.HandleWHEPPatch(db))
+	api.DELETE("/whep/:roomId/:sessionId", byRoomParam, room.HandleWHEPDelete(db))
+	api.PUT("/whep/:roomId/:sessionId/camera", byRoomParam, room.SetWHEPCamera(db))
+	// Tracks published or removed later come as server offers to poll and answer.
+	api.GET("/whep/:roomId/:sessionId/offer", byRoomParam, room.PollWHEPOffer(db))
+	api.POST("/whep/:roomId/:sessionId/answer", byRoomParam, room.HandleWHEPAnswer(db))
+
+	// Playback tokens for HLS/DASH. Revocations go through the database,
+	// so any instance handles them.
+	api.POST("/rooms/:roomId/playback-tokens", room.IssuePlaybackToken(db))
+	api.DELETE("/rooms/:roomId/playback-tokens/:userId", room.RevokePlaybackTokens(db))
+
+	// Status history of a live (host and admins)
+	api.GET("/lives/:roomId/transitions", live.GetLiveTransitions(db))
 
 	// Image Uploads
 	api.POST("/uploads/image", upload.UploadImage())
 	r.Static("/api/uploads", "./storage/uploads")
 
-	// HLS - public access (video players can't send Authorization headers)
-	r.Static("/api/hls", "./hls") // watch the stream -> video.src = `/api/hls/${roomId}/master.m3u8`;
+	// HLS - no Authorization header (video players can't send one): playback
+	// tokens ride in the URLs instead.
+	// Segments are written on the owner's disk, so playback is routed there too.
+	hlsGroup := r.Group("/api/hls", registry.RouteToOwner(cluster.RoomIDPathPrefix("filepath")))
+	// watch the stream -> video.src = `/api/hls/${roomId}/master.m3u8?token=...`,
+	// the hlsUrl POST /api/rooms/:roomId/playback-tokens returns;
+	// low-latency streams get their playlists rendered with blocking reload,
+	// CMAF ones a DASH manifest as well: `/api/hls/${roomId}/manifest.mpd`.
+	playback := gin.WrapH(http.StripPrefix("/api/hls", hls.NewPlaybackServer("./hls")))
+	hlsGroup.GET("/*filepath", playback)
+	hlsGroup.HEAD("/*filepath", playback)
 
 	// Discover (public)
 	r.GET("/api/discover", discover.GetDiscover(db))
@@ -129,7 +202,10 @@ func Routes(r *gin.Engine, db *gorm.DB, jwtToken string, stunServerURL string, w
 	r.GET("/api/discover/categories/:id/lives", discover.GetCategoryLives(db))
 	r.GET("/api/lives", live.GetLives(db))
 	r.GET("/api/lives/:roomId", live.GetLiveByRoomID(db))
-	r.Static("/replays-storage", "./storage/replays")
+	// Replays are checked for playback tokens like lives.
+	replays := gin.WrapH(http.StripPrefix("/replays-storage", hls.NewPlaybackServer("./storage/replays")))
+	r.GET("/replays-storage/*filepath", replays)
+	r.HEAD("/replays-storage/*filepath", replays)
 	r.GET("/api/scrape/marmiton", scrape.ScrapeMarmiton())
 
 	// Not found
@@ -0,0 +1,55 @@
+package turnserver
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ICEServer is one entry of RTCConfiguration.iceServers.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEServersResponse is the ICE configuration of the current user.
+type ICEServersResponse struct {
+	ICEServers []ICEServer `json:"iceServers"`
+	// ExpiresAt is when the TURN credentials expire, absent without TURN.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// GetICEServers godoc
+// @Summary      Get ICE servers
+// @Description  ICE server list to pass to RTCPeerConnection: the STUN server, and the embedded TURN server over UDP and TCP with credentials of the current user when enabled. Fetch it again before expiresAt.
+// @Tags         webrtc
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {object}  ICEServersResponse
+// @Failure      401  {object}  map[string]string "error: unauthorized"
+// @Router       /api/ice-servers [get]
+func GetICEServers(stunURL string, server *Server) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString("userId")
+		if userID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+
+		res := ICEServersResponse{ICEServers: []ICEServer{{URLs: []string{stunURL}}}}
+		if server != nil {
+			username, password, expiresAt := server.Credentials(userID, c.GetTime("tokenExpiresAt"))
+			res.ICEServers = append(res.ICEServers, ICEServer{
+				URLs:       server.URLs(),
+				Username:   username,
+				Credential: password,
+			})
+			res.ExpiresAt = &expiresAt
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, res)
+	}
+}
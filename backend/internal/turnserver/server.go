@@ -0,0 +1,211 @@
+// Package turnserver runs the optional TURN relay embedded in the backend,
+// for clients whose NAT or firewall keeps them from reaching the SFU directly.
+package turnserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/turn/v4"
+)
+
+// DefaultPort is the standard TURN port, used for both UDP and TCP.
+const DefaultPort = 3478
+
+// DefaultCredentialTTL is how long issued credentials stay valid when
+// TURN_CREDENTIAL_TTL_MINUTES is not configured.
+const DefaultCredentialTTL = time.Hour
+
+// Config configures the embedded TURN server.
+type Config struct {
+	Enabled bool
+	// PublicIP is the address clients reach the server and its relays on.
+	PublicIP string
+	Realm    string
+	UDPPort  int
+	TCPPort  int
+	// RelayMinPort and RelayMaxPort bound the UDP ports of the relays.
+	RelayMinPort uint16
+	RelayMaxPort uint16
+	// Secret signs the time-limited credentials (TURN REST API).
+	Secret        string
+	CredentialTTL time.Duration
+	// AllowedPeers are the only addresses relays may send to: the SFU's.
+	// The server is no open relay into the host's network, and does not
+	// start without any.
+	AllowedPeers []net.IP
+}
+
+// ConfigFromEnv reads TURN_ENABLED, TURN_PUBLIC_IP, TURN_REALM,
+// TURN_UDP_PORT, TURN_TCP_PORT, TURN_RELAY_PORT_MIN, TURN_RELAY_PORT_MAX,
+// TURN_SECRET, TURN_CREDENTIAL_TTL_MINUTES and TURN_ALLOWED_PEERS. The public
+// IP and the allowed peers default to webrtcIP; the secret defaults to one
+// derived from jwtSecret.
+func ConfigFromEnv(jwtSecret, webrtcIP string) Config {
+	cfg := Config{
+		PublicIP:      os.Getenv("TURN_PUBLIC_IP"),
+		Realm:         os.Getenv("TURN_REALM"),
+		UDPPort:       DefaultPort,
+		TCPPort:       DefaultPort,
+		RelayMinPort:  49152,
+		RelayMaxPort:  49351,
+		Secret:        os.Getenv("TURN_SECRET"),
+		CredentialTTL: DefaultCredentialTTL,
+	}
+	cfg.Enabled, _ = strconv.ParseBool(os.Getenv("TURN_ENABLED"))
+	if cfg.PublicIP == "" {
+		cfg.PublicIP = webrtcIP
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = "etchebest"
+	}
+	if v, err := strconv.Atoi(os.Getenv("TURN_UDP_PORT")); err == nil && v > 0 {
+		cfg.UDPPort = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("TURN_TCP_PORT")); err == nil && v > 0 {
+		cfg.TCPPort = v
+	}
+	if v, err := strconv.ParseUint(os.Getenv("TURN_RELAY_PORT_MIN"), 10, 16); err == nil && v > 0 {
+		cfg.RelayMinPort = uint16(v)
+	}
+	if v, err := strconv.ParseUint(os.Getenv("TURN_RELAY_PORT_MAX"), 10, 16); err == nil && v > 0 {
+		cfg.RelayMaxPort = uint16(v)
+	}
+	if cfg.Secret == "" {
+		// Never hand the JWT key itself to the TURN machinery.
+		mac := hmac.New(sha256.New, []byte(jwtSecret))
+		mac.Write([]byte("turn-credentials"))
+		cfg.Secret = hex.EncodeToString(mac.Sum(nil))
+	}
+	if v, err := strconv.Atoi(os.Getenv("TURN_CREDENTIAL_TTL_MINUTES")); err == nil && v > 0 {
+		cfg.CredentialTTL = time.Duration(v) * time.Minute
+	}
+	peers := os.Getenv("TURN_ALLOWED_PEERS")
+	if peers == "" {
+		peers = webrtcIP
+	}
+	for _, p := range strings.Split(peers, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		ip := net.ParseIP(p)
+		if ip == nil {
+			log.Printf("[TURN] ignoring allowed peer %q: not an IP address", p)
+			continue
+		}
+		cfg.AllowedPeers = append(cfg.AllowedPeers, ip)
+	}
+	return cfg
+}
+
+// Server is a running TURN server.
+type Server struct {
+	cfg    Config
+	server *turn.Server
+}
+
+// Start listens on the configured UDP and TCP ports. Clients authenticate
+// with the credentials handed out by Credentials.
+func Start(cfg Config) (*Server, error) {
+	publicIP := net.ParseIP(cfg.PublicIP)
+	if publicIP == nil {
+		return nil, fmt.Errorf("invalid TURN public IP %q", cfg.PublicIP)
+	}
+	if cfg.RelayMinPort > cfg.RelayMaxPort {
+		return nil, fmt.Errorf("invalid TURN relay port range %d-%d", cfg.RelayMinPort, cfg.RelayMaxPort)
+	}
+	// Relays could reach nothing: a misconfiguration, not a server to run.
+	if len(cfg.AllowedPeers) == 0 {
+		return nil, fmt.Errorf("no TURN allowed peers: set TURN_ALLOWED_PEERS or WEBRTC_IP to the SFU's IP addresses")
+	}
+
+	udpConn, err := net.ListenPacket("udp4", ":"+strconv.Itoa(cfg.UDPPort))
+	if err != nil {
+		return nil, fmt.Errorf("listen TURN UDP: %w", err)
+	}
+	tcpListener, err := net.Listen("tcp4", ":"+strconv.Itoa(cfg.TCPPort))
+	if err != nil {
+		_ = udpConn.Close()
+		return nil, fmt.Errorf("listen TURN TCP: %w", err)
+	}
+
+	relays := func() turn.RelayAddressGenerator {
+		return &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: publicIP,
+			Address:      "0.0.0.0",
+			MinPort:      cfg.RelayMinPort,
+			MaxPort:      cfg.RelayMaxPort,
+		}
+	}
+	permit := func(clientAddr net.Addr, peerIP net.IP) bool {
+		for _, ip := range cfg.AllowedPeers {
+			if ip.Equal(peerIP) {
+				return true
+			}
+		}
+		log.Printf("[TURN] refused relay from %s to %s", clientAddr, peerIP)
+		return false
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm:       cfg.Realm,
+		AuthHandler: turn.LongTermTURNRESTAuthHandler(cfg.Secret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            udpConn,
+			RelayAddressGenerator: relays(),
+			PermissionHandler:     permit,
+		}},
+		ListenerConfigs: []turn.ListenerConfig{{
+			Listener:              tcpListener,
+			RelayAddressGenerator: relays(),
+			PermissionHandler:     permit,
+		}},
+	})
+	if err != nil {
+		_ = udpConn.Close()
+		_ = tcpListener.Close()
+		return nil, err
+	}
+
+	log.Printf("[TURN] listening on udp/%d and tcp/%d, relaying from %s ports %d-%d",
+		cfg.UDPPort, cfg.TCPPort, cfg.PublicIP, cfg.RelayMinPort, cfg.RelayMaxPort)
+	return &Server{cfg: cfg, server: server}, nil
+}
+
+// Close stops the server and its relays.
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// URLs returns the TURN URLs of the server, over UDP and TCP.
+func (s *Server) URLs() []string {
+	return []string{
+		fmt.Sprintf("turn:%s:%d?transport=udp", s.cfg.PublicIP, s.cfg.UDPPort),
+		fmt.Sprintf("turn:%s:%d?transport=tcp", s.cfg.PublicIP, s.cfg.TCPPort),
+	}
+}
+
+// Credentials issues the TURN REST API credentials of userID, valid for the
+// configured TTL but never past notAfter, the expiry of the user's session
+// token. A zero notAfter only applies the TTL.
+func (s *Server) Credentials(userID string, notAfter time.Time) (username, password string, expiresAt time.Time) {
+	expiresAt = time.Now().Add(s.cfg.CredentialTTL)
+	if !notAfter.IsZero() && notAfter.Before(expiresAt) {
+		expiresAt = notAfter
+	}
+	username = strconv.FormatInt(expiresAt.Unix(), 10) + ":" + userID
+	mac := hmac.New(sha1.New, []byte(s.cfg.Secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil)), expiresAt
+}
@@ -0,0 +1,26 @@
+package turnserver
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestStartRefusesAnOpenRelay(t *testing.T) {
+	t.Setenv("TURN_ALLOWED_PEERS", "")
+	t.Setenv("TURN_PUBLIC_IP", "203.0.113.1")
+	cfg := ConfigFromEnv("secret", "sfu.example.com")
+	if len(cfg.AllowedPeers) != 0 {
+		t.Fatalf("allowed peers %v from a host name", cfg.AllowedPeers)
+	}
+	if _, err := Start(cfg); err == nil || !strings.Contains(err.Error(), "allowed peers") {
+		t.Fatalf("Start without allowed peers: err=%v", err)
+	}
+
+	t.Setenv("TURN_ALLOWED_PEERS", "10.0.0.2, bogus,10.0.0.3")
+	cfg = ConfigFromEnv("secret", "10.0.0.1")
+	want := []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}
+	if len(cfg.AllowedPeers) != len(want) || !cfg.AllowedPeers[0].Equal(want[0]) || !cfg.AllowedPeers[1].Equal(want[1]) {
+		t.Errorf("allowed peers = %v, want %v", cfg.AllowedPeers, want)
+	}
+}
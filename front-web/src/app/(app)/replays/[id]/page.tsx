@@ -15,27 +15,28 @@ import {
 
 import HomeFooter from "@/components/home/HomeFooter";
 import { getLiveByRoomId, type LiveDTO } from "@/lib/lives";
+import { useAuth } from "@/lib/useAuth";
+import {
+  getMediaUrl,
+  getPlaybackToken,
+  playbackRefreshDelay,
+  withPlaybackToken,
+} from "@/services/streaming";
 
 type QualityOption = {
   label: string;
   value: string;
 };
 
-function getPublicMediaUrl(path: string) {
-  if (path.startsWith("http")) return path;
-
-  const baseUrl =
-    process.env.NEXT_PUBLIC_API_BASE_URL?.replace(/\/api\/?$/, "") || "";
-
-  return `${baseUrl}${path}`;
-}
-
 export default function ReplayDetailPage() {
   const params = useParams<{ id: string }>();
   const replayId = params?.id;
 
+  const { token, ready } = useAuth();
+
   const videoRef = useRef<HTMLVideoElement | null>(null);
   const hlsRef = useRef<Hls | null>(null);
+  const playbackTokenRef = useRef("");
 
   const [replay, setReplay] = useState<LiveDTO | null>(null);
   const [loading, setLoading] = useState(true);
@@ -69,14 +70,68 @@ export default function ReplayDetailPage() {
     loadReplay();
   }, [replayId]);
 
-  const replayUrl = useMemo(() => {
-    if (!replay?.replay_url) return "";
-    return getPublicMediaUrl(replay.replay_url);
-  }, [replay]);
+  const [replayUrl, setReplayUrl] = useState("");
 
   const isHlsReplay = useMemo(() => {
-    return replayUrl.endsWith(".m3u8");
-  }, [replayUrl]);
+    return Boolean(replay?.replay_url?.endsWith(".m3u8"));
+  }, [replay]);
+
+  // The replay is only served with a playback token, renewed before it
+  // expires: hls.js swaps it on its next requests, the native player
+  // reloads the replay where it was.
+  useEffect(() => {
+    if (!replay?.replay_url || !ready) return;
+    if (!token) {
+      setVideoError("Connectez-vous pour regarder ce replay.");
+      return;
+    }
+    let cancelled = false;
+    let refreshTimer: ReturnType<typeof setTimeout> | null = null;
+
+    const fetchPlaybackToken = (first: boolean) => {
+      getPlaybackToken(replay.room_id, token)
+        .then((playback) => {
+          if (cancelled) return;
+          if (!playback.replayUrl) {
+            setVideoError("Impossible de lire ce replay.");
+            return;
+          }
+          playbackTokenRef.current = playback.token;
+          const url = getMediaUrl(playback.replayUrl);
+          const video = videoRef.current;
+          if (first) {
+            setReplayUrl(url);
+          } else if (!hlsRef.current && video) {
+            const resumeAt = video.currentTime;
+            const wasPaused = video.paused;
+            video.addEventListener(
+              "loadedmetadata",
+              () => {
+                video.currentTime = resumeAt;
+                if (!wasPaused) video.play().catch(() => {});
+              },
+              { once: true }
+            );
+            video.src = url;
+          }
+          refreshTimer = setTimeout(() => fetchPlaybackToken(false), playbackRefreshDelay(playback));
+        })
+        .catch(() => {
+          if (cancelled) return;
+          if (!first) {
+            refreshTimer = setTimeout(() => fetchPlaybackToken(false), 10_000);
+            return;
+          }
+          setVideoError("Impossible de lire ce replay.");
+        });
+    };
+
+    fetchPlaybackToken(true);
+    return () => {
+      cancelled = true;
+      if (refreshTimer) clearTimeout(refreshTimer);
+    };
+  }, [replay, token, ready]);
 
   const applyQuality = useCallback((value: string, hlsInstance?: Hls | null) => {
     const hls = hlsInstance ?? hlsRef.current;
@@ -127,6 +182,9 @@ export default function ReplayDetailPage() {
         backBufferLength: 900,
         maxBufferLength: 30,
         maxMaxBufferLength: 60,
+        xhrSetup: (xhr, url) => {
+          xhr.open("GET", withPlaybackToken(url, playbackTokenRef.current));
+        },
       });
 
       hlsRef.current = hls;
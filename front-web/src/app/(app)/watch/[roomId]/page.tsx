@@ -16,7 +16,10 @@ import {
   ChefHat,
 } from "lucide-react";
 import {
-  getHLSUrl,
+  getPlaybackToken,
+  getMediaUrl,
+  playbackRefreshDelay,
+  withPlaybackToken,
   getChatMessages,
   postChatMessage,
   getRooms,
@@ -81,9 +84,41 @@ export default function WatchRoomPage() {
   const [sending, setSending] = useState(false);
   const [chatMessages, setChatMessages] = useState<ChatMessage[]>([]);
 
-  const hlsUrl = useMemo(() => {
-    return roomId ? getHLSUrl(roomId) : "";
-  }, [roomId]);
+  const [hlsUrl, setHlsUrl] = useState("");
+  const playbackTokenRef = useRef("");
+
+  // The playback token is renewed before it expires: hls.js swaps it on its
+  // next requests, the native player reloads the stream with it.
+  useEffect(() => {
+    if (!roomId || !token) return;
+    let cancelled = false;
+    let refreshTimer: ReturnType<typeof setTimeout> | null = null;
+
+    const fetchPlaybackToken = (first: boolean) => {
+      getPlaybackToken(roomId, token)
+        .then((playback) => {
+          if (cancelled) return;
+          playbackTokenRef.current = playback.token;
+          if (first || !hlsRef.current) setHlsUrl(getMediaUrl(playback.hlsUrl));
+          refreshTimer = setTimeout(() => fetchPlaybackToken(false), playbackRefreshDelay(playback));
+        })
+        .catch(() => {
+          if (cancelled) return;
+          if (!first) {
+            refreshTimer = setTimeout(() => fetchPlaybackToken(false), 10_000);
+            return;
+          }
+          setLoading(false);
+          setError("Impossible de charger le stream.");
+        });
+    };
+
+    fetchPlaybackToken(true);
+    return () => {
+      cancelled = true;
+      if (refreshTimer) clearTimeout(refreshTimer);
+    };
+  }, [roomId, token]);
 
   const liveTitle = room?.name || liveInfo?.title || "Live en direct";
   const viewers = room?.viewers ?? null;
@@ -297,6 +332,9 @@ export default function WatchRoomPage() {
           backBufferLength: 900,
           maxBufferLength: 30,
           maxMaxBufferLength: 90,
+          xhrSetup: (xhr, url) => {
+            xhr.open("GET", withPlaybackToken(url, playbackTokenRef.current));
+          },
         });
 
         hlsRef.current = hls;
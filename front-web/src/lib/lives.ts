@@ -19,7 +19,7 @@ export type LiveDTO = {
   title: string;
   description?: string;
   dish_name?: string;
-  status: "scheduled" | "live" | "ended";
+  status: "scheduled" | "live" | "interrupted" | "processing_replay" | "ended" | "cancelled";
 
   scheduled_at?: string;
   created_at: string;
@@ -122,9 +122,40 @@ export async function sendICECandidate(
 
 // ---------- HLS ----------
 
-export function getHLSUrl(roomId: string): string {
+export interface PlaybackToken {
+  token: string;
+  expiresAt: string;
+  hlsUrl: string;
+  replayUrl?: string;
+}
+
+// The stream is only served with a playback token, which the URLs carry.
+export async function getPlaybackToken(roomId: string, token?: string | null): Promise<PlaybackToken> {
   const rid = encodeURIComponent(roomId);
-  return `${MEDIA_BASE_URL}/api/hls/${rid}/master.m3u8`;
+  return apiFetch<PlaybackToken>(`/rooms/${rid}/playback-tokens`, {
+    method: "POST",
+    token: token ?? undefined,
+    cache: "no-store",
+  });
+}
+
+export function getMediaUrl(path: string): string {
+  return `${MEDIA_BASE_URL}${path}`;
+}
+
+// Playback tokens expire: players fetch a new one before, once most of
+// its lifetime went by.
+export function playbackRefreshDelay(playback: PlaybackToken): number {
+  const left = new Date(playback.expiresAt).getTime() - Date.now();
+  return Math.max(left * 0.8, 5_000);
+}
+
+// Swaps the playback token a media URL carries for a fresher one.
+export function withPlaybackToken(url: string, token: string): string {
+  const u = new URL(url);
+  if (!u.searchParams.has("token")) return url;
+  u.searchParams.set("token", token);
+  return u.toString();
 }
 
 // ---------- Chat ----------
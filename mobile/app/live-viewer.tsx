@@ -1,6 +1,6 @@
 import { Ionicons } from '@expo/vector-icons';
 import { useLocalSearchParams, useRouter } from 'expo-router';
-import React, { useState } from 'react';
+import React, { useEffect, useState } from 'react';
 import {
     StyleSheet,
     Text,
@@ -9,7 +9,7 @@ import {
 } from 'react-native';
 import { SafeAreaView } from 'react-native-safe-area-context';
 import HLSPlayer from '../components/HLSPlayer';
-import { getHLSUrl } from '../services/streaming';
+import { getHLSUrl, getPlaybackToken, playbackRefreshDelay } from '../services/streaming';
 
 export default function LiveViewerScreen() {
     const router = useRouter();
@@ -18,8 +18,38 @@ export default function LiveViewerScreen() {
         roomName?: string;
     }>();
     const [hasError, setHasError] = useState(false);
+    const [hlsUrl, setHlsUrl] = useState('');
 
-    const hlsUrl = roomId ? getHLSUrl(roomId) : '';
+    // A retry fetches a new playback token. The token is renewed before it
+    // expires, the player moving to the URL carrying the new one.
+    useEffect(() => {
+        if (!roomId || hasError) return;
+        let cancelled = false;
+        let refreshTimer: ReturnType<typeof setTimeout> | null = null;
+
+        const fetchPlaybackToken = (first: boolean) => {
+            getPlaybackToken(roomId)
+                .then((playback) => {
+                    if (cancelled) return;
+                    setHlsUrl(getHLSUrl(roomId, playback));
+                    refreshTimer = setTimeout(() => fetchPlaybackToken(false), playbackRefreshDelay(playback));
+                })
+                .catch(() => {
+                    if (cancelled) return;
+                    if (first) {
+                        setHasError(true);
+                    } else {
+                        refreshTimer = setTimeout(() => fetchPlaybackToken(false), 10_000);
+                    }
+                });
+        };
+
+        fetchPlaybackToken(true);
+        return () => {
+            cancelled = true;
+            if (refreshTimer) clearTimeout(refreshTimer);
+        };
+    }, [roomId, hasError]);
 
     const renderVideoContent = () => {
         if (!roomId) {
@@ -49,6 +79,9 @@ export default function LiveViewerScreen() {
                 </View>
             );
         }
+        if (!hlsUrl) {
+            return null;
+        }
         return (
             <HLSPlayer
                 uri={hlsUrl}
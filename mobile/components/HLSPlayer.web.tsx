@@ -9,12 +9,36 @@ interface HLSPlayerProps {
     style?: any;
 }
 
+// splitPlaybackToken separates a stream URL from the playback token it
+// carries.
+function splitPlaybackToken(uri: string): [string, string] {
+    if (!uri) return ['', ''];
+    const url = new URL(uri);
+    const token = url.searchParams.get('token') ?? '';
+    url.searchParams.delete('token');
+    return [url.toString(), token];
+}
+
+function withPlaybackToken(uri: string, token: string): string {
+    const url = new URL(uri);
+    if (!url.searchParams.has('token')) return uri;
+    url.searchParams.set('token', token);
+    return url.toString();
+}
+
 export default function HLSPlayer({ uri, onLoad, onError, style }: HLSPlayerProps) {
     const videoRef = useRef<HTMLVideoElement>(null);
     const hlsRef = useRef<Hls | null>(null);
     const [loading, setLoading] = useState(true);
     const [error, setError] = useState<string | null>(null);
 
+    // A renewed playback token only changes the token the URL carries:
+    // hls.js swaps it on its next requests instead of reloading the stream.
+    const [streamUri, token] = splitPlaybackToken(uri);
+    const tokenRef = useRef(token);
+    tokenRef.current = token;
+    const sourceKey = Hls.isSupported() ? streamUri : uri;
+
     useEffect(() => {
         const video = videoRef.current;
         if (!video || !uri) return;
@@ -39,6 +63,9 @@ export default function HLSPlayer({ uri, onLoad, onError, style }: HLSPlayerProp
                 startPosition: -1,
                 maxBufferHole: 0.5,
                 segmentLoadingTimeout: 10000,
+                xhrSetup: (xhr, url) => {
+                    xhr.open('GET', withPlaybackToken(url, tokenRef.current));
+                },
             });
             hlsRef.current = hls;
 
@@ -90,7 +117,7 @@ export default function HLSPlayer({ uri, onLoad, onError, style }: HLSPlayerProp
         }
 
         return cleanup;
-    }, [uri]);
+    }, [sourceKey]);
 
     if (error) {
         return (
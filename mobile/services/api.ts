@@ -90,7 +90,7 @@ export interface Live {
   dish_id: number;
   view_count: number;
   current_viewers: number;
-  status: 'scheduled' | 'live' | 'ended';
+  status: 'scheduled' | 'live' | 'interrupted' | 'processing_replay' | 'ended' | 'cancelled';
   started_at?: string;
   thumbnail_url: string;
   user?: {
@@ -169,6 +169,33 @@ export async function sendRenegotiationAnswer(roomId: string, sdp: string): Prom
 
 // ---------- HLS ----------
 
-export function getHLSUrl(roomId: string): string {
-    return `${BASE_URL}/hls/${roomId}/master.m3u8`;
+export interface PlaybackToken {
+    token: string;
+    expiresAt: string;
+    hlsUrl: string;
+    replayUrl?: string;
+}
+
+// The stream is only served with a playback token, which the URLs carry.
+export async function getPlaybackToken(roomId: string): Promise<PlaybackToken> {
+    const res = await fetch(`${BASE_URL}/rooms/${roomId}/playback-tokens`, {
+        method: 'POST',
+        headers: await authHeaders(),
+    });
+    await throwIfUnauthorized(res);
+    if (!res.ok) {
+        throw new Error(await getErrorMessage(res, `Playback token failed (${res.status})`));
+    }
+    return res.json();
+}
+
+export function getHLSUrl(roomId: string, playback: PlaybackToken): string {
+    return `${BASE_URL}/hls/${roomId}/master.m3u8?token=${encodeURIComponent(playback.token)}`;
+}
+
+// Playback tokens expire: players fetch a new one before, once most of
+// its lifetime went by.
+export function playbackRefreshDelay(playback: PlaybackToken): number {
+    const left = new Date(playback.expiresAt).getTime() - Date.now();
+    return Math.max(left * 0.8, 5_000);
 }